@@ -1,31 +1,94 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 
 	"pawnshop/client/pkg/client"
+	"pawnshop/server/pkg/framing"
 	"pawnshop/server/pkg/messages"
 )
 
 /*
 Runs a lightweight client used to test the pawn shop server.
-It accepts two flags: offer and demand, which are the offer and demand values
-which will be used in the offer sent to the server.
+It accepts flags for the offer and demand values which will be used in the offer sent to the server,
+for the ID of a loan to redeem instead, in which case offer is the repayment, for selling an item with the
+value offer for at least demand instead, for the index of an inventory item with the value demand to buy for
+at most offer instead,
+for asking for a quote for the offer instead, for the token of a quote that guarantees the answer to the offer,
+for the W3C traceparent of the trace the offer is part of,
+for the network and address of the server, for the framing mode used by the server, and for TLS:
+tls enables TLS, cacert is the CA used to verify the server, cert and key are the client certificate
+used for mutual TLS, and servername overrides the name the server certificate is verified against.
+The answer of the server is printed as JSON, including the ID of the loan of a pawn if loans are enabled,
+which redeem takes, and the token of a quote, which token takes.
 */
 func main() {
 	offer := flag.Int("offer", 0, "offer")
 	demand := flag.Int("demand", 0, "demand")
+	redeem := flag.String("redeem", "", "ID of a loan to redeem with the offer as repayment, as printed in the answer to a pawn")
+	sell := flag.Bool("sell", false, "sell an item with the value of the offer for at least the demand")
+	buy := flag.Int("buy", -1, "index of an inventory item with the value of the demand to buy for at most the offer")
+	quote := flag.Bool("quote", false, "ask for a quote for the offer and demand without making the offer")
+	token := flag.String("token", "", "token of a quote for the offer and demand")
+	traceParent := flag.String("traceparent", "", "W3C traceparent of the trace the offer is part of")
+	network := flag.String("network", "tcp", "network of the server, tcp or unix")
+	addr := flag.String("addr", "127.0.0.1:8080", "address of the server")
+	framingStr := flag.String("framing", string(framing.NewlineMode), "framing mode")
+	useTLS := flag.Bool("tls", false, "connect using TLS")
+	caFile := flag.String("cacert", "", "CA certificate used to verify the server")
+	certFile := flag.String("cert", "", "client certificate for mutual TLS")
+	keyFile := flag.String("key", "", "client key for mutual TLS")
+	serverName := flag.String("servername", "", "server name to verify the server certificate against")
 	flag.Parse()
 
-	client := &client.Client{}
-	err := client.Run(
-		messages.CreateOffer(
-			*offer,
-			*demand,
-		),
-	)
+	mode, err := framing.ParseMode(*framingStr)
+	if err != nil {
+		fmt.Println("Client failed to parse framing mode: ", err)
+		return
+	}
+
+	c := &client.Client{
+		Network: *network,
+		Address: *addr,
+		Framing: mode,
+	}
+
+	if *useTLS {
+		c.TLSConfig, err = client.LoadTLSConfig(*caFile, *certFile, *keyFile, *serverName)
+		if err != nil {
+			fmt.Println("Client failed to load TLS configuration: ", err)
+			return
+		}
+	}
+
+	o := messages.CreateOffer(*offer, *demand)
+	switch {
+	case *redeem != "":
+		o = messages.CreateRedeemOffer(*redeem, *offer)
+	case *sell:
+		o = messages.CreateSellOffer(*offer, *demand)
+	case *buy >= 0:
+		o = messages.CreateBuyOffer(*buy, *demand, *offer)
+	case *quote:
+		o = messages.CreateQuoteOffer(*offer, *demand)
+	case *token != "":
+		o = messages.CreateQuotedOffer(*token, *offer, *demand)
+	}
+	o.TraceParent = *traceParent
+
+	ans, err := c.Run(o)
 	if err != nil {
 		fmt.Println("Client failed to run: ", err)
+		return
+	}
+
+	// The answer is printed as sent by the server, so that e.g. the token of a quote can be used with -token
+	b, err := json.Marshal(ans)
+	if err != nil {
+		fmt.Println("Client failed to marshal answer: ", err)
+		return
 	}
+	fmt.Println(string(b))
 }
@@ -5,53 +5,178 @@ It is only used for acceptance tests and therefore does not have any rigorous te
 package client
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"pawnshop/server/pkg/framing"
 	"pawnshop/server/pkg/messages"
 )
 
 const (
-	addr       = "127.0.0.1:8080"
-	bufferSize = 128
+	defaultNetwork = "tcp"
+	defaultAddr    = "127.0.0.1:8080"
 )
 
 /*
 Client is a lightweight client for the pawn shop server.
+Network and Address default to a TCP connection to 127.0.0.1:8080, and Network may also be "unix"
+with Address being a socket path. Framing must match the framing mode of the server's listener,
+and defaults to newline-delimited frames. MaxFrameSize defaults to framing.DefaultMaxFrameSize.
+If TLSConfig is set, the connection to the server is made over TLS, see LoadTLSConfig.
 */
 type Client struct {
+	Network      string
+	Address      string
+	Framing      framing.Mode
+	MaxFrameSize int
+	TLSConfig    *tls.Config
+}
+
+/*
+Session is a long-lived connection to the pawn shop server,
+which can be used to send any number of offers to the server.
+*/
+type Session struct {
+	conn   net.Conn
+	framer framing.Framer
 }
 
 /*
 Runs the client with the given offer.
-It only supports sending a single offer to the server, and does not care about the response.
-A real client would want to be able to send multiple offers to the server as well as
-handle any response from the server appropriately.
+It opens a session, sends a single offer to the server, closes the session again and returns the answer.
 */
-func (c *Client) Run(offer messages.Offer) error {
-	conn, err := net.Dial("tcp", addr)
+func (c *Client) Run(offer messages.Offer) (messages.Answer, error) {
+	s, err := c.NewSession()
 	if err != nil {
-		return fmt.Errorf("failed to connect to server: %w", err)
+		return messages.Answer{}, err
 	}
 	defer func() {
-		conn.Close()
+		s.Close()
 		fmt.Println("Client: Closed connection to server")
 	}()
 
+	return s.Send(offer)
+}
+
+/*
+Opens a new session to the server. The session must be closed by the caller.
+*/
+func (c *Client) NewSession() (*Session, error) {
+	network := c.Network
+	if network == "" {
+		network = defaultNetwork
+	}
+
+	address := c.Address
+	if address == "" {
+		address = defaultAddr
+	}
+
+	var conn net.Conn
+	var err error
+	if c.TLSConfig != nil {
+		conn, err = tls.Dial(network, address, c.TLSConfig)
+	} else {
+		conn, err = net.Dial(network, address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+
+	mode := c.Framing
+	if mode == "" {
+		mode = framing.NewlineMode
+	}
+
+	maxFrameSize := c.MaxFrameSize
+	if maxFrameSize == 0 {
+		maxFrameSize = framing.DefaultMaxFrameSize
+	}
+
+	framer, err := framing.New(conn, mode, maxFrameSize)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create framer: %w", err)
+	}
+
+	return &Session{
+		conn:   conn,
+		framer: framer,
+	}, nil
+}
+
+/*
+Sends an offer to the server and waits for the answer.
+*/
+func (s *Session) Send(offer messages.Offer) (messages.Answer, error) {
 	b, err := json.Marshal(offer)
 	if err != nil {
-		return fmt.Errorf("failed to marshal offer: %w", err)
+		return messages.Answer{}, fmt.Errorf("failed to marshal offer: %w", err)
+	}
+
+	if err = s.framer.WriteFrame(b); err != nil {
+		return messages.Answer{}, fmt.Errorf("failed to write offer: %w", err)
+	}
+
+	ansB, err := s.framer.ReadFrame()
+	if err != nil {
+		return messages.Answer{}, fmt.Errorf("failed to read answer: %w", err)
 	}
 
-	if _, err = conn.Write(b); err != nil {
-		return fmt.Errorf("failed to write offer: %w", err)
+	var ans messages.Answer
+	if err = json.Unmarshal(ansB, &ans); err != nil {
+		return messages.Answer{}, fmt.Errorf("failed to unmarshal answer: %w", err)
 	}
 
-	buf := make([]byte, bufferSize)
+	return ans, nil
+}
 
-	if _, err = conn.Read(buf); err != nil {
-		return fmt.Errorf("failed to read answer: %w", err)
+/*
+Closes the session and its underlying connection.
+*/
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+/*
+Loads a TLS configuration for connecting to a server with TLS.
+caFile is the CA used to verify the server certificate, and uses the system CAs if empty.
+certFile and keyFile are the client certificate and key used for mutual TLS, and are optional.
+serverName overrides the name the server certificate is verified against, and is optional.
+*/
+func LoadTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("both a certificate and a key file are required for a client certificate")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate and key: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
 	}
 
-	return nil
+	return cfg, nil
 }
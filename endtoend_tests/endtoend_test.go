@@ -3,6 +3,7 @@ package acceptancetests
 import (
 	"pawnshop/client/pkg/client"
 	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/pawnshop"
 	"pawnshop/server/pkg/server"
 	"testing"
 	"time"
@@ -16,7 +17,10 @@ and prints the results to stdout. It begins with an inventory size of 5.
 */
 func TestSequentialEndToEndTests(t *testing.T) {
 	invSz := 5
-	srv, err := server.NewPawnShopServer(invSz)
+	srv, err := server.NewPawnShopServer(server.Options{
+		InventorySize: invSz,
+		Listeners:     []server.ListenerOptions{{Address: "127.0.0.1:0"}},
+	})
 	require.NoError(t, err)
 
 	go func() {
@@ -35,37 +39,65 @@ func TestSequentialEndToEndTests(t *testing.T) {
 
 	defer srv.Stop()
 
+	addr := srv.Addrs()[0].String()
+
 	// A client sends an offer {"offer": 7, "demand": 1}
 	// The server accepts it and should now have an inventory of [7, 1, 1, 1, 1]
 	t.Run("First offer - ACCEPT", func(t *testing.T) {
-		client := &client.Client{}
-		err := client.Run(messages.CreateOffer(7, 1))
+		client := &client.Client{Address: addr}
+		ans, err := client.Run(messages.CreateOffer(7, 1))
 		require.NoError(t, err)
+		require.Equal(t, messages.AcceptCode, ans.Code)
 	})
 
 	// A client start sending an offer {"offer": 5, "demand": 3}
 	// The pawnshop server will not accept it because it would infer a loss of 2.
 	// The inventory of the server should still be [7, 1, 1, 1, 1]
 	t.Run("Second offer - REJECT", func(t *testing.T) {
-		client := &client.Client{}
-		err := client.Run(messages.CreateOffer(5, 3))
+		client := &client.Client{Address: addr}
+		ans, err := client.Run(messages.CreateOffer(5, 3))
 		require.NoError(t, err)
+		require.Equal(t, messages.RejectCode, ans.Code)
 	})
 
 	// A client sends an offer {"offer": 4, "demand": 1}
 	// The server accepts it and should now have an inventory of [7, 4, 1, 1, 1]
 	t.Run("Third offer - ACCEPT", func(t *testing.T) {
-		client := &client.Client{}
-		err := client.Run(messages.CreateOffer(4, 1))
+		client := &client.Client{Address: addr}
+		ans, err := client.Run(messages.CreateOffer(4, 1))
 		require.NoError(t, err)
+		require.Equal(t, messages.AcceptCode, ans.Code)
 	})
 
 	// A client sends an offer {"offer": 25, "demand": 8}
 	// The pawnshop server can not accept it.
 	// The inventory of the server should still be [7, 4, 1, 1, 1]
 	t.Run("Fourth offer - REJECT", func(t *testing.T) {
-		client := &client.Client{}
-		err := client.Run(messages.CreateOffer(25, 8))
+		client := &client.Client{Address: addr}
+		ans, err := client.Run(messages.CreateOffer(25, 8))
+		require.NoError(t, err)
+		require.Equal(t, messages.RejectCode, ans.Code)
+	})
+
+	// A client opens a session and sends two offers over the same connection:
+	// {"offer": 3, "demand": 1} is accepted, and the inventory should now be [7, 4, 3, 1, 1]
+	// {"offer": 2, "demand": 2} is rejected, and the inventory should still be [7, 4, 3, 1, 1]
+	t.Run("Fifth and sixth offer in one session - ACCEPT and REJECT", func(t *testing.T) {
+		client := &client.Client{Address: addr}
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+
+		ans, err := session.Send(messages.CreateOffer(3, 1))
+		require.NoError(t, err)
+		require.Equal(t, messages.CreateAcceptedAnswer(1), ans)
+
+		ans, err = session.Send(messages.CreateOffer(2, 2))
 		require.NoError(t, err)
+		require.Equal(t, messages.Answer{Code: messages.RejectCode, Reason: &messages.Reason{
+			Code:    messages.ReasonInvalidOffer,
+			Message: "offer must be greater than demand",
+			Rule:    pawnshop.EnsureProfitRuleID,
+		}}, ans)
 	})
 }
@@ -2,25 +2,112 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"pawnshop/server/pkg/framing"
+	"pawnshop/server/pkg/inventory"
+	"pawnshop/server/pkg/logging"
+	"pawnshop/server/pkg/ruleconfig"
 	"pawnshop/server/pkg/server"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
 )
 
+/*
+listenFlag is a flag that can be given multiple times, collecting one listener per listen address.
+*/
+type listenFlag []server.ListenerOptions
+
+func (l *listenFlag) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *listenFlag) Set(s string) error {
+	opts, err := server.ParseListenAddress(s)
+	if err != nil {
+		return err
+	}
+
+	*l = append(*l, opts)
+	return nil
+}
+
 /*
 Runs the pawn shop server.
-It accepts two flags: size, which is the size of the inventory, and loglevel, which is the log level.
-Defaults to size 2 and log level info.
+It accepts thirty-six flags: size, which is the size of the inventory, loglevel, which is the log level,
+logformat, which is the format of the logs, text or json, listen, which is an address to listen on and may be
+given multiple times, idletimeout, which is how long a session may be idle before it is closed, readtimeout and
+writetimeout, which are how long reading an offer and writing an answer may take, draintimeout, which is how long
+open connections may take to finish on shutdown before they are closed, http, which is the address of the HTTP gateway,
+httpmaxframesize, which is the maximum size of the body of a request to the HTTP gateway, admin, which is the address of the admin listener, datadir, which is the directory the inventory is persisted in, storage, which is the storage backend
+of the inventory, storagefile, which is the file used by the file storage backend, shards, which is the number
+of shards the inventory is partitioned into, routing, which decides which shard gives up an item for an offer,
+loanterm, which enables loans against pledged items and is how long a loan may be redeemed for, interestrate,
+which is the interest on a loan as a fraction of its principal, margin, which is the margin the pawn shop
+buys and sells items for below and above their value, quotettl, which enables quote tokens and is how long
+a quoted item is reserved for, and countermargin, which enables counter-offers and is how far, as a fraction
+of the value of an offer, a rejected offer may be from being accepted to be countered, rules, which is a JSON
+file of rules that offers are validated with, ratelimit, which is how many offers per second a client may make,
+rateburst, which is how many offers a client may make at once, maxconnsperclient, which is how many connections
+a single address may have open, maxconns, which is how many connections all clients may have open, dailyquota,
+which is how many accepted offers a client may make per day, workers, which enables the worker pool and is how many
+connections are handled at once, queuesize, which is how many accepted connections may wait for a worker, overflow,
+which decides what happens to connections accepted while the queue is full, traceexporter, which is where the spans
+of offers are exported to, tracefile, which is the file used by the file trace exporter, otlpendpoint, which is
+the URL of the OpenTelemetry collector used by the otlp trace exporter, livenessprobe and readinessprobe, which are the
+addresses of the TCP liveness and readiness probes, and draindelay, which is how long the server keeps its listeners
+open after it stops being ready on shutdown.
+Defaults to size 2, log level info, text logs, listening on 127.0.0.1:8080, idle, read, write and drain timeouts of
+30 seconds, no HTTP gateway, a maximum HTTP request body of 4096 bytes,
+no admin listener, an inventory that is only kept in memory, no loans, a margin of 20%, no quote tokens, no counter-offers, no configured rules, no limits, no worker pool, no tracing, no TCP probes and no drain delay.
 Also handles graceful shutdown.
 */
 func main() {
+	var listeners listenFlag
 	invSize := flag.Int("size", 2, "inventory size")
 	logLvlStr := flag.String("loglevel", "info", "log level")
+	logFormat := flag.String("logformat", logging.TextFormat, "log format, text or json")
+	flag.Var(&listeners, "listen", "listen address, e.g. 127.0.0.1:8080 or unix:///tmp/pawnshop.sock (repeatable)")
+	idleTimeout := flag.Duration("idletimeout", 0, "session idle timeout (default 30s)")
+	readTimeout := flag.Duration("readtimeout", 0, "how long reading an offer may take (default idletimeout)")
+	writeTimeout := flag.Duration("writetimeout", 0, "how long writing an answer may take (default idletimeout)")
+	drainTimeout := flag.Duration("draintimeout", 0, "how long open connections may take to finish on shutdown before they are closed (default 30s)")
+	dataDir := flag.String("datadir", "", "directory to persist the inventory in (in-memory only if empty)")
+	storage := flag.String("storage", server.MemoryStorage, "inventory storage backend, memory or file")
+	storageFile := flag.String("storagefile", "", "file to store the inventory in when using file storage")
+	shards := flag.Int("shards", 1, "number of independently locked shards the inventory is partitioned into")
+	routing := flag.String("routing", string(inventory.GlobalRouting), "shard routing, global or firstfit")
+	httpAddr := flag.String("http", "", "address of the HTTP gateway, e.g. 127.0.0.1:8081 (disabled if empty)")
+	httpMaxFrameSize := flag.Int("httpmaxframesize", framing.DefaultMaxFrameSize, "maximum size of the body of a request to the HTTP gateway")
+	adminAddr := flag.String("admin", "", "address of the admin listener, e.g. 127.0.0.1:8082 (disabled if empty)")
+	loanTerm := flag.Duration("loanterm", 0, "how long a loan against a pledged item may be redeemed for (loans are disabled if 0)")
+	interestRate := flag.Float64("interestrate", 0, "interest on a loan as a fraction of its principal, e.g. 0.1")
+	margin := flag.Float64("margin", 0.2, "margin the pawn shop buys and sells items for below and above their value")
+	quoteTTL := flag.Duration("quotettl", 0, "how long a quoted item is reserved for the quote token (no tokens if 0)")
+	counterMargin := flag.Float64("countermargin", 0, "how far a rejected offer may be from being accepted to be countered, e.g. 0.1 (no counter-offers if 0)")
+	rulesFile := flag.String("rules", "", "JSON file of rules that offers are validated with (no configured rules if empty)")
+	rateLimit := flag.Float64("ratelimit", 0, "offers per second a client may make on average (no rate limit if 0)")
+	rateBurst := flag.Int("rateburst", 0, "offers a client may make at once before it is rate limited (default ratelimit rounded up)")
+	maxConnsPerClient := flag.Int("maxconnsperclient", 0, "connections a single address may have open at once (no limit if 0)")
+	maxConns := flag.Int("maxconns", 0, "connections all clients may have open at once (no limit if 0)")
+	dailyQuota := flag.Int("dailyquota", 0, "accepted offers a client may make per day in UTC (no quota if 0)")
+	workers := flag.Int("workers", 0, "connections handled at once by the worker pool (no worker pool if 0)")
+	queueSize := flag.Int("queuesize", 0, "accepted connections that may wait for a worker (default workers)")
+	overflow := flag.String("overflow", string(server.BlockOverflow), "what happens to connections accepted while the queue is full, block, reject or close")
+	traceExporter := flag.String("traceexporter", string(server.NoTraceExporter), "where the spans of offers are exported to, none, stdout, file or otlp")
+	traceFile := flag.String("tracefile", "", "file spans are appended to when using the file trace exporter")
+	otlpEndpoint := flag.String("otlpendpoint", "", "URL of the OpenTelemetry collector when using the otlp trace exporter, e.g. http://localhost:4318")
+	livenessProbe := flag.String("livenessprobe", "", "address of the TCP liveness probe, e.g. 127.0.0.1:8083 (disabled if empty)")
+	readinessProbe := flag.String("readinessprobe", "", "address of the TCP readiness probe, e.g. 127.0.0.1:8084 (disabled if empty)")
+	drainDelay := flag.Duration("draindelay", 0, "how long listeners stay open on shutdown after the server stops being ready")
 	flag.Parse()
 
+	if err := logging.SetFormat(*logFormat); err != nil {
+		log.Fatalf("Failed to set log format: %s", err)
+	}
+
 	logLvl, err := log.ParseLevel(*logLvlStr)
 	if err != nil {
 		log.Fatalf("Failed to parse log level: %s", err)
@@ -29,7 +116,58 @@ func main() {
 	log.Infof("Using log level %s", logLvl)
 	log.SetLevel(logLvl)
 
-	srv, err := server.NewPawnShopServer(*invSize)
+	var rules *ruleconfig.Config
+	if *rulesFile != "" {
+		if rules, err = ruleconfig.Load(*rulesFile); err != nil {
+			log.Fatalf("Failed to load rules: %s", err)
+		}
+		log.Infof("Loaded %d rules from %s", rules.Len(), *rulesFile)
+	}
+
+	srv, err := server.NewPawnShopServer(server.Options{
+		InventorySize:    *invSize,
+		Listeners:        listeners,
+		IdleTimeout:      *idleTimeout,
+		ReadTimeout:      *readTimeout,
+		WriteTimeout:     *writeTimeout,
+		DrainTimeout:     *drainTimeout,
+		HTTPAddress:      *httpAddr,
+		HTTPMaxFrameSize: *httpMaxFrameSize,
+		AdminAddress:     *adminAddr,
+		DataDir:          *dataDir,
+		Storage:          *storage,
+		StorageFile:      *storageFile,
+		Shards:           *shards,
+		Routing:          inventory.Routing(*routing),
+		LoanTerm:         *loanTerm,
+		InterestRate:     *interestRate,
+		RetailMargin:     *margin,
+		QuoteTTL:         *quoteTTL,
+		CounterMargin:    *counterMargin,
+		RuleConfig:       rules,
+		Limits: server.LimitOptions{
+			Rate:              *rateLimit,
+			Burst:             *rateBurst,
+			MaxConnsPerClient: *maxConnsPerClient,
+			MaxConns:          *maxConns,
+			DailyQuota:        *dailyQuota,
+		},
+		Pool: server.PoolOptions{
+			Workers:   *workers,
+			QueueSize: *queueSize,
+			Overflow:  server.OverflowPolicy(*overflow),
+		},
+		Tracing: server.TracingOptions{
+			Exporter: server.TraceExporter(*traceExporter),
+			File:     *traceFile,
+			Endpoint: *otlpEndpoint,
+		},
+		Probes: server.ProbeOptions{
+			LivenessAddress:  *livenessProbe,
+			ReadinessAddress: *readinessProbe,
+			DrainDelay:       *drainDelay,
+		},
+	})
 	if err != nil {
 		log.Fatalf("Failed to create new server: %s", err)
 	}
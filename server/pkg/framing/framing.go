@@ -0,0 +1,199 @@
+// Package framing implements the message framing used on connections between the pawn shop server and its clients.
+// Two framing modes are supported: newline-delimited frames and length-prefixed frames.
+package framing
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+/*
+Mode is a framing mode, deciding how frames are delimited on a connection.
+*/
+type Mode string
+
+const (
+	// NewlineMode delimits every frame with a newline character. A trailing carriage return is ignored.
+	NewlineMode Mode = "newline"
+	// LengthPrefixedMode prefixes every frame with its length as a 4 byte big endian unsigned integer.
+	LengthPrefixedMode Mode = "length"
+
+	// DefaultMaxFrameSize is the default maximum size of a frame in bytes, excluding delimiters and prefixes.
+	DefaultMaxFrameSize = 4096
+
+	lengthPrefixSize = 4
+)
+
+var (
+	// ErrFrameTooLarge is returned when a frame is larger than the maximum frame size.
+	ErrFrameTooLarge = errors.New("frame exceeds maximum frame size")
+	// ErrFrameTruncated is returned when a connection ends in the middle of a frame.
+	ErrFrameTruncated = errors.New("frame was truncated")
+)
+
+/*
+Framer reads and writes frames on an underlying connection.
+*/
+type Framer interface {
+	// ReadFrame reads the next frame. It returns io.EOF if the connection ended cleanly in between frames.
+	ReadFrame() ([]byte, error)
+	// WriteFrame writes b as a single frame.
+	WriteFrame(b []byte) error
+}
+
+/*
+Parses a framing mode from its string representation.
+*/
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case NewlineMode, LengthPrefixedMode:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown framing mode %q", s)
+	}
+}
+
+/*
+Creates a new Framer for the given connection, using the given mode and maximum frame size.
+If maxFrameSize is less than 1, an error is returned.
+*/
+func New(rw io.ReadWriter, mode Mode, maxFrameSize int) (Framer, error) {
+	if maxFrameSize < 1 {
+		return nil, errors.New("max frame size must be at least 1")
+	}
+
+	switch mode {
+	case NewlineMode:
+		return &newlineFramer{
+			r:            bufio.NewReader(rw),
+			w:            rw,
+			maxFrameSize: maxFrameSize,
+		}, nil
+	case LengthPrefixedMode:
+		if maxFrameSize > math.MaxUint32 {
+			return nil, fmt.Errorf("max frame size can be at most %d in %s mode", uint32(math.MaxUint32), mode)
+		}
+		return &lengthPrefixedFramer{
+			r:            rw,
+			w:            rw,
+			maxFrameSize: maxFrameSize,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown framing mode %q", mode)
+	}
+}
+
+/*
+newlineFramer is a Framer for newline-delimited frames.
+*/
+type newlineFramer struct {
+	r            *bufio.Reader
+	w            io.Writer
+	maxFrameSize int
+}
+
+/*
+Reads the next newline-delimited frame. The delimiter is not part of the returned frame.
+*/
+func (f *newlineFramer) ReadFrame() ([]byte, error) {
+	var frame []byte
+	for {
+		chunk, err := f.r.ReadSlice('\n')
+
+		// Allow room for the delimiter and an optional carriage return
+		if len(frame)+len(chunk) > f.maxFrameSize+2 {
+			return nil, ErrFrameTooLarge
+		}
+		frame = append(frame, chunk...)
+
+		switch {
+		case err == nil:
+			frame = frame[:len(frame)-1]
+			if len(frame) > 0 && frame[len(frame)-1] == '\r' {
+				frame = frame[:len(frame)-1]
+			}
+			if len(frame) > f.maxFrameSize {
+				return nil, ErrFrameTooLarge
+			}
+			return frame, nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF):
+			if len(frame) == 0 {
+				return nil, io.EOF
+			}
+			return nil, ErrFrameTruncated
+		default:
+			return nil, err
+		}
+	}
+}
+
+/*
+Writes b followed by a newline as a single write.
+*/
+func (f *newlineFramer) WriteFrame(b []byte) error {
+	frame := make([]byte, 0, len(b)+1)
+	frame = append(frame, b...)
+	frame = append(frame, '\n')
+
+	_, err := f.w.Write(frame)
+	return err
+}
+
+/*
+lengthPrefixedFramer is a Framer for length-prefixed frames.
+*/
+type lengthPrefixedFramer struct {
+	r            io.Reader
+	w            io.Writer
+	maxFrameSize int
+}
+
+/*
+Reads the next length-prefixed frame. The prefix is not part of the returned frame.
+*/
+func (f *lengthPrefixedFramer) ReadFrame() ([]byte, error) {
+	prefix := make([]byte, lengthPrefixSize)
+	if _, err := io.ReadFull(f.r, prefix); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrFrameTruncated
+		}
+		return nil, err
+	}
+
+	sz := binary.BigEndian.Uint32(prefix)
+	if uint64(sz) > uint64(f.maxFrameSize) {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, sz)
+	if _, err := io.ReadFull(f.r, frame); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrFrameTruncated
+		}
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+/*
+Writes the length of b followed by b as a single write.
+*/
+func (f *lengthPrefixedFramer) WriteFrame(b []byte) error {
+	if uint64(len(b)) > math.MaxUint32 {
+		return ErrFrameTooLarge
+	}
+
+	frame := make([]byte, lengthPrefixSize, lengthPrefixSize+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	frame = append(frame, b...)
+
+	_, err := f.w.Write(frame)
+	return err
+}
@@ -0,0 +1,225 @@
+package framing
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMode(t *testing.T) {
+	cases := []struct {
+		name     string
+		mode     string
+		expMode  Mode
+		expError bool
+	}{
+		{
+			name:    "newline mode",
+			mode:    "newline",
+			expMode: NewlineMode,
+		},
+		{
+			name:    "length-prefixed mode",
+			mode:    "length",
+			expMode: LengthPrefixedMode,
+		},
+		{
+			name:     "unknown mode, should return error",
+			mode:     "unknown",
+			expError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mode, err := ParseMode(c.mode)
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expMode, mode)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		name         string
+		mode         Mode
+		maxFrameSize int
+		expError     bool
+	}{
+		{
+			name:         "newline mode",
+			mode:         NewlineMode,
+			maxFrameSize: 1,
+		},
+		{
+			name:         "length-prefixed mode",
+			mode:         LengthPrefixedMode,
+			maxFrameSize: DefaultMaxFrameSize,
+		},
+		{
+			name:         "max frame size < 1, should return error",
+			mode:         NewlineMode,
+			maxFrameSize: 0,
+			expError:     true,
+		},
+		{
+			name:         "unknown mode, should return error",
+			mode:         Mode("unknown"),
+			maxFrameSize: DefaultMaxFrameSize,
+			expError:     true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f, err := New(&bytes.Buffer{}, c.mode, c.maxFrameSize)
+			if c.expError {
+				require.Nil(t, f)
+				require.Error(t, err)
+				return
+			}
+			require.NotNil(t, f)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	cases := []struct {
+		name         string
+		mode         Mode
+		maxFrameSize int
+		input        []byte
+		expFrames    []string
+		expError     error
+	}{
+		{
+			name:         "newline mode, multiple frames",
+			mode:         NewlineMode,
+			maxFrameSize: 16,
+			input:        []byte("{\"a\":1}\n{\"b\":2}\r\n"),
+			expFrames:    []string{`{"a":1}`, `{"b":2}`},
+			expError:     io.EOF,
+		},
+		{
+			name:         "newline mode, frame of exactly max frame size",
+			mode:         NewlineMode,
+			maxFrameSize: 4,
+			input:        []byte("abcd\n"),
+			expFrames:    []string{"abcd"},
+			expError:     io.EOF,
+		},
+		{
+			name:         "newline mode, frame larger than max frame size, should return ErrFrameTooLarge",
+			mode:         NewlineMode,
+			maxFrameSize: 4,
+			input:        []byte("abcde\n"),
+			expError:     ErrFrameTooLarge,
+		},
+		{
+			name:         "newline mode, frame larger than read buffer, should return ErrFrameTooLarge",
+			mode:         NewlineMode,
+			maxFrameSize: 8,
+			input:        bytes.Repeat([]byte("a"), 10000),
+			expError:     ErrFrameTooLarge,
+		},
+		{
+			name:         "newline mode, missing delimiter, should return ErrFrameTruncated",
+			mode:         NewlineMode,
+			maxFrameSize: 16,
+			input:        []byte("{\"a\":1}\n{\"b\""),
+			expFrames:    []string{`{"a":1}`},
+			expError:     ErrFrameTruncated,
+		},
+		{
+			name:         "length-prefixed mode, multiple frames",
+			mode:         LengthPrefixedMode,
+			maxFrameSize: 16,
+			input:        []byte("\x00\x00\x00\x07{\"a\":1}\x00\x00\x00\x02{}"),
+			expFrames:    []string{`{"a":1}`, `{}`},
+			expError:     io.EOF,
+		},
+		{
+			name:         "length-prefixed mode, frame larger than max frame size, should return ErrFrameTooLarge",
+			mode:         LengthPrefixedMode,
+			maxFrameSize: 4,
+			input:        []byte("\x00\x00\x00\x05abcde"),
+			expError:     ErrFrameTooLarge,
+		},
+		{
+			name:         "length-prefixed mode, truncated prefix, should return ErrFrameTruncated",
+			mode:         LengthPrefixedMode,
+			maxFrameSize: 16,
+			input:        []byte("\x00\x00"),
+			expError:     ErrFrameTruncated,
+		},
+		{
+			name:         "length-prefixed mode, truncated payload, should return ErrFrameTruncated",
+			mode:         LengthPrefixedMode,
+			maxFrameSize: 16,
+			input:        []byte("\x00\x00\x00\x07{\"a\""),
+			expError:     ErrFrameTruncated,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f, err := New(bytes.NewBuffer(c.input), c.mode, c.maxFrameSize)
+			require.NoError(t, err)
+
+			for _, expFrame := range c.expFrames {
+				frame, err := f.ReadFrame()
+				require.NoError(t, err)
+				require.Equal(t, expFrame, string(frame))
+			}
+
+			_, err = f.ReadFrame()
+			require.ErrorIs(t, err, c.expError)
+		})
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	cases := []struct {
+		name     string
+		mode     Mode
+		frame    string
+		expBytes []byte
+	}{
+		{
+			name:     "newline mode",
+			mode:     NewlineMode,
+			frame:    `{"a":1}`,
+			expBytes: []byte("{\"a\":1}\n"),
+		},
+		{
+			name:     "length-prefixed mode",
+			mode:     LengthPrefixedMode,
+			frame:    `{"a":1}`,
+			expBytes: []byte("\x00\x00\x00\x07{\"a\":1}"),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			f, err := New(buf, c.mode, DefaultMaxFrameSize)
+			require.NoError(t, err)
+
+			err = f.WriteFrame([]byte(c.frame))
+			require.NoError(t, err)
+			require.Equal(t, c.expBytes, buf.Bytes())
+
+			// Frames written should be readable by a framer using the same mode
+			frame, err := f.ReadFrame()
+			require.NoError(t, err)
+			require.Equal(t, c.frame, string(frame))
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package inventory
+
+import (
+	"math"
+	"pawnshop/server/pkg/messages"
+)
+
+/*
+Returns the offer closest to o that the inventory would accept, if the offer is raised by at most maxRaise,
+or the demand is lowered by at most maxRelax. Raising the offer is preferred, as it is more profitable.
+Returns the counter-offer and the value of the item that would be given up for it, or false if there is no
+such offer, e.g. because the inventory would accept o as it is.
+*/
+func (i *Inventory) Counter(o messages.Offer, maxRaise, maxRelax int) (messages.Offer, int, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	var b bounds
+	b.add(i.index, o)
+	return b.counter(o, maxRaise, maxRelax)
+}
+
+/*
+Returns the offer closest to o that any shard of the inventory would accept, see Inventory.Counter.
+*/
+func (s *ShardedInventory) Counter(o messages.Offer, maxRaise, maxRelax int) (messages.Offer, int, bool) {
+	var b bounds
+	for _, inv := range s.shards {
+		inv.lock.Lock()
+		b.add(inv.index, o)
+		inv.lock.Unlock()
+	}
+
+	return b.counter(o, maxRaise, maxRelax)
+}
+
+/*
+bounds holds the available items closest to an offer: the smallest item that satisfies its demand,
+and the largest item that is less than the offer.
+*/
+type bounds struct {
+	above, below       int
+	hasAbove, hasBelow bool
+}
+
+/*
+Adds the items of the index that are closest to the offer to the bounds.
+*/
+func (b *bounds) add(x *index, o messages.Offer) {
+	if k, ok := x.ceiling(o.Demand); ok && (!b.hasAbove || k.value < b.above) {
+		b.above, b.hasAbove = k.value, true
+	}
+	if o.Offer == math.MinInt {
+		return
+	}
+	if k, ok := x.floor(o.Offer - 1); ok && (!b.hasBelow || k.value > b.below) {
+		b.below, b.hasBelow = k.value, true
+	}
+}
+
+/*
+Returns the counter-offer to o within the bounds, see Inventory.Counter.
+*/
+func (b *bounds) counter(o messages.Offer, maxRaise, maxRelax int) (messages.Offer, int, bool) {
+	// The offer is accepted as it is
+	if b.hasAbove && b.above < o.Offer {
+		return messages.Offer{}, 0, false
+	}
+
+	// The offer must be worth more than the smallest item that satisfies the demand
+	if b.hasAbove && b.above < math.MaxInt && b.above+1-o.Offer <= maxRaise {
+		c := o
+		c.Offer = b.above + 1
+		return c, b.above, true
+	}
+
+	// The demand must not be more than the largest item that is worth less than the offer
+	if b.hasBelow && o.Demand-b.below <= maxRelax {
+		c := o
+		c.Demand = b.below
+		return c, b.below, true
+	}
+
+	return messages.Offer{}, 0, false
+}
@@ -0,0 +1,88 @@
+package inventory
+
+import (
+	"context"
+	"pawnshop/server/pkg/messages"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounter(t *testing.T) {
+	cases := []struct {
+		name     string
+		offer    messages.Offer
+		maxRaise int
+		maxRelax int
+		expected messages.Offer
+		expValue int
+		expNok   bool
+	}{
+		{
+			name:     "offer can be raised, should raise it above the best item for the demand",
+			offer:    messages.CreateOffer(5, 3),
+			maxRaise: 1,
+			maxRelax: 1,
+			expected: messages.CreateOffer(6, 3),
+			expValue: 5,
+		},
+		{
+			name:     "offer can not be raised enough, should lower the demand to the best item below the offer",
+			offer:    messages.CreateOffer(5, 3),
+			maxRelax: 1,
+			expected: messages.CreateOffer(5, 2),
+			expValue: 2,
+		},
+		{
+			name:     "no item satisfies the demand, should lower the demand",
+			offer:    messages.CreateOffer(20, 10),
+			maxRaise: 100,
+			maxRelax: 1,
+			expected: messages.CreateOffer(20, 9),
+			expValue: 9,
+		},
+		{
+			name:   "neither can be changed enough, should return nothing",
+			offer:  messages.CreateOffer(5, 3),
+			expNok: true,
+		},
+		{
+			name:     "no item is worth less than the offer, should return nothing",
+			offer:    messages.CreateOffer(1, 0),
+			maxRaise: 1,
+			maxRelax: 10,
+			expNok:   true,
+		},
+		{
+			name:     "offer is accepted as it is, should return nothing",
+			offer:    messages.CreateOffer(6, 3),
+			maxRaise: 10,
+			maxRelax: 10,
+			expNok:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i, err := NewInventoryFromItems([]int{9, 2, 5})
+			require.NoError(t, err)
+			s, err := NewShardedInventory(NewMemoryStorage([]int{9, 2, 5}), 2, GlobalRouting)
+			require.NoError(t, err)
+
+			for _, counter := range []func(messages.Offer, int, int) (messages.Offer, int, bool){i.Counter, s.Counter} {
+				o, value, ok := counter(c.offer, c.maxRaise, c.maxRelax)
+				if c.expNok {
+					assert.False(t, ok)
+					continue
+				}
+				require.True(t, ok)
+				assert.Equal(t, c.expected, o)
+				assert.Equal(t, c.expValue, value)
+
+				// The inventory must accept the counter-offer
+				assert.Equal(t, messages.CreateAcceptedAnswer(c.expValue), i.Quote(context.Background(), o))
+			}
+		})
+	}
+}
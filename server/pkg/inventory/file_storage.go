@@ -0,0 +1,236 @@
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"pawnshop/server/pkg/persistence"
+)
+
+const (
+	// fileStorageMagic identifies a file written by a FileStorage.
+	fileStorageMagic = "PAWNINV1"
+	// fileStorageItemSize is the size of a single item in a FileStorage file.
+	fileStorageItemSize = 8
+)
+
+/*
+FileStorage is a Storage keeping all items in a file on disk. The file consists of an 8 byte
+magic header followed by every item as an 8 byte big endian signed integer, in order of index.
+Every change is synced to disk before it is reported as done.
+*/
+type FileStorage struct {
+	path string
+	file *os.File
+	size int
+}
+
+/*
+Opens the FileStorage at the given path, creating an empty storage if the file does not exist.
+Returns an error if the file exists but is not a valid FileStorage file.
+*/
+func OpenFileStorage(path string) (*FileStorage, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to stat storage file: %w", err)
+	}
+
+	s := &FileStorage{path: path, file: f}
+	if info.Size() == 0 {
+		if err = s.Load(nil); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+
+	magic := make([]byte, len(fileStorageMagic))
+	if _, err = f.ReadAt(magic, 0); err != nil || !bytes.Equal(magic, []byte(fileStorageMagic)) {
+		f.Close()
+		return nil, fmt.Errorf("%s is not an inventory storage file", path)
+	}
+
+	itemsSz := info.Size() - int64(len(fileStorageMagic))
+	if itemsSz%fileStorageItemSize != 0 {
+		f.Close()
+		return nil, fmt.Errorf("storage file %s is corrupted, its size is not a multiple of the item size", path)
+	}
+	s.size = int(itemsSz / fileStorageItemSize)
+
+	return s, nil
+}
+
+/*
+Replaces the entire contents of the storage with the given items. The items are written to a temporary
+file that is renamed into place, so that a crash never leaves a partially written storage file behind.
+*/
+func (f *FileStorage) Load(items []int) error {
+	b := make([]byte, 0, len(fileStorageMagic)+len(items)*fileStorageItemSize)
+	b = append(b, fileStorageMagic...)
+	for _, item := range items {
+		b = binary.BigEndian.AppendUint64(b, uint64(item))
+	}
+
+	tmp, err := os.OpenFile(f.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create storage file: %w", err)
+	}
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write storage file: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync storage file: %w", err)
+	}
+	if err = os.Rename(f.path+".tmp", f.path); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to rename storage file: %w", err)
+	}
+	if err = persistence.SyncDir(filepath.Dir(f.path)); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync storage directory: %w", err)
+	}
+
+	f.file.Close()
+	f.file = tmp
+	f.size = len(items)
+	return nil
+}
+
+/*
+Returns the item at idx.
+*/
+func (f *FileStorage) Get(idx int) (int, error) {
+	if idx < 0 || idx >= f.size {
+		return 0, indexOutOfRangeError(idx, f.size)
+	}
+
+	b := make([]byte, fileStorageItemSize)
+	if _, err := f.file.ReadAt(b, offset(idx)); err != nil {
+		return 0, fmt.Errorf("failed to read item %d from storage file: %w", idx, err)
+	}
+
+	return int(int64(binary.BigEndian.Uint64(b))), nil
+}
+
+/*
+Replaces the item at idx with value, and syncs the change to disk.
+*/
+func (f *FileStorage) Replace(idx, value int) error {
+	if idx < 0 || idx >= f.size {
+		return indexOutOfRangeError(idx, f.size)
+	}
+
+	b := binary.BigEndian.AppendUint64(nil, uint64(value))
+	if _, err := f.file.WriteAt(b, offset(idx)); err != nil {
+		return fmt.Errorf("failed to write item %d to storage file: %w", idx, err)
+	}
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync storage file: %w", err)
+	}
+
+	return nil
+}
+
+/*
+Adds an item with value at the end, and syncs the change to disk.
+*/
+func (f *FileStorage) Add(value int) error {
+	b := binary.BigEndian.AppendUint64(nil, uint64(value))
+	if _, err := f.file.WriteAt(b, offset(f.size)); err != nil {
+		return fmt.Errorf("failed to write item %d to storage file: %w", f.size, err)
+	}
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync storage file: %w", err)
+	}
+
+	f.size++
+	return nil
+}
+
+/*
+Removes the item at idx by moving the last item into its place, and syncs the change to disk.
+The last item is written to idx before the file is truncated, so a crash in between leaves a copy
+of the last item behind rather than losing it.
+*/
+func (f *FileStorage) Remove(idx int) error {
+	if idx < 0 || idx >= f.size {
+		return indexOutOfRangeError(idx, f.size)
+	}
+
+	last, err := f.Get(f.size - 1)
+	if err != nil {
+		return err
+	}
+	if err = f.Replace(idx, last); err != nil {
+		return err
+	}
+
+	if err = f.file.Truncate(offset(f.size - 1)); err != nil {
+		return fmt.Errorf("failed to truncate storage file: %w", err)
+	}
+	if err = f.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync storage file: %w", err)
+	}
+
+	f.size--
+	return nil
+}
+
+/*
+Calls fn for every item in order of index, until fn returns false.
+*/
+func (f *FileStorage) Iterate(fn func(idx, value int) bool) error {
+	r := bufio.NewReader(io.NewSectionReader(f.file, offset(0), int64(f.size)*fileStorageItemSize))
+	b := make([]byte, fileStorageItemSize)
+
+	for idx := 0; idx < f.size; idx++ {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return fmt.Errorf("failed to read item %d from storage file: %w", idx, err)
+		}
+		if !fn(idx, int(int64(binary.BigEndian.Uint64(b)))) {
+			break
+		}
+	}
+
+	return nil
+}
+
+/*
+Returns the number of items in the storage.
+*/
+func (f *FileStorage) Size() int {
+	return f.size
+}
+
+/*
+Closes the storage file.
+*/
+func (f *FileStorage) Close() error {
+	if f.file == nil {
+		return errors.New("storage is already closed")
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+/*
+Returns the offset of the item at idx in a storage file.
+*/
+func offset(idx int) int64 {
+	return int64(len(fileStorageMagic)) + int64(idx)*fileStorageItemSize
+}
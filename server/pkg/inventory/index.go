@@ -0,0 +1,230 @@
+package inventory
+
+import (
+	"math/rand"
+)
+
+/*
+indexKey is the key of an item in an index. Keys are ordered by value, and items with the same value
+are ordered by their index in the inventory.
+*/
+type indexKey struct {
+	value int
+	idx   int
+}
+
+/*
+Returns true if the key is ordered before the other key.
+*/
+func (k indexKey) less(other indexKey) bool {
+	return k.value < other.value || (k.value == other.value && k.idx < other.idx)
+}
+
+/*
+indexNode is a node in the treap of an index.
+*/
+type indexNode struct {
+	key      indexKey
+	priority uint32
+	left     *indexNode
+	right    *indexNode
+}
+
+/*
+index is an ordered multiset of the items in an inventory, implemented as a treap. A treap is a binary
+search tree where every node also has a random priority that is kept in heap order, which keeps the
+tree balanced with high probability, so all operations take O(log n) time.
+It is NOT thread-safe and should be used from another thread-safe function in the inventory.
+*/
+type index struct {
+	root *indexNode
+	size int
+}
+
+/*
+Creates a new index of the given items, where the index of every item is its position in items.
+*/
+func newIndex(items []int) *index {
+	x := &index{}
+	for idx, value := range items {
+		x.insert(value, idx)
+	}
+	return x
+}
+
+/*
+Inserts the item with the given value at idx.
+*/
+func (x *index) insert(value, idx int) {
+	x.root = insertNode(x.root, &indexNode{
+		key:      indexKey{value: value, idx: idx},
+		priority: rand.Uint32(),
+	})
+	x.size++
+}
+
+/*
+Removes the item with the given value at idx. Returns false if there is no such item.
+*/
+func (x *index) remove(value, idx int) bool {
+	var removed bool
+	x.root, removed = removeNode(x.root, indexKey{value: value, idx: idx})
+	if removed {
+		x.size--
+	}
+	return removed
+}
+
+/*
+Returns the item with the smallest value, with ties broken by the smallest index.
+Returns false if the index is empty.
+*/
+func (x *index) min() (indexKey, bool) {
+	if x.root == nil {
+		return indexKey{}, false
+	}
+
+	n := x.root
+	for n.left != nil {
+		n = n.left
+	}
+	return n.key, true
+}
+
+/*
+Returns the item with the largest value, with ties broken by the largest index.
+Returns false if the index is empty.
+*/
+func (x *index) max() (indexKey, bool) {
+	if x.root == nil {
+		return indexKey{}, false
+	}
+
+	n := x.root
+	for n.right != nil {
+		n = n.right
+	}
+	return n.key, true
+}
+
+/*
+Returns the item with the smallest value that is greater than or equal to value, with ties broken by
+the smallest index. Returns false if there is no such item.
+*/
+func (x *index) ceiling(value int) (indexKey, bool) {
+	var best *indexNode
+	for n := x.root; n != nil; {
+		if n.key.value >= value {
+			best = n
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+
+	if best == nil {
+		return indexKey{}, false
+	}
+	return best.key, true
+}
+
+/*
+Returns the item with the largest value that is less than or equal to value, with ties broken by
+the largest index. Returns false if there is no such item.
+*/
+func (x *index) floor(value int) (indexKey, bool) {
+	var best *indexNode
+	for n := x.root; n != nil; {
+		if n.key.value <= value {
+			best = n
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+
+	if best == nil {
+		return indexKey{}, false
+	}
+	return best.key, true
+}
+
+/*
+Inserts node n into the treap rooted at t, and returns the new root.
+*/
+func insertNode(t, n *indexNode) *indexNode {
+	if t == nil {
+		return n
+	}
+
+	if n.priority > t.priority {
+		n.left, n.right = split(t, n.key)
+		return n
+	}
+
+	if n.key.less(t.key) {
+		t.left = insertNode(t.left, n)
+	} else {
+		t.right = insertNode(t.right, n)
+	}
+	return t
+}
+
+/*
+Removes the node with key k from the treap rooted at t, and returns the new root and
+whether a node was removed.
+*/
+func removeNode(t *indexNode, k indexKey) (*indexNode, bool) {
+	if t == nil {
+		return nil, false
+	}
+
+	var removed bool
+	switch {
+	case k.less(t.key):
+		t.left, removed = removeNode(t.left, k)
+	case t.key.less(k):
+		t.right, removed = removeNode(t.right, k)
+	default:
+		return merge(t.left, t.right), true
+	}
+	return t, removed
+}
+
+/*
+Splits the treap rooted at t into a treap with all keys less than k, and a treap with all other keys.
+*/
+func split(t *indexNode, k indexKey) (*indexNode, *indexNode) {
+	if t == nil {
+		return nil, nil
+	}
+
+	if t.key.less(k) {
+		var right *indexNode
+		t.right, right = split(t.right, k)
+		return t, right
+	}
+
+	var left *indexNode
+	left, t.left = split(t.left, k)
+	return left, t
+}
+
+/*
+Merges the treaps rooted at l and r, where all keys in l are less than all keys in r, and returns the new root.
+*/
+func merge(l, r *indexNode) *indexNode {
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+
+	if l.priority > r.priority {
+		l.right = merge(l.right, r)
+		return l
+	}
+	r.left = merge(l, r.left)
+	return r
+}
@@ -0,0 +1,180 @@
+package inventory
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexCeiling(t *testing.T) {
+	cases := []struct {
+		name   string
+		items  []int
+		value  int
+		exp    indexKey
+		expNok bool
+	}{
+		{
+			name:  "exact value, should return it",
+			items: []int{7, 4, 5, 2, 7},
+			value: 5,
+			exp:   indexKey{value: 5, idx: 2},
+		},
+		{
+			name:  "value between items, should return the next larger item",
+			items: []int{7, 4, 5, 2, 7},
+			value: 6,
+			exp:   indexKey{value: 7, idx: 0},
+		},
+		{
+			name:  "value below all items, should return the smallest item",
+			items: []int{7, 4, 5, 2, 7},
+			value: -3,
+			exp:   indexKey{value: 2, idx: 3},
+		},
+		{
+			name:   "value above all items, should return nothing",
+			items:  []int{7, 4, 5, 2, 7},
+			value:  8,
+			expNok: true,
+		},
+		{
+			name:   "empty index, should return nothing",
+			items:  []int{},
+			value:  1,
+			expNok: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			k, ok := newIndex(c.items).ceiling(c.value)
+			assert.Equal(t, !c.expNok, ok)
+			assert.Equal(t, c.exp, k)
+		})
+	}
+}
+
+func TestIndexFloor(t *testing.T) {
+	cases := []struct {
+		name   string
+		items  []int
+		value  int
+		exp    indexKey
+		expNok bool
+	}{
+		{
+			name:  "exact value, should return it",
+			items: []int{7, 4, 5, 2, 7},
+			value: 5,
+			exp:   indexKey{value: 5, idx: 2},
+		},
+		{
+			name:  "value between items, should return the next smaller item",
+			items: []int{7, 4, 5, 2, 7},
+			value: 3,
+			exp:   indexKey{value: 2, idx: 3},
+		},
+		{
+			name:  "value above all items, should return the largest item",
+			items: []int{7, 4, 5, 2, 7},
+			value: 10,
+			exp:   indexKey{value: 7, idx: 4},
+		},
+		{
+			name:   "value below all items, should return nothing",
+			items:  []int{7, 4, 5, 2, 7},
+			value:  1,
+			expNok: true,
+		},
+		{
+			name:   "empty index, should return nothing",
+			items:  []int{},
+			value:  1,
+			expNok: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			k, ok := newIndex(c.items).floor(c.value)
+			assert.Equal(t, !c.expNok, ok)
+			assert.Equal(t, c.exp, k)
+		})
+	}
+}
+
+func TestIndexRemove(t *testing.T) {
+	x := newIndex([]int{3, 1, 3})
+
+	assert.False(t, x.remove(3, 1))
+	assert.Equal(t, 3, x.size)
+
+	assert.True(t, x.remove(1, 1))
+	assert.Equal(t, 2, x.size)
+
+	min, ok := x.min()
+	assert.True(t, ok)
+	assert.Equal(t, indexKey{value: 3, idx: 0}, min)
+
+	max, ok := x.max()
+	assert.True(t, ok)
+	assert.Equal(t, indexKey{value: 3, idx: 2}, max)
+
+	assert.True(t, x.remove(3, 0))
+	assert.True(t, x.remove(3, 2))
+	_, ok = x.min()
+	assert.False(t, ok)
+	_, ok = x.max()
+	assert.False(t, ok)
+}
+
+func TestIndexRandomOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	items := make([]int, 500)
+	for idx := range items {
+		items[idx] = r.Intn(100)
+	}
+	x := newIndex(items)
+
+	for n := 0; n < 2000; n++ {
+		idx := r.Intn(len(items))
+		require.True(t, x.remove(items[idx], idx))
+		items[idx] = r.Intn(100)
+		x.insert(items[idx], idx)
+
+		// Compare against all items sorted by value and index
+		sorted := make([]indexKey, len(items))
+		for idx, value := range items {
+			sorted[idx] = indexKey{value: value, idx: idx}
+		}
+		sort.Slice(sorted, func(a, b int) bool { return sorted[a].less(sorted[b]) })
+
+		min, ok := x.min()
+		require.True(t, ok)
+		require.Equal(t, sorted[0], min)
+
+		max, ok := x.max()
+		require.True(t, ok)
+		require.Equal(t, sorted[len(sorted)-1], max)
+
+		value := r.Intn(110)
+		expPos := sort.Search(len(sorted), func(i int) bool { return sorted[i].value >= value })
+		k, ok := x.ceiling(value)
+		require.Equal(t, expPos < len(sorted), ok)
+		if ok {
+			require.Equal(t, sorted[expPos], k)
+		}
+
+		expPos = sort.Search(len(sorted), func(i int) bool { return sorted[i].value > value }) - 1
+		k, ok = x.floor(value)
+		require.Equal(t, expPos >= 0, ok)
+		if ok {
+			require.Equal(t, sorted[expPos], k)
+		}
+	}
+	require.Equal(t, len(items), x.size)
+}
@@ -1,140 +1,329 @@
 package inventory
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math"
+	"pawnshop/server/pkg/logging"
 	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/tracing"
 
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	defaultItemValue = 1
+	// DefaultItemValue is the value of every item in a fresh inventory.
+	DefaultItemValue = 1
+
+	// maxFormattedItems is the number of items included in the string representation of an inventory,
+	// so that logging a large inventory does not flood the logs
+	maxFormattedItems = 32
 )
 
 /*
 Inventory is a data structure that manages a list of items in a thread safe manner.
 It also provides a function for handling offers from clients, accepting them if they are profitable
-and rejecting them if they are not.
+and rejecting them if they are not. The items are kept in a Storage backend, and are ordered by value
+in an index so that handling an offer takes O(log n) time.
 */
 type Inventory struct {
-	items              []int
-	smallestValue      int
-	smallestValueIndex int
-	lock               sync.Mutex
+	storage Storage
+	index   *index
+	// ages holds the age of every item by index, which is the value of seq when the item was added
+	ages []uint64
+	seq  *atomic.Uint64
+	// pledges holds the index of every held item by the ID of its hold, and held the ID of the hold of every
+	// held item by index. Items are held as pledges or for quotes. Held items are not in the index, so they
+	// are not given up for offers.
+	pledges map[uint64]int
+	held    map[int]uint64
+	journal Journal
+	// lockObserver is told how long every offer waited for the lock, if it is set
+	lockObserver LockObserver
+	lock         sync.Mutex
 }
 
 /*
-Creates a new inventory with the given size.
+Journal is an interface for a durable record of the changes made to an inventory.
+An inventory writes every change to its storage first, and then appends it to the journal. If the change can not
+be appended, it is undone in the storage and fails, so that the journal never records a change that failed.
+Only changes that were appended are applied to the rest of the inventory, e.g. its index.
+*/
+type Journal interface {
+	// Append records that the item at idx was replaced with value.
+	Append(idx, value int) error
+	// Reset records that all items of the inventory were replaced with items, e.g. when it is resized.
+	Reset(items []int) error
+	// Add records that an item with value was added at the end.
+	Add(value int) error
+	// Remove records that the item at idx was removed, and the last item was moved into its place.
+	Remove(idx int) error
+}
+
+/*
+LockObserver is an interface for observing how long offers wait for the lock of an inventory, e.g. to
+export it as a metric. It must be thread-safe, and fast, as it is called with the lock held.
+*/
+type LockObserver interface {
+	// ObserveLockWait is called with the time an offer waited for the lock.
+	ObserveLockWait(wait time.Duration)
+}
+
+/*
+Creates a new in-memory inventory with the given size.
 */
 func NewInventory(sz int) *Inventory {
+	items := DefaultItems(sz)
+
+	return &Inventory{
+		storage: NewMemoryStorage(items),
+		index:   newIndex(items),
+		ages:    make([]uint64, sz),
+		seq:     &atomic.Uint64{},
+		pledges: make(map[uint64]int),
+		held:    make(map[int]uint64),
+		lock:    sync.Mutex{},
+	}
+}
+
+/*
+Returns the items of a fresh inventory of the given size.
+*/
+func DefaultItems(sz int) []int {
 	items := make([]int, sz)
 
 	for i := range items {
-		items[i] = defaultItemValue
+		items[i] = DefaultItemValue
 	}
 
-	return &Inventory{
-		items:              items,
-		smallestValue:      defaultItemValue,
-		smallestValueIndex: 0,
-		lock:               sync.Mutex{},
+	return items
+}
+
+/*
+Creates a new in-memory inventory containing the given items, e.g. items recovered from a journal.
+If there are no items, an error is returned.
+*/
+func NewInventoryFromItems(items []int) (*Inventory, error) {
+	return NewInventoryWithStorage(NewMemoryStorage(items))
+}
+
+/*
+Creates a new inventory backed by the given storage, containing the items already in the storage.
+If the storage contains no items, an error is returned.
+*/
+func NewInventoryWithStorage(st Storage) (*Inventory, error) {
+	if st.Size() == 0 {
+		return nil, errors.New("inventory must contain at least 1 item")
 	}
+
+	i := &Inventory{
+		storage: st,
+		ages:    make([]uint64, st.Size()),
+		seq:     &atomic.Uint64{},
+		pledges: make(map[uint64]int),
+		held:    make(map[int]uint64),
+		lock:    sync.Mutex{},
+	}
+
+	items, err := i.items()
+	if err != nil {
+		return nil, err
+	}
+	i.index = newIndex(items)
+
+	return i, nil
 }
 
 /*
-Handles an offer from the caller. It checks if the offer would be profitable
-for the inventory, and if so, it will allow the offer and return the exchanged value.
-If the offer does not align with the inventory's requirements, it will reject the offer.
+Sets the journal that every change to the inventory is appended to, see Journal.
+*/
+func (i *Inventory) SetJournal(j Journal) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.journal = j
+}
+
+/*
+Sets the observer that is told how long every offer waits for the lock of the inventory.
 */
-func (i *Inventory) HandleOffer(o messages.Offer) messages.Answer {
-	defer log.Infof("Inventory after handling offer: %s", i)
+func (i *Inventory) SetLockObserver(o LockObserver) {
 	i.lock.Lock()
 	defer i.lock.Unlock()
 
-	isP, idx := i.isProfitable(o)
-	if !isP {
-		log.Debugf("Offer %+v is not profitable for the inventory, or not possible for the inventory to accept", o)
-		return messages.CreateRejectAnswer()
+	i.lockObserver = o
+}
+
+/*
+Locks the inventory for an offer, and tells the lock observer how long it waited for the lock.
+The wait is also traced as a span of the offer, if ctx carries one.
+*/
+func (i *Inventory) lockForOffer(ctx context.Context) {
+	_, span := tracing.Start(ctx, "Inventory.lock")
+	start := time.Now()
+	i.lock.Lock()
+	span.End()
+	if i.lockObserver != nil {
+		i.lockObserver.ObserveLockWait(time.Since(start))
 	}
+}
+
+/*
+Handles an offer from the caller. It checks if the offer would be profitable
+for the inventory, and if so, it will allow the offer and return the exchanged value.
+If the offer does not align with the inventory's requirements, it will reject the offer.
+*/
+func (i *Inventory) HandleOffer(ctx context.Context, o messages.Offer) messages.Answer {
+	ctx, span := tracing.Start(ctx, "Inventory.HandleOffer")
+	defer span.End()
+	// Printing the inventory takes O(n) time, so it is only done when debugging
+	defer logging.FromContext(ctx).Debugf("Inventory after handling offer: %s", i)
+	i.lockForOffer(ctx)
+	defer i.lock.Unlock()
 
-	// Hold value to return to client in answer
-	valToRet := i.items[idx]
+	ans, _ := i.handle(ctx, o, swap)
+	span.SetAttribute(tracing.DecisionAttribute, ans.Code)
+	return ans
+}
 
+/*
+Replaces the item at idx, which has the value valToRet, with the offer, and returns the answer to the offer.
+It is NOT thread-safe and should be called from another thread-safe function in the inventory.
+*/
+func (i *Inventory) replace(o messages.Offer, idx, valToRet int) messages.Answer {
 	// Replace the item in the inventory that was decided to be the most
 	// profitable to give up, with the received offer
-	i.items[idx] = o.Offer
-
-	// If the replaced object was the smallest value in the inventory,
-	// we find the new smallest value and its index to avoid the work of iteratively
-	// finding the smallest value for every new offer
-	if idx == i.smallestValueIndex {
-		newSmValue := i.items[0]
-		newSmValueIdx := 0
-		for j := 1; j < len(i.items); j++ {
-			if i.items[j] < newSmValue {
-				newSmValue = i.items[j]
-				newSmValueIdx = j
-			}
+	if err := i.storage.Replace(idx, o.Offer); err != nil {
+		log.Errorf("Failed to replace item %d in storage, rejecting offer %+v: %s", idx, o, err)
+		return messages.CreateRejectAnswerFor(err)
+	}
+	if i.journal != nil {
+		if err := i.journal.Append(idx, o.Offer); err != nil {
+			logUndo(i.storage.Replace(idx, valToRet))
+			log.Errorf("Failed to journal offer %+v, rejecting it: %s", o, err)
+			return messages.CreateRejectAnswerFor(err)
 		}
-		// Cache the new smallest value and its index
-		i.smallestValue = newSmValue
-		i.smallestValueIndex = newSmValueIdx
 	}
 
+	// Keep the index ordered by value in sync with the storage
+	i.index.remove(valToRet, idx)
+	i.index.insert(o.Offer, idx)
+	i.ages[idx] = i.seq.Add(1)
+
 	return messages.CreateAcceptedAnswer(valToRet)
 }
 
 /*
-Returns a string representation of the inventory.
+Returns a copy of the items in the inventory.
+*/
+func (i *Inventory) Items() ([]int, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.items()
+}
+
+/*
+Returns the value of the most valuable item that can be given up for offers.
+Returns false if every item is held.
+*/
+func (i *Inventory) Max() (int, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	k, ok := i.index.max()
+	return k.value, ok
+}
+
+/*
+Returns a copy of the items in the inventory. It is NOT thread-safe and should be
+called from another thread-safe function in the inventory.
+*/
+func (i *Inventory) items() ([]int, error) {
+	items := make([]int, 0, i.storage.Size())
+	err := i.storage.Iterate(func(_, item int) bool {
+		items = append(items, item)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate storage: %w", err)
+	}
+
+	return items, nil
+}
+
+/*
+Returns a string representation of the inventory, with at most the first 32 items.
 */
 func (i *Inventory) String() string {
 	i.lock.Lock()
 	defer i.lock.Unlock()
 
-	s := make([]string, len(i.items))
-	for j, item := range i.items {
+	items, err := i.items()
+	if err != nil {
+		return fmt.Sprintf("[error: %s]", err)
+	}
+
+	return formatItems(items)
+}
+
+/*
+Returns a string representation of the given items, with at most the first maxFormattedItems items.
+*/
+func formatItems(items []int) string {
+	shown := items
+	if len(shown) > maxFormattedItems {
+		shown = shown[:maxFormattedItems]
+	}
+
+	s := make([]string, len(shown), len(shown)+1)
+	for j, item := range shown {
 		s[j] = strconv.Itoa(item)
 	}
+	if len(items) > len(shown) {
+		s = append(s, fmt.Sprintf("... %d more", len(items)-len(shown)))
+	}
 
 	return fmt.Sprintf("[%s]", strings.Join(s, ", "))
 }
 
 /*
 Checks if the offer is possible and can be profitable for the inventory.
-If it is profitable, it will also return the index of the most profitable item in the inventory
-that satisfies the demand. It is NOT thread-safe and should be called from another thread-safe
-function in the inventory.
-*/
-func (i *Inventory) isProfitable(o messages.Offer) (bool, int) {
-	// If the offer is less than or equal to the smallest value in the inventory, it can not be profitable
-	if o.Offer <= i.smallestValue {
-		return false, 0
+If it is profitable, it will return the index and value of the most profitable item in the inventory
+that satisfies the demand, and otherwise an error with the reason why not. If there is an item that satisfies
+the demand, but the offer is not profitable, the index and value of the item are returned along with the error.
+It is NOT thread-safe and should be called from another thread-safe function in the inventory.
+*/
+func (i *Inventory) isProfitable(o messages.Offer) (int, int, error) {
+	// The most profitable item is the smallest item that satisfies the demand.
+	// It must also be less than the offer to ensure profit.
+	k, ok := i.index.ceiling(o.Demand)
+	if !ok {
+		return 0, 0, noMatchingItemError(o)
 	}
-
-	// Find the item in the inventory that gives the highest profit.
-	// It must be greater than or equal to the demand, less than the offer,
-	// and provide a greater profit than any other item in the inventory.
-	maxPrItemVal := math.MaxInt
-	maxPrItemIdx := -1
-	for idx := 0; idx < len(i.items); idx++ {
-		item := i.items[idx]
-		if item >= o.Demand && // Satisfies demand
-			o.Offer > item && // Will ensure profit
-			item < maxPrItemVal { // Is it the best item so far?
-			maxPrItemVal = item
-			maxPrItemIdx = idx
-		}
+	if k.value >= o.Offer {
+		return k.idx, k.value, notProfitableError(o, k.value)
 	}
 
-	// If no item satisfies the demand and gives profit, the offer is not profitable
-	if maxPrItemIdx == -1 {
-		return false, 0
-	}
+	return k.idx, k.value, nil
+}
 
-	return true, maxPrItemIdx
+/*
+Returns the error for an offer whose demand no available item satisfies.
+*/
+func noMatchingItemError(o messages.Offer) error {
+	return messages.Errorf(messages.ReasonNoMatchingItem, "no available item is worth at least the demand of %d", o.Demand)
+}
+
+/*
+Returns the error for an offer that is not worth more than value, the value of the best item for its demand.
+*/
+func notProfitableError(o messages.Offer, value int) error {
+	return messages.Errorf(messages.ReasonNotProfitable, "the best item for the demand is worth %d, which is not less than the offer of %d", value, o.Offer)
 }
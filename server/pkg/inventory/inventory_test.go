@@ -1,8 +1,16 @@
 package inventory
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
 	"pawnshop/server/pkg/messages"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -11,31 +19,69 @@ func TestNewInventory(t *testing.T) {
 	cases := []struct {
 		name     string
 		size     int
-		expected *Inventory
+		expItems []int
+		expMin   indexKey
 	}{
 		{
-			name: "size 1",
-			size: 1,
-			expected: &Inventory{
-				items:              []int{1},
-				smallestValue:      1,
-				smallestValueIndex: 0,
-			},
+			name:     "size 1",
+			size:     1,
+			expItems: []int{1},
+			expMin:   indexKey{value: 1, idx: 0},
 		},
 		{
-			name: "size 5",
-			size: 5,
-			expected: &Inventory{
-				items:              []int{1, 1, 1, 1, 1},
-				smallestValue:      1,
-				smallestValueIndex: 0,
-			},
+			name:     "size 5",
+			size:     5,
+			expItems: []int{1, 1, 1, 1, 1},
+			expMin:   indexKey{value: 1, idx: 0},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i := NewInventory(c.size)
+			assert.Equal(t, &MemoryStorage{items: c.expItems}, i.storage)
+			assert.Equal(t, c.size, i.index.size)
+
+			min, ok := i.index.min()
+			assert.True(t, ok)
+			assert.Equal(t, c.expMin, min)
+		})
+	}
+}
+
+func TestNewInventoryFromItems(t *testing.T) {
+	cases := []struct {
+		name     string
+		items    []int
+		expMin   indexKey
+		expError bool
+	}{
+		{
+			name:   "mixed items",
+			items:  []int{7, 4, 2, 5, 2},
+			expMin: indexKey{value: 2, idx: 2},
+		},
+		{
+			name:     "no items, should return error",
+			items:    []int{},
+			expError: true,
 		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			assert.Equal(t, c.expected, NewInventory(c.size))
+			i, err := NewInventoryFromItems(c.items)
+			if c.expError {
+				assert.Nil(t, i)
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, &MemoryStorage{items: c.items}, i.storage)
+
+			min, ok := i.index.min()
+			assert.True(t, ok)
+			assert.Equal(t, c.expMin, min)
 		})
 	}
 }
@@ -45,8 +91,7 @@ func TestHandleOffer(t *testing.T) {
 		name                     string
 		offer                    messages.Offer
 		expected                 messages.Answer
-		oldSmallestValue         int
-		oldSmallestValueIndex    int
+		expReason                messages.ReasonCode
 		oldItems                 []int
 		expNewItems              []int
 		expNewSmallestValue      int
@@ -63,8 +108,6 @@ func TestHandleOffer(t *testing.T) {
 				Code:  messages.AcceptCode,
 				Value: 1,
 			},
-			oldSmallestValue:         1,
-			oldSmallestValueIndex:    0,
 			oldItems:                 []int{1, 1, 1, 1, 1},
 			expNewSmallestValue:      1,
 			expNewSmallestValueIndex: 1,
@@ -81,8 +124,6 @@ func TestHandleOffer(t *testing.T) {
 				Code:  messages.AcceptCode,
 				Value: 1,
 			},
-			oldSmallestValue:         1,
-			oldSmallestValueIndex:    0,
 			oldItems:                 []int{1, 1, 1, 1, 1},
 			expNewSmallestValue:      1,
 			expNewSmallestValueIndex: 1,
@@ -98,8 +139,7 @@ func TestHandleOffer(t *testing.T) {
 			expected: messages.Answer{
 				Code: messages.RejectCode,
 			},
-			oldSmallestValue:         1,
-			oldSmallestValueIndex:    0,
+			expReason:                messages.ReasonNoMatchingItem,
 			oldItems:                 []int{1, 1, 1, 1, 1},
 			expNewSmallestValue:      1,
 			expNewSmallestValueIndex: 0,
@@ -115,8 +155,7 @@ func TestHandleOffer(t *testing.T) {
 			expected: messages.Answer{
 				Code: messages.RejectCode,
 			},
-			oldSmallestValue:         1,
-			oldSmallestValueIndex:    0,
+			expReason:                messages.ReasonNotProfitable,
 			oldItems:                 []int{1, 1, 1, 1, 1},
 			expNewSmallestValue:      1,
 			expNewSmallestValueIndex: 0,
@@ -132,8 +171,7 @@ func TestHandleOffer(t *testing.T) {
 			expected: messages.Answer{
 				Code: messages.RejectCode,
 			},
-			oldSmallestValue:         2,
-			oldSmallestValueIndex:    0,
+			expReason:                messages.ReasonNotProfitable,
 			oldItems:                 []int{2, 2, 2, 2, 2},
 			expNewSmallestValue:      2,
 			expNewSmallestValueIndex: 0,
@@ -150,8 +188,6 @@ func TestHandleOffer(t *testing.T) {
 				Code:  messages.AcceptCode,
 				Value: 4,
 			},
-			oldSmallestValue:         2,
-			oldSmallestValueIndex:    3,
 			oldItems:                 []int{7, 4, 5, 2, 7},
 			expNewSmallestValue:      2,
 			expNewSmallestValueIndex: 3,
@@ -168,8 +204,6 @@ func TestHandleOffer(t *testing.T) {
 				Code:  messages.AcceptCode,
 				Value: 2,
 			},
-			oldSmallestValue:         2,
-			oldSmallestValueIndex:    3,
 			oldItems:                 []int{7, 4, 5, 2, 7},
 			expNewSmallestValue:      4,
 			expNewSmallestValueIndex: 1,
@@ -185,8 +219,7 @@ func TestHandleOffer(t *testing.T) {
 			expected: messages.Answer{
 				Code: messages.RejectCode,
 			},
-			oldSmallestValue:         2,
-			oldSmallestValueIndex:    3,
+			expReason:                messages.ReasonNoMatchingItem,
 			oldItems:                 []int{7, 4, 5, 2, 7},
 			expNewSmallestValue:      2,
 			expNewSmallestValueIndex: 3,
@@ -196,28 +229,262 @@ func TestHandleOffer(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			i := Inventory{
-				items:              c.oldItems,
-				smallestValue:      c.oldSmallestValue,
-				smallestValueIndex: c.oldSmallestValueIndex,
-			}
+			i, err := NewInventoryFromItems(c.oldItems)
+			assert.NoError(t, err)
+
+			assert.Equal(t, c.expected, withoutReason(t, i.HandleOffer(context.Background(), c.offer), c.expReason))
+			assert.Equal(t, &MemoryStorage{items: c.expNewItems}, i.storage)
+
+			min, ok := i.index.min()
+			assert.True(t, ok)
+			assert.Equal(t, indexKey{value: c.expNewSmallestValue, idx: c.expNewSmallestValueIndex}, min)
+		})
+	}
+}
+
+func TestHandleOfferJournal(t *testing.T) {
+	cases := []struct {
+		name        string
+		offer       messages.Offer
+		journalErr  error
+		expected    messages.Answer
+		expReason   messages.ReasonCode
+		expNewItems []int
+		expRecords  [][2]int
+	}{
+		{
+			name:        "accepted offer, should be journaled",
+			offer:       messages.CreateOffer(5, 2),
+			expected:    messages.CreateAcceptedAnswer(2),
+			expNewItems: []int{7, 5, 4},
+			expRecords:  [][2]int{{1, 5}},
+		},
+		{
+			name:        "rejected offer, should not be journaled",
+			offer:       messages.CreateOffer(5, 6),
+			expected:    messages.CreateRejectAnswer(),
+			expReason:   messages.ReasonNotProfitable,
+			expNewItems: []int{7, 2, 4},
+		},
+		{
+			name:        "accepted offer, failing journal, should be rejected and not applied",
+			offer:       messages.CreateOffer(5, 2),
+			journalErr:  errors.New("disk full"),
+			expected:    messages.CreateRejectAnswer(),
+			expReason:   messages.ReasonInternalError,
+			expNewItems: []int{7, 2, 4},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i, err := NewInventoryFromItems([]int{7, 2, 4})
+			assert.NoError(t, err)
+
+			j := &recordingJournal{err: c.journalErr}
+			i.SetJournal(j)
 
-			assert.Equal(t, c.expected, i.HandleOffer(c.offer))
-			assert.Equal(t, c.expNewItems, i.items)
-			assert.Equal(t, c.expNewSmallestValue, i.smallestValue)
-			assert.Equal(t, c.expNewSmallestValueIndex, i.smallestValueIndex)
+			assert.Equal(t, c.expected, withoutReason(t, i.HandleOffer(context.Background(), c.offer), c.expReason))
+			assert.Equal(t, &MemoryStorage{items: c.expNewItems}, i.storage)
+			assert.Equal(t, c.expRecords, j.records)
+		})
+	}
+}
+
+func TestFailingStorageIsNotJournaled(t *testing.T) {
+	st := &failingStorage{MemoryStorage: NewMemoryStorage([]int{7, 2, 4})}
+	i, err := NewInventoryWithStorage(st)
+	assert.NoError(t, err)
+	j := &recordingJournal{}
+	i.SetJournal(j)
+
+	st.err = errors.New("disk full")
+	assert.Equal(t, messages.CreateRejectAnswer(), withoutReason(t, i.HandleOffer(context.Background(), messages.CreateOffer(5, 2)), messages.ReasonInternalError))
+	_, err = i.Add(5)
+	assert.Error(t, err)
+	_, err = i.Remove(0, func(int) error { return nil })
+	assert.Error(t, err)
+	_, err = i.Resize(5, 1, LowestValueFirst)
+	assert.Error(t, err)
+	assert.Equal(t, &recordingJournal{}, j)
+
+	// The inventory is unchanged, and accepts offers again once the storage recovers
+	st.err = nil
+	items, err := i.Items()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{7, 2, 4}, items)
+	assert.Equal(t, messages.CreateAcceptedAnswer(2), i.HandleOffer(context.Background(), messages.CreateOffer(5, 2)))
+	assert.Equal(t, [][2]int{{1, 5}}, j.records)
+}
+
+/*
+Asserts that the answer has a reason with the given code, or no reason if the code is empty,
+and returns the answer without its reason.
+*/
+func withoutReason(t *testing.T, ans messages.Answer, code messages.ReasonCode) messages.Answer {
+	t.Helper()
+
+	if code == "" {
+		assert.Nil(t, ans.Reason)
+		return ans
+	}
+
+	if assert.NotNil(t, ans.Reason) {
+		assert.Equal(t, code, ans.Reason.Code)
+		assert.NotEmpty(t, ans.Reason.Message)
+	}
+	ans.Reason = nil
+	return ans
+}
+
+/*
+recordingJournal is a Journal that records every successful change, or fails every change with err if set.
+*/
+type recordingJournal struct {
+	err     error
+	records [][2]int
+	resets  [][]int
+	adds    []int
+	removes []int
+}
+
+func (r *recordingJournal) Append(idx, value int) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.records = append(r.records, [2]int{idx, value})
+	return nil
+}
+
+func (r *recordingJournal) Reset(items []int) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.resets = append(r.resets, items)
+	return nil
+}
+
+func (r *recordingJournal) Add(value int) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.adds = append(r.adds, value)
+	return nil
+}
+
+func (r *recordingJournal) Remove(idx int) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.removes = append(r.removes, idx)
+	return nil
+}
+
+/*
+failingStorage is a Storage that fails every change with err if set.
+*/
+type failingStorage struct {
+	*MemoryStorage
+	err error
+}
+
+func (f *failingStorage) Load(items []int) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.MemoryStorage.Load(items)
+}
+
+func (f *failingStorage) Replace(idx, value int) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.MemoryStorage.Replace(idx, value)
+}
+
+func (f *failingStorage) Add(value int) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.MemoryStorage.Add(value)
+}
+
+func (f *failingStorage) Remove(idx int) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.MemoryStorage.Remove(idx)
+}
+
+/*
+lockObserver is a LockObserver that counts the observed waits.
+*/
+type lockObserver struct {
+	waits int
+	lock  sync.Mutex
+}
+
+func (o *lockObserver) ObserveLockWait(wait time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if wait >= 0 {
+		o.waits++
+	}
+}
+
+func TestLockObserver(t *testing.T) {
+	inv, err := NewInventoryFromItems([]int{1, 2, 3})
+	assert.NoError(t, err)
+	sharded, err := NewShardedInventory(NewMemoryStorage([]int{1, 2, 3, 4}), 2, GlobalRouting)
+	assert.NoError(t, err)
+	firstFit, err := NewShardedInventory(NewMemoryStorage([]int{1, 2, 3, 4}), 2, FirstFitRouting)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name string
+		inv  interface {
+			SetLockObserver(o LockObserver)
+			HandleOffer(ctx context.Context, o messages.Offer) messages.Answer
+		}
+		expWaits int
+	}{
+		{
+			name:     "inventory, should observe a single wait",
+			inv:      inv,
+			expWaits: 1,
+		},
+		{
+			name:     "sharded inventory with global routing, should observe a wait per inspected shard",
+			inv:      sharded,
+			expWaits: 3,
+		},
+		{
+			name:     "sharded inventory with first fit routing, should observe a wait for the first shard",
+			inv:      firstFit,
+			expWaits: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o := &lockObserver{}
+			c.inv.SetLockObserver(o)
+
+			assert.Equal(t, messages.CreateAcceptedAnswer(1), c.inv.HandleOffer(context.Background(), messages.CreateOffer(5, 1)))
+			assert.Equal(t, c.expWaits, o.waits)
 		})
 	}
 }
 
 func TestEnsureProfitability(t *testing.T) {
 	cases := []struct {
-		name          string
-		offer         messages.Offer
-		exp           bool
-		items         []int
-		smallestValue int
-		expIdx        int
+		name      string
+		offer     messages.Offer
+		exp       bool
+		expReason messages.ReasonCode
+		items     []int
+		expIdx    int
 	}{
 		{
 			name: "offer < smallestValue, should always return false",
@@ -226,9 +493,9 @@ func TestEnsureProfitability(t *testing.T) {
 				Offer:  2,
 				Demand: 1,
 			},
-			smallestValue: 3,
-			items:         []int{3, 3, 3, 3, 3},
-			exp:           false,
+			items:     []int{3, 3, 3, 3, 3},
+			exp:       false,
+			expReason: messages.ReasonNotProfitable,
 		},
 		{
 			name: "offer > demand, offer > smallestValue, 1st item allows for maximum profit, should return true",
@@ -237,10 +504,9 @@ func TestEnsureProfitability(t *testing.T) {
 				Offer:  2,
 				Demand: 1,
 			},
-			smallestValue: 1,
-			items:         []int{1, 1, 1, 1, 1},
-			expIdx:        0,
-			exp:           true,
+			items:  []int{1, 1, 1, 1, 1},
+			expIdx: 0,
+			exp:    true,
 		},
 		{
 			name: "offer > demand, offer > smallestValue, 3rd item allows for maximum profit, should return true",
@@ -249,10 +515,9 @@ func TestEnsureProfitability(t *testing.T) {
 				Offer:  2,
 				Demand: 1,
 			},
-			smallestValue: 1,
-			items:         []int{2, 2, 1, 2, 2},
-			expIdx:        2,
-			exp:           true,
+			items:  []int{2, 2, 1, 2, 2},
+			expIdx: 2,
+			exp:    true,
 		},
 		{
 			name: "offer > negative demand, offer > smallestValue, 3rd item allows for maximum profit, should return true",
@@ -261,10 +526,9 @@ func TestEnsureProfitability(t *testing.T) {
 				Offer:  2,
 				Demand: -13,
 			},
-			smallestValue: 1,
-			items:         []int{2, 2, 1, 2, 2},
-			expIdx:        2,
-			exp:           true,
+			items:  []int{2, 2, 1, 2, 2},
+			expIdx: 2,
+			exp:    true,
 		},
 		{
 			name: "offer == demand, offer > smallestValue, no items satisfy demand & give profit, should return false",
@@ -273,9 +537,9 @@ func TestEnsureProfitability(t *testing.T) {
 				Offer:  2,
 				Demand: 2,
 			},
-			smallestValue: 1,
-			items:         []int{2, 2, 1, 2, 2},
-			exp:           false,
+			items:     []int{2, 2, 1, 2, 2},
+			exp:       false,
+			expReason: messages.ReasonNotProfitable,
 		},
 		{
 			name: "offer > demand, offer > smallestValue, 5th item allows for maximum profit, should return true",
@@ -284,10 +548,9 @@ func TestEnsureProfitability(t *testing.T) {
 				Offer:  5,
 				Demand: 4,
 			},
-			smallestValue: 3,
-			items:         []int{5, 3, 7, 10, 4},
-			expIdx:        4,
-			exp:           true,
+			items:  []int{5, 3, 7, 10, 4},
+			expIdx: 4,
+			exp:    true,
 		},
 		{
 			name: "offer > demand, offer > smallestValue, 5th item allows maximum profit, should return true",
@@ -296,10 +559,9 @@ func TestEnsureProfitability(t *testing.T) {
 				Offer:  11,
 				Demand: 3,
 			},
-			smallestValue: 3,
-			items:         []int{5, 3, 3, 10, 4},
-			expIdx:        1,
-			exp:           true,
+			items:  []int{5, 3, 3, 10, 4},
+			expIdx: 1,
+			exp:    true,
 		},
 		{
 			name: "offer > demand, offer > smallestValue, no items satisfy demand & give profit, should return true",
@@ -308,22 +570,62 @@ func TestEnsureProfitability(t *testing.T) {
 				Offer:  4,
 				Demand: 2,
 			},
-			smallestValue: 1,
-			items:         []int{1, 1, 1, 1, 1},
-			exp:           false,
+			items:     []int{1, 1, 1, 1, 1},
+			exp:       false,
+			expReason: messages.ReasonNoMatchingItem,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i, err := NewInventoryFromItems(c.items)
+			assert.NoError(t, err)
+
+			idx, value, err := i.isProfitable(c.offer)
+			assert.Equal(t, c.exp, err == nil)
+			if c.exp {
+				assert.Equal(t, c.expIdx, idx)
+				assert.Equal(t, c.items[c.expIdx], value)
+				return
+			}
+			assert.Equal(t, c.expReason, messages.ReasonFor(err).Code)
+		})
+	}
+}
+
+func TestItems(t *testing.T) {
+	cases := []struct {
+		name     string
+		items    []int
+		expected []int
+	}{
+		{
+			name:     "inventory with multiple items",
+			items:    []int{1, 2, 3},
+			expected: []int{1, 2, 3},
+		},
+		{
+			name:     "empty inventory",
+			items:    []int{},
+			expected: []int{},
 		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
 			i := Inventory{
-				items:         c.items,
-				smallestValue: c.smallestValue,
+				storage: &MemoryStorage{items: c.items},
 			}
 
-			ok, idx := i.isProfitable(c.offer)
-			assert.Equal(t, c.exp, ok)
-			assert.Equal(t, c.expIdx, idx)
+			items, err := i.Items()
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, items)
+
+			// Modifying the returned items must not modify the inventory
+			if len(items) > 0 {
+				items[0] = 100
+				assert.Equal(t, &MemoryStorage{items: c.expected}, i.storage)
+			}
 		})
 	}
 }
@@ -349,15 +651,135 @@ func TestString(t *testing.T) {
 			items:    []int{},
 			expected: "[]",
 		},
+		{
+			name:     "large inventory, should only include the first items",
+			items:    DefaultItems(100),
+			expected: "[" + strings.Repeat("1, ", maxFormattedItems) + "... 68 more]",
+		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
 			i := Inventory{
-				items: c.items,
+				storage: &MemoryStorage{items: c.items},
 			}
 
 			assert.Equal(t, c.expected, i.String())
 		})
 	}
 }
+
+func TestHandleOfferMatchesLinearInventory(t *testing.T) {
+	items, offers := randomItemsAndOffers(1000, 5000)
+
+	i, err := NewInventoryFromItems(items)
+	assert.NoError(t, err)
+	l := newLinearInventory(items)
+
+	// The linear inventory gives no reasons for rejecting offers
+	for _, o := range offers {
+		ans := i.HandleOffer(context.Background(), o)
+		ans.Reason = nil
+		assert.Equal(t, l.handleOffer(o), ans)
+	}
+	assert.Equal(t, &MemoryStorage{items: l.items}, i.storage)
+}
+
+func BenchmarkHandleOffer(b *testing.B) {
+	for _, sz := range []int{1000, 10000, 100000} {
+		items, offers := randomItemsAndOffers(sz, 10000)
+
+		b.Run(fmt.Sprintf("linear/size=%d", sz), func(b *testing.B) {
+			l := newLinearInventory(items)
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				l.handleOffer(offers[n%len(offers)])
+			}
+		})
+
+		b.Run(fmt.Sprintf("indexed/size=%d", sz), func(b *testing.B) {
+			i, err := NewInventoryFromItems(items)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				i.HandleOffer(context.Background(), offers[n%len(offers)])
+			}
+		})
+	}
+}
+
+/*
+Returns sz random items and n random offers for them, with a fixed seed so that runs are comparable.
+*/
+func randomItemsAndOffers(sz, n int) ([]int, []messages.Offer) {
+	r := rand.New(rand.NewSource(1))
+
+	items := make([]int, sz)
+	for idx := range items {
+		items[idx] = r.Intn(1000)
+	}
+
+	offers := make([]messages.Offer, n)
+	for idx := range offers {
+		demand := r.Intn(1000)
+		offers[idx] = messages.CreateOffer(demand+r.Intn(100), demand)
+	}
+
+	return items, offers
+}
+
+/*
+linearInventory is the previous implementation of the inventory, which scans every item on each offer.
+It is kept as a reference for the behaviour and performance of Inventory.
+*/
+type linearInventory struct {
+	items              []int
+	smallestValue      int
+	smallestValueIndex int
+}
+
+func newLinearInventory(items []int) *linearInventory {
+	l := &linearInventory{items: make([]int, len(items))}
+	copy(l.items, items)
+	l.updateSmallestValue()
+	return l
+}
+
+func (l *linearInventory) handleOffer(o messages.Offer) messages.Answer {
+	if o.Offer <= l.smallestValue {
+		return messages.CreateRejectAnswer()
+	}
+
+	maxPrItemVal := math.MaxInt
+	maxPrItemIdx := -1
+	for idx, item := range l.items {
+		if item >= o.Demand && o.Offer > item && item < maxPrItemVal {
+			maxPrItemVal = item
+			maxPrItemIdx = idx
+		}
+	}
+	if maxPrItemIdx == -1 {
+		return messages.CreateRejectAnswer()
+	}
+
+	l.items[maxPrItemIdx] = o.Offer
+	if maxPrItemIdx == l.smallestValueIndex {
+		l.updateSmallestValue()
+	}
+
+	return messages.CreateAcceptedAnswer(maxPrItemVal)
+}
+
+func (l *linearInventory) updateSmallestValue() {
+	l.smallestValue = math.MaxInt
+	for idx, item := range l.items {
+		if item < l.smallestValue {
+			l.smallestValue = item
+			l.smallestValueIndex = idx
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pawnshop/server/pkg/messages"
+)
+
+// ErrUnknownPledge is returned when redeeming or forfeiting a pledge that the inventory does not hold.
+var ErrUnknownPledge = errors.New("unknown pledge")
+
+/*
+Handles an offer like HandleOffer, but holds the offered item as a pledge if the offer is accepted.
+A pledged item is not given up for other offers, and can not be liquidated, until it is redeemed or forfeited.
+Returns the answer to the offer, and the ID of the pledge if the offer was accepted.
+*/
+func (i *Inventory) Pledge(ctx context.Context, o messages.Offer) (messages.Answer, uint64) {
+	i.lockForOffer(ctx)
+	defer i.lock.Unlock()
+
+	return i.handle(ctx, o, pledge)
+}
+
+/*
+Redeems a pledge by replacing the pledged item with the repayment, which can then be given up for offers.
+Returns the value of the pledged item, or ErrUnknownPledge if the inventory does not hold the pledge.
+*/
+func (i *Inventory) Redeem(id uint64, repayment int) (int, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	value, ok, err := i.fill(id, repayment, false)
+	if !ok {
+		return 0, ErrUnknownPledge
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to redeem pledge: %w", err)
+	}
+
+	return value, nil
+}
+
+/*
+Forfeits a pledge, so that the pledged item can be given up for offers like any other item.
+Returns the value of the pledged item, or ErrUnknownPledge if the inventory does not hold the pledge.
+*/
+func (i *Inventory) Forfeit(id uint64) (int, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	value, ok, err := i.release(id)
+	if !ok {
+		return 0, ErrUnknownPledge
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to forfeit pledge: %w", err)
+	}
+
+	return value, nil
+}
+
+/*
+action is what an inventory does with the item it would give up for an accepted offer.
+*/
+type action int
+
+const (
+	// swap replaces the item with the offered item.
+	swap action = iota
+	// pledge replaces the item with the offered item, and holds the offered item as a pledge.
+	pledge
+	// reserve holds the item, so that it is not given up for other offers until it is filled or released.
+	reserve
+	// quote leaves the inventory unchanged.
+	quote
+)
+
+/*
+Takes the item at idx, which has the value valToRet, for the offer according to the action.
+Returns the answer to the offer, and the ID of the hold if the offer was accepted and the item is held.
+It is NOT thread-safe and should be called from another thread-safe function in the inventory.
+*/
+func (i *Inventory) take(o messages.Offer, idx, valToRet int, a action) (messages.Answer, uint64) {
+	switch a {
+	case quote:
+		return messages.CreateAcceptedAnswer(valToRet), 0
+	case reserve:
+		i.index.remove(valToRet, idx)
+		return messages.CreateAcceptedAnswer(valToRet), i.hold(idx)
+	}
+
+	ans := i.replace(o, idx, valToRet)
+	if a != pledge || ans.Code != messages.AcceptCode {
+		return ans, 0
+	}
+
+	i.index.remove(o.Offer, idx)
+	return ans, i.hold(idx)
+}
+
+/*
+Holds the item at idx, which must already be removed from the index, and returns the ID of the hold.
+It is NOT thread-safe and should be called from another thread-safe function in the inventory.
+*/
+func (i *Inventory) hold(idx int) uint64 {
+	// Hold IDs share the sequence with the ages, so they are unique across shards
+	id := i.seq.Add(1)
+	i.pledges[id] = idx
+	i.held[idx] = id
+
+	return id
+}
+
+/*
+Replaces the held item with value, and keeps holding it under the same ID if keep is true,
+or releases it so that it can be given up for offers otherwise. Returns the value of the held item,
+and whether the inventory holds the item at all. It is NOT thread-safe and should be called from
+another thread-safe function in the inventory.
+*/
+func (i *Inventory) fill(id uint64, value int, keep bool) (int, bool, error) {
+	idx, ok := i.pledges[id]
+	if !ok {
+		return 0, false, nil
+	}
+
+	old, err := i.storage.Get(idx)
+	if err != nil {
+		return 0, true, fmt.Errorf("failed to get held item %d from storage: %w", idx, err)
+	}
+
+	if err = i.storage.Replace(idx, value); err != nil {
+		return 0, true, fmt.Errorf("failed to replace held item %d in storage: %w", idx, err)
+	}
+	if i.journal != nil {
+		if err = i.journal.Append(idx, value); err != nil {
+			logUndo(i.storage.Replace(idx, old))
+			return 0, true, fmt.Errorf("failed to journal item %d: %w", idx, err)
+		}
+	}
+
+	i.ages[idx] = i.seq.Add(1)
+	if !keep {
+		i.index.insert(value, idx)
+		delete(i.pledges, id)
+		delete(i.held, idx)
+	}
+
+	return old, true, nil
+}
+
+/*
+Releases the held item, so that it can be given up for offers. Returns the value of the held item,
+and whether the inventory holds the item at all. It is NOT thread-safe and should be called from
+another thread-safe function in the inventory.
+*/
+func (i *Inventory) release(id uint64) (int, bool, error) {
+	idx, ok := i.pledges[id]
+	if !ok {
+		return 0, false, nil
+	}
+
+	value, err := i.storage.Get(idx)
+	if err != nil {
+		return 0, true, fmt.Errorf("failed to get held item %d from storage: %w", idx, err)
+	}
+
+	i.index.insert(value, idx)
+	delete(i.pledges, id)
+	delete(i.held, idx)
+
+	return value, true, nil
+}
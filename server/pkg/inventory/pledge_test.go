@@ -0,0 +1,185 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"pawnshop/server/pkg/messages"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+pledgingInventory is an inventory that can hold pledges, either an Inventory or a ShardedInventory.
+*/
+type pledgingInventory interface {
+	HandleOffer(ctx context.Context, o messages.Offer) messages.Answer
+	Pledge(ctx context.Context, o messages.Offer) (messages.Answer, uint64)
+	Redeem(id uint64, repayment int) (int, error)
+	Forfeit(id uint64) (int, error)
+	Resize(size, fill int, policy ShrinkPolicy) (ResizeResult, error)
+	Items() ([]int, error)
+	Max() (int, bool)
+	SetJournal(j Journal)
+}
+
+func TestPledge(t *testing.T) {
+	cases := []struct {
+		name string
+		new  func(items []int) (pledgingInventory, error)
+	}{
+		{
+			name: "inventory",
+			new: func(items []int) (pledgingInventory, error) {
+				return NewInventoryFromItems(items)
+			},
+		},
+		{
+			name: "sharded inventory with global routing",
+			new: func(items []int) (pledgingInventory, error) {
+				return NewShardedInventory(NewMemoryStorage(items), 2, GlobalRouting)
+			},
+		},
+		{
+			name: "sharded inventory with first fit routing",
+			new: func(items []int) (pledgingInventory, error) {
+				return NewShardedInventory(NewMemoryStorage(items), 2, FirstFitRouting)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i, err := c.new([]int{1, 3})
+			require.NoError(t, err)
+
+			j := &recordingJournal{}
+			i.SetJournal(j)
+
+			// A pledge is accepted like an offer, but the pledged item is not given up for other offers
+			ans, id := i.Pledge(context.Background(), messages.CreateOffer(5, 2))
+			assert.Equal(t, messages.CreateAcceptedAnswer(3), ans)
+			assert.NotZero(t, id)
+			assert.Equal(t, messages.CreateRejectAnswer(), withoutReason(t, i.HandleOffer(context.Background(), messages.CreateOffer(10, 4)), messages.ReasonNoMatchingItem))
+			max, ok := i.Max()
+			assert.True(t, ok)
+			assert.Equal(t, 1, max)
+
+			ans, rejected := i.Pledge(context.Background(), messages.CreateOffer(5, 4))
+			assert.Equal(t, messages.CreateRejectAnswer(), withoutReason(t, ans, messages.ReasonNoMatchingItem))
+			assert.Zero(t, rejected)
+
+			// Redeeming replaces the pledged item with the repayment, which can then be given up for offers
+			value, err := i.Redeem(id, 7)
+			require.NoError(t, err)
+			assert.Equal(t, 5, value)
+			assert.Equal(t, [][2]int{{1, 5}, {1, 7}}, j.records)
+			assert.Equal(t, messages.CreateAcceptedAnswer(7), i.HandleOffer(context.Background(), messages.CreateOffer(10, 4)))
+
+			_, err = i.Redeem(id, 7)
+			assert.ErrorIs(t, err, ErrUnknownPledge)
+
+			// Forfeiting makes the pledged item available for offers as it is
+			ans, id = i.Pledge(context.Background(), messages.CreateOffer(2, 1))
+			assert.Equal(t, messages.CreateAcceptedAnswer(1), ans)
+			assert.Equal(t, messages.CreateRejectAnswer(), withoutReason(t, i.HandleOffer(context.Background(), messages.CreateOffer(3, 2)), messages.ReasonNotProfitable))
+
+			value, err = i.Forfeit(id)
+			require.NoError(t, err)
+			assert.Equal(t, 2, value)
+			assert.Equal(t, messages.CreateAcceptedAnswer(2), i.HandleOffer(context.Background(), messages.CreateOffer(3, 2)))
+
+			_, err = i.Forfeit(id)
+			assert.ErrorIs(t, err, ErrUnknownPledge)
+
+			items, err := i.Items()
+			require.NoError(t, err)
+			assert.Equal(t, []int{3, 10}, items)
+		})
+	}
+}
+
+func TestRedeemJournal(t *testing.T) {
+	i, err := NewInventoryFromItems([]int{1, 3})
+	require.NoError(t, err)
+
+	ans, id := i.Pledge(context.Background(), messages.CreateOffer(5, 2))
+	assert.Equal(t, messages.CreateAcceptedAnswer(3), ans)
+
+	// A redemption that can not be journaled is not applied, and the pledge is still held
+	j := &recordingJournal{err: errors.New("disk full")}
+	i.SetJournal(j)
+	_, err = i.Redeem(id, 7)
+	assert.Error(t, err)
+
+	items, err := i.Items()
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 5}, items)
+
+	j.err = nil
+	value, err := i.Redeem(id, 7)
+	require.NoError(t, err)
+	assert.Equal(t, 5, value)
+	assert.Equal(t, [][2]int{{1, 7}}, j.records)
+}
+
+func TestResizeWithPledges(t *testing.T) {
+	cases := []struct {
+		name string
+		new  func(items []int) (pledgingInventory, error)
+	}{
+		{
+			name: "inventory",
+			new: func(items []int) (pledgingInventory, error) {
+				return NewInventoryFromItems(items)
+			},
+		},
+		{
+			name: "sharded inventory",
+			new: func(items []int) (pledgingInventory, error) {
+				return NewShardedInventory(NewMemoryStorage(items), 2, GlobalRouting)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i, err := c.new([]int{4, 9, 2, 8})
+			require.NoError(t, err)
+
+			// Pledge the item at index 2, which would otherwise be liquidated first
+			ans, id := i.Pledge(context.Background(), messages.CreateOffer(3, 2))
+			assert.Equal(t, messages.CreateAcceptedAnswer(2), ans)
+
+			res, err := i.Resize(2, DefaultItemValue, LowestValueFirst)
+			require.NoError(t, err)
+			assert.Equal(t, ResizeResult{OldSize: 4, NewSize: 2, Removed: []Item{
+				{Index: 0, Value: 4},
+				{Index: 3, Value: 8},
+			}}, res)
+
+			items, err := i.Items()
+			require.NoError(t, err)
+			assert.Equal(t, []int{9, 3}, items)
+
+			// The pledge has moved to index 1, and is still not given up for offers
+			assert.Equal(t, messages.CreateRejectAnswer(), withoutReason(t, i.HandleOffer(context.Background(), messages.CreateOffer(4, 0)), messages.ReasonNotProfitable))
+
+			// Pledged items can not be liquidated
+			ans, other := i.Pledge(context.Background(), messages.CreateOffer(10, 8))
+			assert.Equal(t, messages.CreateAcceptedAnswer(9), ans)
+			_, err = i.Resize(1, DefaultItemValue, LowestValueFirst)
+			assert.Error(t, err)
+
+			value, err := i.Forfeit(other)
+			require.NoError(t, err)
+			assert.Equal(t, 10, value)
+
+			value, err = i.Redeem(id, 5)
+			require.NoError(t, err)
+			assert.Equal(t, 3, value)
+			assert.Equal(t, messages.CreateAcceptedAnswer(5), i.HandleOffer(context.Background(), messages.CreateOffer(6, 0)))
+		})
+	}
+}
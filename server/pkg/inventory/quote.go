@@ -0,0 +1,132 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pawnshop/server/pkg/logging"
+	"pawnshop/server/pkg/messages"
+)
+
+// ErrUnknownReservation is returned when filling or releasing a reservation that the inventory does not hold.
+var ErrUnknownReservation = errors.New("unknown reservation")
+
+/*
+Handles an offer like HandleOffer, but without changing the inventory.
+Returns the answer the offer would get, which carries the value of the item that would be given up for it.
+*/
+func (i *Inventory) Quote(ctx context.Context, o messages.Offer) messages.Answer {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	ans, _ := i.handle(ctx, o, quote)
+	return ans
+}
+
+/*
+Handles an offer like Quote, but reserves the item that would be given up for it if the offer would be accepted.
+A reserved item is not given up for other offers, and can not be liquidated, until it is filled or released.
+Returns the answer the offer would get, and the ID of the reservation if the offer would be accepted.
+*/
+func (i *Inventory) Reserve(ctx context.Context, o messages.Offer) (messages.Answer, uint64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.handle(ctx, o, reserve)
+}
+
+/*
+Fills a reservation by replacing the reserved item with the offered item, just like an accepted offer.
+If pledge is true, the offered item is held as a pledge whose ID is the ID of the reservation, see Pledge.
+Returns the value of the reserved item, or ErrUnknownReservation if the inventory does not hold the reservation.
+*/
+func (i *Inventory) Fulfil(id uint64, offer int, pledge bool) (int, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	value, ok, err := i.fill(id, offer, pledge)
+	if !ok {
+		return 0, ErrUnknownReservation
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to fill reservation: %w", err)
+	}
+
+	return value, nil
+}
+
+/*
+Releases a reservation, so that the reserved item can be given up for offers again.
+Returns the value of the reserved item, or ErrUnknownReservation if the inventory does not hold the reservation.
+*/
+func (i *Inventory) Release(id uint64) (int, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	value, ok, err := i.release(id)
+	if !ok {
+		return 0, ErrUnknownReservation
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to release reservation: %w", err)
+	}
+
+	return value, nil
+}
+
+/*
+Checks if the offer is profitable, and if so, takes the item for it according to the action, see take.
+It is NOT thread-safe and should be called from another thread-safe function in the inventory.
+*/
+func (i *Inventory) handle(ctx context.Context, o messages.Offer, a action) (messages.Answer, uint64) {
+	idx, valToRet, err := i.isProfitable(o)
+	if err != nil {
+		logging.FromContext(ctx).Debugf("Offer %+v is not accepted by the inventory: %s", o, err)
+		return messages.CreateRejectAnswerFor(err), 0
+	}
+
+	return i.take(o, idx, valToRet, a)
+}
+
+/*
+Handles an offer like HandleOffer, but without changing the inventory, see Inventory.Quote.
+*/
+func (s *ShardedInventory) Quote(ctx context.Context, o messages.Offer) messages.Answer {
+	ans, _ := s.route(ctx, o, quote)
+	return ans
+}
+
+/*
+Reserves the item that would be given up for an offer, see Inventory.Reserve.
+*/
+func (s *ShardedInventory) Reserve(ctx context.Context, o messages.Offer) (messages.Answer, uint64) {
+	return s.route(ctx, o, reserve)
+}
+
+/*
+Fills a reservation held by any shard, see Inventory.Fulfil.
+*/
+func (s *ShardedInventory) Fulfil(id uint64, offer int, pledge bool) (int, error) {
+	for _, inv := range s.shards {
+		value, err := inv.Fulfil(id, offer, pledge)
+		if !errors.Is(err, ErrUnknownReservation) {
+			return value, err
+		}
+	}
+
+	return 0, ErrUnknownReservation
+}
+
+/*
+Releases a reservation held by any shard, see Inventory.Release.
+*/
+func (s *ShardedInventory) Release(id uint64) (int, error) {
+	for _, inv := range s.shards {
+		value, err := inv.Release(id)
+		if !errors.Is(err, ErrUnknownReservation) {
+			return value, err
+		}
+	}
+
+	return 0, ErrUnknownReservation
+}
@@ -0,0 +1,108 @@
+package inventory
+
+import (
+	"context"
+	"pawnshop/server/pkg/messages"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+quotingInventory is an inventory that can quote offers and reserve items for them, either an Inventory or a ShardedInventory.
+*/
+type quotingInventory interface {
+	pledgingInventory
+	Quote(ctx context.Context, o messages.Offer) messages.Answer
+	Reserve(ctx context.Context, o messages.Offer) (messages.Answer, uint64)
+	Fulfil(id uint64, offer int, pledge bool) (int, error)
+	Release(id uint64) (int, error)
+}
+
+func TestQuote(t *testing.T) {
+	cases := []struct {
+		name string
+		new  func(items []int) (quotingInventory, error)
+	}{
+		{
+			name: "inventory",
+			new: func(items []int) (quotingInventory, error) {
+				return NewInventoryFromItems(items)
+			},
+		},
+		{
+			name: "sharded inventory with global routing",
+			new: func(items []int) (quotingInventory, error) {
+				return NewShardedInventory(NewMemoryStorage(items), 2, GlobalRouting)
+			},
+		},
+		{
+			name: "sharded inventory with first fit routing",
+			new: func(items []int) (quotingInventory, error) {
+				return NewShardedInventory(NewMemoryStorage(items), 2, FirstFitRouting)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i, err := c.new([]int{1, 3})
+			require.NoError(t, err)
+
+			j := &recordingJournal{}
+			i.SetJournal(j)
+
+			// A quote answers like an offer, but does not change the inventory
+			assert.Equal(t, messages.CreateAcceptedAnswer(3), i.Quote(context.Background(), messages.CreateOffer(5, 2)))
+			assert.Equal(t, messages.CreateRejectAnswer(), withoutReason(t, i.Quote(context.Background(), messages.CreateOffer(3, 3)), messages.ReasonNotProfitable))
+			assert.Empty(t, j.records)
+
+			// A reserved item is not given up for other offers
+			ans, id := i.Reserve(context.Background(), messages.CreateOffer(5, 2))
+			assert.Equal(t, messages.CreateAcceptedAnswer(3), ans)
+			assert.NotZero(t, id)
+			assert.Equal(t, messages.CreateRejectAnswer(), withoutReason(t, i.HandleOffer(context.Background(), messages.CreateOffer(10, 2)), messages.ReasonNoMatchingItem))
+			assert.Equal(t, messages.CreateRejectAnswer(), withoutReason(t, i.Quote(context.Background(), messages.CreateOffer(10, 2)), messages.ReasonNoMatchingItem))
+
+			// Filling a reservation replaces the reserved item with the offered item, which can then be given up for offers
+			value, err := i.Fulfil(id, 5, false)
+			require.NoError(t, err)
+			assert.Equal(t, 3, value)
+			assert.Equal(t, [][2]int{{1, 5}}, j.records)
+			assert.Equal(t, messages.CreateAcceptedAnswer(5), i.HandleOffer(context.Background(), messages.CreateOffer(10, 4)))
+
+			_, err = i.Fulfil(id, 5, false)
+			assert.ErrorIs(t, err, ErrUnknownReservation)
+
+			// Releasing a reservation makes the reserved item available for offers as it is
+			ans, id = i.Reserve(context.Background(), messages.CreateOffer(2, 1))
+			assert.Equal(t, messages.CreateAcceptedAnswer(1), ans)
+
+			value, err = i.Release(id)
+			require.NoError(t, err)
+			assert.Equal(t, 1, value)
+			assert.Equal(t, messages.CreateAcceptedAnswer(1), i.HandleOffer(context.Background(), messages.CreateOffer(2, 1)))
+
+			_, err = i.Release(id)
+			assert.ErrorIs(t, err, ErrUnknownReservation)
+
+			// Filling a reservation with a pledge holds the offered item as a pledge with the ID of the reservation
+			ans, id = i.Reserve(context.Background(), messages.CreateOffer(11, 5))
+			assert.Equal(t, messages.CreateAcceptedAnswer(10), ans)
+
+			value, err = i.Fulfil(id, 11, true)
+			require.NoError(t, err)
+			assert.Equal(t, 10, value)
+			assert.Equal(t, messages.CreateRejectAnswer(), withoutReason(t, i.HandleOffer(context.Background(), messages.CreateOffer(12, 5)), messages.ReasonNoMatchingItem))
+
+			value, err = i.Redeem(id, 12)
+			require.NoError(t, err)
+			assert.Equal(t, 11, value)
+
+			items, err := i.Items()
+			require.NoError(t, err)
+			assert.Equal(t, []int{2, 12}, items)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ShrinkPolicy decides which items are liquidated when an inventory is shrunk.
+*/
+type ShrinkPolicy string
+
+const (
+	// LowestValueFirst liquidates the items with the lowest value first.
+	LowestValueFirst ShrinkPolicy = "lowest"
+	// OldestFirst liquidates the items that have been in the inventory for the longest time first.
+	// Items that were in the inventory when the server started are considered the oldest.
+	OldestFirst ShrinkPolicy = "oldest"
+)
+
+/*
+Parses a shrink policy from its string representation.
+*/
+func ParseShrinkPolicy(s string) (ShrinkPolicy, error) {
+	switch p := ShrinkPolicy(s); p {
+	case LowestValueFirst, OldestFirst:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown shrink policy %q", s)
+	}
+}
+
+/*
+Item is an item of an inventory together with its index.
+*/
+type Item struct {
+	Index int
+	Value int
+}
+
+/*
+ResizeResult reports the outcome of resizing an inventory.
+*/
+type ResizeResult struct {
+	OldSize int
+	NewSize int
+	// Removed are the items that were liquidated when shrinking, in the order they were chosen by the
+	// shrink policy, with the index they had before the inventory was resized.
+	Removed []Item
+}
+
+/*
+Resizes the inventory to the given size. Growing the inventory adds items with the value fill at the end.
+Shrinking the inventory liquidates items chosen by the policy, and the remaining items keep their order.
+Pledged items are never liquidated. Offers wait while the inventory is being resized.
+*/
+func (i *Inventory) Resize(size, fill int, policy ShrinkPolicy) (ResizeResult, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	items, err := i.items()
+	if err != nil {
+		return ResizeResult{}, err
+	}
+
+	newItems, newAges, moved, res, err := planResize(items, i.ages, i.held, size, fill, policy, i.seq)
+	if err != nil {
+		return ResizeResult{}, err
+	}
+
+	if err = i.storage.Load(newItems); err != nil {
+		return ResizeResult{}, fmt.Errorf("failed to load resized inventory into storage: %w", err)
+	}
+	if i.journal != nil {
+		if err = i.journal.Reset(newItems); err != nil {
+			logUndo(i.storage.Load(items))
+			return ResizeResult{}, fmt.Errorf("failed to journal resize: %w", err)
+		}
+	}
+	i.ages = newAges
+	i.pledges, i.held = movePledges(i.held, moved)
+	i.index = newIndex(newItems)
+	for idx := range i.held {
+		i.index.remove(newItems[idx], idx)
+	}
+
+	log.Infof("Resized inventory from %d to %d items, liquidated %d items", res.OldSize, res.NewSize, len(res.Removed))
+	return res, nil
+}
+
+/*
+Plans resizing the given items with the given ages and pledged items to size, see Inventory.Resize.
+Returns the new items, their ages, the new index of every item by its old index (or -1 if it is
+liquidated), and the result of the resize.
+*/
+func planResize(items []int, ages []uint64, held map[int]uint64, size, fill int, policy ShrinkPolicy, seq *atomic.Uint64) ([]int, []uint64, []int, ResizeResult, error) {
+	if size < 1 {
+		return nil, nil, nil, ResizeResult{}, errors.New("inventory must contain at least 1 item")
+	}
+	if _, err := ParseShrinkPolicy(string(policy)); err != nil {
+		return nil, nil, nil, ResizeResult{}, err
+	}
+	if size < len(held) {
+		return nil, nil, nil, ResizeResult{}, fmt.Errorf("inventory holds %d pledged or reserved items, which can not be liquidated", len(held))
+	}
+
+	res := ResizeResult{OldSize: len(items), NewSize: size}
+	moved := make([]int, len(items))
+
+	if size >= len(items) {
+		newItems := make([]int, size)
+		newAges := make([]uint64, size)
+		copy(newItems, items)
+		copy(newAges, ages)
+		for idx := range moved {
+			moved[idx] = idx
+		}
+
+		age := seq.Add(1)
+		for idx := len(items); idx < size; idx++ {
+			newItems[idx] = fill
+			newAges[idx] = age
+		}
+		return newItems, newAges, moved, res, nil
+	}
+
+	// Order all indices that are not pledged by the policy, with ties broken by index, and liquidate the first ones
+	order := make([]int, 0, len(items)-len(held))
+	for idx := range items {
+		if _, ok := held[idx]; !ok {
+			order = append(order, idx)
+		}
+	}
+	sort.Slice(order, func(a, b int) bool {
+		x, y := order[a], order[b]
+		if policy == OldestFirst && ages[x] != ages[y] {
+			return ages[x] < ages[y]
+		}
+		if policy == LowestValueFirst && items[x] != items[y] {
+			return items[x] < items[y]
+		}
+		return x < y
+	})
+
+	liquidated := make([]bool, len(items))
+	for _, idx := range order[:len(items)-size] {
+		liquidated[idx] = true
+		res.Removed = append(res.Removed, Item{Index: idx, Value: items[idx]})
+	}
+
+	newItems := make([]int, 0, size)
+	newAges := make([]uint64, 0, size)
+	for idx, item := range items {
+		if liquidated[idx] {
+			moved[idx] = -1
+			continue
+		}
+		moved[idx] = len(newItems)
+		newItems = append(newItems, item)
+		newAges = append(newAges, ages[idx])
+	}
+
+	return newItems, newAges, moved, res, nil
+}
+
+/*
+Returns the pledges and pledged items of an inventory after its items have been moved, see planResize.
+*/
+func movePledges(held map[int]uint64, moved []int) (map[uint64]int, map[int]uint64) {
+	newPledges := make(map[uint64]int, len(held))
+	newHeld := make(map[int]uint64, len(held))
+	for idx, id := range held {
+		newPledges[id] = moved[idx]
+		newHeld[moved[idx]] = id
+	}
+	return newPledges, newHeld
+}
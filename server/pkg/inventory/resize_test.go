@@ -0,0 +1,137 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"pawnshop/server/pkg/messages"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResize(t *testing.T) {
+	cases := []struct {
+		name        string
+		size        int
+		fill        int
+		policy      ShrinkPolicy
+		journalErr  error
+		expected    ResizeResult
+		expNewItems []int
+		expError    bool
+	}{
+		{
+			name:        "grow, should add items with the fill value at the end",
+			size:        6,
+			fill:        DefaultItemValue,
+			policy:      LowestValueFirst,
+			expected:    ResizeResult{OldSize: 4, NewSize: 6},
+			expNewItems: []int{4, 9, 2, 8, 1, 1},
+		},
+		{
+			name:        "grow with supplied value",
+			size:        5,
+			fill:        7,
+			policy:      LowestValueFirst,
+			expected:    ResizeResult{OldSize: 4, NewSize: 5},
+			expNewItems: []int{4, 9, 2, 8, 7},
+		},
+		{
+			name:        "same size, should not change the inventory",
+			size:        4,
+			policy:      OldestFirst,
+			expected:    ResizeResult{OldSize: 4, NewSize: 4},
+			expNewItems: []int{4, 9, 2, 8},
+		},
+		{
+			name:   "shrink lowest value first, should liquidate the lowest items",
+			size:   2,
+			policy: LowestValueFirst,
+			expected: ResizeResult{OldSize: 4, NewSize: 2, Removed: []Item{
+				{Index: 2, Value: 2},
+				{Index: 0, Value: 4},
+			}},
+			expNewItems: []int{9, 8},
+		},
+		{
+			name:   "shrink oldest first, should liquidate the items that were not replaced by offers",
+			size:   2,
+			policy: OldestFirst,
+			expected: ResizeResult{OldSize: 4, NewSize: 2, Removed: []Item{
+				{Index: 0, Value: 4},
+				{Index: 3, Value: 8},
+			}},
+			expNewItems: []int{9, 2},
+		},
+		{
+			name:        "size 0, should return error",
+			size:        0,
+			policy:      LowestValueFirst,
+			expNewItems: []int{4, 9, 2, 8},
+			expError:    true,
+		},
+		{
+			name:        "unknown policy, should return error",
+			size:        2,
+			policy:      "random",
+			expNewItems: []int{4, 9, 2, 8},
+			expError:    true,
+		},
+		{
+			name:        "failing journal, should return error and not resize",
+			size:        2,
+			policy:      LowestValueFirst,
+			journalErr:  errors.New("disk full"),
+			expNewItems: []int{4, 9, 2, 8},
+			expError:    true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Replace the items 1 and 1 at index 1 and 2 by offers, so that they are the youngest items
+			i, err := NewInventoryFromItems([]int{4, 1, 1, 8})
+			require.NoError(t, err)
+			require.Equal(t, messages.CreateAcceptedAnswer(1), i.HandleOffer(context.Background(), messages.CreateOffer(9, 1)))
+			require.Equal(t, messages.CreateAcceptedAnswer(1), i.HandleOffer(context.Background(), messages.CreateOffer(2, 1)))
+
+			j := &recordingJournal{err: c.journalErr}
+			i.SetJournal(j)
+
+			res, err := i.Resize(c.size, c.fill, c.policy)
+			if c.expError {
+				assert.Error(t, err)
+				assert.Empty(t, j.resets)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, c.expected, res)
+				assert.Equal(t, [][]int{c.expNewItems}, j.resets)
+			}
+
+			items, err := i.Items()
+			require.NoError(t, err)
+			assert.Equal(t, c.expNewItems, items)
+			assert.Equal(t, len(c.expNewItems), i.index.size)
+			assert.Len(t, i.ages, len(c.expNewItems))
+		})
+	}
+}
+
+func TestResizeThenHandleOffer(t *testing.T) {
+	i := NewInventory(2)
+
+	_, err := i.Resize(3, 5, LowestValueFirst)
+	require.NoError(t, err)
+
+	// The grown item must be in the index, and be the only item that satisfies the demand
+	assert.Equal(t, messages.CreateAcceptedAnswer(5), i.HandleOffer(context.Background(), messages.CreateOffer(6, 2)))
+
+	_, err = i.Resize(1, 0, OldestFirst)
+	require.NoError(t, err)
+
+	items, err := i.Items()
+	require.NoError(t, err)
+	assert.Equal(t, []int{6}, items)
+	assert.Equal(t, messages.CreateAcceptedAnswer(6), i.HandleOffer(context.Background(), messages.CreateOffer(7, 6)))
+}
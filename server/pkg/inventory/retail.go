@@ -0,0 +1,224 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"pawnshop/server/pkg/messages"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrItemPledged is returned when removing an item that is held as a pledge or reserved for a quote.
+var ErrItemPledged = messages.NewError(messages.ReasonItemUnavailable, errors.New("item is pledged or reserved"))
+
+/*
+Adds an item with value at the end of the inventory, e.g. an item the pawn shop bought.
+Returns the index of the added item.
+*/
+func (i *Inventory) Add(value int) (int, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	idx := len(i.ages)
+	if err := i.storage.Add(value); err != nil {
+		return 0, fmt.Errorf("failed to add item to storage: %w", err)
+	}
+	if i.journal != nil {
+		if err := i.journal.Add(value); err != nil {
+			logUndo(i.storage.Remove(idx))
+			return 0, fmt.Errorf("failed to journal addition: %w", err)
+		}
+	}
+
+	i.ages = append(i.ages, 0)
+	i.link(idx, value, i.seq.Add(1), 0, false)
+
+	log.Debugf("Added item %d with value %d to the inventory", idx, value)
+	return idx, nil
+}
+
+/*
+Removes the item at idx from the inventory, e.g. an item the pawn shop sold, and moves the last item
+into its place. The item is only removed if check returns no error for its value, which is called while
+the inventory is locked. Pledged items can not be removed, and the inventory always keeps at least 1 item.
+Returns the value of the removed item.
+*/
+func (i *Inventory) Remove(idx int, check func(value int) error) (int, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	last := len(i.ages) - 1
+	if idx < 0 || idx > last {
+		return 0, messages.NewError(messages.ReasonUnknownItem, indexOutOfRangeError(idx, len(i.ages)))
+	}
+	if _, ok := i.held[idx]; ok {
+		return 0, ErrItemPledged
+	}
+	if last == 0 {
+		return 0, messages.NewError(messages.ReasonItemUnavailable, errors.New("inventory must contain at least 1 item"))
+	}
+
+	value, err := i.storage.Get(idx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get item %d from storage: %w", idx, err)
+	}
+	lastValue, err := i.storage.Get(last)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get item %d from storage: %w", last, err)
+	}
+	if err = check(value); err != nil {
+		return 0, err
+	}
+
+	if err = i.storage.Remove(idx); err != nil {
+		return 0, fmt.Errorf("failed to remove item %d from storage: %w", idx, err)
+	}
+	if i.journal != nil {
+		if err = i.journal.Remove(idx); err != nil {
+			logUndo(undoRemove(i.storage, idx, value, last, lastValue))
+			return 0, fmt.Errorf("failed to journal removal: %w", err)
+		}
+	}
+
+	moveLast(i, idx, value, i, last, lastValue)
+
+	log.Debugf("Removed item %d with value %d from the inventory", idx, value)
+	return value, nil
+}
+
+/*
+Removes the item at idx with value from the index, ages and pledges of the inventory.
+Returns the age of the item, and its pledge ID if it is pledged. It is NOT thread-safe and should be
+called from another thread-safe function in the inventory.
+*/
+func (i *Inventory) unlink(idx, value int) (uint64, uint64, bool) {
+	age := i.ages[idx]
+	id, held := i.held[idx]
+	if held {
+		delete(i.held, idx)
+		delete(i.pledges, id)
+	} else {
+		i.index.remove(value, idx)
+	}
+
+	return age, id, held
+}
+
+/*
+Adds the item at idx with value to the index, ages and pledges of the inventory, see unlink.
+It is NOT thread-safe and should be called from another thread-safe function in the inventory.
+*/
+func (i *Inventory) link(idx, value int, age, id uint64, held bool) {
+	i.ages[idx] = age
+	if held {
+		i.held[idx] = id
+		i.pledges[id] = idx
+	} else {
+		i.index.insert(value, idx)
+	}
+}
+
+/*
+Removes the item at idx with value from inventory a, and moves the last item of the inventory, which is
+the item at last with lastValue in inventory b, into its place. a and b are the same inventory unless the
+inventory is sharded. The storage must already have been changed, and both inventories must be locked.
+*/
+func moveLast(a *Inventory, idx, value int, b *Inventory, last, lastValue int) {
+	a.unlink(idx, value)
+	if a != b || idx != last {
+		age, id, held := b.unlink(last, lastValue)
+		a.link(idx, lastValue, age, id, held)
+	}
+	b.ages = b.ages[:last]
+}
+
+/*
+Adds an item with value at the end of the inventory, see Inventory.Add. The item belongs to the shard
+its index is partitioned into. Offers wait while the item is being added.
+*/
+func (s *ShardedInventory) Add(value int) (int, error) {
+	s.lockShards()
+	defer s.unlockShards()
+
+	s.storageLock.Lock()
+	idx := s.storage.Size()
+	err := s.storage.Add(value)
+	s.storageLock.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("failed to add item to storage: %w", err)
+	}
+	if s.journal != nil {
+		if err = s.journal.Add(value); err != nil {
+			s.storageLock.Lock()
+			logUndo(s.storage.Remove(idx))
+			s.storageLock.Unlock()
+			return 0, fmt.Errorf("failed to journal addition: %w", err)
+		}
+	}
+
+	inv := s.shards[idx%len(s.shards)]
+	inv.ages = append(inv.ages, 0)
+	inv.link(idx/len(s.shards), value, s.seq.Add(1), 0, false)
+
+	log.Debugf("Added item %d with value %d to the inventory", idx, value)
+	return idx, nil
+}
+
+/*
+Removes the item at idx from the inventory, see Inventory.Remove. The last item may move to another shard,
+and the inventory always keeps at least 1 item per shard. Offers wait while the item is being removed.
+*/
+func (s *ShardedInventory) Remove(idx int, check func(value int) error) (int, error) {
+	s.lockShards()
+	defer s.unlockShards()
+
+	s.storageLock.Lock()
+	size := s.storage.Size()
+	s.storageLock.Unlock()
+
+	last := size - 1
+	if idx < 0 || idx > last {
+		return 0, messages.NewError(messages.ReasonUnknownItem, indexOutOfRangeError(idx, size))
+	}
+	a, b := s.shards[idx%len(s.shards)], s.shards[last%len(s.shards)]
+	if _, ok := a.held[idx/len(s.shards)]; ok {
+		return 0, ErrItemPledged
+	}
+	if size == len(s.shards) {
+		return 0, messages.Errorf(messages.ReasonItemUnavailable, "sharded inventory must contain at least 1 item per shard, got %d items for %d shards", size, len(s.shards))
+	}
+
+	s.storageLock.Lock()
+	value, err := s.storage.Get(idx)
+	var lastValue int
+	if err == nil {
+		lastValue, err = s.storage.Get(last)
+	}
+	s.storageLock.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get items from storage: %w", err)
+	}
+	if err = check(value); err != nil {
+		return 0, err
+	}
+
+	s.storageLock.Lock()
+	err = s.storage.Remove(idx)
+	s.storageLock.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove item %d from storage: %w", idx, err)
+	}
+	if s.journal != nil {
+		if err = s.journal.Remove(idx); err != nil {
+			s.storageLock.Lock()
+			logUndo(undoRemove(s.storage, idx, value, last, lastValue))
+			s.storageLock.Unlock()
+			return 0, fmt.Errorf("failed to journal removal: %w", err)
+		}
+	}
+
+	moveLast(a, idx/len(s.shards), value, b, last/len(s.shards), lastValue)
+
+	log.Debugf("Removed item %d with value %d from the inventory", idx, value)
+	return value, nil
+}
@@ -0,0 +1,115 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"pawnshop/server/pkg/messages"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+retailInventory is an inventory that items can be added to and removed from, either an Inventory
+or a ShardedInventory.
+*/
+type retailInventory interface {
+	pledgingInventory
+	Add(value int) (int, error)
+	Remove(idx int, check func(value int) error) (int, error)
+}
+
+func TestAddAndRemove(t *testing.T) {
+	cases := []struct {
+		name string
+		new  func(items []int) (retailInventory, error)
+	}{
+		{
+			name: "inventory",
+			new: func(items []int) (retailInventory, error) {
+				return NewInventoryFromItems(items)
+			},
+		},
+		{
+			name: "sharded inventory",
+			new: func(items []int) (retailInventory, error) {
+				return NewShardedInventory(NewMemoryStorage(items), 2, GlobalRouting)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i, err := c.new([]int{7, 1, 4, 3})
+			require.NoError(t, err)
+
+			j := &recordingJournal{}
+			i.SetJournal(j)
+
+			// An added item can be given up for offers
+			idx, err := i.Add(5)
+			require.NoError(t, err)
+			assert.Equal(t, 4, idx)
+			assert.Equal(t, messages.CreateAcceptedAnswer(5), i.HandleOffer(context.Background(), messages.CreateOffer(6, 5)))
+
+			// Pledge the last item, which is moved into the place of a removed item
+			ans, id := i.Pledge(context.Background(), messages.CreateOffer(8, 6))
+			assert.Equal(t, messages.CreateAcceptedAnswer(6), ans)
+
+			_, err = i.Remove(4, func(int) error { return nil })
+			assert.ErrorIs(t, err, ErrItemPledged)
+			errCheck := errors.New("too expensive")
+			_, err = i.Remove(0, func(int) error { return errCheck })
+			assert.ErrorIs(t, err, errCheck)
+			_, err = i.Remove(5, func(int) error { return nil })
+			assert.Error(t, err)
+
+			value, err := i.Remove(0, func(value int) error {
+				assert.Equal(t, 7, value)
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, 7, value)
+			assert.Equal(t, []int{5}, j.adds)
+			assert.Equal(t, []int{0}, j.removes)
+
+			items, err := i.Items()
+			require.NoError(t, err)
+			assert.Equal(t, []int{8, 1, 4, 3}, items)
+
+			// The pledge has moved along with the last item
+			assert.Equal(t, messages.CreateRejectAnswer(), withoutReason(t, i.HandleOffer(context.Background(), messages.CreateOffer(9, 5)), messages.ReasonNoMatchingItem))
+			value, err = i.Redeem(id, 10)
+			require.NoError(t, err)
+			assert.Equal(t, 8, value)
+			assert.Equal(t, messages.CreateAcceptedAnswer(10), i.HandleOffer(context.Background(), messages.CreateOffer(11, 5)))
+			assert.Equal(t, messages.CreateAcceptedAnswer(1), i.HandleOffer(context.Background(), messages.CreateOffer(2, 0)))
+
+			// The inventory always keeps at least 1 item per shard
+			for {
+				if _, err = i.Remove(0, func(int) error { return nil }); err != nil {
+					break
+				}
+			}
+			items, err = i.Items()
+			require.NoError(t, err)
+			assert.NotEmpty(t, items)
+		})
+	}
+}
+
+func TestAddAndRemoveFailingJournal(t *testing.T) {
+	i, err := NewInventoryFromItems([]int{7, 1})
+	require.NoError(t, err)
+	i.SetJournal(&recordingJournal{err: errors.New("disk full")})
+
+	_, err = i.Add(5)
+	assert.Error(t, err)
+	_, err = i.Remove(0, func(int) error { return nil })
+	assert.Error(t, err)
+
+	items, err := i.Items()
+	require.NoError(t, err)
+	assert.Equal(t, []int{7, 1}, items)
+}
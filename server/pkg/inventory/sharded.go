@@ -0,0 +1,610 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pawnshop/server/pkg/logging"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/tracing"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Routing decides which shard of a ShardedInventory gives up an item for an offer.
+*/
+type Routing string
+
+const (
+	// GlobalRouting gives up the globally best item for every offer, just like an Inventory.
+	// Every shard is inspected for its best item, and the best of those is given up. If another offer
+	// has taken that item in the meantime, the offer is routed again, up to maxGlobalRoutingAttempts times
+	// before it is routed with all shards locked.
+	GlobalRouting Routing = "global"
+	// FirstFitRouting gives up the best item of the first shard that can accept the offer, starting from
+	// a different shard for every offer. It accepts the same offers as GlobalRouting, but it is approximate
+	// in that the item given up may not be the globally best item. In return, only a single shard
+	// is locked at a time, and in most cases only a single shard is inspected.
+	FirstFitRouting Routing = "firstfit"
+)
+
+// maxGlobalRoutingAttempts is the number of times an offer is routed with GlobalRouting before all shards are locked.
+const maxGlobalRoutingAttempts = 3
+
+/*
+Parses a routing from its string representation.
+*/
+func ParseRouting(s string) (Routing, error) {
+	switch r := Routing(s); r {
+	case GlobalRouting, FirstFitRouting:
+		return r, nil
+	default:
+		return "", fmt.Errorf("unknown routing %q", s)
+	}
+}
+
+/*
+ShardedInventory is an inventory whose items are partitioned across a number of independently locked shards,
+so that offers handled by different shards do not contend with each other. The item at index idx belongs
+to shard idx % shards. The offers that are accepted, and the items given up for them, depend on the routing.
+*/
+type ShardedInventory struct {
+	shards  []*Inventory
+	storage Storage
+	// storageLock serializes all access to the storage, which is shared by all shards
+	storageLock *sync.Mutex
+	journal     Journal
+	routing     Routing
+	next        atomic.Uint64
+	// seq is shared by all shards, so that the ages of items in different shards can be compared
+	seq *atomic.Uint64
+}
+
+/*
+Creates a new sharded inventory backed by the given storage, containing the items already in the storage.
+If there are fewer items in the storage than shards, or the routing is unknown, an error is returned.
+*/
+func NewShardedInventory(st Storage, shards int, routing Routing) (*ShardedInventory, error) {
+	if shards < 1 {
+		return nil, errors.New("sharded inventory must have at least 1 shard")
+	}
+	if st.Size() < shards {
+		return nil, fmt.Errorf("sharded inventory must contain at least 1 item per shard, got %d items for %d shards", st.Size(), shards)
+	}
+	if _, err := ParseRouting(string(routing)); err != nil {
+		return nil, err
+	}
+
+	s := &ShardedInventory{
+		shards:      make([]*Inventory, shards),
+		storage:     st,
+		storageLock: &sync.Mutex{},
+		routing:     routing,
+		seq:         &atomic.Uint64{},
+	}
+
+	for n := range s.shards {
+		inv, err := NewInventoryWithStorage(&shardStorage{
+			storage: st,
+			lock:    s.storageLock,
+			shard:   n,
+			shards:  shards,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create shard %d: %w", n, err)
+		}
+		inv.seq = s.seq
+		s.shards[n] = inv
+	}
+
+	return s, nil
+}
+
+/*
+Sets the journal that every change to the inventory is appended to, see Journal.
+The journal must be thread-safe, as the shards append to it concurrently.
+*/
+func (s *ShardedInventory) SetJournal(j Journal) {
+	s.lockShards()
+	defer s.unlockShards()
+
+	s.journal = j
+	for n, inv := range s.shards {
+		inv.journal = &shardJournal{journal: j, shard: n, shards: len(s.shards)}
+	}
+}
+
+/*
+Sets the observer that is told how long every offer waits for the lock of a shard. An offer that
+inspects more than one shard waits for every one of them.
+*/
+func (s *ShardedInventory) SetLockObserver(o LockObserver) {
+	s.lockShards()
+	defer s.unlockShards()
+
+	for _, inv := range s.shards {
+		inv.lockObserver = o
+	}
+}
+
+/*
+Handles an offer from the caller. It routes the offer to a shard that can accept it, and if there is one,
+it will allow the offer and return the exchanged value. If no shard can accept the offer, it will reject it.
+*/
+func (s *ShardedInventory) HandleOffer(ctx context.Context, o messages.Offer) messages.Answer {
+	ctx, span := tracing.Start(ctx, "ShardedInventory.HandleOffer")
+	defer span.End()
+	// Printing the inventory takes O(n) time, so it is only done when debugging
+	defer logging.FromContext(ctx).Debugf("Inventory after handling offer: %s", s)
+
+	ans, _ := s.route(ctx, o, swap)
+	span.SetAttribute(tracing.DecisionAttribute, ans.Code)
+	return ans
+}
+
+/*
+Handles an offer like HandleOffer, but holds the offered item as a pledge if the offer is accepted,
+see Inventory.Pledge. Returns the answer to the offer, and the ID of the pledge if the offer was accepted.
+*/
+func (s *ShardedInventory) Pledge(ctx context.Context, o messages.Offer) (messages.Answer, uint64) {
+	defer logging.FromContext(ctx).Debugf("Inventory after handling offer: %s", s)
+
+	return s.route(ctx, o, pledge)
+}
+
+/*
+Redeems a pledge held by any shard, see Inventory.Redeem.
+*/
+func (s *ShardedInventory) Redeem(id uint64, repayment int) (int, error) {
+	for _, inv := range s.shards {
+		value, err := inv.Redeem(id, repayment)
+		if !errors.Is(err, ErrUnknownPledge) {
+			return value, err
+		}
+	}
+
+	return 0, ErrUnknownPledge
+}
+
+/*
+Forfeits a pledge held by any shard, see Inventory.Forfeit.
+*/
+func (s *ShardedInventory) Forfeit(id uint64) (int, error) {
+	for _, inv := range s.shards {
+		value, err := inv.Forfeit(id)
+		if !errors.Is(err, ErrUnknownPledge) {
+			return value, err
+		}
+	}
+
+	return 0, ErrUnknownPledge
+}
+
+/*
+Routes an offer to a shard according to the routing, which takes the item for the offer according to the action.
+Returns the answer to the offer, and the ID of the hold if the offer was accepted and the item is held.
+*/
+func (s *ShardedInventory) route(ctx context.Context, o messages.Offer, a action) (messages.Answer, uint64) {
+	if s.routing == FirstFitRouting {
+		return s.routeFirstFit(ctx, o, a)
+	}
+	return s.routeGlobal(ctx, o, a)
+}
+
+/*
+Routes an offer by giving up the globally best item, see GlobalRouting. The shards are inspected one at a time,
+so the best item may be taken by another offer before it can be given up, in which case the offer is routed
+again. After maxGlobalRoutingAttempts, the offer is decided with all shards locked instead.
+*/
+func (s *ShardedInventory) routeGlobal(ctx context.Context, o messages.Offer, a action) (messages.Answer, uint64) {
+	for attempt := 0; attempt < maxGlobalRoutingAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			logging.FromContext(ctx).Debugf("Routing offer %+v was canceled: %s", o, err)
+			return messages.CreateRejectAnswerFor(fmt.Errorf("offer was canceled: %w", err)), 0
+		}
+
+		bestShard, bestIdx, bestValue, rejected := s.best(ctx, o, true)
+		if bestShard == -1 {
+			err := rejected.err(o)
+			logging.FromContext(ctx).Debugf("Offer %+v is not accepted by any shard of the inventory: %s", o, err)
+			return messages.CreateRejectAnswerFor(err), 0
+		}
+		best := indexKey{value: bestValue, idx: s.globalIndex(bestShard, bestIdx)}
+
+		inv := s.shards[bestShard]
+		inv.lockForOffer(ctx)
+		idx, value, err := inv.isProfitable(o)
+		// The best item of the shard may have changed since it was inspected. If it is still at least as
+		// good as the best item, it is still better than the items of all other shards.
+		if err == nil && !best.less(indexKey{value: value, idx: s.globalIndex(bestShard, idx)}) {
+			ans, id := inv.take(o, idx, value, a)
+			inv.lock.Unlock()
+			return ans, id
+		}
+		inv.lock.Unlock()
+
+		logging.FromContext(ctx).Debugf("Best item for offer %+v was taken by another offer, routing it again", o)
+	}
+
+	logging.FromContext(ctx).Debugf("Best item for offer %+v was taken %d times, routing it with all shards locked", o, maxGlobalRoutingAttempts)
+	s.lockShards()
+	defer s.unlockShards()
+
+	bestShard, idx, value, rejected := s.best(ctx, o, false)
+	if bestShard == -1 {
+		err := rejected.err(o)
+		logging.FromContext(ctx).Debugf("Offer %+v is not accepted by any shard of the inventory: %s", o, err)
+		return messages.CreateRejectAnswerFor(err), 0
+	}
+	return s.shards[bestShard].take(o, idx, value, a)
+}
+
+/*
+Finds the globally best item to give up for an offer. Every shard is locked while it is inspected if lock is true,
+otherwise all shards must already be locked. Returns the shard of the best item, its index in the shard and its
+value, or a shard of -1 and the reasons every shard rejected the offer for if no shard can accept it.
+*/
+func (s *ShardedInventory) best(ctx context.Context, o messages.Offer, lock bool) (int, int, int, rejections) {
+	best := indexKey{}
+	bestShard, bestIdx := -1, 0
+	var rejected rejections
+	for n, inv := range s.shards {
+		if lock {
+			inv.lockForOffer(ctx)
+		}
+		idx, value, err := inv.isProfitable(o)
+		if lock {
+			inv.lock.Unlock()
+		}
+
+		k := indexKey{value: value, idx: s.globalIndex(n, idx)}
+		if err != nil {
+			rejected.add(value, err)
+		} else if bestShard == -1 || k.less(best) {
+			best = k
+			bestShard, bestIdx = n, idx
+		}
+	}
+	return bestShard, bestIdx, best.value, rejected
+}
+
+/*
+Routes an offer by giving up the best item of the first shard that can accept it, see FirstFitRouting.
+*/
+func (s *ShardedInventory) routeFirstFit(ctx context.Context, o messages.Offer, a action) (messages.Answer, uint64) {
+	start := int((s.next.Add(1) - 1) % uint64(len(s.shards)))
+
+	var rejected rejections
+	for n := 0; n < len(s.shards); n++ {
+		inv := s.shards[(start+n)%len(s.shards)]
+
+		inv.lockForOffer(ctx)
+		idx, value, err := inv.isProfitable(o)
+		if err == nil {
+			ans, id := inv.take(o, idx, value, a)
+			inv.lock.Unlock()
+			return ans, id
+		}
+		inv.lock.Unlock()
+		rejected.add(value, err)
+	}
+
+	err := rejected.err(o)
+	logging.FromContext(ctx).Debugf("Offer %+v is not accepted by any shard of the inventory: %s", o, err)
+	return messages.CreateRejectAnswerFor(err), 0
+}
+
+/*
+rejections collects why the shards of a ShardedInventory rejected an offer. Just like an Inventory, the offer is
+not profitable if any shard has an item that satisfies the demand, and otherwise no item matches its demand.
+*/
+type rejections struct {
+	found bool
+	best  int
+}
+
+/*
+Adds the error of a shard that rejected the offer, and the value of its best item for the demand, see isProfitable.
+*/
+func (r *rejections) add(value int, err error) {
+	var e *messages.Error
+	if !errors.As(err, &e) || e.Code != messages.ReasonNotProfitable {
+		return
+	}
+	if !r.found || value < r.best {
+		r.found = true
+		r.best = value
+	}
+}
+
+/*
+Returns the error for an offer that all shards rejected.
+*/
+func (r *rejections) err(o messages.Offer) error {
+	if !r.found {
+		return noMatchingItemError(o)
+	}
+	return notProfitableError(o, r.best)
+}
+
+/*
+Resizes the inventory to the given size, see Inventory.Resize. The items are partitioned across the shards
+again, so the size must be at least the number of shards. Offers wait while the inventory is being resized.
+*/
+func (s *ShardedInventory) Resize(size, fill int, policy ShrinkPolicy) (ResizeResult, error) {
+	if size < len(s.shards) {
+		return ResizeResult{}, fmt.Errorf("sharded inventory must contain at least 1 item per shard, got size %d for %d shards", size, len(s.shards))
+	}
+
+	s.lockShards()
+	defer s.unlockShards()
+
+	items, err := s.items()
+	if err != nil {
+		return ResizeResult{}, err
+	}
+
+	ages := make([]uint64, len(items))
+	held := make(map[int]uint64)
+	for n, inv := range s.shards {
+		for idx, age := range inv.ages {
+			ages[s.globalIndex(n, idx)] = age
+		}
+		for idx, id := range inv.held {
+			held[s.globalIndex(n, idx)] = id
+		}
+	}
+
+	newItems, newAges, moved, res, err := planResize(items, ages, held, size, fill, policy, s.seq)
+	if err != nil {
+		return ResizeResult{}, err
+	}
+
+	s.storageLock.Lock()
+	err = s.storage.Load(newItems)
+	s.storageLock.Unlock()
+	if err != nil {
+		return ResizeResult{}, fmt.Errorf("failed to load resized inventory into storage: %w", err)
+	}
+	if s.journal != nil {
+		if err = s.journal.Reset(newItems); err != nil {
+			s.storageLock.Lock()
+			logUndo(s.storage.Load(items))
+			s.storageLock.Unlock()
+			return ResizeResult{}, fmt.Errorf("failed to journal resize: %w", err)
+		}
+	}
+
+	for n, inv := range s.shards {
+		var shardItems []int
+		var shardAges []uint64
+		for idx := n; idx < len(newItems); idx += len(s.shards) {
+			shardItems = append(shardItems, newItems[idx])
+			shardAges = append(shardAges, newAges[idx])
+		}
+		inv.index = newIndex(shardItems)
+		inv.ages = shardAges
+		inv.pledges = make(map[uint64]int)
+		inv.held = make(map[int]uint64)
+	}
+
+	// Pledged items may have moved to another shard, so they are held by the shard they moved to
+	_, newHeld := movePledges(held, moved)
+	for idx, id := range newHeld {
+		inv := s.shards[idx%len(s.shards)]
+		inv.pledges[id] = idx / len(s.shards)
+		inv.held[idx/len(s.shards)] = id
+		inv.index.remove(newItems[idx], idx/len(s.shards))
+	}
+
+	log.Infof("Resized inventory from %d to %d items, liquidated %d items", res.OldSize, res.NewSize, len(res.Removed))
+	return res, nil
+}
+
+/*
+Returns a copy of the items in the inventory.
+*/
+func (s *ShardedInventory) Items() ([]int, error) {
+	s.lockShards()
+	defer s.unlockShards()
+
+	return s.items()
+}
+
+/*
+Returns the value of the most valuable item of all shards that can be given up for offers.
+Returns false if every item is held.
+*/
+func (s *ShardedInventory) Max() (int, bool) {
+	var max int
+	var found bool
+	for _, inv := range s.shards {
+		if value, ok := inv.Max(); ok && (!found || value > max) {
+			max, found = value, true
+		}
+	}
+	return max, found
+}
+
+/*
+Returns a copy of the items in the inventory. It is NOT thread-safe and should be
+called with the locks of all shards held.
+*/
+func (s *ShardedInventory) items() ([]int, error) {
+	s.storageLock.Lock()
+	defer s.storageLock.Unlock()
+
+	items := make([]int, 0, s.storage.Size())
+	err := s.storage.Iterate(func(_, item int) bool {
+		items = append(items, item)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate storage: %w", err)
+	}
+
+	return items, nil
+}
+
+/*
+Returns a string representation of the inventory.
+*/
+func (s *ShardedInventory) String() string {
+	s.lockShards()
+	defer s.unlockShards()
+
+	items, err := s.items()
+	if err != nil {
+		return fmt.Sprintf("[error: %s]", err)
+	}
+
+	return formatItems(items)
+}
+
+/*
+Locks all shards, always in the same order to avoid deadlocks.
+*/
+func (s *ShardedInventory) lockShards() {
+	for _, inv := range s.shards {
+		inv.lock.Lock()
+	}
+}
+
+/*
+Unlocks all shards.
+*/
+func (s *ShardedInventory) unlockShards() {
+	for _, inv := range s.shards {
+		inv.lock.Unlock()
+	}
+}
+
+/*
+Returns the index in the inventory of the item at idx in the given shard.
+*/
+func (s *ShardedInventory) globalIndex(shard, idx int) int {
+	return idx*len(s.shards) + shard
+}
+
+/*
+shardStorage is a view of the items of a single shard in a storage shared by all shards.
+The items of the shard are indexed from 0 within the view.
+*/
+type shardStorage struct {
+	storage Storage
+	lock    *sync.Mutex
+	shard   int
+	shards  int
+}
+
+/*
+Returns an error, as the items of a shard can not be replaced without changing the other shards.
+*/
+func (s *shardStorage) Load(_ []int) error {
+	return errors.New("the items of a shard can not be loaded")
+}
+
+/*
+Returns the item at idx in the shard.
+*/
+func (s *shardStorage) Get(idx int) (int, error) {
+	if idx < 0 || idx >= s.Size() {
+		return 0, indexOutOfRangeError(idx, s.Size())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.storage.Get(idx*s.shards + s.shard)
+}
+
+/*
+Replaces the item at idx in the shard with value.
+*/
+func (s *shardStorage) Replace(idx, value int) error {
+	if idx < 0 || idx >= s.Size() {
+		return indexOutOfRangeError(idx, s.Size())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.storage.Replace(idx*s.shards+s.shard, value)
+}
+
+/*
+Returns an error, as items can not be added to a shard without changing the other shards.
+*/
+func (s *shardStorage) Add(_ int) error {
+	return errors.New("items can not be added to a shard")
+}
+
+/*
+Returns an error, as items can not be removed from a shard without changing the other shards.
+*/
+func (s *shardStorage) Remove(_ int) error {
+	return errors.New("items can not be removed from a shard")
+}
+
+/*
+Calls fn for every item in the shard in order of index, until fn returns false.
+*/
+func (s *shardStorage) Iterate(fn func(idx, value int) bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.storage.Iterate(func(idx, value int) bool {
+		if idx%s.shards != s.shard {
+			return true
+		}
+		return fn(idx/s.shards, value)
+	})
+}
+
+/*
+Returns the number of items in the shard.
+*/
+func (s *shardStorage) Size() int {
+	return (s.storage.Size() - s.shard + s.shards - 1) / s.shards
+}
+
+/*
+shardJournal appends the changes of a single shard to a journal shared by all shards,
+translating the indices of the shard to indices in the inventory.
+*/
+type shardJournal struct {
+	journal Journal
+	shard   int
+	shards  int
+}
+
+/*
+Appends a replacement of the item at idx in the shard with value to the journal.
+*/
+func (s *shardJournal) Append(idx, value int) error {
+	return s.journal.Append(idx*s.shards+s.shard, value)
+}
+
+/*
+Returns an error, as the items of a shard can not be reset without changing the other shards.
+*/
+func (s *shardJournal) Reset(_ []int) error {
+	return errors.New("the items of a shard can not be reset")
+}
+
+/*
+Returns an error, as items can not be added to a shard without changing the other shards.
+*/
+func (s *shardJournal) Add(_ int) error {
+	return errors.New("items can not be added to a shard")
+}
+
+/*
+Returns an error, as items can not be removed from a shard without changing the other shards.
+*/
+func (s *shardJournal) Remove(_ int) error {
+	return errors.New("items can not be removed from a shard")
+}
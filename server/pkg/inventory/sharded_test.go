@@ -0,0 +1,335 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"pawnshop/server/pkg/messages"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewShardedInventory(t *testing.T) {
+	cases := []struct {
+		name     string
+		items    []int
+		shards   int
+		routing  Routing
+		expError bool
+	}{
+		{
+			name:    "more items than shards",
+			items:   []int{1, 2, 3, 4, 5},
+			shards:  2,
+			routing: GlobalRouting,
+		},
+		{
+			name:    "one item per shard",
+			items:   []int{1, 2},
+			shards:  2,
+			routing: FirstFitRouting,
+		},
+		{
+			name:     "fewer items than shards, should return error",
+			items:    []int{1},
+			shards:   2,
+			routing:  GlobalRouting,
+			expError: true,
+		},
+		{
+			name:     "no shards, should return error",
+			items:    []int{1},
+			shards:   0,
+			routing:  GlobalRouting,
+			expError: true,
+		},
+		{
+			name:     "unknown routing, should return error",
+			items:    []int{1},
+			shards:   1,
+			routing:  "random",
+			expError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := NewShardedInventory(NewMemoryStorage(c.items), c.shards, c.routing)
+			if c.expError {
+				assert.Nil(t, s)
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			items, err := s.Items()
+			require.NoError(t, err)
+			assert.Equal(t, c.items, items)
+		})
+	}
+}
+
+func TestShardedInventoryHandleOffer(t *testing.T) {
+	cases := []struct {
+		name        string
+		routing     Routing
+		offer       messages.Offer
+		expected    messages.Answer
+		expReason   messages.ReasonCode
+		expNewItems []int
+	}{
+		{
+			name:        "global routing, should give up the globally best item",
+			routing:     GlobalRouting,
+			offer:       messages.CreateOffer(5, 2),
+			expected:    messages.CreateAcceptedAnswer(3),
+			expNewItems: []int{7, 1, 4, 5, 8, 6},
+		},
+		{
+			name:        "first fit routing, should give up the best item of the first shard that can accept the offer",
+			routing:     FirstFitRouting,
+			offer:       messages.CreateOffer(5, 2),
+			expected:    messages.CreateAcceptedAnswer(4),
+			expNewItems: []int{7, 1, 5, 3, 8, 6},
+		},
+		{
+			name:        "global routing, no shard can accept the offer, should be rejected",
+			routing:     GlobalRouting,
+			offer:       messages.CreateOffer(6, 5),
+			expected:    messages.CreateRejectAnswer(),
+			expReason:   messages.ReasonNotProfitable,
+			expNewItems: []int{7, 1, 4, 3, 8, 6},
+		},
+		{
+			name:        "first fit routing, no shard can accept the offer, should be rejected",
+			routing:     FirstFitRouting,
+			offer:       messages.CreateOffer(6, 5),
+			expected:    messages.CreateRejectAnswer(),
+			expReason:   messages.ReasonNotProfitable,
+			expNewItems: []int{7, 1, 4, 3, 8, 6},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Shard 0 contains [7, 4, 8] and shard 1 contains [1, 3, 6], and the first offer is routed to shard 0 first
+			s, err := NewShardedInventory(NewMemoryStorage([]int{7, 1, 4, 3, 8, 6}), 2, c.routing)
+			require.NoError(t, err)
+
+			j := &recordingJournal{}
+			s.SetJournal(j)
+
+			assert.Equal(t, c.expected, withoutReason(t, s.HandleOffer(context.Background(), c.offer), c.expReason))
+
+			items, err := s.Items()
+			require.NoError(t, err)
+			assert.Equal(t, c.expNewItems, items)
+
+			// The journal must see the indices of the inventory, not of the shard
+			for _, r := range j.records {
+				assert.Equal(t, c.offer.Offer, items[r[0]])
+			}
+		})
+	}
+}
+
+func TestShardedInventoryGlobalRoutingContention(t *testing.T) {
+	// Shard 0 contains [7, 4, 8] and shard 1 contains [1, 3, 6]
+	s, err := NewShardedInventory(NewMemoryStorage([]int{7, 1, 4, 3, 8, 6}), 2, GlobalRouting)
+	require.NoError(t, err)
+
+	// The best item 3 is taken by another offer every time after it was found, so the offer is routed
+	// with all shards locked after the last attempt
+	o := &takingObserver{inv: s.shards[1], value: 3, idx: 1}
+	s.shards[1].SetLockObserver(o)
+
+	assert.Equal(t, messages.CreateAcceptedAnswer(4), s.HandleOffer(context.Background(), messages.CreateOffer(5, 2)))
+	assert.Equal(t, 2*maxGlobalRoutingAttempts, o.locks)
+
+	// Offers that are canceled are not routed again
+	o.locks = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, messages.CreateRejectAnswer(), withoutReason(t, s.HandleOffer(ctx, messages.CreateOffer(5, 2)), messages.ReasonInternalError))
+	assert.Equal(t, 0, o.locks)
+}
+
+func TestShardedInventoryMatchesLinearInventory(t *testing.T) {
+	for _, shards := range []int{1, 3, 8} {
+		items, offers := randomItemsAndOffers(1000, 5000)
+
+		s, err := NewShardedInventory(NewMemoryStorage(items), shards, GlobalRouting)
+		require.NoError(t, err)
+		l := newLinearInventory(items)
+
+		// The linear inventory gives no reasons for rejecting offers
+		for _, o := range offers {
+			ans := s.HandleOffer(context.Background(), o)
+			ans.Reason = nil
+			require.Equal(t, l.handleOffer(o), ans)
+		}
+
+		items, err = s.Items()
+		require.NoError(t, err)
+		assert.Equal(t, l.items, items)
+	}
+}
+
+func TestShardedInventoryConcurrentOffers(t *testing.T) {
+	for _, routing := range []Routing{GlobalRouting, FirstFitRouting} {
+		t.Run(string(routing), func(t *testing.T) {
+			items, offers := randomItemsAndOffers(1000, 8000)
+
+			s, err := NewShardedInventory(NewMemoryStorage(items), 4, routing)
+			require.NoError(t, err)
+
+			// Every accepted offer increases the total value of the inventory by its profit
+			expTotal := sum(items)
+			var totalLock sync.Mutex
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(offers []messages.Offer) {
+					defer wg.Done()
+					for _, o := range offers {
+						if ans := s.HandleOffer(context.Background(), o); ans.Code == messages.AcceptCode {
+							totalLock.Lock()
+							expTotal += o.Offer - ans.Value
+							totalLock.Unlock()
+						}
+					}
+				}(offers[w*1000 : (w+1)*1000])
+			}
+			wg.Wait()
+
+			items, err = s.Items()
+			require.NoError(t, err)
+			assert.Equal(t, expTotal, sum(items))
+
+			// The index of every shard must still match its items
+			for _, inv := range s.shards {
+				shardItems, err := inv.items()
+				require.NoError(t, err)
+				assert.Equal(t, newIndex(shardItems).size, inv.index.size)
+				for idx, value := range shardItems {
+					assert.True(t, inv.index.remove(value, idx))
+				}
+			}
+		})
+	}
+}
+
+func TestShardedInventoryResize(t *testing.T) {
+	s, err := NewShardedInventory(NewMemoryStorage([]int{7, 1, 4, 3, 8, 6}), 2, GlobalRouting)
+	require.NoError(t, err)
+
+	j := &recordingJournal{}
+	s.SetJournal(j)
+
+	res, err := s.Resize(3, DefaultItemValue, LowestValueFirst)
+	require.NoError(t, err)
+	assert.Equal(t, ResizeResult{OldSize: 6, NewSize: 3, Removed: []Item{
+		{Index: 1, Value: 1},
+		{Index: 3, Value: 3},
+		{Index: 2, Value: 4},
+	}}, res)
+	assert.Equal(t, [][]int{{7, 8, 6}}, j.resets)
+
+	// The items are partitioned again, so shard 0 contains [7, 6] and shard 1 contains [8]
+	assert.Equal(t, 2, s.shards[0].index.size)
+	assert.Equal(t, 1, s.shards[1].index.size)
+	assert.Equal(t, messages.CreateAcceptedAnswer(6), s.HandleOffer(context.Background(), messages.CreateOffer(9, 5)))
+	assert.Equal(t, [][2]int{{2, 9}}, j.records)
+
+	res, err = s.Resize(5, 2, OldestFirst)
+	require.NoError(t, err)
+	assert.Equal(t, ResizeResult{OldSize: 3, NewSize: 5}, res)
+
+	items, err := s.Items()
+	require.NoError(t, err)
+	assert.Equal(t, []int{7, 8, 9, 2, 2}, items)
+
+	// There must be at least 1 item per shard
+	_, err = s.Resize(1, DefaultItemValue, LowestValueFirst)
+	assert.Error(t, err)
+}
+
+func BenchmarkShardedInventoryParallel(b *testing.B) {
+	items, offers := randomItemsAndOffers(100000, 10000)
+
+	b.Run("unsharded", func(b *testing.B) {
+		i, err := NewInventoryFromItems(items)
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchmarkParallelOffers(b, i.HandleOffer, offers)
+	})
+
+	for _, routing := range []Routing{GlobalRouting, FirstFitRouting} {
+		for _, shards := range []int{4, 16} {
+			b.Run(fmt.Sprintf("%s/shards=%d", routing, shards), func(b *testing.B) {
+				s, err := NewShardedInventory(NewMemoryStorage(items), shards, routing)
+				if err != nil {
+					b.Fatal(err)
+				}
+				benchmarkParallelOffers(b, s.HandleOffer, offers)
+			})
+		}
+	}
+}
+
+/*
+Handles the offers with handleOffer from multiple goroutines in parallel.
+*/
+func benchmarkParallelOffers(b *testing.B, handleOffer func(context.Context, messages.Offer) messages.Answer, offers []messages.Offer) {
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			handleOffer(context.Background(), offers[int(next.Add(1))%len(offers)])
+		}
+	})
+}
+
+func TestParseRouting(t *testing.T) {
+	r, err := ParseRouting("firstfit")
+	require.NoError(t, err)
+	assert.Equal(t, FirstFitRouting, r)
+
+	_, err = ParseRouting("random")
+	assert.Error(t, err)
+}
+
+/*
+Returns the sum of the given items.
+*/
+func sum(items []int) int {
+	s := 0
+	for _, item := range items {
+		s += item
+	}
+	return s
+}
+
+/*
+takingObserver is a LockObserver of a shard that takes the item at idx with value out of the index every other time
+the shard is locked, and puts it back otherwise, as if another offer took it right after it was found.
+*/
+type takingObserver struct {
+	inv   *Inventory
+	value int
+	idx   int
+	locks int
+}
+
+func (o *takingObserver) ObserveLockWait(_ time.Duration) {
+	if o.locks++; o.locks%2 == 0 {
+		o.inv.index.remove(o.value, o.idx)
+	} else if o.locks > 1 {
+		o.inv.index.insert(o.value, o.idx)
+	}
+}
@@ -0,0 +1,145 @@
+package inventory
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Storage is an interface for the storage backend of an inventory, holding the items of the inventory by index.
+Storages do not need to be thread-safe, as the inventory serializes all access to its storage.
+*/
+type Storage interface {
+	// Load replaces the entire contents of the storage with the given items.
+	Load(items []int) error
+	// Get returns the item at idx.
+	Get(idx int) (int, error)
+	// Replace replaces the item at idx with value.
+	Replace(idx, value int) error
+	// Add adds an item with value at the end.
+	Add(value int) error
+	// Remove removes the item at idx by moving the last item into its place.
+	Remove(idx int) error
+	// Iterate calls fn for every item in order of index, until fn returns false.
+	Iterate(fn func(idx, value int) bool) error
+	// Size returns the number of items in the storage.
+	Size() int
+}
+
+/*
+Undoes removing the item at idx with value from st, where lastValue is the value of the item at last
+that was moved into its place.
+*/
+func undoRemove(st Storage, idx, value, last, lastValue int) error {
+	if idx == last {
+		return st.Add(value)
+	}
+	if err := st.Add(lastValue); err != nil {
+		return err
+	}
+	return st.Replace(idx, value)
+}
+
+/*
+Logs the error of undoing a change to storage that could not be journaled, if there is one.
+The storage then holds a change that the journal and the rest of the inventory do not.
+*/
+func logUndo(err error) {
+	if err != nil {
+		log.Errorf("Failed to undo change to storage that could not be journaled: %s", err)
+	}
+}
+
+/*
+MemoryStorage is a Storage keeping all items in memory.
+*/
+type MemoryStorage struct {
+	items []int
+}
+
+/*
+Creates a new MemoryStorage containing a copy of the given items.
+*/
+func NewMemoryStorage(items []int) *MemoryStorage {
+	s := &MemoryStorage{}
+	_ = s.Load(items)
+	return s
+}
+
+/*
+Replaces the entire contents of the storage with a copy of the given items.
+*/
+func (m *MemoryStorage) Load(items []int) error {
+	m.items = make([]int, len(items))
+	copy(m.items, items)
+	return nil
+}
+
+/*
+Returns the item at idx.
+*/
+func (m *MemoryStorage) Get(idx int) (int, error) {
+	if idx < 0 || idx >= len(m.items) {
+		return 0, indexOutOfRangeError(idx, len(m.items))
+	}
+	return m.items[idx], nil
+}
+
+/*
+Replaces the item at idx with value.
+*/
+func (m *MemoryStorage) Replace(idx, value int) error {
+	if idx < 0 || idx >= len(m.items) {
+		return indexOutOfRangeError(idx, len(m.items))
+	}
+	m.items[idx] = value
+	return nil
+}
+
+/*
+Adds an item with value at the end.
+*/
+func (m *MemoryStorage) Add(value int) error {
+	m.items = append(m.items, value)
+	return nil
+}
+
+/*
+Removes the item at idx by moving the last item into its place.
+*/
+func (m *MemoryStorage) Remove(idx int) error {
+	if idx < 0 || idx >= len(m.items) {
+		return indexOutOfRangeError(idx, len(m.items))
+	}
+	last := len(m.items) - 1
+	m.items[idx] = m.items[last]
+	m.items = m.items[:last]
+	return nil
+}
+
+/*
+Calls fn for every item in order of index, until fn returns false.
+*/
+func (m *MemoryStorage) Iterate(fn func(idx, value int) bool) error {
+	for idx, value := range m.items {
+		if !fn(idx, value) {
+			break
+		}
+	}
+	return nil
+}
+
+/*
+Returns the number of items in the storage.
+*/
+func (m *MemoryStorage) Size() int {
+	return len(m.items)
+}
+
+/*
+Returns an error for an index that is out of range for a storage of the given size.
+*/
+func indexOutOfRangeError(idx, sz int) error {
+	return fmt.Errorf("index %d is out of range for %d items", idx, sz)
+}
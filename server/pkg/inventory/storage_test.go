@@ -0,0 +1,145 @@
+package inventory
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage(t *testing.T) {
+	storages := []struct {
+		name string
+		open func(t *testing.T) Storage
+	}{
+		{
+			name: "memory",
+			open: func(t *testing.T) Storage {
+				return NewMemoryStorage(nil)
+			},
+		},
+		{
+			name: "file",
+			open: func(t *testing.T) Storage {
+				s, err := OpenFileStorage(filepath.Join(t.TempDir(), "inventory.db"))
+				require.NoError(t, err)
+				t.Cleanup(func() { s.Close() })
+				return s
+			},
+		},
+	}
+
+	for _, st := range storages {
+		t.Run(st.name, func(t *testing.T) {
+			s := st.open(t)
+			require.Equal(t, 0, s.Size())
+
+			require.NoError(t, s.Load([]int{3, 1, 2}))
+			require.Equal(t, 3, s.Size())
+
+			v, err := s.Get(1)
+			require.NoError(t, err)
+			assert.Equal(t, 1, v)
+
+			require.NoError(t, s.Replace(1, -7))
+			v, err = s.Get(1)
+			require.NoError(t, err)
+			assert.Equal(t, -7, v)
+
+			_, err = s.Get(3)
+			assert.Error(t, err)
+			assert.Error(t, s.Replace(-1, 5))
+
+			var items []int
+			require.NoError(t, s.Iterate(func(_, value int) bool {
+				items = append(items, value)
+				return len(items) < 2
+			}))
+			assert.Equal(t, []int{3, -7}, items)
+
+			// Removing an item moves the last item into its place
+			require.NoError(t, s.Add(4))
+			require.Equal(t, 4, s.Size())
+			require.NoError(t, s.Remove(0))
+			require.Equal(t, 3, s.Size())
+			assert.Error(t, s.Remove(3))
+
+			items = nil
+			require.NoError(t, s.Iterate(func(_, value int) bool {
+				items = append(items, value)
+				return true
+			}))
+			assert.Equal(t, []int{4, -7, 2}, items)
+		})
+	}
+}
+
+func TestFileStorageReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.db")
+
+	s, err := OpenFileStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, s.Load([]int{1, 2, 3}))
+	require.NoError(t, s.Replace(2, 5))
+	require.NoError(t, s.Load([]int{4, 5}))
+	require.NoError(t, s.Replace(0, 6))
+	require.NoError(t, s.Close())
+
+	s, err = OpenFileStorage(path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	i, err := NewInventoryWithStorage(s)
+	require.NoError(t, err)
+	items, err := i.Items()
+	require.NoError(t, err)
+	assert.Equal(t, []int{6, 5}, items)
+}
+
+func TestOpenFileStorage(t *testing.T) {
+	cases := []struct {
+		name     string
+		content  []byte
+		expItems []int
+		expError bool
+	}{
+		{
+			name:     "existing storage file, should contain its items",
+			content:  append([]byte(fileStorageMagic), 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 9),
+			expItems: []int{4, 9},
+		},
+		{
+			name:     "file without magic header, should return error",
+			content:  []byte("not an inventory"),
+			expError: true,
+		},
+		{
+			name:     "truncated item, should return error",
+			content:  append([]byte(fileStorageMagic), 0, 0, 0, 4),
+			expError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "inventory.db")
+			require.NoError(t, os.WriteFile(path, c.content, 0o600))
+
+			s, err := OpenFileStorage(path)
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer s.Close()
+
+			i, err := NewInventoryWithStorage(s)
+			require.NoError(t, err)
+			items, err := i.Items()
+			require.NoError(t, err)
+			assert.Equal(t, c.expItems, items)
+		})
+	}
+}
@@ -0,0 +1,285 @@
+/*
+Package loans implements the loans of a pawn shop. A client pawns an item by pledging it as security for
+a loan, and can redeem the item by repaying the loan with interest before it is due. Once a loan is due
+without being repaid, the pledged item is forfeited to the pawn shop.
+*/
+package loans
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownLoan is returned when redeeming a loan that the book does not contain.
+	ErrUnknownLoan = errors.New("unknown loan")
+	// ErrLoanDue is returned when redeeming a loan that is already due.
+	ErrLoanDue = errors.New("loan is due")
+	// ErrInsufficientRepayment is returned when redeeming a loan with less than its repayment.
+	ErrInsufficientRepayment = errors.New("repayment is less than principal and interest")
+	// ErrNotOwner is returned when redeeming a loan that was taken out by another client.
+	ErrNotOwner = errors.New("loan was taken out by another client")
+	// ErrLoanOutOfRange is returned when opening a loan whose interest or repayment does not fit in an int.
+	ErrLoanOutOfRange = errors.New("interest or repayment of loan is out of range")
+)
+
+/*
+Clock is an interface for the source of the current time, so that the lifecycle of loans can be tested
+without waiting for them to become due.
+*/
+type Clock interface {
+	Now() time.Time
+}
+
+/*
+SystemClock is a Clock that returns the current system time.
+*/
+type SystemClock struct{}
+
+/*
+Returns the current system time.
+*/
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+/*
+Loan is a loan against a pledged item.
+*/
+type Loan struct {
+	// ID identifies the loan to the client, and is hard to guess.
+	ID string
+	// PledgeID identifies the pledged item in the inventory.
+	PledgeID uint64
+	// Pledge is the value of the pledged item.
+	Pledge int
+	// Principal is the value lent to the client.
+	Principal int
+	// Interest is the value the client has to pay on top of the principal to redeem the pledged item.
+	Interest int
+	// Due is the time the loan must be repaid before.
+	Due time.Time
+	// Owner identifies the client that took out the loan, if it authenticated. Only the owner may redeem the loan.
+	Owner string
+}
+
+/*
+Returns the value the client has to repay to redeem the pledged item. It can not overflow for loans opened
+by a Book, which refuses loans whose repayment does not fit in an int.
+*/
+func (l Loan) Repayment() int {
+	return l.Principal + l.Interest
+}
+
+/*
+Book keeps track of all open loans of a pawn shop. It is safe for concurrent use.
+*/
+type Book struct {
+	clock Clock
+	term  time.Duration
+	// rate is the interest rate in basis points, so that interest is calculated exactly
+	rate  int64
+	loans map[string]Loan
+	due   dueHeap
+	lock  sync.Mutex
+}
+
+/*
+Creates a new book of loans that are due after term, and accrue interest at the given rate,
+e.g. 0.1 for 10% of the principal. The interest is rounded up to a whole value.
+*/
+func NewBook(clock Clock, term time.Duration, rate float64) (*Book, error) {
+	if clock == nil {
+		return nil, errors.New("clock can not be nil")
+	}
+	if term <= 0 {
+		return nil, errors.New("loan term must be positive")
+	}
+	if rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return nil, errors.New("interest rate can not be negative")
+	}
+
+	return &Book{
+		clock: clock,
+		term:  term,
+		rate:  int64(math.Round(rate * 10000)),
+		loans: make(map[string]Loan),
+	}, nil
+}
+
+/*
+Opens a loan of principal against the pledged item with the given pledge ID and value, taken out by owner.
+The owner is empty if the client did not authenticate. Returns ErrLoanOutOfRange if the interest or the
+repayment of the loan does not fit in an int.
+*/
+func (b *Book) Open(pledgeID uint64, pledge, principal int, owner string) (Loan, error) {
+	interest, err := b.interest(principal)
+	if err != nil {
+		return Loan{}, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return Loan{}, err
+	}
+
+	l := Loan{
+		ID:        id,
+		PledgeID:  pledgeID,
+		Pledge:    pledge,
+		Principal: principal,
+		Interest:  interest,
+		Due:       b.clock.Now().Add(b.term),
+		Owner:     owner,
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.loans[l.ID] = l
+	heap.Push(&b.due, l)
+
+	return l, nil
+}
+
+/*
+Returns the interest on a loan of principal, rounded up, or ErrLoanOutOfRange if the interest or the
+repayment of the loan does not fit in an int.
+*/
+func (b *Book) interest(principal int) (int, error) {
+	// Calculated exactly, as principal * rate can overflow for large principals
+	interest := new(big.Int).Mul(big.NewInt(int64(principal)), big.NewInt(b.rate))
+	interest.Add(interest, big.NewInt(9999))
+	interest.Div(interest, big.NewInt(10000))
+
+	repayment := new(big.Int).Add(interest, big.NewInt(int64(principal)))
+	if !fitsInt(interest) || !fitsInt(repayment) {
+		return 0, fmt.Errorf("%w: principal is %d", ErrLoanOutOfRange, principal)
+	}
+	return int(interest.Int64()), nil
+}
+
+/*
+Returns true if x fits in an int.
+*/
+func fitsInt(x *big.Int) bool {
+	return x.IsInt64() && x.Int64() <= math.MaxInt && x.Int64() >= math.MinInt
+}
+
+/*
+Redeems the loan with the given ID with a repayment of amount by owner. The loan must not be due, and
+the amount must be at least its repayment. The pledged item is given back by calling redeem, and the loan
+is only closed if redeem succeeds. Returns the redeemed loan.
+*/
+func (b *Book) Redeem(id string, amount int, owner string, redeem func(l Loan) error) (Loan, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	l, ok := b.loans[id]
+	if !ok {
+		return Loan{}, ErrUnknownLoan
+	}
+	if l.Owner != "" && l.Owner != owner {
+		return Loan{}, ErrNotOwner
+	}
+	if !b.clock.Now().Before(l.Due) {
+		return Loan{}, ErrLoanDue
+	}
+	if amount < l.Repayment() {
+		return Loan{}, ErrInsufficientRepayment
+	}
+
+	if err := redeem(l); err != nil {
+		return Loan{}, err
+	}
+
+	// The loan is left in the due heap, and skipped once it is due
+	delete(b.loans, id)
+	return l, nil
+}
+
+/*
+Forfeits all loans that are due by calling forfeit for each of them, in order of due date. A loan is only
+closed if forfeit succeeds, so that it is forfeited again later otherwise. Returns the forfeited loans.
+*/
+func (b *Book) ForfeitDue(forfeit func(l Loan) error) ([]Loan, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.clock.Now()
+	var forfeited []Loan
+	for b.due.Len() > 0 && !now.Before(b.due[0].Due) {
+		l := b.due[0]
+		if _, ok := b.loans[l.ID]; !ok {
+			heap.Pop(&b.due)
+			continue
+		}
+
+		if err := forfeit(l); err != nil {
+			return forfeited, fmt.Errorf("failed to forfeit loan %s: %w", l.ID, err)
+		}
+
+		heap.Pop(&b.due)
+		delete(b.loans, l.ID)
+		forfeited = append(forfeited, l)
+	}
+
+	return forfeited, nil
+}
+
+/*
+Returns the number of open loans.
+*/
+func (b *Book) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return len(b.loans)
+}
+
+/*
+Returns a new random loan ID.
+*/
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate loan ID: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+/*
+dueHeap is a heap of loans ordered by due date. It implements heap.Interface.
+*/
+type dueHeap []Loan
+
+func (h dueHeap) Len() int {
+	return len(h)
+}
+
+func (h dueHeap) Less(a, b int) bool {
+	return h[a].Due.Before(h[b].Due)
+}
+
+func (h dueHeap) Swap(a, b int) {
+	h[a], h[b] = h[b], h[a]
+}
+
+func (h *dueHeap) Push(x any) {
+	*h = append(*h, x.(Loan))
+}
+
+func (h *dueHeap) Pop() any {
+	old := *h
+	l := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return l
+}
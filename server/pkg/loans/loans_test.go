@@ -0,0 +1,201 @@
+package loans
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBook(t *testing.T) {
+	cases := []struct {
+		name     string
+		clock    Clock
+		term     time.Duration
+		rate     float64
+		expError bool
+	}{
+		{name: "Valid book", clock: SystemClock{}, term: time.Hour, rate: 0.1},
+		{name: "No interest", clock: SystemClock{}, term: time.Hour, rate: 0},
+		{name: "Nil clock, should return error", term: time.Hour, expError: true},
+		{name: "Zero term, should return error", clock: SystemClock{}, expError: true},
+		{name: "Negative rate, should return error", clock: SystemClock{}, term: time.Hour, rate: -0.1, expError: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := NewBook(c.clock, c.term, c.rate)
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	cases := []struct {
+		name        string
+		rate        float64
+		principal   int
+		expInterest int
+		expError    bool
+	}{
+		{name: "Interest is exact", rate: 0.07, principal: 100, expInterest: 7},
+		{name: "Interest is rounded up", rate: 0.1, principal: 5, expInterest: 1},
+		{name: "No interest", rate: 0, principal: 5, expInterest: 0},
+		{name: "Largest principal without interest", rate: 0, principal: math.MaxInt, expInterest: 0},
+		{name: "Largest repayment", rate: 1, principal: math.MaxInt / 2, expInterest: math.MaxInt / 2},
+		{name: "Repayment out of range, should return error", rate: 1, principal: math.MaxInt/2 + 1, expError: true},
+		{name: "Interest of a large principal is exact", rate: 0.1, principal: 1 << 60, expInterest: 115292150460684698},
+		{name: "Repayment of the largest principal out of range, should return error", rate: 0.1, principal: math.MaxInt, expError: true},
+		{name: "Interest out of range, should return error", rate: 3, principal: math.MaxInt / 2, expError: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			b, err := NewBook(clock, time.Hour, c.rate)
+			require.NoError(t, err)
+
+			l, err := b.Open(1, 10, c.principal, "")
+			if c.expError {
+				require.ErrorIs(t, err, ErrLoanOutOfRange)
+				require.Equal(t, 0, b.Len())
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, l.ID, 32)
+			require.Equal(t, c.expInterest, l.Interest)
+			require.Equal(t, c.principal+c.expInterest, l.Repayment())
+			require.Equal(t, clock.now.Add(time.Hour), l.Due)
+			require.Equal(t, 1, b.Len())
+
+			other, err := b.Open(2, 10, c.principal, "")
+			require.NoError(t, err)
+			require.NotEqual(t, l.ID, other.ID)
+		})
+	}
+}
+
+func TestRedeem(t *testing.T) {
+	errRedeem := errors.New("redeem failed")
+
+	cases := []struct {
+		name     string
+		advance  time.Duration
+		id       string
+		amount   int
+		owner    string
+		redeem   error
+		expError error
+	}{
+		{name: "Redeem with exact repayment", amount: 11},
+		{name: "Redeem with more than repayment", amount: 20},
+		{name: "Redeem just before due", advance: time.Hour - time.Nanosecond, amount: 11},
+		{name: "Unknown loan, should return error", id: "unknown", amount: 11, expError: ErrUnknownLoan},
+		{name: "Loan is due, should return error", advance: time.Hour, amount: 11, expError: ErrLoanDue},
+		{name: "Insufficient repayment, should return error", amount: 10, expError: ErrInsufficientRepayment},
+		{name: "Another owner, should return error", amount: 11, owner: "other", expError: ErrNotOwner},
+		{name: "Failed redemption, should return error", amount: 11, redeem: errRedeem, expError: errRedeem},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			b, err := NewBook(clock, time.Hour, 0.1)
+			require.NoError(t, err)
+
+			l, err := b.Open(1, 20, 10, "owner")
+			require.NoError(t, err)
+			clock.Advance(c.advance)
+
+			id := l.ID
+			if c.id != "" {
+				id = c.id
+			}
+			owner := "owner"
+			if c.owner != "" {
+				owner = c.owner
+			}
+
+			var redeemed []Loan
+			got, err := b.Redeem(id, c.amount, owner, func(l Loan) error {
+				redeemed = append(redeemed, l)
+				return c.redeem
+			})
+			if c.expError != nil {
+				require.ErrorIs(t, err, c.expError)
+				require.Equal(t, 1, b.Len())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, l, got)
+			require.Equal(t, []Loan{l}, redeemed)
+			require.Equal(t, 0, b.Len())
+
+			// A redeemed loan can neither be redeemed nor forfeited again
+			_, err = b.Redeem(id, c.amount, owner, func(Loan) error { return nil })
+			require.ErrorIs(t, err, ErrUnknownLoan)
+			clock.Advance(2 * time.Hour)
+			forfeited, err := b.ForfeitDue(func(Loan) error { return nil })
+			require.NoError(t, err)
+			require.Empty(t, forfeited)
+		})
+	}
+}
+
+func TestForfeitDue(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b, err := NewBook(clock, time.Hour, 0.1)
+	require.NoError(t, err)
+
+	first, err := b.Open(1, 20, 10, "")
+	require.NoError(t, err)
+	clock.Advance(time.Minute)
+	second, err := b.Open(2, 20, 10, "")
+	require.NoError(t, err)
+
+	// No loan is due yet
+	forfeited, err := b.ForfeitDue(func(Loan) error { return nil })
+	require.NoError(t, err)
+	require.Empty(t, forfeited)
+
+	// A failed forfeiture keeps the loan, so that it is forfeited again later
+	clock.Advance(time.Hour - time.Minute)
+	errForfeit := errors.New("forfeit failed")
+	forfeited, err = b.ForfeitDue(func(Loan) error { return errForfeit })
+	require.ErrorIs(t, err, errForfeit)
+	require.Empty(t, forfeited)
+	require.Equal(t, 2, b.Len())
+
+	// Only the first loan is due
+	forfeited, err = b.ForfeitDue(func(Loan) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, []Loan{first}, forfeited)
+	require.Equal(t, 1, b.Len())
+
+	clock.Advance(time.Minute)
+	forfeited, err = b.ForfeitDue(func(Loan) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, []Loan{second}, forfeited)
+	require.Equal(t, 0, b.Len())
+}
+
+/*
+fakeClock is a Clock whose time only changes when it is advanced.
+*/
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,102 @@
+/*
+Package logging carries structured log fields, e.g. the IDs of the connection and offer being handled, through a
+context.Context, so that every log line about an offer can be correlated across the server, pawnshop and inventory
+packages. It also configures the format of the logs.
+*/
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// TextFormat logs human-readable lines with the fields as key=value pairs.
+	TextFormat = "text"
+	// JSONFormat logs one JSON object per line, with the fields as keys.
+	JSONFormat = "json"
+)
+
+// The names of the structured log fields.
+const (
+	// ConnIDField is the ID of the connection, or HTTP request, an offer was received on.
+	ConnIDField = "conn_id"
+	// RemoteAddrField is the remote address of the client.
+	RemoteAddrField = "remote_addr"
+	// OfferIDField is the ID of the offer.
+	OfferIDField = "offer_id"
+	// CodeField is the code of the offer.
+	CodeField = "code"
+	// OfferField is the offer of the offer.
+	OfferField = "offer"
+	// DemandField is the demand of the offer.
+	DemandField = "demand"
+	// DecisionField is the code of the answer to the offer.
+	DecisionField = "decision"
+	// ReasonField is the reason code of the answer to the offer, if it has one.
+	ReasonField = "reason"
+	// RuleField is the ID of the validation rule that rejected the offer.
+	RuleField = "rule"
+	// DurationField is the time it took to handle the offer.
+	DurationField = "duration"
+	// TraceIDField is the ID of the trace of the offer, if offers are traced.
+	TraceIDField = "trace_id"
+)
+
+/*
+Sets the format of the standard logger, either TextFormat or JSONFormat.
+*/
+func SetFormat(format string) error {
+	switch format {
+	case TextFormat:
+		log.SetFormatter(&log.TextFormatter{})
+	case JSONFormat:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+/*
+fieldsKey is the context key of the log fields.
+*/
+type fieldsKey struct{}
+
+/*
+Returns a copy of ctx carrying the given log fields on top of the fields it already carries.
+*/
+func WithFields(ctx context.Context, fields log.Fields) context.Context {
+	parent, _ := ctx.Value(fieldsKey{}).(log.Fields)
+
+	merged := make(log.Fields, len(parent)+len(fields))
+	for k, v := range parent {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+/*
+Returns a log entry of the standard logger with the fields carried by ctx.
+*/
+func FromContext(ctx context.Context) *log.Entry {
+	fields, _ := ctx.Value(fieldsKey{}).(log.Fields)
+	return log.WithFields(fields)
+}
+
+/*
+Returns a new random ID for a connection or an offer.
+*/
+func NewID() string {
+	var b [8]byte
+	// Reading from crypto/rand never fails on supported platforms
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithFields(t *testing.T) {
+	conn := WithFields(context.Background(), log.Fields{ConnIDField: "c1", RemoteAddrField: "127.0.0.1"})
+	offer := WithFields(conn, log.Fields{OfferIDField: "o1", ConnIDField: "c2"})
+
+	assert.Equal(t, log.Fields{ConnIDField: "c1", RemoteAddrField: "127.0.0.1"}, FromContext(conn).Data)
+	assert.Equal(t, log.Fields{ConnIDField: "c2", RemoteAddrField: "127.0.0.1", OfferIDField: "o1"}, FromContext(offer).Data)
+	assert.Empty(t, FromContext(context.Background()).Data)
+}
+
+func TestSetFormat(t *testing.T) {
+	out := log.StandardLogger().Out
+	defer func() {
+		log.SetOutput(out)
+		require.NoError(t, SetFormat(TextFormat))
+	}()
+
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	require.NoError(t, SetFormat(JSONFormat))
+
+	ctx := WithFields(context.Background(), log.Fields{ConnIDField: "c1", OfferField: 5})
+	FromContext(ctx).Info("Handled offer")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(b.Bytes(), &line))
+	assert.Equal(t, "c1", line[ConnIDField])
+	assert.Equal(t, float64(5), line[OfferField])
+	assert.Equal(t, "Handled offer", line["msg"])
+
+	require.Error(t, SetFormat("xml"))
+}
+
+func TestNewID(t *testing.T) {
+	a, b := NewID(), NewID()
+	assert.Len(t, a, 16)
+	assert.NotEqual(t, a, b)
+}
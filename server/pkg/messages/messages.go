@@ -1,10 +1,24 @@
 package messages
 
+import (
+	"fmt"
+	"time"
+)
+
 const (
-	PawnCode        = "PAWN"
-	RejectCode      = "REJECT"
-	AcceptCode      = "ACCEPT"
-	UnsupportedCode = "UNSUPPORTED"
+	PawnCode          = "PAWN"
+	RedeemCode        = "REDEEM"
+	SellCode          = "SELL"
+	BuyCode           = "BUY"
+	QuoteCode         = "QUOTE"
+	AcceptCounterCode = "ACCEPT_COUNTER"
+	RejectCode        = "REJECT"
+	AcceptCode        = "ACCEPT"
+	CounterCode       = "COUNTER"
+	UnsupportedCode   = "UNSUPPORTED"
+	ErrorCode         = "ERROR"
+	ThrottledCode     = "THROTTLED"
+	BusyCode          = "BUSY"
 )
 
 /*
@@ -14,6 +28,16 @@ type Offer struct {
 	Code   string `json:"code"`
 	Offer  int    `json:"offer"`
 	Demand int    `json:"demand"`
+	// Loan is the ID of the loan to redeem with a REDEEM offer, in which case Offer is the repayment.
+	Loan string `json:"loan,omitempty"`
+	// Item is the index of the inventory item to purchase with a BUY offer, in which case Offer is the most
+	// the client is willing to pay, and Demand the value of the item the client expects at the index.
+	Item int `json:"item,omitempty"`
+	// Quote is the token of a quote for the same offer and demand, which guarantees the quoted answer to a PAWN offer.
+	Quote string `json:"quote,omitempty"`
+	// TraceParent is the trace context of the client in the format of the W3C traceparent header, e.g.
+	// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01, which makes the spans of the offer part of its trace.
+	TraceParent string `json:"traceparent,omitempty"`
 }
 
 /*
@@ -27,12 +51,115 @@ func CreateOffer(off int, dem int) Offer {
 	}
 }
 
+/*
+Creates a new Offer asking for the answer to an offer with the given offer and demand, without making it.
+*/
+func CreateQuoteOffer(off int, dem int) Offer {
+	return Offer{
+		Code:   QuoteCode,
+		Offer:  off,
+		Demand: dem,
+	}
+}
+
+/*
+Creates a new Offer with the given offer and demand, that is answered as quoted by the quote with the given token.
+*/
+func CreateQuotedOffer(token string, off int, dem int) Offer {
+	return Offer{
+		Code:   PawnCode,
+		Offer:  off,
+		Demand: dem,
+		Quote:  token,
+	}
+}
+
+/*
+Creates a new Offer accepting the last counter-offer the pawn shop made in the session.
+*/
+func CreateAcceptCounterOffer() Offer {
+	return Offer{
+		Code: AcceptCounterCode,
+	}
+}
+
+/*
+Creates a new Offer redeeming the loan with the given ID with the given repayment.
+*/
+func CreateRedeemOffer(loan string, repayment int) Offer {
+	return Offer{
+		Code:  RedeemCode,
+		Offer: repayment,
+		Loan:  loan,
+	}
+}
+
+/*
+Creates a new Offer selling an item with the given value to the pawn shop for at least minPrice.
+*/
+func CreateSellOffer(value int, minPrice int) Offer {
+	return Offer{
+		Code:   SellCode,
+		Offer:  value,
+		Demand: minPrice,
+	}
+}
+
+/*
+Creates a new Offer buying the inventory item with the given value at the given index from the pawn shop
+for at most maxPrice.
+*/
+func CreateBuyOffer(item int, value int, maxPrice int) Offer {
+	return Offer{
+		Code:   BuyCode,
+		Offer:  maxPrice,
+		Demand: value,
+		Item:   item,
+	}
+}
+
 /*
 Answer is a struct that represents an answer.
 */
 type Answer struct {
 	Code  string `json:"code"`
 	Value int    `json:"value,omitempty"`
+	// Price is the price the client paid for an item bought with an accepted BUY offer.
+	Price int `json:"price,omitempty"`
+	// Loan holds the terms of the loan taken out by an accepted PAWN offer, if the pawn shop lends against pledges.
+	Loan *LoanTerms `json:"loan,omitempty"`
+	// Quote holds the token of an accepted QUOTE offer, if the pawn shop reserves items for quotes.
+	Quote *QuoteTerms `json:"quote,omitempty"`
+	// Counter holds the offer and demand the pawn shop would accept instead of a rejected PAWN offer.
+	Counter *CounterOffer `json:"counter,omitempty"`
+	// Reason holds the reason an offer was not accepted.
+	Reason *Reason `json:"reason,omitempty"`
+}
+
+/*
+LoanTerms is a struct that represents the terms of a loan against a pledged item.
+*/
+type LoanTerms struct {
+	ID        string    `json:"id"`
+	Principal int       `json:"principal"`
+	Repayment int       `json:"repayment"`
+	Due       time.Time `json:"due"`
+}
+
+/*
+QuoteTerms is a struct that represents a quote, which guarantees its answer to an offer made before it expires.
+*/
+type QuoteTerms struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+/*
+CounterOffer is a struct that represents the offer and demand of a counter-offer.
+*/
+type CounterOffer struct {
+	Offer  int `json:"offer"`
+	Demand int `json:"demand"`
 }
 
 /*
@@ -45,6 +172,52 @@ func CreateAcceptedAnswer(value int) Answer {
 	}
 }
 
+/*
+Creates a new Answer with the value of a bought item and the price it was bought for.
+*/
+func CreateBuyAnswer(value int, price int) Answer {
+	return Answer{
+		Code:  AcceptCode,
+		Value: value,
+		Price: price,
+	}
+}
+
+/*
+Creates a new Answer with the given principal and the terms of the loan it was lent under.
+*/
+func CreateLoanAnswer(terms LoanTerms) Answer {
+	return Answer{
+		Code:  AcceptCode,
+		Value: terms.Principal,
+		Loan:  &terms,
+	}
+}
+
+/*
+Creates a new Answer with the given quoted value and the terms of the quote.
+*/
+func CreateQuoteAnswer(value int, terms QuoteTerms) Answer {
+	return Answer{
+		Code:  AcceptCode,
+		Value: value,
+		Quote: &terms,
+	}
+}
+
+/*
+Creates a new Answer with the CounterCode, carrying the counter-offer, the value of the item that would be given up
+for it, and the reason the original offer was rejected.
+*/
+func CreateCounterAnswer(value int, counter CounterOffer, reason *Reason) Answer {
+	return Answer{
+		Code:    CounterCode,
+		Value:   value,
+		Counter: &counter,
+		Reason:  reason,
+	}
+}
+
 /*
 Creates a new Answer with the RejectCode.
 */
@@ -53,3 +226,71 @@ func CreateRejectAnswer() Answer {
 		Code: RejectCode,
 	}
 }
+
+/*
+Creates a new Answer with the RejectCode and the reason for err, see ReasonFor.
+*/
+func CreateRejectAnswerFor(err error) Answer {
+	reason := ReasonFor(err)
+	return Answer{
+		Code:   RejectCode,
+		Reason: &reason,
+	}
+}
+
+/*
+Creates a new Answer with the UnsupportedCode for an offer with the given code.
+*/
+func CreateUnsupportedAnswer(code string) Answer {
+	return Answer{
+		Code: UnsupportedCode,
+		Reason: &Reason{
+			Code:    ReasonUnsupportedCode,
+			Message: fmt.Sprintf("code %q is not supported", code),
+		},
+	}
+}
+
+/*
+Creates a new Answer with the ErrorCode.
+*/
+func CreateErrorAnswer() Answer {
+	return Answer{
+		Code: ErrorCode,
+	}
+}
+
+/*
+Creates a new Answer with the ThrottledCode and the reason for err, see ReasonFor.
+*/
+func CreateThrottledAnswerFor(err error) Answer {
+	reason := ReasonFor(err)
+	return Answer{
+		Code:   ThrottledCode,
+		Reason: &reason,
+	}
+}
+
+/*
+Creates a new Answer with the BusyCode, for a connection that the server has no capacity to handle.
+*/
+func CreateBusyAnswer() Answer {
+	return Answer{
+		Code: BusyCode,
+		Reason: &Reason{
+			Code:    ReasonServerBusy,
+			Message: "the server is too busy to handle the connection, try again later",
+		},
+	}
+}
+
+/*
+Creates a new Answer with the ErrorCode and the reason for err, see ReasonFor.
+*/
+func CreateErrorAnswerFor(err error) Answer {
+	reason := ReasonFor(err)
+	return Answer{
+		Code:   ErrorCode,
+		Reason: &reason,
+	}
+}
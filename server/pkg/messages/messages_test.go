@@ -2,6 +2,7 @@ package messages
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -75,3 +76,117 @@ func TestCreateRejectAnswer(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateErrorAnswer(t *testing.T) {
+	cases := []struct {
+		name      string
+		expAnswer Answer
+	}{
+		{
+			name: "Create error answer",
+			expAnswer: Answer{
+				Code: "ERROR",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expAnswer, CreateErrorAnswer())
+		})
+	}
+}
+
+func TestCreateThrottledAnswerFor(t *testing.T) {
+	assert.Equal(t, Answer{
+		Code:   "THROTTLED",
+		Reason: &Reason{Code: ReasonRateLimited, Message: "too many offers"},
+	}, CreateThrottledAnswerFor(Errorf(ReasonRateLimited, "too many offers")))
+}
+
+func TestCreateBusyAnswer(t *testing.T) {
+	answer := CreateBusyAnswer()
+	assert.Equal(t, "BUSY", answer.Code)
+	assert.Equal(t, ReasonServerBusy, answer.Reason.Code)
+}
+
+func TestCreateRedeemOffer(t *testing.T) {
+	cases := []struct {
+		name      string
+		loan      string
+		repayment int
+		expOffer  Offer
+	}{
+		{
+			name:      "Create redeem offer",
+			loan:      "abc",
+			repayment: 6,
+			expOffer: Offer{
+				Code:  "REDEEM",
+				Offer: 6,
+				Loan:  "abc",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expOffer, CreateRedeemOffer(c.loan, c.repayment))
+		})
+	}
+}
+
+func TestCreateLoanAnswer(t *testing.T) {
+	due := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name      string
+		terms     LoanTerms
+		expAnswer Answer
+	}{
+		{
+			name:  "Create loan answer",
+			terms: LoanTerms{ID: "abc", Principal: 5, Repayment: 6, Due: due},
+			expAnswer: Answer{
+				Code:  "ACCEPT",
+				Value: 5,
+				Loan:  &LoanTerms{ID: "abc", Principal: 5, Repayment: 6, Due: due},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expAnswer, CreateLoanAnswer(c.terms))
+		})
+	}
+}
+
+func TestCreateRetailOffers(t *testing.T) {
+	cases := []struct {
+		name     string
+		offer    Offer
+		expOffer Offer
+	}{
+		{
+			name:     "Create sell offer",
+			offer:    CreateSellOffer(10, 7),
+			expOffer: Offer{Code: "SELL", Offer: 10, Demand: 7},
+		},
+		{
+			name:     "Create buy offer",
+			offer:    CreateBuyOffer(2, 10, 12),
+			expOffer: Offer{Code: "BUY", Offer: 12, Demand: 10, Item: 2},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expOffer, c.offer)
+		})
+	}
+}
+
+func TestCreateBuyAnswer(t *testing.T) {
+	assert.Equal(t, Answer{Code: "ACCEPT", Value: 10, Price: 12}, CreateBuyAnswer(10, 12))
+}
@@ -0,0 +1,118 @@
+package messages
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+ReasonCode is a machine-readable code for the reason an offer was not accepted.
+*/
+type ReasonCode string
+
+const (
+	// ReasonMalformedOffer means that the offer could not be decoded.
+	ReasonMalformedOffer ReasonCode = "MALFORMED_OFFER"
+	// ReasonUnsupportedCode means that the code of the offer is unknown, or not enabled on the pawn shop.
+	ReasonUnsupportedCode ReasonCode = "UNSUPPORTED_CODE"
+	// ReasonInvalidOffer means that the offer failed validation, e.g. because it is not greater than its demand.
+	ReasonInvalidOffer ReasonCode = "INVALID_OFFER"
+	// ReasonNoMatchingItem means that no item in the inventory is worth at least the demand.
+	ReasonNoMatchingItem ReasonCode = "NO_MATCHING_ITEM"
+	// ReasonNotProfitable means that the offer is not worth more than the item that would be given up for it.
+	ReasonNotProfitable ReasonCode = "NOT_PROFITABLE"
+	// ReasonPriceNotMet means that the price of a SELL or BUY offer, or the repayment of a REDEEM offer, is not acceptable.
+	ReasonPriceNotMet ReasonCode = "PRICE_NOT_MET"
+	// ReasonUnknownItem means that the item of a BUY offer is not in the inventory, or has moved to another index.
+	ReasonUnknownItem ReasonCode = "UNKNOWN_ITEM"
+	// ReasonItemUnavailable means that the item of a BUY offer can not be sold, e.g. because it is pledged.
+	ReasonItemUnavailable ReasonCode = "ITEM_UNAVAILABLE"
+	// ReasonUnknownLoan means that the loan of a REDEEM offer does not exist, or has already been closed.
+	ReasonUnknownLoan ReasonCode = "UNKNOWN_LOAN"
+	// ReasonLoanDue means that the loan of a REDEEM offer is due, so its pledge has been forfeited.
+	ReasonLoanDue ReasonCode = "LOAN_DUE"
+	// ReasonNotLoanOwner means that the loan of a REDEEM offer was taken out by another client.
+	ReasonNotLoanOwner ReasonCode = "NOT_LOAN_OWNER"
+	// ReasonUnknownQuote means that the quote of an offer does not exist, has expired or was made for another client.
+	ReasonUnknownQuote ReasonCode = "UNKNOWN_QUOTE"
+	// ReasonUnknownCounter means that there is no counter-offer to accept in the session.
+	ReasonUnknownCounter ReasonCode = "UNKNOWN_COUNTER"
+	// ReasonRateLimited means that the client made offers faster than its rate limit allows.
+	ReasonRateLimited ReasonCode = "RATE_LIMITED"
+	// ReasonTooManyConnections means that the client, or all clients together, have too many open connections.
+	ReasonTooManyConnections ReasonCode = "TOO_MANY_CONNECTIONS"
+	// ReasonQuotaExceeded means that the client has used up its daily quota of accepted offers.
+	ReasonQuotaExceeded ReasonCode = "QUOTA_EXCEEDED"
+	// ReasonServerBusy means that the server has no capacity to handle the connection. It may be opened again later.
+	ReasonServerBusy ReasonCode = "SERVER_BUSY"
+	// ReasonFrameTooLarge means that the frame of the offer is larger than the maximum frame size.
+	ReasonFrameTooLarge ReasonCode = "FRAME_TOO_LARGE"
+	// ReasonTruncatedFrame means that the connection was closed in the middle of the frame of the offer.
+	ReasonTruncatedFrame ReasonCode = "TRUNCATED_FRAME"
+	// ReasonInternalError means that the pawn shop failed to handle the offer. The offer may be sent again.
+	ReasonInternalError ReasonCode = "INTERNAL_ERROR"
+)
+
+/*
+Reason is a struct that represents the reason an offer was not accepted.
+*/
+type Reason struct {
+	Code    ReasonCode `json:"code"`
+	Message string     `json:"message"`
+	// Rule is the ID of the validation rule that rejected the offer, if the reason is INVALID_OFFER.
+	Rule string `json:"rule,omitempty"`
+}
+
+/*
+Error is an error with a reason code, whose message is returned to the client as the reason of the answer.
+Errors that are not an Error are internal errors, whose message is not returned to the client.
+*/
+type Error struct {
+	Code ReasonCode
+	Err  error
+	// Rule is the ID of the validation rule that returned the error, if any.
+	Rule string
+}
+
+/*
+Creates a new Error with the given reason code, wrapping err.
+*/
+func NewError(code ReasonCode, err error) *Error {
+	return &Error{
+		Code: code,
+		Err:  err,
+	}
+}
+
+/*
+Creates a new Error with the given reason code, and a message formatted like fmt.Errorf.
+*/
+func Errorf(code ReasonCode, format string, a ...any) *Error {
+	return NewError(code, fmt.Errorf(format, a...))
+}
+
+/*
+Returns the message of the wrapped error.
+*/
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+/*
+Returns the wrapped error.
+*/
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+/*
+Returns the reason for err. If err is not an Error, the reason is an internal error.
+*/
+func ReasonFor(err error) Reason {
+	var e *Error
+	if errors.As(err, &e) {
+		return Reason{Code: e.Code, Message: err.Error(), Rule: e.Rule}
+	}
+
+	return Reason{Code: ReasonInternalError, Message: "internal error"}
+}
@@ -0,0 +1,546 @@
+// Package metrics implements counters, gauges and histograms that are exposed in the Prometheus text format,
+// so that they can be scraped by Prometheus and compatible monitoring systems.
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentType is the content type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// namePattern is the pattern that the names of metrics and labels must match.
+var namePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+/*
+Metric is an interface for a metric that can be written in the Prometheus text format.
+*/
+type Metric interface {
+	// Name returns the name of the metric.
+	Name() string
+	// write writes the samples of the metric, without its HELP and TYPE lines.
+	write(w io.Writer) error
+	// describe returns the help text and the type of the metric.
+	describe() (help, typ string)
+	// validate returns an error if the metric is invalid, e.g. because of an invalid label name.
+	validate() error
+}
+
+/*
+Registry is a set of metrics that are written together, in the order they were registered. It is thread-safe.
+*/
+type Registry struct {
+	metrics []Metric
+	names   map[string]bool
+	// hooks are called before the metrics are written, e.g. to update gauges that are expensive to keep current
+	hooks []func()
+	lock  sync.Mutex
+}
+
+/*
+Creates a new empty Registry.
+*/
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+/*
+Registers metrics with the registry. Returns an error if a metric is invalid, e.g. because of an invalid name,
+or its name is already registered, in which case none of the metrics are registered.
+*/
+func (r *Registry) Register(metrics ...Metric) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := make(map[string]bool, len(metrics))
+	for _, m := range metrics {
+		if !namePattern.MatchString(m.Name()) {
+			return fmt.Errorf("invalid metric name %q", m.Name())
+		}
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("invalid metric %q: %w", m.Name(), err)
+		}
+		if r.names[m.Name()] || names[m.Name()] {
+			return fmt.Errorf("metric %q is already registered", m.Name())
+		}
+		names[m.Name()] = true
+	}
+
+	for _, m := range metrics {
+		r.names[m.Name()] = true
+	}
+	r.metrics = append(r.metrics, metrics...)
+	return nil
+}
+
+/*
+Registers a hook that is called every time before the metrics are written.
+*/
+func (r *Registry) OnScrape(hook func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.hooks = append(r.hooks, hook)
+}
+
+/*
+Writes all metrics in the Prometheus text format.
+*/
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	metrics := r.metrics
+	hooks := r.hooks
+	r.lock.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		help, typ := m.describe()
+		if _, err := fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.Name(), escapeHelp(help), m.Name(), typ); err != nil {
+			return err
+		}
+		if err := m.write(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+/*
+Returns an HTTP handler that serves the metrics in the Prometheus text format.
+*/
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", ContentType)
+		// The client may have gone away, in which case there is nobody to report the error to
+		_ = r.Write(w)
+	})
+}
+
+/*
+desc is the name, help text and label names of a metric.
+*/
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+/*
+Returns the name of the metric.
+*/
+func (d desc) Name() string {
+	return d.name
+}
+
+/*
+Returns the labels of a series of the metric with the given label values, in the Prometheus text format.
+Extra labels, e.g. the bucket of a histogram, are added at the end.
+*/
+func (d desc) formatLabels(values []string, extra ...string) string {
+	if len(d.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(d.labels)+len(extra)/2)
+	for i, l := range d.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+/*
+Returns an error if the label names are invalid.
+*/
+func (d desc) validate() error {
+	for _, l := range d.labels {
+		if !namePattern.MatchString(l) || strings.HasPrefix(l, "__") || l == "le" {
+			return fmt.Errorf("invalid label name %q", l)
+		}
+	}
+	return nil
+}
+
+/*
+Counter is a metric whose series only ever increase, e.g. the number of offers received, one series per
+combination of label values.
+*/
+type Counter struct {
+	desc
+	series *seriesMap
+}
+
+/*
+Creates a new Counter with the given name, help text and label names.
+*/
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{desc: desc{name: name, help: help, labels: labels}, series: newSeriesMap()}
+}
+
+/*
+Increments the series with the given label values by 1.
+*/
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+/*
+Increments the series with the given label values by v, which must not be negative.
+Missing label values are empty, and extra label values are ignored.
+*/
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	c.series.add(c.labelValues(values), v)
+}
+
+/*
+Returns the value of the series with the given label values.
+*/
+func (c *Counter) Value(values ...string) float64 {
+	return c.series.get(c.labelValues(values))
+}
+
+/*
+Returns exactly one label value per label name.
+*/
+func (d desc) labelValues(values []string) []string {
+	out := make([]string, len(d.labels))
+	copy(out, values)
+	return out
+}
+
+/*
+Returns the help text and type of the counter.
+*/
+func (c *Counter) describe() (string, string) {
+	return c.help, "counter"
+}
+
+/*
+Writes the samples of the counter.
+*/
+func (c *Counter) write(w io.Writer) error {
+	return c.series.write(w, c.name, c.desc)
+}
+
+/*
+Gauge is a metric whose series can go up and down, e.g. the number of open connections, one series per
+combination of label values.
+*/
+type Gauge struct {
+	desc
+	series *seriesMap
+}
+
+/*
+Creates a new Gauge with the given name, help text and label names.
+*/
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{desc: desc{name: name, help: help, labels: labels}, series: newSeriesMap()}
+}
+
+/*
+Sets the series with the given label values to v.
+*/
+func (g *Gauge) Set(v float64, values ...string) {
+	g.series.set(g.labelValues(values), v)
+}
+
+/*
+Adds v, which may be negative, to the series with the given label values.
+*/
+func (g *Gauge) Add(v float64, values ...string) {
+	g.series.add(g.labelValues(values), v)
+}
+
+/*
+Returns the value of the series with the given label values.
+*/
+func (g *Gauge) Value(values ...string) float64 {
+	return g.series.get(g.labelValues(values))
+}
+
+/*
+Returns the help text and type of the gauge.
+*/
+func (g *Gauge) describe() (string, string) {
+	return g.help, "gauge"
+}
+
+/*
+Writes the samples of the gauge.
+*/
+func (g *Gauge) write(w io.Writer) error {
+	return g.series.write(w, g.name, g.desc)
+}
+
+/*
+seriesMap holds the values of the series of a counter or gauge by their label values. It is thread-safe.
+*/
+type seriesMap struct {
+	values map[string]*series
+	lock   sync.Mutex
+}
+
+/*
+series is the value of a series together with its label values.
+*/
+type series struct {
+	labels []string
+	value  float64
+}
+
+/*
+Creates a new seriesMap without series.
+*/
+func newSeriesMap() *seriesMap {
+	return &seriesMap{values: make(map[string]*series)}
+}
+
+/*
+Returns the value of the series with the given label values, or 0 if it does not exist.
+*/
+func (s *seriesMap) get(labels []string) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if v, ok := s.values[seriesKey(labels)]; ok {
+		return v.value
+	}
+	return 0
+}
+
+/*
+Adds v to the series with the given label values.
+*/
+func (s *seriesMap) add(labels []string, v float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lookup(labels).value += v
+}
+
+/*
+Sets the series with the given label values to v.
+*/
+func (s *seriesMap) set(labels []string, v float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lookup(labels).value = v
+}
+
+/*
+Returns the series with the given label values, creating it if it does not exist. It is NOT thread-safe.
+*/
+func (s *seriesMap) lookup(labels []string) *series {
+	key := seriesKey(labels)
+	v, ok := s.values[key]
+	if !ok {
+		v = &series{labels: labels}
+		s.values[key] = v
+	}
+	return v
+}
+
+/*
+Writes all series, ordered by their label values so that the output is stable. A metric without labels
+always has a single series, even if it was never changed.
+*/
+func (s *seriesMap) write(w io.Writer, name string, d desc) error {
+	s.lock.Lock()
+	all := make([]series, 0, len(s.values))
+	for _, v := range s.values {
+		all = append(all, *v)
+	}
+	s.lock.Unlock()
+
+	if len(all) == 0 && len(d.labels) == 0 {
+		all = append(all, series{})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return seriesKey(all[i].labels) < seriesKey(all[j].labels)
+	})
+
+	for _, v := range all {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", name, d.formatLabels(v.labels), formatValue(v.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Returns the key of a series by its label values.
+*/
+func seriesKey(labels []string) string {
+	return strings.Join(labels, "\xff")
+}
+
+// LatencyBuckets are histogram buckets in seconds for the latency of handling a request, from 100µs to 10s.
+var LatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// LockWaitBuckets are histogram buckets in seconds for the time spent waiting for a lock, from 1µs to 1s.
+var LockWaitBuckets = []float64{0.000001, 0.00001, 0.0001, 0.001, 0.01, 0.1, 1}
+
+/*
+Histogram is a metric that counts observations, e.g. latencies, in buckets. It has no labels.
+*/
+type Histogram struct {
+	desc
+	// bounds are the upper bounds of the buckets, in ascending order, and counts the number of observations
+	// in every bucket, with an extra bucket for observations above the last bound
+	bounds []float64
+	counts []uint64
+	sum    float64
+	lock   sync.Mutex
+}
+
+/*
+Creates a new Histogram with the given name, help text and upper bounds of its buckets, which must be
+in strictly ascending order.
+*/
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return &Histogram{
+		desc:   desc{name: name, help: help},
+		bounds: append([]float64(nil), buckets...),
+		counts: make([]uint64, len(buckets)+1),
+	}
+}
+
+/*
+Returns an error if the buckets of the histogram are not in strictly ascending order.
+*/
+func (h *Histogram) validate() error {
+	if len(h.bounds) == 0 {
+		return errors.New("histogram must have at least 1 bucket")
+	}
+	for i, b := range h.bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) || (i > 0 && b <= h.bounds[i-1]) {
+			return errors.New("histogram buckets must be finite and in strictly ascending order")
+		}
+	}
+	return nil
+}
+
+/*
+Records an observation of v.
+*/
+func (h *Histogram) Observe(v float64) {
+	idx := sort.SearchFloat64s(h.bounds, v)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.counts[idx]++
+	h.sum += v
+}
+
+/*
+Records an observation of a duration in seconds.
+*/
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+/*
+Returns the number of observations, and their sum.
+*/
+func (h *Histogram) Count() (uint64, float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var count uint64
+	for _, c := range h.counts {
+		count += c
+	}
+	return count, h.sum
+}
+
+/*
+Returns the help text and type of the histogram.
+*/
+func (h *Histogram) describe() (string, string) {
+	return h.help, "histogram"
+}
+
+/*
+Writes the samples of the histogram.
+*/
+func (h *Histogram) write(w io.Writer) error {
+	h.lock.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum := h.sum
+	h.lock.Unlock()
+
+	// Buckets are cumulative in the Prometheus text format
+	var cumulative uint64
+	for i, c := range counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = formatValue(h.bounds[i])
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(nil, "le", le), cumulative); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatValue(sum), h.name, cumulative)
+	return err
+}
+
+/*
+Returns a sample value in the Prometheus text format.
+*/
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+/*
+Escapes a help text for the Prometheus text format.
+*/
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+/*
+Escapes a label value for the Prometheus text format.
+*/
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(strings.ToValidUTF8(s, "\uFFFD"))
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	offers := NewCounter("offers_total", "Offers received.", "code")
+	conns := NewGauge("open_connections", "Open connections.")
+	latency := NewHistogram("latency_seconds", "Latency of offers.", []float64{0.1, 1})
+
+	r := NewRegistry()
+	require.NoError(t, r.Register(offers, conns, latency))
+
+	scrapes := 0
+	r.OnScrape(func() {
+		scrapes++
+		conns.Set(3)
+	})
+
+	offers.Inc("PAWN")
+	offers.Add(2, "SELL")
+	offers.Inc("PAWN")
+	offers.Add(-1, "PAWN")
+	latency.Observe(0.05)
+	latency.ObserveDuration(500 * time.Millisecond)
+	latency.Observe(2)
+
+	var b strings.Builder
+	require.NoError(t, r.Write(&b))
+	assert.Equal(t, `# HELP offers_total Offers received.
+# TYPE offers_total counter
+offers_total{code="PAWN"} 2
+offers_total{code="SELL"} 2
+# HELP open_connections Open connections.
+# TYPE open_connections gauge
+open_connections 3
+# HELP latency_seconds Latency of offers.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+`, b.String())
+	assert.Equal(t, 1, scrapes)
+
+	count, sum := latency.Count()
+	assert.Equal(t, uint64(3), count)
+	assert.InDelta(t, 2.55, sum, 1e-9)
+	assert.Equal(t, float64(2), offers.Value("SELL"))
+	assert.Equal(t, float64(0), offers.Value("BUY"))
+}
+
+func TestRegistryRegisterErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		metrics []Metric
+	}{
+		{
+			name:    "Invalid metric name",
+			metrics: []Metric{NewCounter("offers-total", "")},
+		},
+		{
+			name:    "Invalid label name",
+			metrics: []Metric{NewCounter("offers_total", "", "le")},
+		},
+		{
+			name:    "Duplicate metric name",
+			metrics: []Metric{NewCounter("offers_total", ""), NewGauge("offers_total", "")},
+		},
+		{
+			name:    "Histogram without buckets",
+			metrics: []Metric{NewHistogram("latency_seconds", "", nil)},
+		},
+		{
+			name:    "Histogram with unordered buckets",
+			metrics: []Metric{NewHistogram("latency_seconds", "", []float64{1, 0.1})},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := NewRegistry()
+			require.Error(t, r.Register(c.metrics...))
+
+			var b strings.Builder
+			require.NoError(t, r.Write(&b))
+			assert.Empty(t, b.String())
+		})
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	c := NewCounter("offers_total", "Offers with a \\ and\na newline.", "reason")
+	r := NewRegistry()
+	require.NoError(t, r.Register(c))
+	c.Inc("a \"quoted\" \\ reason\n")
+
+	var b strings.Builder
+	require.NoError(t, r.Write(&b))
+	assert.Equal(t, `# HELP offers_total Offers with a \\ and\na newline.
+# TYPE offers_total counter
+offers_total{reason="a \"quoted\" \\ reason\n"} 1
+`, b.String())
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	g := NewGauge("items", "Items.")
+	require.NoError(t, r.Register(g))
+	g.Set(7)
+
+	srv := httptest.NewServer(r.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ContentType, resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "items 7\n")
+
+	resp, err = http.Post(srv.URL, "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
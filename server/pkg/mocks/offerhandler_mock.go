@@ -10,6 +10,7 @@
 package mocks
 
 import (
+	context "context"
 	messages "pawnshop/server/pkg/messages"
 	reflect "reflect"
 
@@ -40,17 +41,17 @@ func (m *MockOfferHandler) EXPECT() *MockOfferHandlerMockRecorder {
 }
 
 // HandleOffer mocks base method.
-func (m *MockOfferHandler) HandleOffer(o messages.Offer) messages.Answer {
+func (m *MockOfferHandler) HandleOffer(ctx context.Context, o messages.Offer) messages.Answer {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "HandleOffer", o)
+	ret := m.ctrl.Call(m, "HandleOffer", ctx, o)
 	ret0, _ := ret[0].(messages.Answer)
 	return ret0
 }
 
 // HandleOffer indicates an expected call of HandleOffer.
-func (mr *MockOfferHandlerMockRecorder) HandleOffer(o any) *gomock.Call {
+func (mr *MockOfferHandlerMockRecorder) HandleOffer(ctx, o any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleOffer", reflect.TypeOf((*MockOfferHandler)(nil).HandleOffer), o)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleOffer", reflect.TypeOf((*MockOfferHandler)(nil).HandleOffer), ctx, o)
 }
 
 // String mocks base method.
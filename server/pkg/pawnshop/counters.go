@@ -0,0 +1,102 @@
+package pawnshop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"pawnshop/server/pkg/logging"
+	"pawnshop/server/pkg/messages"
+)
+
+/*
+counterHandler is an interface for an inventory that can find the offer closest to an offer that it would accept.
+*/
+type counterHandler interface {
+	Counter(o messages.Offer, maxRaise, maxRelax int) (messages.Offer, int, bool)
+}
+
+/*
+Enables counters, so that a PAWN offer that is valid, but rejected by the inventory, gets a counter-offer if
+raising its offer or lowering its demand by at most the margin would make it acceptable. The margin is a fraction
+of the offer or demand, e.g. 0.1 for 10%. The counter-offer can be accepted with an ACCEPT_COUNTER offer in the
+same session. Returns an error if the inventory can not make counter-offers.
+*/
+func (p *PawnShop) EnableCounters(margin float64) error {
+	if margin <= 0 || margin > 1 || math.IsNaN(margin) {
+		return fmt.Errorf("counter margin must be greater than 0 and at most 1, got %v", margin)
+	}
+
+	counters, ok := p.inventory.(counterHandler)
+	if !ok {
+		return errors.New("inventory can not make counter-offers")
+	}
+
+	p.counters = counters
+	p.counterMargin = int64(math.Round(margin * 10000))
+	return nil
+}
+
+/*
+Returns a counter-offer instead of ans, the answer to the offer, if the offer was rejected by the inventory and
+there is a valid counter-offer within the margin. The counter-offer is kept in the session, if there is one.
+*/
+func (p *PawnShop) counter(ctx context.Context, offer messages.Offer, ans messages.Answer) messages.Answer {
+	if ans.Code != messages.RejectCode || ans.Reason == nil {
+		return ans
+	}
+	if ans.Reason.Code != messages.ReasonNoMatchingItem && ans.Reason.Code != messages.ReasonNotProfitable {
+		return ans
+	}
+
+	c, value, ok := p.counters.Counter(offer, p.counterDelta(offer.Offer), p.counterDelta(offer.Demand))
+	if !ok {
+		return ans
+	}
+	if err := p.validator.Validate(ctx, c); err != nil {
+		logging.FromContext(ctx).Debugf("Counter-offer %+v to offer %+v is not valid: %s", c, offer, err)
+		return ans
+	}
+
+	if s, ok := SessionFromContext(ctx); ok {
+		s.setCounter(c)
+	}
+
+	logging.FromContext(ctx).Debugf("Countering offer %+v with %+v", offer, c)
+	return messages.CreateCounterAnswer(value, messages.CounterOffer{Offer: c.Offer, Demand: c.Demand}, ans.Reason)
+}
+
+/*
+Accepts the last counter-offer made in the session, by handling it like a PAWN offer.
+*/
+func (p *PawnShop) acceptCounter(ctx context.Context, offer messages.Offer) messages.Answer {
+	if p.counters == nil {
+		logging.FromContext(ctx).Debugf("Offer %+v can not be handled, as counters are not enabled", offer)
+		return messages.CreateUnsupportedAnswer(offer.Code)
+	}
+
+	var c messages.Offer
+	s, ok := SessionFromContext(ctx)
+	if ok {
+		c, ok = s.takeCounter()
+	}
+	if !ok {
+		logging.FromContext(ctx).Debugf("Offer %+v can not be handled, as there is no counter-offer in the session", offer)
+		return messages.CreateRejectAnswerFor(messages.Errorf(messages.ReasonUnknownCounter, "no counter-offer to accept"))
+	}
+
+	logging.FromContext(ctx).Debugf("Accepting counter-offer %+v", c)
+	return p.handlePawn(ctx, c)
+}
+
+/*
+Returns the most a counter-offer may change value by, which is the margin of the magnitude of value, rounded down.
+*/
+func (p *PawnShop) counterDelta(value int) int {
+	v := int64(value)
+	if v < 0 {
+		v = -v
+	}
+	// Split the multiplication so that it can not overflow
+	return int(v/10000*p.counterMargin + v%10000*p.counterMargin/10000)
+}
@@ -0,0 +1,104 @@
+package pawnshop
+
+import (
+	"context"
+	"pawnshop/server/pkg/inventory"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/mocks"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestEnableCounters(t *testing.T) {
+	cases := []struct {
+		name      string
+		inventory offerHandler
+		margin    float64
+		expError  bool
+	}{
+		{
+			name:      "Margin of 10%",
+			inventory: inventory.NewInventory(2),
+			margin:    0.1,
+		},
+		{
+			name:      "No margin, should return error",
+			inventory: inventory.NewInventory(2),
+			margin:    0,
+			expError:  true,
+		},
+		{
+			name:      "Margin of more than 100%, should return error",
+			inventory: inventory.NewInventory(2),
+			margin:    1.5,
+			expError:  true,
+		},
+		{
+			name:      "Inventory can not make counter-offers, should return error",
+			inventory: mocks.NewMockOfferHandler(gomock.NewController(t)),
+			margin:    0.1,
+			expError:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := NewPawnShop(c.inventory)
+			require.NoError(t, err)
+
+			err = p.EnableCounters(c.margin)
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestHandleOfferCounter(t *testing.T) {
+	inv, err := inventory.NewInventoryFromItems([]int{2, 5, 9})
+	require.NoError(t, err)
+	p, err := NewPawnShop(inv)
+	require.NoError(t, err)
+	require.NoError(t, p.EnableCounters(0.2))
+
+	// Raising the offer by 1 makes it profitable, and the counter-offer can be accepted in the same session
+	ctx := WithSession(context.Background(), NewSession())
+	assert.Equal(t, messages.CreateCounterAnswer(5, messages.CounterOffer{Offer: 6, Demand: 3}, &messages.Reason{
+		Code:    messages.ReasonNotProfitable,
+		Message: "the best item for the demand is worth 5, which is not less than the offer of 5",
+	}), p.HandleOffer(ctx, messages.CreateOffer(5, 3)))
+	assert.Equal(t, messages.CreateAcceptedAnswer(5), p.HandleOffer(ctx, messages.CreateAcceptCounterOffer()))
+	assert.Equal(t, rejectAnswer(messages.ReasonUnknownCounter, "no counter-offer to accept"),
+		p.HandleOffer(ctx, messages.CreateAcceptCounterOffer()))
+
+	// Lowering the demand by 1 makes it acceptable, but without a session, the counter-offer can not be accepted
+	assert.Equal(t, messages.CreateCounterAnswer(9, messages.CounterOffer{Offer: 20, Demand: 9}, &messages.Reason{
+		Code:    messages.ReasonNoMatchingItem,
+		Message: "no available item is worth at least the demand of 10",
+	}), p.HandleOffer(context.Background(), messages.CreateOffer(20, 10)))
+	assert.Equal(t, rejectAnswer(messages.ReasonUnknownCounter, "no counter-offer to accept"),
+		p.HandleOffer(context.Background(), messages.CreateAcceptCounterOffer()))
+
+	// Invalid offers, and offers that are too far off, are rejected without a counter-offer
+	assert.Equal(t, invalidAnswer(EnsureProfitRuleID, "offer must be greater than demand"),
+		p.HandleOffer(ctx, messages.CreateOffer(3, 20)))
+	assert.Equal(t, rejectAnswer(messages.ReasonNotProfitable, "the best item for the demand is worth 2, which is not less than the offer of 2"),
+		p.HandleOffer(ctx, messages.CreateOffer(2, 1)))
+
+	items, err := inv.Items()
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 6, 9}, items)
+}
+
+func TestHandleOfferCounterNotEnabled(t *testing.T) {
+	p, err := NewPawnShop(inventory.NewInventory(2))
+	require.NoError(t, err)
+
+	assert.Equal(t, messages.CreateUnsupportedAnswer(messages.AcceptCounterCode),
+		p.HandleOffer(WithSession(context.Background(), NewSession()), messages.CreateAcceptCounterOffer()))
+}
@@ -0,0 +1,56 @@
+package pawnshop
+
+import (
+	"context"
+)
+
+/*
+ClientIdentity is the identity of an authenticated client, taken from the certificate
+the client presented when connecting with mutual TLS.
+*/
+type ClientIdentity struct {
+	// CommonName is the common name of the subject of the client certificate.
+	CommonName string
+	// SerialNumber is the serial number of the client certificate in decimal.
+	SerialNumber string
+	// Fingerprint is the hex encoded SHA-256 fingerprint of the client certificate.
+	Fingerprint string
+}
+
+/*
+Returns a string representation of the client identity.
+*/
+func (c ClientIdentity) String() string {
+	return c.CommonName + " (" + c.Fingerprint + ")"
+}
+
+/*
+clientIdentityKey is the context key of the client identity.
+*/
+type clientIdentityKey struct{}
+
+/*
+Returns a copy of ctx carrying the given client identity.
+*/
+func WithClientIdentity(ctx context.Context, id ClientIdentity) context.Context {
+	return context.WithValue(ctx, clientIdentityKey{}, id)
+}
+
+/*
+Returns the client identity carried by ctx, and whether ctx carried a client identity at all.
+Offers from clients that did not authenticate with a client certificate carry no identity.
+*/
+func ClientIdentityFromContext(ctx context.Context) (ClientIdentity, bool) {
+	id, ok := ctx.Value(clientIdentityKey{}).(ClientIdentity)
+	return id, ok
+}
+
+/*
+Returns the owner of loans and quotes of the client of ctx, which is empty if the client did not authenticate.
+*/
+func clientOwner(ctx context.Context) string {
+	if id, ok := ClientIdentityFromContext(ctx); ok {
+		return id.Fingerprint
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package pawnshop
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIdentityFromContext(t *testing.T) {
+	id := ClientIdentity{
+		CommonName:   "client",
+		SerialNumber: "1",
+		Fingerprint:  "ab",
+	}
+
+	cases := []struct {
+		name  string
+		ctx   context.Context
+		expID ClientIdentity
+		expOK bool
+	}{
+		{
+			name:  "context with identity",
+			ctx:   WithClientIdentity(context.Background(), id),
+			expID: id,
+			expOK: true,
+		},
+		{
+			name:  "context without identity",
+			ctx:   context.Background(),
+			expOK: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			id, ok := ClientIdentityFromContext(c.ctx)
+			require.Equal(t, c.expOK, ok)
+			require.Equal(t, c.expID, id)
+		})
+	}
+}
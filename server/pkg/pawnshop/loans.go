@@ -0,0 +1,146 @@
+package pawnshop
+
+import (
+	"context"
+	"errors"
+	"pawnshop/server/pkg/inventory"
+	"pawnshop/server/pkg/loans"
+	"pawnshop/server/pkg/logging"
+	"pawnshop/server/pkg/messages"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+pledgeHandler is an interface for an inventory that can hold offered items as pledges for loans.
+*/
+type pledgeHandler interface {
+	Pledge(ctx context.Context, o messages.Offer) (messages.Answer, uint64)
+	Redeem(id uint64, repayment int) (int, error)
+	Forfeit(id uint64) (int, error)
+}
+
+/*
+Enables loans, so that every accepted PAWN offer pledges the offered item as security for a loan in the book,
+instead of swapping it for an item of the inventory. Returns an error if the inventory can not hold pledges.
+*/
+func (p *PawnShop) EnableLoans(book *loans.Book) error {
+	if book == nil {
+		return errors.New("loan book can not be nil")
+	}
+
+	pledges, ok := p.inventory.(pledgeHandler)
+	if !ok {
+		return errors.New("inventory can not hold pledges")
+	}
+
+	p.loans = book
+	p.pledges = pledges
+	return nil
+}
+
+/*
+Pawns the offered item by pledging it, and lends the value of the item given up for it as the principal
+of a new loan. The offer must already be validated.
+*/
+func (p *PawnShop) pawn(ctx context.Context, offer messages.Offer) messages.Answer {
+	ans, pledgeID := p.pledges.Pledge(ctx, offer)
+	if ans.Code != messages.AcceptCode {
+		return ans
+	}
+
+	return p.lend(ctx, offer, pledgeID, ans.Value)
+}
+
+/*
+Lends the principal against the pledged item of the offer, and returns the answer with the terms of the loan.
+*/
+func (p *PawnShop) lend(ctx context.Context, offer messages.Offer, pledgeID uint64, principal int) messages.Answer {
+	l, err := p.loans.Open(pledgeID, offer.Offer, principal, clientOwner(ctx))
+	if errors.Is(err, loans.ErrLoanOutOfRange) {
+		// The loan is refused, so the pawn is undone by giving back the pledge for the item given up for it
+		logging.FromContext(ctx).Debugf("Refusing loan for offer %+v: %s", offer, err)
+		if _, err = p.pledges.Redeem(pledgeID, principal); err == nil {
+			return messages.CreateRejectAnswerFor(messages.NewError(messages.ReasonInvalidOffer, loans.ErrLoanOutOfRange))
+		}
+		logging.FromContext(ctx).Errorf("Failed to undo pledge %d: %s", pledgeID, err)
+	}
+	if err != nil {
+		// Without a loan the pledge can never be redeemed, so it is forfeited right away
+		logging.FromContext(ctx).Errorf("Failed to open loan for offer %+v, forfeiting the pledge: %s", offer, err)
+		if _, err = p.pledges.Forfeit(pledgeID); err != nil {
+			logging.FromContext(ctx).Errorf("Failed to forfeit pledge %d: %s", pledgeID, err)
+		}
+		return messages.CreateAcceptedAnswer(principal)
+	}
+
+	logging.FromContext(ctx).Debugf("Opened loan %s of %d against a pledge of %d, due %s", l.ID, l.Principal, l.Pledge, l.Due)
+	return messages.CreateLoanAnswer(messages.LoanTerms{
+		ID:        l.ID,
+		Principal: l.Principal,
+		Repayment: l.Repayment(),
+		Due:       l.Due,
+	})
+}
+
+/*
+Redeems the loan of a REDEEM offer with the offered repayment, and gives back the pledged item.
+*/
+func (p *PawnShop) redeem(ctx context.Context, offer messages.Offer) messages.Answer {
+	if p.loans == nil {
+		logging.FromContext(ctx).Debugf("Offer %+v can not be handled, as loans are not enabled", offer)
+		return messages.CreateUnsupportedAnswer(offer.Code)
+	}
+
+	var value int
+	l, err := p.loans.Redeem(offer.Loan, offer.Offer, clientOwner(ctx), func(l loans.Loan) error {
+		var err error
+		value, err = p.pledges.Redeem(l.PledgeID, offer.Offer)
+		return err
+	})
+	if err != nil {
+		logging.FromContext(ctx).Debugf("Loan of offer %+v can not be redeemed: %s", offer, err)
+		return messages.CreateRejectAnswerFor(loanError(err))
+	}
+
+	logging.FromContext(ctx).Debugf("Redeemed loan %s with a repayment of %d", l.ID, offer.Offer)
+	return messages.CreateAcceptedAnswer(value)
+}
+
+/*
+Forfeits the pledges of all loans that are due, so that they can be given up for offers.
+*/
+func (p *PawnShop) forfeitDueLoans() {
+	forfeited, err := p.loans.ForfeitDue(func(l loans.Loan) error {
+		_, err := p.pledges.Forfeit(l.PledgeID)
+		if errors.Is(err, inventory.ErrUnknownPledge) {
+			// The pledge is gone, e.g. because the loan was redeemed concurrently
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		log.Errorf("Failed to forfeit due loans: %s", err)
+	}
+
+	for _, l := range forfeited {
+		log.Infof("Loan %s was not repaid by %s, forfeited pledge of %d", l.ID, l.Due, l.Pledge)
+	}
+}
+
+/*
+Returns err with the reason code of the loan error it wraps, if any.
+*/
+func loanError(err error) error {
+	switch {
+	case errors.Is(err, loans.ErrUnknownLoan):
+		return messages.NewError(messages.ReasonUnknownLoan, err)
+	case errors.Is(err, loans.ErrLoanDue):
+		return messages.NewError(messages.ReasonLoanDue, err)
+	case errors.Is(err, loans.ErrInsufficientRepayment):
+		return messages.NewError(messages.ReasonPriceNotMet, err)
+	case errors.Is(err, loans.ErrNotOwner):
+		return messages.NewError(messages.ReasonNotLoanOwner, err)
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package pawnshop
+
+import (
+	"context"
+	"math"
+	"pawnshop/server/pkg/inventory"
+	"pawnshop/server/pkg/loans"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/mocks"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestEnableLoans(t *testing.T) {
+	book, err := loans.NewBook(loans.SystemClock{}, time.Hour, 0.1)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name      string
+		inventory offerHandler
+		book      *loans.Book
+		expError  bool
+	}{
+		{
+			name:      "Inventory can hold pledges",
+			inventory: inventory.NewInventory(2),
+			book:      book,
+		},
+		{
+			name:      "Inventory can not hold pledges, should return error",
+			inventory: mocks.NewMockOfferHandler(gomock.NewController(t)),
+			book:      book,
+			expError:  true,
+		},
+		{
+			name:      "No book, should return error",
+			inventory: inventory.NewInventory(2),
+			expError:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := NewPawnShop(c.inventory)
+			require.NoError(t, err)
+
+			err = p.EnableLoans(c.book)
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestHandleOfferLoans(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	book, err := loans.NewBook(clock, time.Hour, 0.5)
+	require.NoError(t, err)
+
+	inv, err := inventory.NewInventoryFromItems([]int{2, 4})
+	require.NoError(t, err)
+	p, err := NewPawnShop(inv)
+	require.NoError(t, err)
+	require.NoError(t, p.EnableLoans(book))
+
+	// Pawning lends the item given up for the offer, with interest
+	ans := p.HandleOffer(context.Background(), messages.CreateOffer(6, 3))
+	require.NotNil(t, ans.Loan)
+	assert.Equal(t, messages.CreateLoanAnswer(messages.LoanTerms{
+		ID:        ans.Loan.ID,
+		Principal: 4,
+		Repayment: 6,
+		Due:       clock.now.Add(time.Hour),
+	}), ans)
+
+	// Invalid offers are still rejected
+	assert.Equal(t, invalidAnswer(EnsureProfitRuleID, "offer must be greater than demand"), p.HandleOffer(context.Background(), messages.CreateOffer(3, 3)))
+
+	// Loans taken out by an authenticated client can only be redeemed by that client
+	owned := p.HandleOffer(WithClientIdentity(context.Background(), ClientIdentity{Fingerprint: "a"}), messages.CreateOffer(3, 1))
+	require.NotNil(t, owned.Loan)
+	assert.Equal(t, rejectAnswer(messages.ReasonNotLoanOwner, "loan was taken out by another client"), p.HandleOffer(
+		WithClientIdentity(context.Background(), ClientIdentity{Fingerprint: "b"}), messages.CreateRedeemOffer(owned.Loan.ID, 3)))
+	assert.Equal(t, messages.CreateAcceptedAnswer(3), p.HandleOffer(
+		WithClientIdentity(context.Background(), ClientIdentity{Fingerprint: "a"}), messages.CreateRedeemOffer(owned.Loan.ID, 3)))
+
+	// Redeeming requires the full repayment, and gives back the pledged item
+	assert.Equal(t, rejectAnswer(messages.ReasonPriceNotMet, "repayment is less than principal and interest"),
+		p.HandleOffer(context.Background(), messages.CreateRedeemOffer(ans.Loan.ID, 5)))
+	assert.Equal(t, messages.CreateAcceptedAnswer(6), p.HandleOffer(context.Background(), messages.CreateRedeemOffer(ans.Loan.ID, 6)))
+	assert.Equal(t, rejectAnswer(messages.ReasonUnknownLoan, "unknown loan"),
+		p.HandleOffer(context.Background(), messages.CreateRedeemOffer(ans.Loan.ID, 6)))
+
+	items, err := inv.Items()
+	require.NoError(t, err)
+	assert.Equal(t, []int{3, 6}, items)
+
+	// Once a loan is due, it can not be redeemed, and its pledge is forfeited
+	due := p.HandleOffer(context.Background(), messages.CreateOffer(7, 5))
+	require.NotNil(t, due.Loan)
+	assert.Equal(t, rejectAnswer(messages.ReasonNoMatchingItem, "no available item is worth at least the demand of 6"),
+		p.HandleOffer(context.Background(), messages.CreateOffer(8, 6)))
+
+	clock.now = clock.now.Add(time.Hour)
+	assert.Equal(t, rejectAnswer(messages.ReasonUnknownLoan, "unknown loan"),
+		p.HandleOffer(context.Background(), messages.CreateRedeemOffer(due.Loan.ID, 9)))
+	assert.Equal(t, 0, book.Len())
+
+	ans = p.HandleOffer(context.Background(), messages.CreateOffer(8, 6))
+	require.NotNil(t, ans.Loan)
+	assert.Equal(t, 7, ans.Value)
+}
+
+func TestHandleOfferLoanOutOfRange(t *testing.T) {
+	book, err := loans.NewBook(loans.SystemClock{}, time.Hour, 1)
+	require.NoError(t, err)
+
+	inv, err := inventory.NewInventoryFromItems([]int{1 << 62, 1})
+	require.NoError(t, err)
+	p, err := NewPawnShop(inv)
+	require.NoError(t, err)
+	require.NoError(t, p.EnableLoans(book))
+
+	// The repayment of the loan would overflow, so the offer is rejected and the pawn undone
+	assert.Equal(t, rejectAnswer(messages.ReasonInvalidOffer, "interest or repayment of loan is out of range"),
+		p.HandleOffer(context.Background(), messages.CreateOffer(math.MaxInt, 1<<62)))
+	assert.Equal(t, 0, book.Len())
+
+	items, err := inv.Items()
+	require.NoError(t, err)
+	assert.Equal(t, []int{1 << 62, 1}, items)
+
+	// The item can still be pawned for a loan that fits
+	ans := p.HandleOffer(context.Background(), messages.CreateOffer(math.MaxInt, 1))
+	require.NotNil(t, ans.Loan)
+	assert.Equal(t, 2, ans.Loan.Repayment)
+}
+
+func TestHandleOfferRedeemWithoutLoans(t *testing.T) {
+	p, err := NewPawnShop(inventory.NewInventory(2))
+	require.NoError(t, err)
+
+	assert.Equal(t, messages.CreateUnsupportedAnswer(messages.RedeemCode), p.HandleOffer(context.Background(), messages.CreateRedeemOffer("abc", 5)))
+}
+
+/*
+fakeClock is a loans.Clock whose time only changes when it is set.
+*/
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
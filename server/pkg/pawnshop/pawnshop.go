@@ -1,10 +1,13 @@
 package pawnshop
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"pawnshop/server/pkg/loans"
+	"pawnshop/server/pkg/logging"
 	"pawnshop/server/pkg/messages"
-
-	log "github.com/sirupsen/logrus"
+	"pawnshop/server/pkg/tracing"
 )
 
 /*
@@ -12,55 +15,194 @@ offerHandler is an interface for an offerHandler that can handle offers as well
 return a string representation of itself.
 */
 type offerHandler interface {
-	HandleOffer(o messages.Offer) messages.Answer
+	HandleOffer(ctx context.Context, o messages.Offer) messages.Answer
 	fmt.Stringer
 }
 
 /*
-offerValidator is an interface for a validator that can validate offers.
+PawnShop is a pawn shop that handles offers from callers with a backing inventory and offer validator.
+It lends against pledged items if loans are enabled, and buys and sells items if retail is enabled.
+It keeps a book of quotes if quotes have a TTL, and counters rejected offers within a margin
+if counters are enabled.
 */
-type offerValidator interface {
-	validate(o messages.Offer) error
+type PawnShop struct {
+	inventory offerHandler
+	validator Rule
+	// retailValidator validates SELL and BUY offers, whose offer and demand do not mean the same as for PAWN offers
+	retailValidator Rule
+	recorders       []acceptedRecorder
+	clock           loans.Clock
+	loans           *loans.Book
+	pledges         pledgeHandler
+	pricing         PricingPolicy
+	retail          retailHandler
+	quoter          quoteHandler
+	quotes          *quoteBook
+	counters        counterHandler
+	// counterMargin is the margin of counter-offers in basis points
+	counterMargin int64
 }
 
 /*
-PawnShop is a pawn shop that handles offers from callers and has a backing inventory
-and offer validator.
+options are the options of a PawnShop.
 */
-type PawnShop struct {
-	inventory offerHandler
-	validator offerValidator
+type options struct {
+	rules       []Rule
+	retailRules []Rule
+	clock       loans.Clock
+}
+
+/*
+Option is an option of a PawnShop, passed to NewPawnShop.
+*/
+type Option func(o *options)
+
+/*
+Returns an option that validates offers with the given rules, after the EnsureProfitRule.
+May be given multiple times, in which case the rules are checked in the order they were given.
+*/
+func WithRules(rules ...Rule) Option {
+	return func(o *options) {
+		o.rules = append(o.rules, rules...)
+	}
+}
+
+/*
+Returns an option that validates SELL and BUY offers with the given rules. Retail offers are not validated
+with the rules of WithRules or the EnsureProfitRule, as their offer and demand are prices and values, see
+messages.CreateSellOffer and messages.CreateBuyOffer. May be given multiple times, like WithRules.
+*/
+func WithRetailRules(rules ...Rule) Option {
+	return func(o *options) {
+		o.retailRules = append(o.retailRules, rules...)
+	}
+}
+
+/*
+Returns an option that sets the clock of the time offers are handled at, see OfferTimeFromContext.
+Defaults to loans.SystemClock.
+*/
+func WithClock(clock loans.Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
 }
 
 /*
-Creates a new PawnShop with the given inventory and an offer validator.
+Creates a new PawnShop with the given inventory and an offer validator, which validates offers
+with the EnsureProfitRule and the rules of the given options. Retail offers are validated with the retail rules
+of the given options only.
 */
-func NewPawnShop(inv offerHandler) (*PawnShop, error) {
-	val, err := newValidator(
-		&ensureProfitRule{},
-	)
+func NewPawnShop(inv offerHandler, opts ...Option) (*PawnShop, error) {
+	o := options{
+		rules: []Rule{&EnsureProfitRule{}},
+		clock: loans.SystemClock{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.clock == nil {
+		return nil, errors.New("clock can not be nil")
+	}
+
+	val, err := NewValidator(o.rules...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create validator, %w", err)
 	}
+	retailVal, err := NewValidator(o.retailRules...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create retail validator, %w", err)
+	}
 
 	return &PawnShop{
-		inventory: inv,
-		validator: val,
+		inventory:       inv,
+		validator:       val,
+		retailValidator: retailVal,
+		recorders:       append(findRecorders(o.rules), findRecorders(o.retailRules)...),
+		clock:           o.clock,
 	}, nil
 }
 
 /*
 Handles an offer from a client. It checks if the offer is valid and sane,
 and if so, it forwards the offer to the inventory.
+The context carries the identity of the client, if the client authenticated with a certificate,
+and is given the time the offer is handled at for the validation rules, unless it carries one already.
+If loans are enabled, loans that are due are forfeited first, and REDEEM offers redeem loans.
+If retail is enabled, SELL and BUY offers sell items to and buy items from the pawn shop.
+If quotes are enabled, QUOTE offers are answered without changing the inventory, and expired quotes are released first.
+If counters are enabled, rejected PAWN offers get a counter-offer, which ACCEPT_COUNTER offers accept.
+Offers with an unknown code, or a code that is not enabled, get an UNSUPPORTED answer.
+*/
+func (p *PawnShop) HandleOffer(ctx context.Context, offer messages.Offer) (ans messages.Answer) {
+	ctx, span := tracing.Start(ctx, "PawnShop.HandleOffer")
+	defer func() {
+		span.SetAttribute(tracing.DecisionAttribute, ans.Code)
+		span.End()
+		// Quotes do not change the inventory, so they are not counted as accepted offers
+		if ans.Code == messages.AcceptCode && offer.Code != messages.QuoteCode {
+			for _, r := range p.recorders {
+				r.recordAccepted(ctx, offer)
+			}
+		}
+	}()
+
+	if id, ok := ClientIdentityFromContext(ctx); ok {
+		logging.FromContext(ctx).Debugf("Handling offer %+v from client %s", offer, id)
+	}
+	if _, ok := OfferTimeFromContext(ctx); !ok {
+		ctx = WithOfferTime(ctx, p.clock.Now())
+	}
+	// Printing the inventory takes O(n) time and blocks all offers, so it is only done when debugging
+	logging.FromContext(ctx).Debugf("Inventory before handling offer: %s", p.inventory)
+
+	if p.loans != nil {
+		p.forfeitDueLoans()
+	}
+	if p.quotes != nil {
+		p.releaseExpiredQuotes()
+	}
+	switch offer.Code {
+	case messages.RedeemCode:
+		return p.redeem(ctx, offer)
+	case messages.SellCode:
+		return p.sell(ctx, offer)
+	case messages.BuyCode:
+		return p.buy(ctx, offer)
+	case messages.QuoteCode:
+		return p.quote(ctx, offer)
+	case messages.AcceptCounterCode:
+		return p.acceptCounter(ctx, offer)
+	case messages.PawnCode:
+		return p.handlePawn(ctx, offer)
+	default:
+		logging.FromContext(ctx).Debugf("Offer %+v has an unsupported code", offer)
+		return messages.CreateUnsupportedAnswer(offer.Code)
+	}
+}
+
+/*
+Handles a PAWN offer. It checks if the offer is valid and sane, and if so, it forwards the offer to the inventory.
 */
-func (p *PawnShop) HandleOffer(offer messages.Offer) messages.Answer {
-	log.Infof("Inventory before handling offer: %s", p.inventory)
+func (p *PawnShop) handlePawn(ctx context.Context, offer messages.Offer) messages.Answer {
+	if offer.Quote != "" {
+		return p.pawnQuoted(ctx, offer)
+	}
 
-	if err := p.validator.validate(offer); err != nil {
-		log.Debugf("Offer %+v is not valid: %s", offer, err)
-		log.Infof("Inventory after handling offer: %s", p.inventory)
-		return messages.CreateRejectAnswer()
+	if err := p.validate(ctx, offer); err != nil {
+		logging.FromContext(ctx).Debugf("Inventory after handling offer: %s", p.inventory)
+		return messages.CreateRejectAnswerFor(err)
 	}
 
-	return p.inventory.HandleOffer(offer)
+	var ans messages.Answer
+	if p.loans != nil {
+		ans = p.pawn(ctx, offer)
+	} else {
+		ans = p.inventory.HandleOffer(ctx, offer)
+	}
+
+	if p.counters != nil {
+		return p.counter(ctx, offer, ans)
+	}
+	return ans
 }
@@ -1,15 +1,22 @@
 package pawnshop
 
 import (
+	"context"
 	"pawnshop/server/pkg/messages"
 	"pawnshop/server/pkg/mocks"
 	"testing"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
 )
 
 func TestHandleOffer(t *testing.T) {
+	// The inventory is only logged when debugging
+	lvl := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(lvl)
+
 	ctrl := gomock.NewController(t)
 	mockOfferHandler := mocks.NewMockOfferHandler(ctrl)
 
@@ -31,7 +38,7 @@ func TestHandleOffer(t *testing.T) {
 				Value: 1,
 			},
 			expectations: func() {
-				mockOfferHandler.EXPECT().HandleOffer(messages.Offer{
+				mockOfferHandler.EXPECT().HandleOffer(gomock.Any(), messages.Offer{
 					Code:   "PAWN",
 					Offer:  2,
 					Demand: 1,
@@ -49,8 +56,24 @@ func TestHandleOffer(t *testing.T) {
 				Offer:  2,
 				Demand: 5,
 			},
+			expected: invalidAnswer(EnsureProfitRuleID, "offer must be greater than demand"),
+			expectations: func() {
+				mockOfferHandler.EXPECT().String().Return("[]").Times(1) // Used for logging inventory
+			},
+		},
+		{
+			name: "Offer has an unknown code, should return UNSUPPORTED",
+			offer: messages.Offer{
+				Code:   "STEAL",
+				Offer:  2,
+				Demand: 1,
+			},
 			expected: messages.Answer{
-				Code: messages.RejectCode,
+				Code: messages.UnsupportedCode,
+				Reason: &messages.Reason{
+					Code:    messages.ReasonUnsupportedCode,
+					Message: `code "STEAL" is not supported`,
+				},
 			},
 			expectations: func() {
 				mockOfferHandler.EXPECT().String().Return("[]").Times(1) // Used for logging inventory
@@ -64,7 +87,34 @@ func TestHandleOffer(t *testing.T) {
 
 			shop, err := NewPawnShop(mockOfferHandler)
 			require.NoError(t, err)
-			require.Equal(t, c.expected, shop.HandleOffer(c.offer))
+			require.Equal(t, c.expected, shop.HandleOffer(context.Background(), c.offer))
 		})
 	}
 }
+
+/*
+Returns a REJECT answer with the given reason.
+*/
+func rejectAnswer(code messages.ReasonCode, message string) messages.Answer {
+	return messages.Answer{
+		Code: messages.RejectCode,
+		Reason: &messages.Reason{
+			Code:    code,
+			Message: message,
+		},
+	}
+}
+
+/*
+Returns a REJECT answer for an offer that the rule with the given ID did not accept.
+*/
+func invalidAnswer(rule, message string) messages.Answer {
+	return messages.Answer{
+		Code: messages.RejectCode,
+		Reason: &messages.Reason{
+			Code:    messages.ReasonInvalidOffer,
+			Message: message,
+			Rule:    rule,
+		},
+	}
+}
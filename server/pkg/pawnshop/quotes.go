@@ -0,0 +1,257 @@
+package pawnshop
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"pawnshop/server/pkg/loans"
+	"pawnshop/server/pkg/logging"
+	"pawnshop/server/pkg/messages"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+quoteHandler is an interface for an inventory that can quote offers without changing, and reserve items for quotes.
+*/
+type quoteHandler interface {
+	Quote(ctx context.Context, o messages.Offer) messages.Answer
+	Reserve(ctx context.Context, o messages.Offer) (messages.Answer, uint64)
+	Fulfil(id uint64, offer int, pledge bool) (int, error)
+	Release(id uint64) (int, error)
+}
+
+/*
+Enables quotes, so that QUOTE offers are validated and checked by the inventory like PAWN offers, but without
+changing the inventory. If ttl is positive, the item that would be given up for an accepted QUOTE offer is
+reserved for ttl, and the answer carries a token that guarantees the quoted answer to a PAWN offer with the
+same offer and demand until then. Returns an error if the inventory can not quote offers.
+*/
+func (p *PawnShop) EnableQuotes(clock loans.Clock, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("quote TTL can not be negative")
+	}
+	if ttl > 0 && clock == nil {
+		return errors.New("clock can not be nil")
+	}
+
+	quoter, ok := p.inventory.(quoteHandler)
+	if !ok {
+		return errors.New("inventory can not quote offers")
+	}
+
+	p.quoter = quoter
+	if ttl > 0 {
+		p.quotes = newQuoteBook(clock, ttl)
+	}
+	return nil
+}
+
+/*
+Answers a QUOTE offer with the answer the offer would get, without changing the inventory.
+If quotes have a TTL, the item that would be given up is reserved, and the answer carries the quote.
+*/
+func (p *PawnShop) quote(ctx context.Context, offer messages.Offer) messages.Answer {
+	if p.quoter == nil {
+		logging.FromContext(ctx).Debugf("Offer %+v can not be handled, as quotes are not enabled", offer)
+		return messages.CreateUnsupportedAnswer(offer.Code)
+	}
+
+	if err := p.validate(ctx, offer); err != nil {
+		return messages.CreateRejectAnswerFor(err)
+	}
+
+	if p.quotes == nil {
+		return p.quoter.Quote(ctx, offer)
+	}
+
+	ans, id := p.quoter.Reserve(ctx, offer)
+	if ans.Code != messages.AcceptCode {
+		return ans
+	}
+
+	q, err := p.quotes.open(id, offer, clientOwner(ctx))
+	if err != nil {
+		logging.FromContext(ctx).Errorf("Failed to open quote for offer %+v, releasing the reservation: %s", offer, err)
+		p.release(id)
+		return messages.CreateRejectAnswerFor(err)
+	}
+
+	logging.FromContext(ctx).Debugf("Quoted %d for offer %+v, valid until %s", ans.Value, offer, q.expires)
+	return messages.CreateQuoteAnswer(ans.Value, messages.QuoteTerms{
+		Token:   q.token,
+		Expires: q.expires,
+	})
+}
+
+/*
+Answers a PAWN offer carrying the token of a quote as quoted, by giving up the reserved item for it.
+The offer is not validated again, as the quote was validated for the same offer and demand.
+*/
+func (p *PawnShop) pawnQuoted(ctx context.Context, offer messages.Offer) messages.Answer {
+	if p.quotes == nil {
+		logging.FromContext(ctx).Debugf("Offer %+v can not be handled, as quotes have no tokens", offer)
+		return messages.CreateRejectAnswerFor(errUnknownQuote)
+	}
+
+	q, err := p.quotes.take(offer.Quote, offer, clientOwner(ctx))
+	if err != nil {
+		logging.FromContext(ctx).Debugf("Quote of offer %+v can not be used: %s", offer, err)
+		return messages.CreateRejectAnswerFor(err)
+	}
+
+	value, err := p.quoter.Fulfil(q.reservation, offer.Offer, p.loans != nil)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("Failed to fill reservation for offer %+v, releasing it: %s", offer, err)
+		p.release(q.reservation)
+		return messages.CreateRejectAnswerFor(err)
+	}
+
+	if p.loans == nil {
+		return messages.CreateAcceptedAnswer(value)
+	}
+	return p.lend(ctx, offer, q.reservation, value)
+}
+
+/*
+Releases the reservations of all quotes that have expired, so that their items can be given up for offers.
+*/
+func (p *PawnShop) releaseExpiredQuotes() {
+	for _, q := range p.quotes.expire() {
+		log.Debugf("Quote for offer %d and demand %d expired at %s", q.offer, q.demand, q.expires)
+		p.release(q.reservation)
+	}
+}
+
+/*
+Releases a reservation, logging any error.
+*/
+func (p *PawnShop) release(id uint64) {
+	if _, err := p.quoter.Release(id); err != nil {
+		log.Errorf("Failed to release reservation %d: %s", id, err)
+	}
+}
+
+// errUnknownQuote is returned for an offer with a quote that does not exist, has expired or belongs to another client.
+var errUnknownQuote = messages.NewError(messages.ReasonUnknownQuote, errors.New("unknown quote"))
+
+/*
+quote is a quote for an offer, which holds the reservation of the item that was quoted.
+*/
+type quote struct {
+	token       string
+	reservation uint64
+	offer       int
+	demand      int
+	owner       string
+	expires     time.Time
+}
+
+/*
+quoteBook keeps track of all open quotes of a pawn shop. It is safe for concurrent use.
+*/
+type quoteBook struct {
+	clock  loans.Clock
+	ttl    time.Duration
+	quotes map[string]*quote
+	// queue holds the quotes in the order they expire in, as they all live for the same time.
+	// Quotes that have been taken stay in the queue until they expire, but not in quotes.
+	queue []*quote
+	lock  sync.Mutex
+}
+
+/*
+Creates a new quoteBook, whose quotes expire after ttl.
+*/
+func newQuoteBook(clock loans.Clock, ttl time.Duration) *quoteBook {
+	return &quoteBook{
+		clock:  clock,
+		ttl:    ttl,
+		quotes: make(map[string]*quote),
+	}
+}
+
+/*
+Opens a quote for the offer, holding the reservation of the quoted item, for the given owner.
+*/
+func (b *quoteBook) open(reservation uint64, o messages.Offer, owner string) (*quote, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	q := &quote{
+		token:       token,
+		reservation: reservation,
+		offer:       o.Offer,
+		demand:      o.Demand,
+		owner:       owner,
+		expires:     b.clock.Now().Add(b.ttl),
+	}
+	b.quotes[token] = q
+	b.queue = append(b.queue, q)
+
+	return q, nil
+}
+
+/*
+Takes the quote with the given token out of the book, so that its reservation can be filled with the offer.
+Returns an error if the quote does not exist, has expired, belongs to another owner or was made for another offer.
+*/
+func (b *quoteBook) take(token string, o messages.Offer, owner string) (*quote, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	q, ok := b.quotes[token]
+	// Expired quotes are left for expire, which releases their reservations
+	if !ok || q.owner != owner || !b.clock.Now().Before(q.expires) {
+		return nil, errUnknownQuote
+	}
+	if q.offer != o.Offer || q.demand != o.Demand {
+		return nil, messages.Errorf(messages.ReasonInvalidOffer, "quote was made for offer %d and demand %d", q.offer, q.demand)
+	}
+
+	delete(b.quotes, token)
+	return q, nil
+}
+
+/*
+Removes all quotes that have expired from the book, and returns them.
+*/
+func (b *quoteBook) expire() []*quote {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.clock.Now()
+	var expired []*quote
+	n := 0
+	for ; n < len(b.queue) && !now.Before(b.queue[n].expires); n++ {
+		q := b.queue[n]
+		if _, ok := b.quotes[q.token]; ok {
+			delete(b.quotes, q.token)
+			expired = append(expired, q)
+		}
+	}
+	b.queue = b.queue[n:]
+
+	return expired
+}
+
+/*
+Returns a new random quote token.
+*/
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate quote token: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
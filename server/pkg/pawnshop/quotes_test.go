@@ -0,0 +1,175 @@
+package pawnshop
+
+import (
+	"context"
+	"pawnshop/server/pkg/inventory"
+	"pawnshop/server/pkg/loans"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/mocks"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestEnableQuotes(t *testing.T) {
+	cases := []struct {
+		name      string
+		inventory offerHandler
+		clock     loans.Clock
+		ttl       time.Duration
+		expError  bool
+	}{
+		{
+			name:      "Quotes without tokens",
+			inventory: inventory.NewInventory(2),
+		},
+		{
+			name:      "Quotes with tokens",
+			inventory: inventory.NewInventory(2),
+			clock:     loans.SystemClock{},
+			ttl:       time.Minute,
+		},
+		{
+			name:      "Inventory can not quote offers, should return error",
+			inventory: mocks.NewMockOfferHandler(gomock.NewController(t)),
+			expError:  true,
+		},
+		{
+			name:      "Negative TTL, should return error",
+			inventory: inventory.NewInventory(2),
+			clock:     loans.SystemClock{},
+			ttl:       -time.Minute,
+			expError:  true,
+		},
+		{
+			name:      "Tokens without clock, should return error",
+			inventory: inventory.NewInventory(2),
+			ttl:       time.Minute,
+			expError:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := NewPawnShop(c.inventory)
+			require.NoError(t, err)
+
+			err = p.EnableQuotes(c.clock, c.ttl)
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestHandleOfferQuote(t *testing.T) {
+	inv, err := inventory.NewInventoryFromItems([]int{2, 4})
+	require.NoError(t, err)
+	p, err := NewPawnShop(inv)
+	require.NoError(t, err)
+	require.NoError(t, p.EnableQuotes(nil, 0))
+
+	// A quote is validated and answered like an offer, but does not change the inventory
+	assert.Equal(t, messages.CreateAcceptedAnswer(4), p.HandleOffer(context.Background(), messages.CreateQuoteOffer(5, 3)))
+	assert.Equal(t, invalidAnswer(EnsureProfitRuleID, "offer must be greater than demand"),
+		p.HandleOffer(context.Background(), messages.CreateQuoteOffer(3, 3)))
+	assert.Equal(t, rejectAnswer(messages.ReasonNotProfitable, "the best item for the demand is worth 4, which is not less than the offer of 4"),
+		p.HandleOffer(context.Background(), messages.CreateQuoteOffer(4, 3)))
+
+	items, err := inv.Items()
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 4}, items)
+
+	// Without tokens, quotes can not be used to make offers
+	assert.Equal(t, rejectAnswer(messages.ReasonUnknownQuote, "unknown quote"),
+		p.HandleOffer(context.Background(), messages.CreateQuotedOffer("abc", 5, 3)))
+}
+
+func TestHandleOfferQuoteWithToken(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	inv, err := inventory.NewInventoryFromItems([]int{2, 4})
+	require.NoError(t, err)
+	p, err := NewPawnShop(inv)
+	require.NoError(t, err)
+	require.NoError(t, p.EnableQuotes(clock, time.Minute))
+
+	// The quoted item is reserved, so it is not given up for other offers
+	ans := p.HandleOffer(context.Background(), messages.CreateQuoteOffer(5, 3))
+	require.NotNil(t, ans.Quote)
+	assert.Equal(t, messages.CreateQuoteAnswer(4, messages.QuoteTerms{
+		Token:   ans.Quote.Token,
+		Expires: clock.now.Add(time.Minute),
+	}), ans)
+	assert.Equal(t, rejectAnswer(messages.ReasonNoMatchingItem, "no available item is worth at least the demand of 3"),
+		p.HandleOffer(context.Background(), messages.CreateOffer(6, 3)))
+
+	// The quote can only be used by the same client, for the quoted offer and demand
+	assert.Equal(t, rejectAnswer(messages.ReasonInvalidOffer, "quote was made for offer 5 and demand 3"),
+		p.HandleOffer(context.Background(), messages.CreateQuotedOffer(ans.Quote.Token, 6, 3)))
+	assert.Equal(t, rejectAnswer(messages.ReasonUnknownQuote, "unknown quote"), p.HandleOffer(
+		WithClientIdentity(context.Background(), ClientIdentity{Fingerprint: "a"}), messages.CreateQuotedOffer(ans.Quote.Token, 5, 3)))
+	assert.Equal(t, messages.CreateAcceptedAnswer(4), p.HandleOffer(context.Background(), messages.CreateQuotedOffer(ans.Quote.Token, 5, 3)))
+	assert.Equal(t, rejectAnswer(messages.ReasonUnknownQuote, "unknown quote"),
+		p.HandleOffer(context.Background(), messages.CreateQuotedOffer(ans.Quote.Token, 5, 3)))
+
+	// Once a quote has expired, it can not be used, and the quoted item can be given up for offers again
+	expired := p.HandleOffer(context.Background(), messages.CreateQuoteOffer(6, 5))
+	require.NotNil(t, expired.Quote)
+	assert.Equal(t, 5, expired.Value)
+
+	clock.now = clock.now.Add(time.Minute)
+	assert.Equal(t, rejectAnswer(messages.ReasonUnknownQuote, "unknown quote"),
+		p.HandleOffer(context.Background(), messages.CreateQuotedOffer(expired.Quote.Token, 6, 5)))
+	assert.Equal(t, messages.CreateAcceptedAnswer(5), p.HandleOffer(context.Background(), messages.CreateOffer(6, 5)))
+
+	items, err := inv.Items()
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 6}, items)
+}
+
+func TestHandleOfferQuoteWithLoans(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	book, err := loans.NewBook(clock, time.Hour, 0.5)
+	require.NoError(t, err)
+
+	inv, err := inventory.NewInventoryFromItems([]int{2, 4})
+	require.NoError(t, err)
+	p, err := NewPawnShop(inv)
+	require.NoError(t, err)
+	require.NoError(t, p.EnableLoans(book))
+	require.NoError(t, p.EnableQuotes(clock, time.Minute))
+
+	// A quoted offer pledges the offered item, just like an offer without a quote
+	quoted := p.HandleOffer(context.Background(), messages.CreateQuoteOffer(6, 3))
+	require.NotNil(t, quoted.Quote)
+	assert.Equal(t, 4, quoted.Value)
+
+	ans := p.HandleOffer(context.Background(), messages.CreateQuotedOffer(quoted.Quote.Token, 6, 3))
+	require.NotNil(t, ans.Loan)
+	assert.Equal(t, messages.CreateLoanAnswer(messages.LoanTerms{
+		ID:        ans.Loan.ID,
+		Principal: 4,
+		Repayment: 6,
+		Due:       clock.now.Add(time.Hour),
+	}), ans)
+	assert.Equal(t, rejectAnswer(messages.ReasonNoMatchingItem, "no available item is worth at least the demand of 3"),
+		p.HandleOffer(context.Background(), messages.CreateOffer(7, 3)))
+
+	assert.Equal(t, messages.CreateAcceptedAnswer(6), p.HandleOffer(context.Background(), messages.CreateRedeemOffer(ans.Loan.ID, 6)))
+
+	items, err := inv.Items()
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 6}, items)
+}
+
+func TestHandleOfferQuoteNotEnabled(t *testing.T) {
+	p, err := NewPawnShop(inventory.NewInventory(2))
+	require.NoError(t, err)
+
+	assert.Equal(t, messages.CreateUnsupportedAnswer(messages.QuoteCode), p.HandleOffer(context.Background(), messages.CreateQuoteOffer(5, 1)))
+}
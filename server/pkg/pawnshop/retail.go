@@ -0,0 +1,178 @@
+package pawnshop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"pawnshop/server/pkg/logging"
+	"pawnshop/server/pkg/messages"
+)
+
+/*
+retailHandler is an interface for an inventory that items can be added to and removed from.
+*/
+type retailHandler interface {
+	Add(value int) (int, error)
+	Remove(idx int, check func(value int) error) (int, error)
+}
+
+/*
+PricingPolicy decides the prices the pawn shop buys and sells items for.
+*/
+type PricingPolicy interface {
+	// BuyPrice returns the price the pawn shop pays for an item with value, or an error if it can not be represented.
+	BuyPrice(value int) (int, error)
+	// SellPrice returns the price the pawn shop sells an item with value for, or an error if it can not be represented.
+	SellPrice(value int) (int, error)
+}
+
+/*
+MarginPricing is a PricingPolicy that buys items below their value and sells items above their value by a margin.
+*/
+type MarginPricing struct {
+	// margin is the margin in basis points, so that prices are calculated exactly
+	margin int64
+}
+
+/*
+Creates a new MarginPricing with the given margin as a fraction of the value of an item, e.g. 0.2 for 20%.
+Items are bought for their value less the margin rounded down, and sold for their value plus the margin rounded up.
+*/
+func NewMarginPricing(margin float64) (*MarginPricing, error) {
+	if margin < 0 || margin >= 1 || math.IsNaN(margin) {
+		return nil, fmt.Errorf("margin must be at least 0 and less than 1, got %v", margin)
+	}
+
+	return &MarginPricing{margin: int64(math.Round(margin * 10000))}, nil
+}
+
+/*
+Returns the value less the margin, rounded down, or an error if the price does not fit in an int.
+*/
+func (m *MarginPricing) BuyPrice(value int) (int, error) {
+	price := new(big.Int).Mul(big.NewInt(int64(value)), big.NewInt(10000-m.margin))
+	// Div rounds down for positive divisors
+	return priceToInt(price.Div(price, big.NewInt(10000)))
+}
+
+/*
+Returns the value plus the margin, rounded up, or an error if the price does not fit in an int.
+*/
+func (m *MarginPricing) SellPrice(value int) (int, error) {
+	price := new(big.Int).Mul(big.NewInt(-int64(value)), big.NewInt(10000+m.margin))
+	price.Div(price, big.NewInt(10000))
+	return priceToInt(price.Neg(price))
+}
+
+/*
+Converts a price to an int, or returns an error if it does not fit in one.
+*/
+func priceToInt(price *big.Int) (int, error) {
+	if !price.IsInt64() || price.Int64() > math.MaxInt || price.Int64() < math.MinInt {
+		return 0, fmt.Errorf("price %s is out of range", price)
+	}
+	return int(price.Int64()), nil
+}
+
+/*
+Enables retail, so that SELL offers sell items to the pawn shop and BUY offers buy items from the pawn shop,
+at the prices decided by the pricing policy. Returns an error if items can not be added to and removed from the inventory.
+*/
+func (p *PawnShop) EnableRetail(pricing PricingPolicy) error {
+	if pricing == nil {
+		return errors.New("pricing policy can not be nil")
+	}
+
+	retail, ok := p.inventory.(retailHandler)
+	if !ok {
+		return errors.New("inventory does not support adding and removing items")
+	}
+
+	p.pricing = pricing
+	p.retail = retail
+	return nil
+}
+
+/*
+Buys the item of a SELL offer from the client for the buying price of the pricing policy, if it is at least
+the demand of the offer, and adds it to the inventory. The offer must be valid by the retail rules,
+and the price positive.
+*/
+func (p *PawnShop) sell(ctx context.Context, offer messages.Offer) messages.Answer {
+	if p.retail == nil {
+		logging.FromContext(ctx).Debugf("Offer %+v can not be handled, as retail is not enabled", offer)
+		return messages.CreateUnsupportedAnswer(offer.Code)
+	}
+	if offer.Offer <= 0 {
+		logging.FromContext(ctx).Debugf("Offer %+v is not valid: only items with a positive value can be sold", offer)
+		return messages.CreateRejectAnswerFor(messages.Errorf(messages.ReasonInvalidOffer, "only items with a positive value can be sold"))
+	}
+
+	if err := p.validate(ctx, offer); err != nil {
+		return messages.CreateRejectAnswerFor(err)
+	}
+
+	price, err := p.pricing.BuyPrice(offer.Offer)
+	if err == nil && price <= 0 {
+		err = fmt.Errorf("price %d is not positive", price)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Debugf("Offer %+v is rejected, it has no valid buying price: %s", offer, err)
+		return messages.CreateRejectAnswerFor(messages.Errorf(messages.ReasonInvalidOffer, "the item has no valid buying price: %s", err))
+	}
+	if price < offer.Demand {
+		logging.FromContext(ctx).Debugf("Offer %+v is rejected, the pawn shop only pays %d", offer, price)
+		return messages.CreateRejectAnswerFor(messages.Errorf(messages.ReasonPriceNotMet, "the pawn shop only pays %d", price))
+	}
+
+	if _, err := p.retail.Add(offer.Offer); err != nil {
+		logging.FromContext(ctx).Errorf("Failed to add item of offer %+v to the inventory: %s", offer, err)
+		return messages.CreateRejectAnswerFor(err)
+	}
+
+	return messages.CreateAcceptedAnswer(price)
+}
+
+/*
+Sells the item of a BUY offer to the client for the selling price of the pricing policy, if it is at most
+the offer, and removes it from the inventory. The item must have the value of the demand, as items move when
+other items are removed. The offer must be valid by the retail rules, and the price positive.
+*/
+func (p *PawnShop) buy(ctx context.Context, offer messages.Offer) messages.Answer {
+	if p.retail == nil {
+		logging.FromContext(ctx).Debugf("Offer %+v can not be handled, as retail is not enabled", offer)
+		return messages.CreateUnsupportedAnswer(offer.Code)
+	}
+
+	if err := p.validate(ctx, offer); err != nil {
+		return messages.CreateRejectAnswerFor(err)
+	}
+
+	var price int
+	value, err := p.retail.Remove(offer.Item, func(value int) error {
+		if value != offer.Demand {
+			return messages.Errorf(messages.ReasonUnknownItem, "item %d has value %d, not %d", offer.Item, value, offer.Demand)
+		}
+
+		var err error
+		price, err = p.pricing.SellPrice(value)
+		if err == nil && price <= 0 {
+			err = fmt.Errorf("price %d is not positive", price)
+		}
+		if err != nil {
+			return messages.Errorf(messages.ReasonInvalidOffer, "the item has no valid selling price: %s", err)
+		}
+		if price > offer.Offer {
+			return messages.Errorf(messages.ReasonPriceNotMet, "item costs %d", price)
+		}
+		return nil
+	})
+	if err != nil {
+		logging.FromContext(ctx).Debugf("Item of offer %+v can not be bought: %s", offer, err)
+		return messages.CreateRejectAnswerFor(err)
+	}
+
+	return messages.CreateBuyAnswer(value, price)
+}
@@ -0,0 +1,271 @@
+package pawnshop
+
+import (
+	"context"
+	"errors"
+	"math"
+	"pawnshop/server/pkg/inventory"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/mocks"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestMarginPricing(t *testing.T) {
+	cases := []struct {
+		name         string
+		margin       float64
+		value        int
+		expBuyPrice  int
+		expSellPrice int
+		expSellError bool
+		expError     bool
+	}{
+		{name: "Exact prices", margin: 0.2, value: 10, expBuyPrice: 8, expSellPrice: 12},
+		{name: "Prices are rounded in favour of the pawn shop", margin: 0.2, value: 7, expBuyPrice: 5, expSellPrice: 9},
+		{name: "Negative values are rounded in favour of the pawn shop", margin: 0.2, value: -7, expBuyPrice: -6, expSellPrice: -8},
+		{name: "No margin", margin: 0, value: 7, expBuyPrice: 7, expSellPrice: 7},
+		{name: "Large values are priced exactly", margin: 0.2, value: 1 << 52, expBuyPrice: 3602879701896396, expSellPrice: 5404319552844596},
+		{name: "Selling price out of range, should return error", margin: 0.2, value: math.MaxInt, expBuyPrice: 7378697629483820645, expSellError: true},
+		{name: "Negative margin, should return error", margin: -0.1, expError: true},
+		{name: "Margin of 100%, should return error", margin: 1, expError: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := NewMarginPricing(c.margin)
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			buyPrice, err := m.BuyPrice(c.value)
+			require.NoError(t, err)
+			assert.Equal(t, c.expBuyPrice, buyPrice)
+
+			sellPrice, err := m.SellPrice(c.value)
+			if c.expSellError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.expSellPrice, sellPrice)
+		})
+	}
+}
+
+func TestEnableRetail(t *testing.T) {
+	pricing, err := NewMarginPricing(0.2)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name      string
+		inventory offerHandler
+		pricing   PricingPolicy
+		expError  bool
+	}{
+		{
+			name:      "Inventory supports retail",
+			inventory: inventory.NewInventory(2),
+			pricing:   pricing,
+		},
+		{
+			name:      "Inventory does not support retail, should return error",
+			inventory: mocks.NewMockOfferHandler(gomock.NewController(t)),
+			pricing:   pricing,
+			expError:  true,
+		},
+		{
+			name:      "No pricing policy, should return error",
+			inventory: inventory.NewInventory(2),
+			expError:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := NewPawnShop(c.inventory)
+			require.NoError(t, err)
+
+			err = p.EnableRetail(c.pricing)
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestHandleOfferRetail(t *testing.T) {
+	cases := []struct {
+		name        string
+		offer       messages.Offer
+		expected    messages.Answer
+		expNewItems []int
+	}{
+		{
+			name:        "Sell for the buying price, should add the item",
+			offer:       messages.CreateSellOffer(10, 8),
+			expected:    messages.CreateAcceptedAnswer(8),
+			expNewItems: []int{5, 1, 10},
+		},
+		{
+			name:        "Sell for more than the buying price, should be rejected",
+			offer:       messages.CreateSellOffer(10, 9),
+			expected:    rejectAnswer(messages.ReasonPriceNotMet, "the pawn shop only pays 8"),
+			expNewItems: []int{5, 1},
+		},
+		{
+			name:        "Sell an item without value, should be rejected",
+			offer:       messages.CreateSellOffer(0, 0),
+			expected:    rejectAnswer(messages.ReasonInvalidOffer, "only items with a positive value can be sold"),
+			expNewItems: []int{5, 1},
+		},
+		{
+			name:        "Buy for the selling price, should remove the item",
+			offer:       messages.CreateBuyOffer(0, 5, 6),
+			expected:    messages.CreateBuyAnswer(5, 6),
+			expNewItems: []int{1},
+		},
+		{
+			name:        "Buy for less than the selling price, should be rejected",
+			offer:       messages.CreateBuyOffer(0, 5, 5),
+			expected:    rejectAnswer(messages.ReasonPriceNotMet, "item costs 6"),
+			expNewItems: []int{5, 1},
+		},
+		{
+			name:        "Buy an unknown item, should be rejected",
+			offer:       messages.CreateBuyOffer(2, 5, 100),
+			expected:    rejectAnswer(messages.ReasonUnknownItem, "index 2 is out of range for 2 items"),
+			expNewItems: []int{5, 1},
+		},
+		{
+			name:        "Buy an item that is not at the index, should be rejected",
+			offer:       messages.CreateBuyOffer(1, 5, 100),
+			expected:    rejectAnswer(messages.ReasonUnknownItem, "item 1 has value 1, not 5"),
+			expNewItems: []int{5, 1},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			inv, err := inventory.NewInventoryFromItems([]int{5, 1})
+			require.NoError(t, err)
+			p, err := NewPawnShop(inv)
+			require.NoError(t, err)
+
+			pricing, err := NewMarginPricing(0.2)
+			require.NoError(t, err)
+			require.NoError(t, p.EnableRetail(pricing))
+
+			assert.Equal(t, c.expected, p.HandleOffer(context.Background(), c.offer))
+
+			items, err := inv.Items()
+			require.NoError(t, err)
+			assert.Equal(t, c.expNewItems, items)
+		})
+	}
+}
+
+func TestHandleOfferRetailRules(t *testing.T) {
+	inv, err := inventory.NewInventoryFromItems([]int{5, 1, 1})
+	require.NoError(t, err)
+	p, err := NewPawnShop(inv,
+		WithRules(&MaxOfferRule{Max: 3}, RuleFunc(func(_ context.Context, o messages.Offer) error {
+			if o.Demand < 1 {
+				return errors.New("demand must be at least 1")
+			}
+			return nil
+		})),
+		WithRetailRules(&MaxOfferRule{Max: 6}))
+	require.NoError(t, err)
+
+	pricing, err := NewMarginPricing(0.2)
+	require.NoError(t, err)
+	require.NoError(t, p.EnableRetail(pricing))
+
+	// The rules of PAWN offers do not apply to retail offers, whose offer is a price or the value of an item
+	assert.Equal(t, invalidAnswer(MaxOfferRuleID, "offer must be at most 3"), p.HandleOffer(context.Background(), messages.CreateOffer(6, 1)))
+	assert.Equal(t, messages.CreateBuyAnswer(5, 6), p.HandleOffer(context.Background(), messages.CreateBuyOffer(0, 5, 6)))
+	assert.Equal(t, messages.CreateAcceptedAnswer(4), p.HandleOffer(context.Background(), messages.CreateSellOffer(5, 0)))
+
+	// Retail offers are validated with the retail rules instead
+	assert.Equal(t, invalidAnswer(MaxOfferRuleID, "offer must be at most 6"), p.HandleOffer(context.Background(), messages.CreateSellOffer(7, 0)))
+}
+
+func TestHandleOfferRetailLargeValues(t *testing.T) {
+	cases := []struct {
+		name        string
+		items       []int
+		offer       messages.Offer
+		expected    messages.Answer
+		expNewItems []int
+	}{
+		{
+			name:        "Buy a valuable item for its exact selling price, should remove the item",
+			items:       []int{1 << 50, 1},
+			offer:       messages.CreateBuyOffer(0, 1<<50, MaxSafeValue),
+			expected:    messages.CreateBuyAnswer(1<<50, 1351079888211149),
+			expNewItems: []int{1},
+		},
+		{
+			name:        "Buy a valuable item for nothing, should be rejected",
+			items:       []int{1 << 50, 1},
+			offer:       messages.CreateBuyOffer(0, 1<<50, 0),
+			expected:    rejectAnswer(messages.ReasonPriceNotMet, "item costs 1351079888211149"),
+			expNewItems: []int{1 << 50, 1},
+		},
+		{
+			name:        "Buy an item whose selling price is out of range, should be rejected",
+			items:       []int{math.MaxInt, 1},
+			offer:       messages.CreateBuyOffer(0, math.MaxInt, math.MaxInt),
+			expected:    rejectAnswer(messages.ReasonInvalidOffer, "the item has no valid selling price: price 11068046444225730969 is out of range"),
+			expNewItems: []int{math.MaxInt, 1},
+		},
+		{
+			name:        "Sell a valuable item for its exact buying price, should add the item",
+			items:       []int{1},
+			offer:       messages.CreateSellOffer(1<<52, 0),
+			expected:    messages.CreateAcceptedAnswer(3602879701896396),
+			expNewItems: []int{1, 1 << 52},
+		},
+		{
+			name:        "Sell an item the pawn shop would pay nothing for, should be rejected",
+			items:       []int{1},
+			offer:       messages.CreateSellOffer(1, 0),
+			expected:    rejectAnswer(messages.ReasonInvalidOffer, "the item has no valid buying price: price 0 is not positive"),
+			expNewItems: []int{1},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			inv, err := inventory.NewInventoryFromItems(c.items)
+			require.NoError(t, err)
+			p, err := NewPawnShop(inv)
+			require.NoError(t, err)
+
+			pricing, err := NewMarginPricing(0.2)
+			require.NoError(t, err)
+			require.NoError(t, p.EnableRetail(pricing))
+
+			assert.Equal(t, c.expected, p.HandleOffer(context.Background(), c.offer))
+
+			items, err := inv.Items()
+			require.NoError(t, err)
+			assert.Equal(t, c.expNewItems, items)
+		})
+	}
+}
+
+func TestHandleOfferRetailNotEnabled(t *testing.T) {
+	p, err := NewPawnShop(inventory.NewInventory(2))
+	require.NoError(t, err)
+
+	assert.Equal(t, messages.CreateUnsupportedAnswer(messages.SellCode), p.HandleOffer(context.Background(), messages.CreateSellOffer(10, 1)))
+	assert.Equal(t, messages.CreateUnsupportedAnswer(messages.BuyCode), p.HandleOffer(context.Background(), messages.CreateBuyOffer(0, 1, 10)))
+}
@@ -0,0 +1,70 @@
+package pawnshop
+
+import (
+	"context"
+	"pawnshop/server/pkg/messages"
+	"sync"
+)
+
+/*
+Session holds the state of a client across the offers it makes in a session, e.g. on a single connection.
+It is safe for concurrent use.
+*/
+type Session struct {
+	// counter is the last counter-offer made in the session that has not been accepted yet
+	counter *messages.Offer
+	lock    sync.Mutex
+}
+
+/*
+Creates a new, empty Session.
+*/
+func NewSession() *Session {
+	return &Session{}
+}
+
+/*
+Sets the counter-offer that can be accepted in the session, replacing any previous counter-offer.
+*/
+func (s *Session) setCounter(c messages.Offer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.counter = &c
+}
+
+/*
+Takes the counter-offer out of the session, and returns false if there is none.
+*/
+func (s *Session) takeCounter() (messages.Offer, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.counter == nil {
+		return messages.Offer{}, false
+	}
+	c := *s.counter
+	s.counter = nil
+	return c, true
+}
+
+/*
+sessionKey is the context key of the session.
+*/
+type sessionKey struct{}
+
+/*
+Returns a copy of ctx carrying the given session.
+*/
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+/*
+Returns the session carried by ctx, and whether ctx carried a session at all.
+Offers that are not made in a session, e.g. over HTTP, carry no session.
+*/
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	s, ok := ctx.Value(sessionKey{}).(*Session)
+	return s, ok
+}
@@ -1,47 +1,375 @@
 package pawnshop
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"pawnshop/server/pkg/logging"
 	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/tracing"
+	"time"
 )
 
+// ruleTypeAttribute is the span attribute with the Go type of a rule, which identifies rules without an ID.
+const ruleTypeAttribute = "rule_type"
+
+/*
+Rule is an interface for a rule that can validate an offer before it is handled.
+The context carries the identity of the client, see ClientIdentityFromContext, and the time the offer
+is handled at, see OfferTimeFromContext. An offer that a rule returns an error for is rejected as invalid,
+with the error as the message of the reason.
+*/
+type Rule interface {
+	Validate(ctx context.Context, o messages.Offer) error
+}
+
+/*
+RuleFunc is a function that can be used as a Rule.
+*/
+type RuleFunc func(ctx context.Context, o messages.Offer) error
+
+/*
+Validates an offer by calling the function.
+*/
+func (f RuleFunc) Validate(ctx context.Context, o messages.Offer) error {
+	return f(ctx, o)
+}
+
+/*
+RuleError is an error of a rule with a stable ID, which is reported in the reason of the rejected offer and in logs.
+*/
+type RuleError struct {
+	// ID is the stable ID of the rule that returned the error.
+	ID  string
+	Err error
+}
+
+/*
+Returns the message of the wrapped error.
+*/
+func (e *RuleError) Error() string {
+	return e.Err.Error()
+}
+
 /*
-offerValidationRule is an interface for a rule that can validate an offer.
+Returns the wrapped error.
 */
-type offerValidationRule interface {
-	validate(o messages.Offer) error
+func (e *RuleError) Unwrap() error {
+	return e.Err
 }
 
 /*
-validator is a struct that contains a list of offerValidationRules.
+Returns the ID of the rule that returned err, or an empty string if it has no ID.
 */
-type validator struct {
-	rules []offerValidationRule
+func RuleIDFor(err error) string {
+	var e *RuleError
+	if errors.As(err, &e) {
+		return e.ID
+	}
+	return ""
+}
+
+/*
+identifiedRule is a rule with a stable ID.
+*/
+type identifiedRule struct {
+	id   string
+	rule Rule
+}
+
+/*
+Returns a rule that validates offers with the given rule, and reports its errors with the given ID,
+unless the error already carries the ID of a rule the given rule is composed of.
+*/
+func WithID(id string, rule Rule) Rule {
+	return &identifiedRule{
+		id:   id,
+		rule: rule,
+	}
 }
 
 /*
-Creates a new validator with the given rules.
+Validates an offer with the rule, adding the ID to its error.
 */
-func newValidator(rules ...offerValidationRule) (*validator, error) {
+func (r *identifiedRule) Validate(ctx context.Context, o messages.Offer) error {
+	err := r.rule.Validate(ctx, o)
+	if err == nil || RuleIDFor(err) != "" {
+		return err
+	}
+	return &RuleError{ID: r.id, Err: err}
+}
+
+/*
+Returns the identified rule.
+*/
+func (r *identifiedRule) rules() []Rule {
+	return []Rule{r.rule}
+}
+
+/*
+compositeRule is an interface for a rule that is composed of other rules, so that nil rules
+can be found when creating a validator.
+*/
+type compositeRule interface {
+	rules() []Rule
+}
+
+/*
+acceptedRecorder is an interface for a rule that keeps track of the offers that were accepted after validation.
+*/
+type acceptedRecorder interface {
+	recordAccepted(ctx context.Context, o messages.Offer)
+}
+
+/*
+Returns the rules, and the rules they are composed of, that keep track of accepted offers.
+*/
+func findRecorders(rules []Rule) []acceptedRecorder {
+	var recorders []acceptedRecorder
 	for _, rule := range rules {
-		if rule == nil {
-			return nil, errors.New("validator rules can not be nil")
+		if r, ok := rule.(acceptedRecorder); ok {
+			recorders = append(recorders, r)
 		}
+		if c, ok := rule.(compositeRule); ok {
+			recorders = append(recorders, findRecorders(c.rules())...)
+		}
+	}
+	return recorders
+}
+
+/*
+Validator is a Rule that validates an offer with a list of rules, all of which must accept the offer.
+*/
+type Validator struct {
+	all allRule
+}
+
+/*
+Creates a new validator with the given rules. Returns an error if any rule, or any rule they are composed of, is nil.
+*/
+func NewValidator(rules ...Rule) (*Validator, error) {
+	if err := checkRules(rules); err != nil {
+		return nil, err
 	}
 
-	return &validator{
-		rules: rules,
+	return &Validator{
+		all: rules,
 	}, nil
 }
 
 /*
-Validates an offer with the validator's rules.
+Returns an error if any of the rules, or any rule they are composed of, is nil.
+*/
+func checkRules(rules []Rule) error {
+	for _, rule := range rules {
+		if rule == nil {
+			return errors.New("validator rules can not be nil")
+		}
+		if c, ok := rule.(compositeRule); ok {
+			if err := checkRules(c.rules()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Validates an offer with the validator's rules, returning the error of the first rule that does not accept it.
+Every rule is traced as a span of its own, if ctx carries a span.
+*/
+func (v *Validator) Validate(ctx context.Context, o messages.Offer) error {
+	ctx, span := tracing.Start(ctx, "Validator.Validate")
+	defer span.End()
+
+	for _, rule := range v.all {
+		if err := validateTraced(ctx, rule, o); err != nil {
+			span.SetError(err)
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Validates an offer with a rule in a span of its own, so that the time spent in every rule can be seen.
+*/
+func validateTraced(ctx context.Context, rule Rule, o messages.Offer) error {
+	ctx, span := tracing.Start(ctx, "Rule.Validate")
+	defer span.End()
+
+	span.SetAttribute(ruleTypeAttribute, fmt.Sprintf("%T", rule))
+	if r, ok := rule.(*identifiedRule); ok {
+		span.SetAttribute(tracing.RuleAttribute, r.id)
+	}
+
+	err := rule.Validate(ctx, o)
+	if id := RuleIDFor(err); id != "" {
+		span.SetAttribute(tracing.RuleAttribute, id)
+	}
+	span.SetError(err)
+	return err
+}
+
+/*
+Returns the rules of the validator.
+*/
+func (v *Validator) rules() []Rule {
+	return v.all
+}
+
+/*
+allRule is a rule that accepts an offer if all of its rules accept it.
 */
-func (v validator) validate(o messages.Offer) error {
-	for _, rule := range v.rules {
-		if err := rule.validate(o); err != nil {
+type allRule []Rule
+
+/*
+Returns a rule that accepts an offer if all of the given rules accept it, which it checks in order.
+A rule without any rules accepts every offer.
+*/
+func All(rules ...Rule) Rule {
+	return allRule(rules)
+}
+
+/*
+Validates an offer with all of the rules, returning the error of the first rule that does not accept it.
+*/
+func (a allRule) Validate(ctx context.Context, o messages.Offer) error {
+	for _, rule := range a {
+		if err := rule.Validate(ctx, o); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+/*
+Returns the rules the rule is composed of.
+*/
+func (a allRule) rules() []Rule {
+	return a
+}
+
+/*
+anyRule is a rule that accepts an offer if any of its rules accepts it.
+*/
+type anyRule []Rule
+
+/*
+Returns a rule that accepts an offer if any of the given rules accepts it, which it checks in order.
+If no rule accepts the offer, the error carries the errors of all rules. A rule without any rules accepts no offer.
+*/
+func Any(rules ...Rule) Rule {
+	return anyRule(rules)
+}
+
+/*
+Validates an offer with the rules until one of them accepts it.
+*/
+func (a anyRule) Validate(ctx context.Context, o messages.Offer) error {
+	if len(a) == 0 {
+		return errors.New("no rule accepts the offer")
+	}
+
+	errs := make([]error, 0, len(a))
+	for _, rule := range a {
+		err := rule.Validate(ctx, o)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+/*
+Returns the rules the rule is composed of.
+*/
+func (a anyRule) rules() []Rule {
+	return a
+}
+
+/*
+notRule is a rule that accepts an offer if its rule does not accept it.
+*/
+type notRule struct {
+	rule    Rule
+	message string
+}
+
+/*
+Returns a rule that accepts an offer if the given rule does not accept it.
+Otherwise, it returns an error with the given message.
+*/
+func Not(rule Rule, message string) Rule {
+	return &notRule{
+		rule:    rule,
+		message: message,
+	}
+}
+
+/*
+Validates an offer with the negated rule, returning an error if it accepts the offer.
+*/
+func (n *notRule) Validate(ctx context.Context, o messages.Offer) error {
+	if err := n.rule.Validate(ctx, o); err != nil {
+		return nil
+	}
+	return errors.New(n.message)
+}
+
+/*
+Returns the negated rule.
+*/
+func (n *notRule) rules() []Rule {
+	return []Rule{n.rule}
+}
+
+/*
+Validates an offer with the validator of the pawn shop, or its retail validator for SELL and BUY offers.
+If the offer is not valid, the returned error is an INVALID_OFFER error carrying the ID of the rule that rejected
+the offer, if it has one.
+*/
+func (p *PawnShop) validate(ctx context.Context, o messages.Offer) *messages.Error {
+	validator := p.validator
+	if o.Code == messages.SellCode || o.Code == messages.BuyCode {
+		validator = p.retailValidator
+	}
+
+	err := validator.Validate(ctx, o)
+	if err == nil {
+		return nil
+	}
+
+	id := RuleIDFor(err)
+	entry := logging.FromContext(ctx)
+	if id != "" {
+		entry = entry.WithField(logging.RuleField, id)
+	}
+	entry.Debugf("Offer %+v is not valid: %s", o, err)
+
+	e := messages.NewError(messages.ReasonInvalidOffer, err)
+	e.Rule = id
+	return e
+}
+
+/*
+offerTimeKey is the context key of the time an offer is handled at.
+*/
+type offerTimeKey struct{}
+
+/*
+Returns a copy of ctx carrying the time an offer is handled at.
+*/
+func WithOfferTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, offerTimeKey{}, t)
+}
+
+/*
+Returns the time an offer is handled at carried by ctx, and whether ctx carried a time at all.
+The PawnShop sets the time with its clock for every offer that does not carry one already.
+*/
+func OfferTimeFromContext(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(offerTimeKey{}).(time.Time)
+	return t, ok
+}
@@ -1,22 +1,299 @@
 package pawnshop
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
+	"math/big"
 	"pawnshop/server/pkg/messages"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// The stable IDs of the built-in rules, which are reported in the reasons of rejected offers and in logs.
+const (
+	EnsureProfitRuleID  = "ensure_profit"
+	NonNegativeRuleID   = "non_negative"
+	MaxOfferRuleID      = "max_offer"
+	MaxDemandRuleID     = "max_demand"
+	MinMarginRuleID     = "min_margin"
+	OverflowGuardRuleID = "overflow_guard"
+	MaxItemDemandRuleID = "max_item_demand"
+	CooldownRuleID      = "client_cooldown"
+)
+
+// MaxSafeValue is the largest magnitude of an offer or demand that the OverflowGuardRule accepts.
+// It is the largest integer that a JSON number can represent exactly in most languages.
+const MaxSafeValue = 1<<53 - 1
+
 /*
-ensureProfitRule is a rule that ensures that the offer is greater than the demand.
+EnsureProfitRule is a rule that ensures that the offer is greater than the demand.
+Every PawnShop validates offers with it before any custom rules.
 */
-type ensureProfitRule struct{}
+type EnsureProfitRule struct{}
 
 /*
-validate validates an offer with the ensureProfitRule.
+Validate validates an offer with the EnsureProfitRule.
 */
-func (e *ensureProfitRule) validate(o messages.Offer) error {
+func (e *EnsureProfitRule) Validate(_ context.Context, o messages.Offer) error {
 	if o.Offer <= o.Demand {
-		return errors.New("offer must be greater than demand")
+		return &RuleError{ID: EnsureProfitRuleID, Err: errors.New("offer must be greater than demand")}
+	}
+
+	return nil
+}
+
+/*
+NonNegativeRule is a rule that ensures that neither the offer nor the demand is negative.
+*/
+type NonNegativeRule struct{}
+
+/*
+Validate validates an offer with the NonNegativeRule.
+*/
+func (n *NonNegativeRule) Validate(_ context.Context, o messages.Offer) error {
+	if o.Offer < 0 || o.Demand < 0 {
+		return &RuleError{ID: NonNegativeRuleID, Err: errors.New("offer and demand must not be negative")}
+	}
+
+	return nil
+}
+
+/*
+MaxOfferRule is a rule that ensures that the offer is at most Max.
+*/
+type MaxOfferRule struct {
+	Max int
+}
+
+/*
+Validate validates an offer with the MaxOfferRule.
+*/
+func (m *MaxOfferRule) Validate(_ context.Context, o messages.Offer) error {
+	if o.Offer > m.Max {
+		return &RuleError{ID: MaxOfferRuleID, Err: fmt.Errorf("offer must be at most %d", m.Max)}
+	}
+
+	return nil
+}
+
+/*
+MaxDemandRule is a rule that ensures that the demand is at most Max.
+*/
+type MaxDemandRule struct {
+	Max int
+}
+
+/*
+Validate validates an offer with the MaxDemandRule.
+*/
+func (m *MaxDemandRule) Validate(_ context.Context, o messages.Offer) error {
+	if o.Demand > m.Max {
+		return &RuleError{ID: MaxDemandRuleID, Err: fmt.Errorf("demand must be at most %d", m.Max)}
+	}
+
+	return nil
+}
+
+/*
+MinMarginRule is a rule that ensures that the offer exceeds the demand by at least a margin of the offer.
+*/
+type MinMarginRule struct {
+	// margin is the minimum margin in basis points
+	margin int64
+}
+
+/*
+Creates a new MinMarginRule with the given margin as a fraction of the offer, e.g. 0.1 for 10%.
+The margin must be greater than 0 and less than 1.
+*/
+func NewMinMarginRule(margin float64) (*MinMarginRule, error) {
+	if margin <= 0 || margin >= 1 || math.IsNaN(margin) {
+		return nil, fmt.Errorf("minimum margin must be greater than 0 and less than 1, got %v", margin)
+	}
+
+	return &MinMarginRule{
+		margin: int64(math.Round(margin * 10000)),
+	}, nil
+}
+
+/*
+Validate validates an offer with the MinMarginRule.
+*/
+func (m *MinMarginRule) Validate(_ context.Context, o messages.Offer) error {
+	// (offer - demand) / offer >= margin, multiplied out so that it is exact and can not overflow
+	profit := new(big.Int).Sub(big.NewInt(int64(o.Offer)), big.NewInt(int64(o.Demand)))
+	profit.Mul(profit, big.NewInt(10000))
+	required := new(big.Int).Mul(big.NewInt(int64(o.Offer)), big.NewInt(m.margin))
+	if profit.Cmp(required) < 0 {
+		return &RuleError{
+			ID:  MinMarginRuleID,
+			Err: fmt.Errorf("offer must exceed demand by at least %s%% of the offer", formatBasisPoints(m.margin)),
+		}
+	}
+
+	return nil
+}
+
+/*
+Returns basis points as a percentage, without trailing zeros.
+*/
+func formatBasisPoints(bp int64) string {
+	return strconv.FormatFloat(float64(bp)/100, 'f', -1, 64)
+}
+
+/*
+OverflowGuardRule is a rule that ensures that the magnitudes of the offer and demand are at most MaxSafeValue,
+so that they are represented exactly by clients, and their sum or difference can not overflow.
+It does not bound any other arithmetic, e.g. loans and retail prices are calculated exactly and rejected if out of range.
+*/
+type OverflowGuardRule struct{}
+
+/*
+Validate validates an offer with the OverflowGuardRule.
+*/
+func (g *OverflowGuardRule) Validate(_ context.Context, o messages.Offer) error {
+	if o.Offer > MaxSafeValue || o.Offer < -MaxSafeValue || o.Demand > MaxSafeValue || o.Demand < -MaxSafeValue {
+		return &RuleError{ID: OverflowGuardRuleID, Err: fmt.Errorf("offer and demand must be at most %d in magnitude", MaxSafeValue)}
 	}
 
 	return nil
 }
+
+/*
+MaxValuer is an interface for an inventory that knows the value of its most valuable item.
+*/
+type MaxValuer interface {
+	// Max returns the value of the most valuable item that can be given up for offers, or false if there is none.
+	Max() (int, bool)
+}
+
+/*
+MaxItemDemandRule is a rule that ensures that the demand does not exceed the value of the most valuable item
+that can currently be given up by Inventory, or a ratio of it, see NewMaxItemDemandRatioRule. Such offers
+would be rejected by the inventory anyway, but the rule rejects them without locking the inventory for an offer.
+*/
+type MaxItemDemandRule struct {
+	Inventory MaxValuer
+	// ratio is the ratio of the value of the most valuable item in basis points, or 0 for its whole value
+	ratio int64
+}
+
+/*
+Creates a new MaxItemDemandRule that ensures that the demand is at most the given ratio of the value of
+the most valuable item of inv, e.g. 0.5 for 50%. The ratio must be positive.
+*/
+func NewMaxItemDemandRatioRule(inv MaxValuer, ratio float64) (*MaxItemDemandRule, error) {
+	if ratio <= 0 || ratio > math.MaxInt64/10000 || math.IsNaN(ratio) {
+		return nil, fmt.Errorf("maximum demand ratio must be positive, got %v", ratio)
+	}
+
+	return &MaxItemDemandRule{
+		Inventory: inv,
+		ratio:     int64(math.Round(ratio * 10000)),
+	}, nil
+}
+
+/*
+Validate validates an offer with the MaxItemDemandRule.
+*/
+func (m *MaxItemDemandRule) Validate(_ context.Context, o messages.Offer) error {
+	max, ok := m.Inventory.Max()
+	if !ok {
+		return &RuleError{ID: MaxItemDemandRuleID, Err: errors.New("no item can be given up")}
+	}
+	if m.ratio == 0 {
+		if o.Demand > max {
+			return &RuleError{ID: MaxItemDemandRuleID, Err: fmt.Errorf("demand must be at most %d, the value of the most valuable item", max)}
+		}
+		return nil
+	}
+
+	// demand / max <= ratio, multiplied out so that it is exact and can not overflow
+	demand := new(big.Int).Mul(big.NewInt(int64(o.Demand)), big.NewInt(10000))
+	allowed := new(big.Int).Mul(big.NewInt(int64(max)), big.NewInt(m.ratio))
+	if demand.Cmp(allowed) > 0 {
+		return &RuleError{
+			ID:  MaxItemDemandRuleID,
+			Err: fmt.Errorf("demand must be at most %s%% of the most valuable item", formatBasisPoints(m.ratio)),
+		}
+	}
+
+	return nil
+}
+
+/*
+CooldownRule is a rule that ensures that an authenticated client waits at least the cooldown after an accepted offer
+before making another offer. The time of an offer is taken from its context, see OfferTimeFromContext.
+Only offers that a PawnShop accepts start the cooldown, so rejected offers and quotes do not.
+Offers of clients that did not authenticate are not limited, as they can not be told apart.
+*/
+type CooldownRule struct {
+	cooldown time.Duration
+	// last holds the time of the last accepted offer of every client by its owner, and swept the number of clients
+	// after expired clients were last removed
+	last  map[string]time.Time
+	swept int
+	lock  sync.Mutex
+}
+
+/*
+Creates a new CooldownRule with the given cooldown, which must be positive.
+*/
+func NewCooldownRule(cooldown time.Duration) (*CooldownRule, error) {
+	if cooldown <= 0 {
+		return nil, fmt.Errorf("cooldown must be positive, got %s", cooldown)
+	}
+
+	return &CooldownRule{
+		cooldown: cooldown,
+		last:     make(map[string]time.Time),
+	}, nil
+}
+
+/*
+Validate validates an offer with the CooldownRule.
+*/
+func (c *CooldownRule) Validate(ctx context.Context, _ messages.Offer) error {
+	owner := clientOwner(ctx)
+	now, ok := OfferTimeFromContext(ctx)
+	if owner == "" || !ok {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if last, ok := c.last[owner]; ok && now.Before(last.Add(c.cooldown)) {
+		return &RuleError{ID: CooldownRuleID, Err: fmt.Errorf("client must wait %s between offers", c.cooldown)}
+	}
+	return nil
+}
+
+/*
+Starts the cooldown of the client of an accepted offer.
+*/
+func (c *CooldownRule) recordAccepted(ctx context.Context, _ messages.Offer) {
+	owner := clientOwner(ctx)
+	now, ok := OfferTimeFromContext(ctx)
+	if owner == "" || !ok {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.last[owner] = now
+
+	// Remove expired clients once the number of clients has doubled, so that sweeping takes amortized O(1) time
+	if len(c.last) > 2*c.swept {
+		for o, t := range c.last {
+			if !now.Before(t.Add(c.cooldown)) {
+				delete(c.last, o)
+			}
+		}
+		c.swept = len(c.last)
+	}
+}
@@ -1,9 +1,14 @@
 package pawnshop
 
 import (
+	"context"
+	"math"
+	"pawnshop/server/pkg/inventory"
 	"pawnshop/server/pkg/messages"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -60,9 +65,9 @@ func TestEnsureProfitRuleValidate(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			epr := ensureProfitRule{}
+			epr := EnsureProfitRule{}
 
-			err := epr.validate(c.offer)
+			err := epr.Validate(context.Background(), c.offer)
 			if c.expError {
 				require.Error(t, err)
 			} else {
@@ -71,3 +76,188 @@ func TestEnsureProfitRuleValidate(t *testing.T) {
 		})
 	}
 }
+
+/*
+fixedMax is a MaxValuer whose most valuable item is max.
+*/
+type fixedMax struct {
+	max int
+	ok  bool
+}
+
+func (f fixedMax) Max() (int, bool) {
+	return f.max, f.ok
+}
+
+func TestRuleLibrary(t *testing.T) {
+	margin, err := NewMinMarginRule(0.125)
+	require.NoError(t, err)
+	ratio, err := NewMaxItemDemandRatioRule(fixedMax{max: 9, ok: true}, 0.5)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		rule     Rule
+		offer    messages.Offer
+		expID    string
+		expError string
+	}{
+		{name: "Non-negative values, should not return error", rule: &NonNegativeRule{}, offer: messages.CreateOffer(1, 0)},
+		{
+			name:     "Negative demand, should return error",
+			rule:     &NonNegativeRule{},
+			offer:    messages.CreateOffer(1, -1),
+			expID:    NonNegativeRuleID,
+			expError: "offer and demand must not be negative",
+		},
+		{name: "Offer of exactly the cap, should not return error", rule: &MaxOfferRule{Max: 10}, offer: messages.CreateOffer(10, 1)},
+		{
+			name:     "Offer above the cap, should return error",
+			rule:     &MaxOfferRule{Max: 10},
+			offer:    messages.CreateOffer(11, 1),
+			expID:    MaxOfferRuleID,
+			expError: "offer must be at most 10",
+		},
+		{
+			name:     "Demand above the cap, should return error",
+			rule:     &MaxDemandRule{Max: 10},
+			offer:    messages.CreateOffer(20, 11),
+			expID:    MaxDemandRuleID,
+			expError: "demand must be at most 10",
+		},
+		{name: "Margin of exactly the minimum, should not return error", rule: margin, offer: messages.CreateOffer(8, 7)},
+		{
+			name:     "Margin below the minimum, should return error",
+			rule:     margin,
+			offer:    messages.CreateOffer(9, 8),
+			expID:    MinMarginRuleID,
+			expError: "offer must exceed demand by at least 12.5% of the offer",
+		},
+		{
+			name:  "Largest safe values, should not return error",
+			rule:  &OverflowGuardRule{},
+			offer: messages.CreateOffer(MaxSafeValue, -MaxSafeValue),
+		},
+		{
+			name:     "Value that could overflow, should return error",
+			rule:     &OverflowGuardRule{},
+			offer:    messages.CreateOffer(math.MaxInt, 1),
+			expID:    OverflowGuardRuleID,
+			expError: "offer and demand must be at most 9007199254740991 in magnitude",
+		},
+		{
+			name:  "Demand of exactly the most valuable item, should not return error",
+			rule:  &MaxItemDemandRule{Inventory: fixedMax{max: 5, ok: true}},
+			offer: messages.CreateOffer(10, 5),
+		},
+		{
+			name:     "Demand above the most valuable item, should return error",
+			rule:     &MaxItemDemandRule{Inventory: fixedMax{max: 5, ok: true}},
+			offer:    messages.CreateOffer(10, 6),
+			expID:    MaxItemDemandRuleID,
+			expError: "demand must be at most 5, the value of the most valuable item",
+		},
+		{
+			name:     "No item can be given up, should return error",
+			rule:     &MaxItemDemandRule{Inventory: fixedMax{}},
+			offer:    messages.CreateOffer(10, 0),
+			expID:    MaxItemDemandRuleID,
+			expError: "no item can be given up",
+		},
+		{name: "Demand of exactly the ratio of the most valuable item, should not return error", rule: ratio, offer: messages.CreateOffer(10, 4)},
+		{
+			name:     "Demand above the ratio of the most valuable item, should return error",
+			rule:     ratio,
+			offer:    messages.CreateOffer(10, 5),
+			expID:    MaxItemDemandRuleID,
+			expError: "demand must be at most 50% of the most valuable item",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.rule.Validate(context.Background(), c.offer)
+			if c.expError == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, c.expError)
+			assert.Equal(t, c.expID, RuleIDFor(err))
+		})
+	}
+}
+
+func TestNewMinMarginRule(t *testing.T) {
+	_, err := NewMinMarginRule(0)
+	require.Error(t, err)
+	_, err = NewMinMarginRule(1)
+	require.Error(t, err)
+	_, err = NewMinMarginRule(math.NaN())
+	require.Error(t, err)
+}
+
+func TestNewMaxItemDemandRatioRule(t *testing.T) {
+	_, err := NewMaxItemDemandRatioRule(fixedMax{}, 0)
+	require.Error(t, err)
+	_, err = NewMaxItemDemandRatioRule(fixedMax{}, math.NaN())
+	require.Error(t, err)
+	_, err = NewMaxItemDemandRatioRule(fixedMax{}, 2)
+	require.NoError(t, err)
+}
+
+func TestCooldownRule(t *testing.T) {
+	_, err := NewCooldownRule(0)
+	require.Error(t, err)
+
+	rule, err := NewCooldownRule(time.Minute)
+	require.NoError(t, err)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	alice := WithClientIdentity(context.Background(), ClientIdentity{CommonName: "alice", Fingerprint: "a1"})
+	bob := WithClientIdentity(context.Background(), ClientIdentity{CommonName: "bob", Fingerprint: "b1"})
+	offer := messages.CreateOffer(2, 1)
+
+	// Validating offers does not start the cooldown, only accepted offers do
+	require.NoError(t, rule.Validate(WithOfferTime(alice, now), offer))
+	require.NoError(t, rule.Validate(WithOfferTime(alice, now), offer))
+	rule.recordAccepted(WithOfferTime(alice, now), offer)
+
+	// The next offer of the same client must wait, even if it is made at the same instant
+	err = rule.Validate(WithOfferTime(alice, now), offer)
+	require.EqualError(t, err, "client must wait 1m0s between offers")
+	assert.Equal(t, CooldownRuleID, RuleIDFor(err))
+	err = rule.Validate(WithOfferTime(alice, now.Add(30*time.Second)), offer)
+	require.EqualError(t, err, "client must wait 1m0s between offers")
+
+	// Other clients, and clients that did not authenticate, are not limited
+	require.NoError(t, rule.Validate(WithOfferTime(bob, now.Add(30*time.Second)), offer))
+	rule.recordAccepted(WithOfferTime(context.Background(), now), offer)
+	require.NoError(t, rule.Validate(WithOfferTime(context.Background(), now), offer))
+
+	require.NoError(t, rule.Validate(WithOfferTime(alice, now.Add(time.Minute)), offer))
+}
+
+func TestHandleOfferCooldown(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	rule, err := NewCooldownRule(time.Minute)
+	require.NoError(t, err)
+
+	inv, err := inventory.NewInventoryFromItems([]int{5, 5})
+	require.NoError(t, err)
+	p, err := NewPawnShop(inv, WithRules(rule), WithClock(clock))
+	require.NoError(t, err)
+	require.NoError(t, p.EnableQuotes(nil, 0))
+	alice := WithClientIdentity(context.Background(), ClientIdentity{CommonName: "alice", Fingerprint: "a1"})
+
+	// Rejected offers and quotes do not start the cooldown
+	assert.Equal(t, rejectAnswer(messages.ReasonNoMatchingItem, "no available item is worth at least the demand of 10"),
+		p.HandleOffer(alice, messages.CreateOffer(11, 10)))
+	assert.Equal(t, messages.CreateAcceptedAnswer(5), p.HandleOffer(alice, messages.CreateQuoteOffer(6, 5)))
+
+	// Of two offers at the same instant, only the first is accepted
+	assert.Equal(t, messages.CreateAcceptedAnswer(5), p.HandleOffer(alice, messages.CreateOffer(6, 5)))
+	assert.Equal(t, invalidAnswer(CooldownRuleID, "client must wait 1m0s between offers"), p.HandleOffer(alice, messages.CreateOffer(7, 5)))
+
+	clock.now = clock.now.Add(time.Minute)
+	assert.Equal(t, messages.CreateAcceptedAnswer(5), p.HandleOffer(alice, messages.CreateOffer(7, 5)))
+}
@@ -1,39 +1,63 @@
 package pawnshop
 
 import (
+	"context"
+	"errors"
+	"pawnshop/server/pkg/inventory"
 	"pawnshop/server/pkg/messages"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+/*
+maxDemandRule is a rule that ensures that the demand is at most max.
+*/
+func maxDemandRule(max int) Rule {
+	return RuleFunc(func(_ context.Context, o messages.Offer) error {
+		if o.Demand > max {
+			return errors.New("demand is too high")
+		}
+		return nil
+	})
+}
+
 func TestNewValidator(t *testing.T) {
 	cases := []struct {
 		name     string
 		offer    messages.Offer
-		rules    []offerValidationRule
+		rules    []Rule
 		expError bool
 	}{
 		{
-			name: "ensureProfitRule - should not return error",
-			rules: []offerValidationRule{
-				&ensureProfitRule{},
+			name: "EnsureProfitRule - should not return error",
+			rules: []Rule{
+				&EnsureProfitRule{},
 			},
 			expError: false,
 		},
 		{
 
 			name: "nil rule - should fail creating validator - should return error",
-			rules: []offerValidationRule{
+			rules: []Rule{
 				nil,
 			},
 			expError: true,
 		},
+		{
+			name: "nil rule inside a combinator - should fail creating validator - should return error",
+			rules: []Rule{
+				All(&EnsureProfitRule{}, Any(maxDemandRule(1), Not(nil, "never"))),
+			},
+			expError: true,
+		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			validator, err := newValidator(
+			validator, err := NewValidator(
 				c.rules...,
 			)
 			if c.expError {
@@ -51,47 +75,180 @@ func TestValidate(t *testing.T) {
 	cases := []struct {
 		name     string
 		offer    messages.Offer
-		rules    []offerValidationRule
-		expError bool
+		rules    []Rule
+		expError string
 	}{
 		{
-			name: "ensureProfitRule - demand < offer, should not return error",
+			name: "EnsureProfitRule - demand < offer, should not return error",
 			offer: messages.Offer{
 				Offer:  2,
 				Demand: 1,
 			},
-			rules: []offerValidationRule{
-				&ensureProfitRule{},
+			rules: []Rule{
+				&EnsureProfitRule{},
 			},
-			expError: false,
 		},
 		{
 
-			name: "ensureProfitRule - demand > offer, should return error",
+			name: "EnsureProfitRule - demand > offer, should return error",
 			offer: messages.Offer{
 				Offer:  2,
 				Demand: 3,
 			},
-			rules: []offerValidationRule{
-				&ensureProfitRule{},
+			rules: []Rule{
+				&EnsureProfitRule{},
 			},
-			expError: true,
+			expError: "offer must be greater than demand",
+		},
+		{
+			name:  "All - every rule accepts, should not return error",
+			offer: messages.CreateOffer(5, 2),
+			rules: []Rule{
+				All(&EnsureProfitRule{}, maxDemandRule(2)),
+			},
+		},
+		{
+			name:  "All - a rule does not accept, should return its error",
+			offer: messages.CreateOffer(5, 3),
+			rules: []Rule{
+				All(&EnsureProfitRule{}, maxDemandRule(2)),
+			},
+			expError: "demand is too high",
+		},
+		{
+			name:  "Any - a rule accepts, should not return error",
+			offer: messages.CreateOffer(2, 3),
+			rules: []Rule{
+				Any(&EnsureProfitRule{}, maxDemandRule(3)),
+			},
+		},
+		{
+			name:  "Any - no rule accepts, should return the errors of all rules",
+			offer: messages.CreateOffer(2, 4),
+			rules: []Rule{
+				Any(&EnsureProfitRule{}, maxDemandRule(3)),
+			},
+			expError: "offer must be greater than demand\ndemand is too high",
+		},
+		{
+			name:  "Any - without rules, should return error",
+			offer: messages.CreateOffer(2, 1),
+			rules: []Rule{
+				Any(),
+			},
+			expError: "no rule accepts the offer",
+		},
+		{
+			name:  "Not - the rule does not accept, should not return error",
+			offer: messages.CreateOffer(5, 3),
+			rules: []Rule{
+				Not(maxDemandRule(2), "demand is too low"),
+			},
+		},
+		{
+			name:  "Not - the rule accepts, should return error",
+			offer: messages.CreateOffer(5, 2),
+			rules: []Rule{
+				Not(maxDemandRule(2), "demand is too low"),
+			},
+			expError: "demand is too low",
 		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			validator, err := newValidator(
+			validator, err := NewValidator(
 				c.rules...,
 			)
 			require.NoError(t, err)
 
-			err = validator.validate(c.offer)
-			if c.expError {
-				require.Error(t, err)
+			err = validator.Validate(context.Background(), c.offer)
+			if c.expError != "" {
+				require.EqualError(t, err, c.expError)
 			} else {
 				require.NoError(t, err)
 			}
 		})
 	}
 }
+
+func TestWithID(t *testing.T) {
+	rule := WithID("low_demand", maxDemandRule(2))
+
+	err := rule.Validate(context.Background(), messages.CreateOffer(5, 3))
+	require.EqualError(t, err, "demand is too high")
+	assert.Equal(t, "low_demand", RuleIDFor(err))
+	require.NoError(t, rule.Validate(context.Background(), messages.CreateOffer(5, 2)))
+
+	// The ID of the innermost rule with an ID is reported
+	err = WithID("outer", All(&EnsureProfitRule{}, rule)).Validate(context.Background(), messages.CreateOffer(1, 2))
+	assert.Equal(t, EnsureProfitRuleID, RuleIDFor(err))
+	assert.Empty(t, RuleIDFor(maxDemandRule(2).Validate(context.Background(), messages.CreateOffer(5, 3))))
+}
+
+func TestNewPawnShopWithRules(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	alice := ClientIdentity{CommonName: "alice", Fingerprint: "a1"}
+
+	// Only alice may pawn, and only before 18:00
+	rule := RuleFunc(func(ctx context.Context, o messages.Offer) error {
+		if id, ok := ClientIdentityFromContext(ctx); !ok || id != alice {
+			return errors.New("only alice may pawn")
+		}
+		if t, ok := OfferTimeFromContext(ctx); !ok || t.Hour() >= 18 {
+			return errors.New("the pawn shop is closed")
+		}
+		return nil
+	})
+
+	cases := []struct {
+		name     string
+		ctx      context.Context
+		offer    messages.Offer
+		expected messages.Answer
+	}{
+		{
+			name:     "Offer from alice during opening hours, should be accepted",
+			ctx:      WithClientIdentity(context.Background(), alice),
+			offer:    messages.CreateOffer(5, 1),
+			expected: messages.CreateAcceptedAnswer(1),
+		},
+		{
+			name:     "Offer from an anonymous client, should be rejected",
+			ctx:      context.Background(),
+			offer:    messages.CreateOffer(5, 1),
+			expected: rejectAnswer(messages.ReasonInvalidOffer, "only alice may pawn"),
+		},
+		{
+			name:     "Offer from alice after opening hours, should be rejected",
+			ctx:      WithOfferTime(WithClientIdentity(context.Background(), alice), now.Add(7*time.Hour)),
+			offer:    messages.CreateOffer(5, 1),
+			expected: rejectAnswer(messages.ReasonInvalidOffer, "the pawn shop is closed"),
+		},
+		{
+			name:     "Offer that is not profitable, should be rejected by the EnsureProfitRule first",
+			ctx:      context.Background(),
+			offer:    messages.CreateOffer(1, 5),
+			expected: invalidAnswer(EnsureProfitRuleID, "offer must be greater than demand"),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			inv, err := inventory.NewInventoryFromItems([]int{1, 3})
+			require.NoError(t, err)
+			p, err := NewPawnShop(inv, WithRules(rule), WithClock(&fakeClock{now: now}))
+			require.NoError(t, err)
+
+			assert.Equal(t, c.expected, p.HandleOffer(c.ctx, c.offer))
+		})
+	}
+}
+
+func TestNewPawnShopOptionErrors(t *testing.T) {
+	_, err := NewPawnShop(inventory.NewInventory(1), WithRules(nil))
+	require.Error(t, err)
+
+	_, err = NewPawnShop(inventory.NewInventory(1), WithClock(nil))
+	require.Error(t, err)
+}
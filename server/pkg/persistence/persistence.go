@@ -0,0 +1,508 @@
+/*
+Package persistence implements durable storage of an inventory, using a write-ahead log and snapshots.
+The inventory writes every change to its storage first, and then appends it to the log, which is synced to disk
+before the change is answered. If the change can not be appended, the log is rolled back to before the record,
+and the inventory undoes the change in its storage, so that a failed change is neither answered nor recovered.
+The log is periodically compacted into a snapshot of all items, and on startup the latest snapshot is loaded
+and the log is replayed on top of it to recover the inventory.
+*/
+package persistence
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	walFileName      = "inventory.wal"
+	snapshotFileName = "inventory.snapshot"
+
+	// DefaultSnapshotInterval is the default number of log records after which the log is compacted into a snapshot.
+	DefaultSnapshotInterval = 1000
+
+	// recordSize is the size of a log record: an op, an index, a value and a checksum.
+	recordSize = 1 + 8 + 8 + 4
+)
+
+/*
+op is the type of a change recorded in the log.
+*/
+type op uint8
+
+const (
+	// opReplace replaces the item at an index with a value.
+	opReplace op = 1
+	// opAdd adds an item with a value at the end.
+	opAdd op = 2
+	// opRemove removes the item at an index, moving the last item into its place.
+	opRemove op = 3
+)
+
+/*
+snapshot is the on-disk format of a snapshot.
+*/
+type snapshot struct {
+	Items []int `json:"items"`
+}
+
+/*
+logFile is the file of the write-ahead log, which is an *os.File unless a test injects failures.
+*/
+type logFile interface {
+	io.ReadWriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+/*
+Store is a durable store of the items of an inventory. It implements inventory.Journal,
+and is safe for concurrent use.
+*/
+type Store struct {
+	dir string
+	wal logFile
+	// broken is the error of a failed rollback of the log, after which no more records can be appended to it
+	broken           error
+	records          int
+	snapshotInterval int
+	items            []int
+	lock             sync.Mutex
+}
+
+/*
+Opens the store in the given directory, creating the directory if it does not exist.
+The items are recovered from the latest snapshot and the log. If the directory contains no
+previous state, the store starts out with the given initial items.
+The log is compacted into a snapshot every snapshotInterval records. If snapshotInterval is
+less than 1, DefaultSnapshotInterval is used.
+Returns the store and the recovered items.
+*/
+func Open(dir string, initial []int, snapshotInterval int) (*Store, []int, error) {
+	if snapshotInterval < 1 {
+		snapshotInterval = DefaultSnapshotInterval
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	items, err := loadSnapshot(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+	if items == nil {
+		items = make([]int, len(initial))
+		copy(items, initial)
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+
+	items, records, err := replay(wal, items)
+	if err != nil {
+		wal.Close()
+		return nil, nil, err
+	}
+
+	s := &Store{
+		dir:              dir,
+		wal:              wal,
+		records:          records,
+		snapshotInterval: snapshotInterval,
+		items:            items,
+	}
+
+	// Always start from a fresh snapshot, so that initial items and recovered state are durable
+	if err = s.snapshot(); err != nil {
+		wal.Close()
+		return nil, nil, err
+	}
+
+	log.Infof("Recovered inventory of size %d from %s, replayed %d log records", len(items), dir, records)
+
+	recovered := make([]int, len(items))
+	copy(recovered, items)
+	return s, recovered, nil
+}
+
+/*
+Appends a replacement of the item at idx with value to the log, and syncs the log to disk.
+The change is durable once Append returns without an error. Compacts the log into a snapshot
+if enough records have been appended since the last snapshot.
+*/
+func (s *Store) Append(idx, value int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.wal == nil {
+		return errors.New("store is closed")
+	}
+	if idx < 0 || idx >= len(s.items) {
+		return fmt.Errorf("index %d is out of range for %d items", idx, len(s.items))
+	}
+
+	if err := s.write(opReplace, idx, value); err != nil {
+		return err
+	}
+
+	s.items[idx] = value
+	s.compact()
+	return nil
+}
+
+/*
+Appends an addition of an item with value at the end to the log, and syncs the log to disk.
+The change is durable once Add returns without an error.
+*/
+func (s *Store) Add(value int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.wal == nil {
+		return errors.New("store is closed")
+	}
+
+	if err := s.write(opAdd, len(s.items), value); err != nil {
+		return err
+	}
+
+	s.items = append(s.items, value)
+	s.compact()
+	return nil
+}
+
+/*
+Appends a removal of the item at idx to the log, and syncs the log to disk. The last item is moved
+into the place of the removed item. The change is durable once Remove returns without an error.
+*/
+func (s *Store) Remove(idx int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.wal == nil {
+		return errors.New("store is closed")
+	}
+	if idx < 0 || idx >= len(s.items) {
+		return fmt.Errorf("index %d is out of range for %d items", idx, len(s.items))
+	}
+	if len(s.items) == 1 {
+		return errors.New("store must contain at least 1 item")
+	}
+
+	if err := s.write(opRemove, idx, 0); err != nil {
+		return err
+	}
+
+	s.items = removeItem(s.items, idx)
+	s.compact()
+	return nil
+}
+
+/*
+Replaces all items with the given items, e.g. when the inventory is resized, and makes the change durable
+with a snapshot. The log is first compacted into a snapshot of the current items, so that a crash never
+replays records of the current items onto the new items.
+*/
+func (s *Store) Reset(items []int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.wal == nil {
+		return errors.New("store is closed")
+	}
+	if len(items) == 0 {
+		return errors.New("store must contain at least 1 item")
+	}
+
+	if err := s.snapshot(); err != nil {
+		return err
+	}
+
+	old := s.items
+	s.items = make([]int, len(items))
+	copy(s.items, items)
+	if err := s.snapshot(); err != nil {
+		s.items = old
+		return err
+	}
+
+	return nil
+}
+
+/*
+Writes a record to the log and syncs the log to disk.
+It is NOT thread-safe and should be called with the lock held.
+*/
+func (s *Store) write(o op, idx, value int) error {
+	if s.broken != nil {
+		return fmt.Errorf("write-ahead log can not be appended to: %w", s.broken)
+	}
+
+	offset, err := s.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to seek write-ahead log: %w", err)
+	}
+	if _, err = s.wal.Write(encodeRecord(o, idx, value)); err != nil {
+		return s.rollback(offset, fmt.Errorf("failed to append to write-ahead log: %w", err))
+	}
+	if err = s.wal.Sync(); err != nil {
+		return s.rollback(offset, fmt.Errorf("failed to sync write-ahead log: %w", err))
+	}
+
+	s.records++
+	return nil
+}
+
+/*
+Rolls the log back to offset, where the record that failed with err began, so that neither a partial record
+nor a record of a change that failed is ever replayed. Returns err, joined with the error of the rollback if
+the log can not be rolled back, in which case no more records can be appended to the log.
+It is NOT thread-safe and should be called with the lock held.
+*/
+func (s *Store) rollback(offset int64, err error) error {
+	rerr := s.wal.Truncate(offset)
+	if rerr == nil {
+		_, rerr = s.wal.Seek(offset, io.SeekStart)
+	}
+	if rerr != nil {
+		s.broken = fmt.Errorf("failed to roll back write-ahead log: %w", rerr)
+		return errors.Join(err, s.broken)
+	}
+	return err
+}
+
+/*
+Compacts the log into a snapshot if enough records have been written since the last snapshot.
+It is NOT thread-safe and should be called with the lock held.
+*/
+func (s *Store) compact() {
+	if s.records < s.snapshotInterval {
+		return
+	}
+
+	// The change is already durable in the log, so a failed snapshot is not an error for the caller
+	if err := s.snapshot(); err != nil {
+		log.Errorf("Failed to compact write-ahead log into snapshot: %s", err)
+	}
+}
+
+/*
+Writes a final snapshot and closes the store.
+*/
+func (s *Store) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.wal == nil {
+		return nil
+	}
+
+	err := s.snapshot()
+	if cerr := s.wal.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("failed to close write-ahead log: %w", cerr)
+	}
+	s.wal = nil
+
+	return err
+}
+
+/*
+Writes a snapshot of all items and truncates the log. The snapshot is written to a temporary
+file and renamed into place, so that a crash never leaves a partially written snapshot behind.
+It is NOT thread-safe and should be called with the lock held.
+*/
+func (s *Store) snapshot() error {
+	b, err := json.Marshal(snapshot{Items: s.items})
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	path := filepath.Join(s.dir, snapshotFileName)
+	if err = writeFileSync(path+".tmp", b); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to rename snapshot: %w", err)
+	}
+	if err = SyncDir(s.dir); err != nil {
+		return fmt.Errorf("failed to sync data directory: %w", err)
+	}
+
+	// Only truncate the log once the snapshot containing its records is durable
+	if err = s.wal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if _, err = s.wal.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek write-ahead log: %w", err)
+	}
+	if err = s.wal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+
+	// The log is empty again, so it can be appended to even if an earlier rollback failed
+	s.records = 0
+	s.broken = nil
+	return nil
+}
+
+/*
+Loads the items of a snapshot. Returns nil items and no error if the snapshot does not exist.
+*/
+func loadSnapshot(path string) ([]int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var snap snapshot
+	if err = json.Unmarshal(b, &snap); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshot: %w", err)
+	}
+	if snap.Items == nil {
+		return nil, errors.New("snapshot contains no items")
+	}
+
+	return snap.Items, nil
+}
+
+/*
+Replays the records of the log onto items, and returns the resulting items and the number of records replayed.
+A torn or corrupted record at the end of the log, left behind by a crash in the middle of
+an append, ends the replay, and the log is truncated to the last intact record.
+Leaves the log positioned at its end, ready for appending.
+*/
+func replay(wal *os.File, items []int) ([]int, int, error) {
+	if _, err := wal.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, fmt.Errorf("failed to seek write-ahead log: %w", err)
+	}
+
+	records := 0
+	buf := make([]byte, recordSize)
+	for {
+		_, err := io.ReadFull(wal, buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Warnf("Ignoring torn record at the end of the write-ahead log after %d records", records)
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read write-ahead log: %w", err)
+		}
+
+		o, idx, value, ok := decodeRecord(buf)
+		if !ok {
+			log.Warnf("Ignoring corrupted record in the write-ahead log after %d records", records)
+			break
+		}
+
+		switch o {
+		case opReplace:
+			if idx < 0 || idx >= len(items) {
+				return nil, 0, fmt.Errorf("write-ahead log record %d has index %d out of range for %d items", records, idx, len(items))
+			}
+			items[idx] = value
+		case opAdd:
+			items = append(items, value)
+		case opRemove:
+			if idx < 0 || idx >= len(items) || len(items) == 1 {
+				return nil, 0, fmt.Errorf("write-ahead log record %d removes index %d of %d items", records, idx, len(items))
+			}
+			items = removeItem(items, idx)
+		default:
+			return nil, 0, fmt.Errorf("write-ahead log record %d has unknown op %d", records, o)
+		}
+		records++
+	}
+
+	end := int64(records * recordSize)
+	if err := wal.Truncate(end); err != nil {
+		return nil, 0, fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if _, err := wal.Seek(end, io.SeekStart); err != nil {
+		return nil, 0, fmt.Errorf("failed to seek write-ahead log: %w", err)
+	}
+
+	return items, records, nil
+}
+
+/*
+Removes the item at idx by moving the last item into its place, and returns the remaining items.
+*/
+func removeItem(items []int, idx int) []int {
+	last := len(items) - 1
+	items[idx] = items[last]
+	return items[:last]
+}
+
+/*
+Encodes a log record.
+*/
+func encodeRecord(o op, idx, value int) []byte {
+	b := make([]byte, recordSize)
+	b[0] = byte(o)
+	binary.BigEndian.PutUint64(b[1:9], uint64(idx))
+	binary.BigEndian.PutUint64(b[9:17], uint64(value))
+	binary.BigEndian.PutUint32(b[17:], crc32.ChecksumIEEE(b[:17]))
+	return b
+}
+
+/*
+Decodes a log record, and returns false if its checksum does not match.
+*/
+func decodeRecord(b []byte) (op, int, int, bool) {
+	if crc32.ChecksumIEEE(b[:17]) != binary.BigEndian.Uint32(b[17:]) {
+		return 0, 0, 0, false
+	}
+
+	return op(b[0]), int(int64(binary.BigEndian.Uint64(b[1:9]))), int(int64(binary.BigEndian.Uint64(b[9:17]))), true
+}
+
+/*
+Writes b to the file at path and syncs it to disk.
+*/
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/*
+SyncDir syncs a directory to disk, making the creation and renames of files in it durable.
+*/
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,338 @@
+package persistence
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	cases := []struct {
+		name     string
+		initial  []int
+		appends  [][2]int
+		expItems []int
+	}{
+		{
+			name:     "fresh directory, should use initial items",
+			initial:  []int{1, 1, 1},
+			expItems: []int{1, 1, 1},
+		},
+		{
+			name:     "existing directory, should recover appended changes and ignore initial items",
+			initial:  []int{1, 1, 1},
+			appends:  [][2]int{{0, 5}, {2, 7}, {0, 9}},
+			expItems: []int{9, 1, 7},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			s, items, err := Open(dir, c.initial, DefaultSnapshotInterval)
+			require.NoError(t, err)
+			require.Equal(t, c.initial, items)
+
+			for _, a := range c.appends {
+				require.NoError(t, s.Append(a[0], a[1]))
+			}
+
+			// Simulate a crash by closing the log without writing a final snapshot
+			require.NoError(t, s.wal.Close())
+
+			_, items, err = Open(dir, []int{2, 2, 2, 2}, DefaultSnapshotInterval)
+			require.NoError(t, err)
+			require.Equal(t, c.expItems, items)
+		})
+	}
+}
+
+func TestAppend(t *testing.T) {
+	cases := []struct {
+		name       string
+		idx        int
+		value      int
+		expError   bool
+		expRecords int
+	}{
+		{
+			name:       "index in range",
+			idx:        1,
+			value:      5,
+			expRecords: 1,
+		},
+		{
+			name:     "negative index, should return error",
+			idx:      -1,
+			value:    5,
+			expError: true,
+		},
+		{
+			name:     "index out of range, should return error",
+			idx:      2,
+			value:    5,
+			expError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, _, err := Open(t.TempDir(), []int{1, 1}, DefaultSnapshotInterval)
+			require.NoError(t, err)
+			defer s.Close()
+
+			err = s.Append(c.idx, c.value)
+			if c.expError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, c.expRecords, s.records)
+		})
+	}
+}
+
+func TestSnapshotCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	s, _, err := Open(dir, []int{1, 1}, 2)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Append(0, 3))
+	require.NoError(t, s.Append(1, 4))
+
+	// The second append reaches the snapshot interval and compacts the log
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), info.Size())
+
+	require.NoError(t, s.Append(0, 5))
+	info, err = os.Stat(filepath.Join(dir, walFileName))
+	require.NoError(t, err)
+	require.Equal(t, int64(recordSize), info.Size())
+
+	require.NoError(t, s.wal.Close())
+
+	_, items, err := Open(dir, nil, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 4}, items)
+}
+
+func TestReset(t *testing.T) {
+	dir := t.TempDir()
+
+	s, _, err := Open(dir, []int{1, 1, 1}, DefaultSnapshotInterval)
+	require.NoError(t, err)
+	require.NoError(t, s.Append(2, 3))
+
+	// Records appended after the reset must use the indices of the new items
+	require.NoError(t, s.Reset([]int{3, 4}))
+	require.NoError(t, s.Append(1, 5))
+	require.Error(t, s.Append(2, 5))
+	require.Error(t, s.Reset(nil))
+
+	// Simulate a crash by closing the log without writing a final snapshot
+	require.NoError(t, s.wal.Close())
+
+	_, items, err := Open(dir, nil, DefaultSnapshotInterval)
+	require.NoError(t, err)
+	require.Equal(t, []int{3, 5}, items)
+}
+
+func TestAddAndRemove(t *testing.T) {
+	dir := t.TempDir()
+
+	s, _, err := Open(dir, []int{1, 2, 3}, DefaultSnapshotInterval)
+	require.NoError(t, err)
+
+	// Removing an item moves the last item into its place
+	require.NoError(t, s.Add(4))
+	require.NoError(t, s.Remove(0))
+	require.NoError(t, s.Append(2, 5))
+	require.Error(t, s.Append(3, 5))
+	require.Error(t, s.Remove(3))
+
+	// Simulate a crash by closing the log without writing a final snapshot
+	require.NoError(t, s.wal.Close())
+
+	s, items, err := Open(dir, nil, DefaultSnapshotInterval)
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 2, 5}, items)
+
+	// The store must always contain at least 1 item
+	for len(s.items) > 1 {
+		require.NoError(t, s.Remove(0))
+	}
+	require.Error(t, s.Remove(0))
+	require.NoError(t, s.Close())
+}
+
+func TestClose(t *testing.T) {
+	dir := t.TempDir()
+
+	s, _, err := Open(dir, []int{1, 1}, DefaultSnapshotInterval)
+	require.NoError(t, err)
+	require.NoError(t, s.Append(1, 3))
+
+	require.NoError(t, s.Close())
+	require.NoError(t, s.Close())
+	require.Error(t, s.Append(0, 3))
+
+	items, err := loadSnapshot(filepath.Join(dir, snapshotFileName))
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 3}, items)
+}
+
+func TestReplayDamagedLog(t *testing.T) {
+	cases := []struct {
+		name     string
+		damage   func(b []byte) []byte
+		expItems []int
+		expError bool
+	}{
+		{
+			name: "torn record at the end, should be ignored",
+			damage: func(b []byte) []byte {
+				return append(b, encodeRecord(opReplace, 0, 100)[:recordSize/2]...)
+			},
+			expItems: []int{3, 4},
+		},
+		{
+			name: "corrupted record at the end, should be ignored",
+			damage: func(b []byte) []byte {
+				r := encodeRecord(opReplace, 0, 100)
+				r[5] ^= 0xff
+				return append(b, r...)
+			},
+			expItems: []int{3, 4},
+		},
+		{
+			name: "intact record with index out of range, should return error",
+			damage: func(b []byte) []byte {
+				return append(b, encodeRecord(opReplace, 5, 100)...)
+			},
+			expError: true,
+		},
+		{
+			name: "intact record with unknown op, should return error",
+			damage: func(b []byte) []byte {
+				return append(b, encodeRecord(op(99), 0, 100)...)
+			},
+			expError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			s, _, err := Open(dir, []int{1, 1}, DefaultSnapshotInterval)
+			require.NoError(t, err)
+			require.NoError(t, s.Append(0, 3))
+			require.NoError(t, s.Append(1, 4))
+			require.NoError(t, s.wal.Close())
+
+			path := filepath.Join(dir, walFileName)
+			b, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(path, c.damage(b), 0o600))
+
+			s, items, err := Open(dir, nil, DefaultSnapshotInterval)
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, c.expItems, items)
+		})
+	}
+}
+
+func TestFailedWriteIsRolledBack(t *testing.T) {
+	cases := []struct {
+		name        string
+		file        func(f *os.File) *failingFile
+		expRollback bool
+	}{
+		{
+			name: "partial write, should be rolled back",
+			file: func(f *os.File) *failingFile { return &failingFile{File: f, failWrite: true} },
+		},
+		{
+			name: "failed sync, should be rolled back",
+			file: func(f *os.File) *failingFile { return &failingFile{File: f, failSync: true} },
+		},
+		{
+			name:        "failed rollback, should refuse further records",
+			file:        func(f *os.File) *failingFile { return &failingFile{File: f, failSync: true, failTruncate: true} },
+			expRollback: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			s, _, err := Open(dir, []int{1, 1, 1}, DefaultSnapshotInterval)
+			require.NoError(t, err)
+			require.NoError(t, s.Append(0, 5))
+
+			f := c.file(s.wal.(*os.File))
+			s.wal = f
+			err = s.Append(1, 6)
+			require.Error(t, err)
+			require.Equal(t, c.expRollback, strings.Contains(err.Error(), "failed to roll back write-ahead log"))
+
+			f.failWrite, f.failSync, f.failTruncate = false, false, false
+			err = s.Append(2, 7)
+			if c.expRollback {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			// Reopen without closing, as if the server crashed, so that the items are recovered from the log
+			_, items, err := Open(dir, nil, DefaultSnapshotInterval)
+			require.NoError(t, err)
+			require.Equal(t, []int{5, 1, 7}, items)
+		})
+	}
+}
+
+/*
+failingFile is a log file that fails writes after writing half of the bytes, syncs and truncates, if set.
+*/
+type failingFile struct {
+	*os.File
+	failWrite    bool
+	failSync     bool
+	failTruncate bool
+}
+
+func (f *failingFile) Write(b []byte) (int, error) {
+	if f.failWrite {
+		n, _ := f.File.Write(b[:len(b)/2])
+		return n, errors.New("disk full")
+	}
+	return f.File.Write(b)
+}
+
+func (f *failingFile) Sync() error {
+	if f.failSync {
+		return errors.New("disk full")
+	}
+	return f.File.Sync()
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errors.New("disk full")
+	}
+	return f.File.Truncate(size)
+}
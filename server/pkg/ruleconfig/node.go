@@ -0,0 +1,241 @@
+package ruleconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+nodeKind is the kind of a JSON value.
+*/
+type nodeKind int
+
+const (
+	objectNode nodeKind = iota
+	arrayNode
+	stringNode
+	numberNode
+	boolNode
+	nullNode
+)
+
+/*
+Returns the name of the kind, as used in error messages.
+*/
+func (k nodeKind) String() string {
+	switch k {
+	case objectNode:
+		return "an object"
+	case arrayNode:
+		return "an array"
+	case stringNode:
+		return "a string"
+	case numberNode:
+		return "a number"
+	case boolNode:
+		return "a boolean"
+	default:
+		return "null"
+	}
+}
+
+/*
+node is a JSON value together with its offset in the configuration, so that errors can point at it.
+*/
+type node struct {
+	kind   nodeKind
+	offset int64
+	fields []field
+	items  []*node
+	str    string
+	num    json.Number
+}
+
+/*
+field is a field of a JSON object, together with the offset of its key.
+*/
+type field struct {
+	key    string
+	offset int64
+	value  *node
+}
+
+/*
+parser parses a JSON document into nodes.
+*/
+type parser struct {
+	data []byte
+	dec  *json.Decoder
+}
+
+/*
+Parses data, which must contain exactly one JSON value, into nodes.
+*/
+func parse(data []byte) (*node, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	p := &parser{data: data, dec: dec}
+
+	n, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+
+	off := p.start()
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, newError(data, off, errors.New("unexpected data after the configuration"))
+	}
+	return n, nil
+}
+
+/*
+Returns the offset of the next token, skipping whitespace and separators, which the decoder does not report.
+*/
+func (p *parser) start() int64 {
+	off := p.dec.InputOffset()
+	for off < int64(len(p.data)) && bytes.IndexByte([]byte(" \t\r\n:,"), p.data[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+/*
+Parses the next value.
+*/
+func (p *parser) value() (*node, error) {
+	off := p.start()
+	tok, err := p.dec.Token()
+	if err != nil {
+		return nil, p.syntaxError(err)
+	}
+
+	n := &node{offset: off}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			n.kind = objectNode
+			err = p.object(n)
+		} else {
+			n.kind = arrayNode
+			err = p.array(n)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case string:
+		n.kind = stringNode
+		n.str = t
+	case json.Number:
+		n.kind = numberNode
+		n.num = t
+	case bool:
+		n.kind = boolNode
+	default:
+		n.kind = nullNode
+	}
+	return n, nil
+}
+
+/*
+Parses the fields of an object up to and including its closing delimiter.
+*/
+func (p *parser) object(n *node) error {
+	for p.dec.More() {
+		off := p.start()
+		tok, err := p.dec.Token()
+		if err != nil {
+			return p.syntaxError(err)
+		}
+
+		v, err := p.value()
+		if err != nil {
+			return err
+		}
+		n.fields = append(n.fields, field{key: tok.(string), offset: off, value: v})
+	}
+
+	if _, err := p.dec.Token(); err != nil {
+		return p.syntaxError(err)
+	}
+	return nil
+}
+
+/*
+Parses the items of an array up to and including its closing delimiter.
+*/
+func (p *parser) array(n *node) error {
+	for p.dec.More() {
+		v, err := p.value()
+		if err != nil {
+			return err
+		}
+		n.items = append(n.items, v)
+	}
+
+	if _, err := p.dec.Token(); err != nil {
+		return p.syntaxError(err)
+	}
+	return nil
+}
+
+/*
+Returns an Error for an error of the decoder, at the offset of the syntax error if it has one.
+*/
+func (p *parser) syntaxError(err error) error {
+	off := p.dec.InputOffset()
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// The offset of a syntax error is just after the offending byte, unless the input ended
+		off = syntaxErr.Offset
+		if off < int64(len(p.data)) && off > 0 {
+			off--
+		}
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		off = int64(len(p.data))
+		err = errors.New("unexpected end of the configuration")
+	}
+	return newError(p.data, off, err)
+}
+
+/*
+Error is an error in a rule configuration, at the line and column it was found at.
+*/
+type Error struct {
+	// Line is the line of the error, starting at 1.
+	Line int
+	// Column is the column of the error in bytes, starting at 1.
+	Column int
+	Err    error
+}
+
+/*
+Creates a new Error at the given offset of data.
+*/
+func newError(data []byte, off int64, err error) *Error {
+	if off > int64(len(data)) {
+		off = int64(len(data))
+	}
+
+	before := data[:off]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return &Error{Line: line, Column: column, Err: err}
+}
+
+/*
+Returns a string representation of the error, with its position.
+*/
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Err)
+}
+
+/*
+Returns the underlying error.
+*/
+func (e *Error) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,468 @@
+/*
+Package ruleconfig loads validation rules for a pawn shop from a JSON configuration file, so that the validation
+policy can be changed without recompiling. A configuration is an object with a list of rules, e.g.
+
+	{
+	  "rules": [
+	    {"rule": "offer_bounds", "min": 1, "max": 1000},
+	    {"rule": "min_profit_margin", "percent": 10},
+	    {"rule": "deny_clients", "clients": ["mallory"]}
+	  ],
+	  "retail_rules": [
+	    {"rule": "deny_clients", "clients": ["mallory"]}
+	  ]
+	}
+
+An offer must be accepted by every rule, and the kind of the rule that rejects an offer is reported
+as the rule of the reason. The min_profit_margin and max_demand_ratio rules are the MinMarginRule and
+MaxItemDemandRule of the pawnshop package, and are reported with their IDs, min_margin and max_item_demand. The rules validate PAWN offers, and the optional retail rules validate SELL and
+BUY offers, whose offer and demand are prices and values. Only the client rules can be retail rules.
+Invalid configurations are reported with the line and column of the error.
+*/
+package ruleconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/pawnshop"
+	"strconv"
+)
+
+/*
+Inventory is an interface for the inventory that rules relative to the current inventory are checked against.
+*/
+type Inventory interface {
+	// Max returns the value of the most valuable item that can be given up for offers, or false if there is none.
+	Max() (int, bool)
+}
+
+/*
+Config is a parsed rule configuration, which can be compiled into rules for an inventory.
+*/
+type Config struct {
+	rules       []ruleSpec
+	retailRules []ruleSpec
+}
+
+/*
+ruleSpec is a parsed rule, which creates the rule for an inventory.
+*/
+type ruleSpec func(inv Inventory) pawnshop.Rule
+
+/*
+Loads the rule configuration from the file at path.
+*/
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rule configuration: %w", err)
+	}
+
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule configuration %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+/*
+Parses a rule configuration. If it is invalid, the returned error is an *Error with the position of the problem.
+*/
+func Parse(data []byte) (*Config, error) {
+	root, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &configParser{data: data}
+	obj, err := c.object(root)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, ok := obj.get("rules")
+	if !ok {
+		return nil, c.errorf(root, "missing field %q", "rules")
+	}
+	retailRules, hasRetail := obj.get("retail_rules")
+	if err := obj.done(); err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if cfg.rules, err = c.rules(rules, "rules", false); err != nil {
+		return nil, err
+	}
+	if hasRetail {
+		if cfg.retailRules, err = c.rules(retailRules, "retail_rules", true); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+/*
+Returns the number of rules in the configuration.
+*/
+func (c *Config) Len() int {
+	return len(c.rules)
+}
+
+/*
+Returns the rules of the configuration, checked against the given inventory.
+*/
+func (c *Config) Rules(inv Inventory) []pawnshop.Rule {
+	return build(c.rules, inv)
+}
+
+/*
+Returns the retail rules of the configuration, checked against the given inventory.
+*/
+func (c *Config) RetailRules(inv Inventory) []pawnshop.Rule {
+	return build(c.retailRules, inv)
+}
+
+/*
+Returns the rules of the given specs, checked against the given inventory.
+*/
+func build(specs []ruleSpec, inv Inventory) []pawnshop.Rule {
+	rules := make([]pawnshop.Rule, len(specs))
+	for i, spec := range specs {
+		rules[i] = spec(inv)
+	}
+	return rules
+}
+
+/*
+configParser turns the nodes of a configuration into rules.
+*/
+type configParser struct {
+	data []byte
+}
+
+/*
+Returns an Error at the position of n.
+*/
+func (c *configParser) errorf(n *node, format string, args ...any) error {
+	return newError(c.data, n.offset, fmt.Errorf(format, args...))
+}
+
+/*
+Parses the array n of rules in the field with the given name. If retail is true, only client rules are allowed.
+*/
+func (c *configParser) rules(n *node, name string, retail bool) ([]ruleSpec, error) {
+	if n.kind != arrayNode {
+		return nil, c.errorf(n, "%s must be an array, got %s", name, n.kind)
+	}
+
+	var specs []ruleSpec
+	for _, r := range n.items {
+		spec, err := c.rule(r, retail)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+/*
+Parses a single rule, which is an object whose rule field names the kind of rule.
+If retail is true, only client rules are allowed.
+*/
+func (c *configParser) rule(n *node, retail bool) (ruleSpec, error) {
+	obj, err := c.object(n)
+	if err != nil {
+		return nil, err
+	}
+
+	kind, ok := obj.get("rule")
+	if !ok {
+		return nil, c.errorf(n, "missing field %q", "rule")
+	}
+	if kind.kind != stringNode {
+		return nil, c.errorf(kind, "rule must be a string, got %s", kind.kind)
+	}
+
+	if retail && kind.str != "allow_clients" && kind.str != "deny_clients" {
+		return nil, c.errorf(kind, "rule %q can not validate retail offers", kind.str)
+	}
+
+	var spec ruleSpec
+	switch kind.str {
+	case "offer_bounds":
+		spec, err = c.bounds(obj, "offer", func(o messages.Offer) int { return o.Offer })
+	case "demand_bounds":
+		spec, err = c.bounds(obj, "demand", func(o messages.Offer) int { return o.Demand })
+	case "min_profit":
+		spec, err = c.minProfit(obj)
+	case "min_profit_margin":
+		spec, err = c.minProfitMargin(obj)
+	case "max_demand_ratio":
+		spec, err = c.maxDemandRatio(obj)
+	case "allow_clients":
+		spec, err = c.clients(obj, true)
+	case "deny_clients":
+		spec, err = c.clients(obj, false)
+	default:
+		return nil, c.errorf(kind, "unknown rule %q", kind.str)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := obj.done(); err != nil {
+		return nil, err
+	}
+
+	// The kind of a rule is its stable ID, unless it is a rule of the pawnshop library, which has its own
+	id := kind.str
+	return func(inv Inventory) pawnshop.Rule {
+		return pawnshop.WithID(id, spec(inv))
+	}, nil
+}
+
+/*
+Parses a bounds rule, which requires a value of the offer to be at least min and at most max.
+*/
+func (c *configParser) bounds(obj *object, name string, value func(o messages.Offer) int) (ruleSpec, error) {
+	minNode, hasMin := obj.get("min")
+	maxNode, hasMax := obj.get("max")
+	if !hasMin && !hasMax {
+		return nil, c.errorf(obj.n, "%s_bounds must have a min or a max", name)
+	}
+
+	min, max := math.MinInt, math.MaxInt
+	var err error
+	if hasMin {
+		if min, err = c.integer(minNode, "min"); err != nil {
+			return nil, err
+		}
+	}
+	if hasMax {
+		if max, err = c.integer(maxNode, "max"); err != nil {
+			return nil, err
+		}
+		if max < min {
+			return nil, c.errorf(maxNode, "max must not be less than min %d", min)
+		}
+	}
+
+	return func(Inventory) pawnshop.Rule {
+		return pawnshop.RuleFunc(func(_ context.Context, o messages.Offer) error {
+			v := value(o)
+			if v < min {
+				return fmt.Errorf("%s must be at least %d", name, min)
+			}
+			if v > max {
+				return fmt.Errorf("%s must be at most %d", name, max)
+			}
+			return nil
+		})
+	}, nil
+}
+
+/*
+Parses a minimum profit rule, which requires the offer to exceed the demand by at least amount.
+*/
+func (c *configParser) minProfit(obj *object) (ruleSpec, error) {
+	n, ok := obj.get("amount")
+	if !ok {
+		return nil, c.errorf(obj.n, "missing field %q", "amount")
+	}
+	amount, err := c.integer(n, "amount")
+	if err != nil {
+		return nil, err
+	}
+	if amount <= 0 {
+		return nil, c.errorf(n, "amount must be positive, got %d", amount)
+	}
+
+	return func(Inventory) pawnshop.Rule {
+		return pawnshop.RuleFunc(func(_ context.Context, o messages.Offer) error {
+			profit := new(big.Int).Sub(big.NewInt(int64(o.Offer)), big.NewInt(int64(o.Demand)))
+			if profit.Cmp(big.NewInt(int64(amount))) < 0 {
+				return fmt.Errorf("offer must exceed demand by at least %d", amount)
+			}
+			return nil
+		})
+	}, nil
+}
+
+/*
+Parses a minimum profit margin rule, which requires the offer to exceed the demand by at least
+the given percent of the offer. It is a pawnshop.MinMarginRule.
+*/
+func (c *configParser) minProfitMargin(obj *object) (ruleSpec, error) {
+	n, ok := obj.get("percent")
+	if !ok {
+		return nil, c.errorf(obj.n, "missing field %q", "percent")
+	}
+	bp, err := c.percent(n)
+	if err != nil {
+		return nil, err
+	}
+	if bp <= 0 || bp >= 10000 {
+		return nil, c.errorf(n, "percent must be greater than 0 and less than 100, got %s", n.num)
+	}
+
+	rule, err := pawnshop.NewMinMarginRule(float64(bp) / 10000)
+	if err != nil {
+		return nil, c.errorf(n, "%w", err)
+	}
+	return func(Inventory) pawnshop.Rule {
+		return rule
+	}, nil
+}
+
+/*
+Parses a maximum demand ratio rule, which requires the demand to be at most the given percent
+of the most valuable item in the inventory. It is a pawnshop.MaxItemDemandRule.
+*/
+func (c *configParser) maxDemandRatio(obj *object) (ruleSpec, error) {
+	n, ok := obj.get("percent")
+	if !ok {
+		return nil, c.errorf(obj.n, "missing field %q", "percent")
+	}
+	bp, err := c.percent(n)
+	if err != nil {
+		return nil, err
+	}
+	if bp <= 0 {
+		return nil, c.errorf(n, "percent must be greater than 0, got %s", n.num)
+	}
+	ratio := float64(bp) / 10000
+	if _, err := pawnshop.NewMaxItemDemandRatioRule(nil, ratio); err != nil {
+		return nil, c.errorf(n, "%w", err)
+	}
+
+	return func(inv Inventory) pawnshop.Rule {
+		// The ratio was checked above, so the rule can be created for any inventory
+		rule, _ := pawnshop.NewMaxItemDemandRatioRule(inv, ratio)
+		return rule
+	}, nil
+}
+
+/*
+Parses a client list rule. If allow is true, only the listed clients may make offers,
+otherwise the listed clients may not. Clients are listed by common name or certificate fingerprint.
+*/
+func (c *configParser) clients(obj *object, allow bool) (ruleSpec, error) {
+	n, ok := obj.get("clients")
+	if !ok {
+		return nil, c.errorf(obj.n, "missing field %q", "clients")
+	}
+	if n.kind != arrayNode {
+		return nil, c.errorf(n, "clients must be an array, got %s", n.kind)
+	}
+	if len(n.items) == 0 {
+		return nil, c.errorf(n, "clients must not be empty")
+	}
+
+	listed := make(map[string]bool, len(n.items))
+	for _, item := range n.items {
+		if item.kind != stringNode || item.str == "" {
+			return nil, c.errorf(item, "clients must be non-empty strings")
+		}
+		listed[item.str] = true
+	}
+
+	return func(Inventory) pawnshop.Rule {
+		return pawnshop.RuleFunc(func(ctx context.Context, _ messages.Offer) error {
+			id, ok := pawnshop.ClientIdentityFromContext(ctx)
+			isListed := ok && (listed[id.CommonName] || listed[id.Fingerprint])
+			if allow && !isListed {
+				return errors.New("client is not allowed to make offers")
+			}
+			if !allow && isListed {
+				return errors.New("client is denied from making offers")
+			}
+			return nil
+		})
+	}, nil
+}
+
+/*
+Returns the value of n, which must be an integer.
+*/
+func (c *configParser) integer(n *node, name string) (int, error) {
+	if n.kind != numberNode {
+		return 0, c.errorf(n, "%s must be an integer, got %s", name, n.kind)
+	}
+	v, err := strconv.Atoi(n.num.String())
+	if err != nil {
+		return 0, c.errorf(n, "%s must be an integer, got %s", name, n.num)
+	}
+	return v, nil
+}
+
+/*
+Returns the value of n, which must be a percentage, in basis points.
+*/
+func (c *configParser) percent(n *node) (int64, error) {
+	if n.kind != numberNode {
+		return 0, c.errorf(n, "percent must be a number, got %s", n.kind)
+	}
+	v, err := n.num.Float64()
+	if err != nil || v > math.MaxInt64/100 {
+		return 0, c.errorf(n, "percent is out of range, got %s", n.num)
+	}
+	return int64(math.Round(v * 100)), nil
+}
+
+/*
+object is a JSON object whose fields are consumed while parsing, so that unknown fields can be reported.
+*/
+type object struct {
+	c    *configParser
+	n    *node
+	used map[string]bool
+}
+
+/*
+Returns n as an object. Duplicate fields are reported at the second key.
+*/
+func (c *configParser) object(n *node) (*object, error) {
+	if n.kind != objectNode {
+		return nil, c.errorf(n, "expected an object, got %s", n.kind)
+	}
+
+	seen := make(map[string]bool, len(n.fields))
+	for _, f := range n.fields {
+		if seen[f.key] {
+			return nil, newError(c.data, f.offset, fmt.Errorf("duplicate field %q", f.key))
+		}
+		seen[f.key] = true
+	}
+	return &object{c: c, n: n, used: make(map[string]bool, len(n.fields))}, nil
+}
+
+/*
+Returns the value of the field with the given key, and marks it as used.
+*/
+func (o *object) get(key string) (*node, bool) {
+	for _, f := range o.n.fields {
+		if f.key == key {
+			o.used[key] = true
+			return f.value, true
+		}
+	}
+	return nil, false
+}
+
+/*
+Returns an error at the first field that was not used.
+*/
+func (o *object) done() error {
+	for _, f := range o.n.fields {
+		if !o.used[f.key] {
+			return newError(o.c.data, f.offset, fmt.Errorf("unknown field %q", f.key))
+		}
+	}
+	return nil
+}
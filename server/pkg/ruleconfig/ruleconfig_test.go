@@ -0,0 +1,395 @@
+package ruleconfig
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/pawnshop"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+fakeInventory is an Inventory whose most valuable item is max.
+*/
+type fakeInventory struct {
+	max int
+	ok  bool
+}
+
+func (f fakeInventory) Max() (int, bool) {
+	return f.max, f.ok
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		config    string
+		expLine   int
+		expColumn int
+		expError  string
+	}{
+		{
+			name:      "Invalid JSON",
+			config:    "{\n  \"rules\": [x]\n}",
+			expLine:   2,
+			expColumn: 13,
+			expError:  "invalid character 'x' looking for beginning of value",
+		},
+		{
+			name:      "Truncated JSON",
+			config:    "{\n  \"rules\": [\n",
+			expLine:   3,
+			expColumn: 1,
+			expError:  "unexpected end of JSON input",
+		},
+		{
+			name:      "Data after the configuration",
+			config:    `{"rules": []} {}`,
+			expLine:   1,
+			expColumn: 15,
+			expError:  "unexpected data after the configuration",
+		},
+		{
+			name:      "Not an object",
+			config:    `[]`,
+			expLine:   1,
+			expColumn: 1,
+			expError:  "expected an object, got an array",
+		},
+		{
+			name:      "Missing rules",
+			config:    `{}`,
+			expLine:   1,
+			expColumn: 1,
+			expError:  `missing field "rules"`,
+		},
+		{
+			name:      "Unknown top level field",
+			config:    "{\n  \"rules\": [],\n  \"rulez\": []\n}",
+			expLine:   3,
+			expColumn: 3,
+			expError:  `unknown field "rulez"`,
+		},
+		{
+			name:      "Duplicate field",
+			config:    `{"rules": [], "rules": []}`,
+			expLine:   1,
+			expColumn: 15,
+			expError:  `duplicate field "rules"`,
+		},
+		{
+			name:      "Unknown rule",
+			config:    "{\"rules\": [\n  {\"rule\": \"max_offer\", \"max\": 5}\n]}",
+			expLine:   2,
+			expColumn: 12,
+			expError:  `unknown rule "max_offer"`,
+		},
+		{
+			name:      "Rule without kind",
+			config:    "{\"rules\": [\n  {\"max\": 5}\n]}",
+			expLine:   2,
+			expColumn: 3,
+			expError:  `missing field "rule"`,
+		},
+		{
+			name:      "Unknown field of a rule",
+			config:    "{\"rules\": [\n  {\"rule\": \"offer_bounds\", \"max\": 5, \"maximum\": 6}\n]}",
+			expLine:   2,
+			expColumn: 38,
+			expError:  `unknown field "maximum"`,
+		},
+		{
+			name:      "Bounds without min or max",
+			config:    "{\"rules\": [\n  {\"rule\": \"demand_bounds\"}\n]}",
+			expLine:   2,
+			expColumn: 3,
+			expError:  "demand_bounds must have a min or a max",
+		},
+		{
+			name:      "Bounds with max less than min",
+			config:    "{\"rules\": [\n  {\"rule\": \"offer_bounds\",\n   \"min\": 5,\n   \"max\": 3}\n]}",
+			expLine:   4,
+			expColumn: 11,
+			expError:  "max must not be less than min 5",
+		},
+		{
+			name:      "Fractional bound",
+			config:    `{"rules": [{"rule": "offer_bounds", "min": 1.5}]}`,
+			expLine:   1,
+			expColumn: 44,
+			expError:  "min must be an integer, got 1.5",
+		},
+		{
+			name:      "Bound that is not a number",
+			config:    `{"rules": [{"rule": "offer_bounds", "min": "1"}]}`,
+			expLine:   1,
+			expColumn: 44,
+			expError:  "min must be an integer, got a string",
+		},
+		{
+			name:      "Minimum profit that is not positive",
+			config:    `{"rules": [{"rule": "min_profit", "amount": 0}]}`,
+			expLine:   1,
+			expColumn: 45,
+			expError:  "amount must be positive, got 0",
+		},
+		{
+			name:      "Minimum profit margin of 100%",
+			config:    `{"rules": [{"rule": "min_profit_margin", "percent": 100}]}`,
+			expLine:   1,
+			expColumn: 53,
+			expError:  "percent must be greater than 0 and less than 100, got 100",
+		},
+		{
+			name:      "Maximum demand ratio without percent",
+			config:    `{"rules": [{"rule": "max_demand_ratio"}]}`,
+			expLine:   1,
+			expColumn: 12,
+			expError:  `missing field "percent"`,
+		},
+		{
+			name:      "Empty client list",
+			config:    `{"rules": [{"rule": "allow_clients", "clients": []}]}`,
+			expLine:   1,
+			expColumn: 49,
+			expError:  "clients must not be empty",
+		},
+		{
+			name:      "Client that is not a string",
+			config:    `{"rules": [{"rule": "deny_clients", "clients": ["alice", 5]}]}`,
+			expLine:   1,
+			expColumn: 58,
+			expError:  "clients must be non-empty strings",
+		},
+		{
+			name:      "Retail rules that are not an array",
+			config:    `{"rules": [], "retail_rules": 5}`,
+			expLine:   1,
+			expColumn: 31,
+			expError:  "retail_rules must be an array, got a number",
+		},
+		{
+			name:      "Retail rule that is not a client rule",
+			config:    `{"rules": [], "retail_rules": [{"rule": "min_profit", "amount": 1}]}`,
+			expLine:   1,
+			expColumn: 41,
+			expError:  `rule "min_profit" can not validate retail offers`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(c.config))
+			require.Nil(t, cfg)
+
+			var cfgErr *Error
+			require.ErrorAs(t, err, &cfgErr)
+			assert.Equal(t, c.expLine, cfgErr.Line)
+			assert.Equal(t, c.expColumn, cfgErr.Column)
+			assert.EqualError(t, cfgErr.Err, c.expError)
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	alice := pawnshop.ClientIdentity{CommonName: "alice", Fingerprint: "a1"}
+	mallory := pawnshop.ClientIdentity{CommonName: "mallory", Fingerprint: "m1"}
+
+	cases := []struct {
+		name      string
+		config    string
+		inventory fakeInventory
+		ctx       context.Context
+		offer     messages.Offer
+		expError  string
+	}{
+		{
+			name:   "Offer within bounds, should not return error",
+			config: `{"rules": [{"rule": "offer_bounds", "min": 2, "max": 10}]}`,
+			offer:  messages.CreateOffer(10, 1),
+		},
+		{
+			name:     "Offer below the bounds, should return error",
+			config:   `{"rules": [{"rule": "offer_bounds", "min": 2, "max": 10}]}`,
+			offer:    messages.CreateOffer(1, 0),
+			expError: "offer must be at least 2",
+		},
+		{
+			name:     "Demand above the bounds, should return error",
+			config:   `{"rules": [{"rule": "demand_bounds", "max": 10}]}`,
+			offer:    messages.CreateOffer(20, 11),
+			expError: "demand must be at most 10",
+		},
+		{
+			name:   "Profit of exactly the minimum, should not return error",
+			config: `{"rules": [{"rule": "min_profit", "amount": 3}]}`,
+			offer:  messages.CreateOffer(5, 2),
+		},
+		{
+			name:     "Profit below the minimum, should return error",
+			config:   `{"rules": [{"rule": "min_profit", "amount": 3}]}`,
+			offer:    messages.CreateOffer(5, 3),
+			expError: "offer must exceed demand by at least 3",
+		},
+		{
+			name:   "Profit margin of exactly the minimum, should not return error",
+			config: `{"rules": [{"rule": "min_profit_margin", "percent": 12.5}]}`,
+			offer:  messages.CreateOffer(8, 7),
+		},
+		{
+			name:     "Profit margin below the minimum, should return error",
+			config:   `{"rules": [{"rule": "min_profit_margin", "percent": 12.5}]}`,
+			offer:    messages.CreateOffer(9, 8),
+			expError: "offer must exceed demand by at least 12.5% of the offer",
+		},
+		{
+			name:      "Demand of exactly the maximum ratio, should not return error",
+			config:    `{"rules": [{"rule": "max_demand_ratio", "percent": 50}]}`,
+			inventory: fakeInventory{max: 9, ok: true},
+			offer:     messages.CreateOffer(10, 4),
+		},
+		{
+			name:      "Demand above the maximum ratio, should return error",
+			config:    `{"rules": [{"rule": "max_demand_ratio", "percent": 50}]}`,
+			inventory: fakeInventory{max: 9, ok: true},
+			offer:     messages.CreateOffer(10, 5),
+			expError:  "demand must be at most 50% of the most valuable item",
+		},
+		{
+			name:     "Maximum demand ratio without available items, should return error",
+			config:   `{"rules": [{"rule": "max_demand_ratio", "percent": 50}]}`,
+			offer:    messages.CreateOffer(10, 5),
+			expError: "no item can be given up",
+		},
+		{
+			name:   "Allowed client by common name, should not return error",
+			config: `{"rules": [{"rule": "allow_clients", "clients": ["alice"]}]}`,
+			ctx:    pawnshop.WithClientIdentity(context.Background(), alice),
+			offer:  messages.CreateOffer(2, 1),
+		},
+		{
+			name:     "Anonymous client with an allow list, should return error",
+			config:   `{"rules": [{"rule": "allow_clients", "clients": ["alice"]}]}`,
+			offer:    messages.CreateOffer(2, 1),
+			expError: "client is not allowed to make offers",
+		},
+		{
+			name:     "Denied client by fingerprint, should return error",
+			config:   `{"rules": [{"rule": "deny_clients", "clients": ["m1"]}]}`,
+			ctx:      pawnshop.WithClientIdentity(context.Background(), mallory),
+			offer:    messages.CreateOffer(2, 1),
+			expError: "client is denied from making offers",
+		},
+		{
+			name:   "Anonymous client with a deny list, should not return error",
+			config: `{"rules": [{"rule": "deny_clients", "clients": ["m1"]}]}`,
+			offer:  messages.CreateOffer(2, 1),
+		},
+		{
+			name: "Several rules, should return the error of the first rule that does not accept the offer",
+			config: `{"rules": [
+				{"rule": "offer_bounds", "max": 100},
+				{"rule": "min_profit", "amount": 2},
+				{"rule": "demand_bounds", "min": 5}
+			]}`,
+			offer:    messages.CreateOffer(5, 4),
+			expError: "offer must exceed demand by at least 2",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(c.config))
+			require.NoError(t, err)
+
+			v, err := pawnshop.NewValidator(cfg.Rules(c.inventory)...)
+			require.NoError(t, err)
+
+			ctx := c.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+
+			err = v.Validate(ctx, c.offer)
+			if c.expError != "" {
+				require.EqualError(t, err, c.expError)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRuleIDs(t *testing.T) {
+	cases := []struct {
+		name  string
+		rule  string
+		offer messages.Offer
+		expID string
+	}{
+		{name: "Configured rule, should have its kind as ID", rule: `{"rule": "min_profit", "amount": 3}`, offer: messages.CreateOffer(5, 3), expID: "min_profit"},
+		{
+			name:  "Minimum profit margin, should have the ID of the library rule",
+			rule:  `{"rule": "min_profit_margin", "percent": 12.5}`,
+			offer: messages.CreateOffer(9, 8),
+			expID: pawnshop.MinMarginRuleID,
+		},
+		{
+			name:  "Maximum demand ratio, should have the ID of the library rule",
+			rule:  `{"rule": "max_demand_ratio", "percent": 50}`,
+			offer: messages.CreateOffer(10, 5),
+			expID: pawnshop.MaxItemDemandRuleID,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(`{"rules": [` + c.rule + `]}`))
+			require.NoError(t, err)
+
+			v, err := pawnshop.NewValidator(cfg.Rules(fakeInventory{max: 9, ok: true})...)
+			require.NoError(t, err)
+			assert.Equal(t, c.expID, pawnshop.RuleIDFor(v.Validate(context.Background(), c.offer)))
+		})
+	}
+}
+
+func TestRetailRules(t *testing.T) {
+	mallory := pawnshop.WithClientIdentity(context.Background(), pawnshop.ClientIdentity{CommonName: "mallory", Fingerprint: "m1"})
+
+	cfg, err := Parse([]byte(`{
+		"rules": [{"rule": "demand_bounds", "min": 1}],
+		"retail_rules": [{"rule": "deny_clients", "clients": ["mallory"]}]
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, 1, cfg.Len())
+
+	v, err := pawnshop.NewValidator(cfg.RetailRules(fakeInventory{})...)
+	require.NoError(t, err)
+	assert.NoError(t, v.Validate(context.Background(), messages.CreateBuyOffer(0, 5, 6)))
+	assert.EqualError(t, v.Validate(mallory, messages.CreateBuyOffer(0, 5, 6)), "client is denied from making offers")
+
+	cfg, err = Parse([]byte(`{"rules": []}`))
+	require.NoError(t, err)
+	assert.Empty(t, cfg.RetailRules(fakeInventory{}))
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"rules": [{"rule": "min_profit", "amount": 2}]}`), 0o600))
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, cfg.Len())
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"rules": [{"rule": "min_profit"}]}`), 0o600))
+	_, err = Load(path)
+	assert.EqualError(t, err, "invalid rule configuration "+path+`: line 1, column 12: missing field "amount"`)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pawnshop/server/pkg/inventory"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxAdminRequestSize is the maximum size of the body of a request to the admin listener.
+const maxAdminRequestSize = 4096
+
+/*
+ResizeRequest is the request body of POST /inventory/resize.
+*/
+type ResizeRequest struct {
+	// Size is the new size of the inventory.
+	Size int `json:"size"`
+	// Fill is the value of the items added when growing the inventory. Defaults to inventory.DefaultItemValue.
+	Fill *int `json:"fill,omitempty"`
+	// Policy is the shrink policy used when shrinking the inventory. Defaults to inventory.LowestValueFirst.
+	Policy inventory.ShrinkPolicy `json:"policy,omitempty"`
+}
+
+/*
+ResizeResponse is the response body of POST /inventory/resize.
+*/
+type ResizeResponse struct {
+	OldSize int           `json:"old_size"`
+	NewSize int           `json:"new_size"`
+	Removed []RemovedItem `json:"removed"`
+}
+
+/*
+RemovedItem is an item that was liquidated when shrinking the inventory, with the index it had before.
+*/
+type RemovedItem struct {
+	Index int `json:"index"`
+	Value int `json:"value"`
+}
+
+/*
+ErrorResponse is the response body of a failed request to the admin listener.
+*/
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+/*
+Creates the handler of the admin listener. It serves:
+
+  - POST /inventory/resize, with a ResizeRequest as the request body and a ResizeResponse as the response body.
+  - GET /pool, with the PoolStats of the server as the response body.
+  - GET /metrics, with the metrics of the server in the Prometheus text format as the response body.
+  - GET /livez and GET /readyz, the same probes as the HTTP gateway.
+*/
+func (p *PawnShopServer) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/inventory/resize", p.handleAdminResize)
+	mux.HandleFunc("/pool", p.handleAdminPool)
+	mux.Handle("/metrics", p.metrics.registry.Handler())
+	mux.HandleFunc("/livez", p.handleHTTPLive)
+	mux.HandleFunc("/readyz", p.handleHTTPReady)
+	return mux
+}
+
+/*
+Handles GET /pool.
+*/
+func (p *PawnShopServer) handleAdminPool(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p.PoolStats())
+}
+
+/*
+Handles POST /inventory/resize. Invalid requests are answered with 400 Bad Request, and failures
+to resize the inventory with 500 Internal Server Error. Offers continue to be handled while the
+inventory is resized, but wait for the resize to finish.
+*/
+func (p *PawnShopServer) handleAdminResize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ResizeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestSize)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid request: %s", err)})
+		return
+	}
+
+	fill := inventory.DefaultItemValue
+	if req.Fill != nil {
+		fill = *req.Fill
+	}
+	if req.Policy == "" {
+		req.Policy = inventory.LowestValueFirst
+	}
+	if _, err := inventory.ParseShrinkPolicy(string(req.Policy)); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if req.Size < p.opts.Shards {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("size must be at least %d", p.opts.Shards)})
+		return
+	}
+
+	res, err := p.inventory.Resize(req.Size, fill, req.Policy)
+	if err != nil {
+		log.Errorf("Failed to resize inventory: %s", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	resp := ResizeResponse{OldSize: res.OldSize, NewSize: res.NewSize, Removed: make([]RemovedItem, len(res.Removed))}
+	for i, item := range res.Removed {
+		resp.Removed[i] = RemovedItem{Index: item.Index, Value: item.Value}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"pawnshop/server/pkg/framing"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/pawnshop"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminResize(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 3,
+		AdminAddress:  "127.0.0.1:0",
+	})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	require.NotNil(t, s.AdminAddr())
+	require.Equal(t, messages.CreateAcceptedAnswer(1), sendOffer(t, s, `{"code": "PAWN", "offer": 5, "demand": 1}`))
+
+	cases := []struct {
+		name      string
+		method    string
+		body      string
+		expStatus int
+		expBody   any
+		expItems  []int
+	}{
+		{
+			name:      "Grow with default value",
+			method:    http.MethodPost,
+			body:      `{"size": 4}`,
+			expStatus: http.StatusOK,
+			expBody:   ResizeResponse{OldSize: 3, NewSize: 4, Removed: []RemovedItem{}},
+			expItems:  []int{5, 1, 1, 1},
+		},
+		{
+			name:      "Grow with supplied value",
+			method:    http.MethodPost,
+			body:      `{"size": 5, "fill": 3}`,
+			expStatus: http.StatusOK,
+			expBody:   ResizeResponse{OldSize: 4, NewSize: 5, Removed: []RemovedItem{}},
+			expItems:  []int{5, 1, 1, 1, 3},
+		},
+		{
+			name:      "Shrink lowest value first",
+			method:    http.MethodPost,
+			body:      `{"size": 3}`,
+			expStatus: http.StatusOK,
+			expBody: ResizeResponse{OldSize: 5, NewSize: 3, Removed: []RemovedItem{
+				{Index: 1, Value: 1},
+				{Index: 2, Value: 1},
+			}},
+			expItems: []int{5, 1, 3},
+		},
+		{
+			name:      "Shrink oldest first",
+			method:    http.MethodPost,
+			body:      `{"size": 1, "policy": "oldest"}`,
+			expStatus: http.StatusOK,
+			// The item with value 5 was added by an offer before the other items were added by growing
+			expBody: ResizeResponse{OldSize: 3, NewSize: 1, Removed: []RemovedItem{
+				{Index: 0, Value: 5},
+				{Index: 1, Value: 1},
+			}},
+			expItems: []int{3},
+		},
+		{
+			name:      "Size 0",
+			method:    http.MethodPost,
+			body:      `{"size": 0}`,
+			expStatus: http.StatusBadRequest,
+			expItems:  []int{3},
+		},
+		{
+			name:      "Unknown policy",
+			method:    http.MethodPost,
+			body:      `{"size": 2, "policy": "random"}`,
+			expStatus: http.StatusBadRequest,
+			expItems:  []int{3},
+		},
+		{
+			name:      "Malformed request",
+			method:    http.MethodPost,
+			body:      `not a JSON body`,
+			expStatus: http.StatusBadRequest,
+			expItems:  []int{3},
+		},
+		{
+			name:      "Wrong method",
+			method:    http.MethodGet,
+			expStatus: http.StatusMethodNotAllowed,
+			expItems:  []int{3},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, err := http.NewRequest(c.method, "http://"+s.AdminAddr().String()+"/inventory/resize", strings.NewReader(c.body))
+			require.NoError(t, err)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, c.expStatus, resp.StatusCode)
+
+			if c.expBody != nil {
+				expBody, err := json.Marshal(c.expBody)
+				require.NoError(t, err)
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.JSONEq(t, string(expBody), string(body))
+			}
+
+			items, err := s.inventory.Items()
+			require.NoError(t, err)
+			require.Equal(t, c.expItems, items)
+		})
+	}
+}
+
+func TestAdminResizeWhileHandlingOffers(t *testing.T) {
+	for _, shards := range []int{1, 2} {
+		t.Run(fmt.Sprintf("shards=%d", shards), func(t *testing.T) {
+			opts := Options{
+				InventorySize: 10,
+				Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+				AdminAddress:  "127.0.0.1:0",
+				DataDir:       t.TempDir(),
+				Shards:        shards,
+			}
+			s, stopped := startServer(t, opts)
+
+			// Keep sending offers in a session while the inventory is resized
+			var wg sync.WaitGroup
+			wg.Add(1)
+			done := make(chan struct{})
+			go func() {
+				defer wg.Done()
+
+				conn, err := net.Dial("tcp", s.Addrs()[0].String())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close()
+
+				framer, err := framing.New(conn, framing.NewlineMode, framing.DefaultMaxFrameSize)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				for n := 1; ; n++ {
+					select {
+					case <-done:
+						return
+					default:
+					}
+
+					if err = framer.WriteFrame([]byte(fmt.Sprintf(`{"code": "PAWN", "offer": %d, "demand": 1}`, n+1))); err != nil {
+						t.Error(err)
+						return
+					}
+					if _, err = framer.ReadFrame(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+
+			for _, size := range []int{20, 5, 15, 2, 8} {
+				resp, err := http.Post("http://"+s.AdminAddr().String()+"/inventory/resize", "application/json",
+					strings.NewReader(fmt.Sprintf(`{"size": %d}`, size)))
+				require.NoError(t, err)
+				resp.Body.Close()
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+			close(done)
+			wg.Wait()
+
+			items, err := s.inventory.Items()
+			require.NoError(t, err)
+			require.Len(t, items, 8)
+			require.NoError(t, s.Stop())
+			require.NoError(t, <-stopped)
+
+			// The resized inventory and all offers accepted after the resize must be recovered
+			s, stopped = startServer(t, opts)
+			defer func() {
+				require.NoError(t, s.Stop())
+				require.NoError(t, <-stopped)
+			}()
+
+			recovered, err := s.inventory.Items()
+			require.NoError(t, err)
+			require.Equal(t, items, recovered)
+		})
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 3,
+		AdminAddress:  "127.0.0.1:0",
+	})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	conn := dialSession(t, s)
+	require.Equal(t, messages.CreateAcceptedAnswer(1), conn.send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+	require.Equal(t, messages.CreateAcceptedAnswer(1), conn.send(`{"code": "PAWN", "offer": 4, "demand": 1}`))
+	require.Equal(t, invalidAnswer(pawnshop.EnsureProfitRuleID), withoutReasonMessage(t, conn.send(`{"code": "PAWN", "offer": 1, "demand": 2}`)))
+	require.Equal(t, messages.UnsupportedCode, conn.send(`{"code": "STEAL", "offer": 1, "demand": 2}`).Code)
+	require.Equal(t, messages.RejectCode, conn.send(`not an offer`).Code)
+
+	resp, err := http.Get("http://" + s.AdminAddr().String() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	samples := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		require.True(t, ok, line)
+		samples[name] = value
+	}
+
+	expected := map[string]string{
+		`pawnshop_offers_received_total{code="PAWN"}`:                                    "3",
+		`pawnshop_offers_received_total{code="other"}`:                                   "2",
+		`pawnshop_offers_accepted_total{code="PAWN"}`:                                    "2",
+		`pawnshop_offers_rejected_total{answer="REJECT",reason="INVALID_OFFER"}`:         "1",
+		`pawnshop_offers_rejected_total{answer="REJECT",reason="MALFORMED_OFFER"}`:       "1",
+		`pawnshop_offers_rejected_total{answer="UNSUPPORTED",reason="UNSUPPORTED_CODE"}`: "1",
+		`pawnshop_offer_handling_seconds_count`:                                          "4",
+		`pawnshop_inventory_lock_wait_seconds_count`:                                     "2",
+		`pawnshop_open_connections`:                                                      "1",
+		`pawnshop_active_connections`:                                                    "1",
+		`pawnshop_queued_connections`:                                                    "0",
+		`pawnshop_inventory_items`:                                                       "3",
+		`pawnshop_inventory_value`:                                                       "10",
+		`pawnshop_inventory_min_item_value`:                                              "1",
+		`pawnshop_inventory_max_item_value`:                                              "5",
+	}
+	for name, value := range expected {
+		require.Equal(t, value, samples[name], name)
+	}
+}
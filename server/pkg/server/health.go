@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+State is the state of a server in its lifecycle, as reported by its probes.
+*/
+type State string
+
+const (
+	// StartingState is the state of a server that has been created, but is not accepting connections yet.
+	StartingState State = "starting"
+	// ReadyState is the state of a server that is accepting connections. The inventory has been loaded, or recovered
+	// from the data directory, by the time a server is created, so a server is ready as soon as its listeners are.
+	ReadyState State = "ready"
+	// DrainingState is the state of a server that is being stopped. It keeps handling offers on open connections
+	// until they are closed, but is no longer ready to take new traffic.
+	DrainingState State = "draining"
+	// StoppedState is the state of a server that has stopped completely.
+	StoppedState State = "stopped"
+)
+
+/*
+ProbeOptions configures the TCP probes of a server, and how a server drains before it stops.
+The HTTP probes are served by the HTTP gateway and the admin listener.
+*/
+type ProbeOptions struct {
+	// LivenessAddress is the host:port pair of the TCP liveness probe, which accepts connections for as long as
+	// the server is responsive, and answers each with the state of the server. It is disabled if empty.
+	LivenessAddress string
+	// ReadinessAddress is the host:port pair of the TCP readiness probe, which only accepts connections while the
+	// server is ready, and answers each with the state of the server. It is disabled if empty.
+	ReadinessAddress string
+	// DrainDelay is how long a stopping server keeps its listeners open after it stops being ready,
+	// so that load balancers notice the failing readiness probes before connections are refused. Defaults to 0.
+	DrainDelay time.Duration
+}
+
+/*
+Returns a copy of the probe options with defaults applied, or an error if any option is invalid.
+*/
+func (o ProbeOptions) withDefaults() (ProbeOptions, error) {
+	if o.DrainDelay < 0 {
+		return ProbeOptions{}, errors.New("drain delay can not be negative")
+	}
+	return o, nil
+}
+
+/*
+Returns the state of the server.
+*/
+func (p *PawnShopServer) State() State {
+	return p.state.Load().(State)
+}
+
+/*
+Sets the state of the server to next if it is in the state from. Returns false if it is in another state.
+*/
+func (p *PawnShopServer) transition(from, next State) bool {
+	if !p.state.CompareAndSwap(from, next) {
+		return false
+	}
+	log.Debugf("Server is %s", next)
+	return true
+}
+
+/*
+Accepts connections on a TCP probe until its listener is closed.
+*/
+func (p *PawnShopServer) acceptProbes(l net.Listener) {
+	defer p.wg.Done()
+
+	log.Infof("Started probe, listening at %s", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Debugf("Stopped probe at %s", l.Addr())
+				return
+			}
+			log.Errorf("Failed to accept probe: %s", err)
+			continue
+		}
+		go p.answerProbe(conn)
+	}
+}
+
+/*
+Answers a TCP probe with the state of the server, and closes it.
+*/
+func (p *PawnShopServer) answerProbe(conn net.Conn) {
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(p.opts.WriteTimeout)); err != nil {
+		log.Debugf("Failed to set write deadline on probe: %s", err)
+		return
+	}
+	if _, err := conn.Write([]byte(p.State() + "\n")); err != nil {
+		log.Debugf("Failed to answer probe: %s", err)
+	}
+}
+
+/*
+Handles GET /livez, and GET /healthz for backwards compatibility.
+*/
+func (p *PawnShopServer) handleHTTPLive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+/*
+Handles GET /readyz. The status of the response is the state of the server.
+*/
+func (p *PawnShopServer) handleHTTPReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := p.State()
+	if state != ReadyState {
+		writeJSON(w, http.StatusServiceUnavailable, HealthResponse{Status: string(state)})
+		return
+	}
+	writeJSON(w, http.StatusOK, HealthResponse{Status: string(state)})
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"pawnshop/server/pkg/messages"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerProbes(t *testing.T) {
+	s, err := NewPawnShopServer(Options{
+		InventorySize: 2,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		HTTPAddress:   "127.0.0.1:0",
+		AdminAddress:  "127.0.0.1:0",
+		Probes: ProbeOptions{
+			LivenessAddress:  "127.0.0.1:0",
+			ReadinessAddress: "127.0.0.1:0",
+			DrainDelay:       200 * time.Millisecond,
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, StartingState, s.State())
+	require.Nil(t, s.LivenessAddr())
+	require.Nil(t, s.ReadinessAddr())
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(t, s)
+
+	gateway := "http://" + s.HTTPAddr().String()
+	admin := "http://" + s.AdminAddr().String()
+	liveness := s.LivenessAddr().String()
+	readiness := s.ReadinessAddr().String()
+
+	// A ready server passes every probe
+	for _, base := range []string{gateway, admin} {
+		requireProbe(t, base+"/livez", http.StatusOK, "ok")
+		requireProbe(t, base+"/readyz", http.StatusOK, "ready")
+	}
+	requireProbe(t, gateway+"/healthz", http.StatusOK, "ok")
+	require.Equal(t, "ready\n", readTCPProbe(t, liveness))
+	require.Equal(t, "ready\n", readTCPProbe(t, readiness))
+
+	sess := dialSession(t, s)
+	stopErr := make(chan error, 1)
+	go func() {
+		stopErr <- s.Stop()
+	}()
+	for s.State() != DrainingState {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A draining server fails its readiness probes, but stays live and keeps handling offers until the drain delay
+	// is over
+	for _, base := range []string{gateway, admin} {
+		requireProbe(t, base+"/livez", http.StatusOK, "ok")
+		requireProbe(t, base+"/readyz", http.StatusServiceUnavailable, "draining")
+	}
+	require.Equal(t, "draining\n", readTCPProbe(t, liveness))
+	_, err = net.Dial("tcp", readiness)
+	require.Error(t, err)
+	require.False(t, s.IsRunning())
+	require.Equal(t, messages.CreateAcceptedAnswer(1), sess.send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+
+	require.NoError(t, <-stopErr)
+	require.NoError(t, <-stopped)
+	require.Equal(t, StoppedState, s.State())
+	_, err = net.Dial("tcp", liveness)
+	require.Error(t, err)
+}
+
+/*
+Requires that the HTTP probe at url responds with the given status code and status.
+*/
+func requireProbe(t *testing.T, url string, expStatus int, status string) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, expStatus, resp.StatusCode, url)
+	var health HealthResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+	require.Equal(t, HealthResponse{Status: status}, health, url)
+}
+
+/*
+Connects to the TCP probe at addr, and returns its answer.
+*/
+func readTCPProbe(t *testing.T, addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	answer, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(answer)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"pawnshop/server/pkg/logging"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/tracing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+inventoryViewer is an interface for viewing the items of an inventory.
+*/
+type inventoryViewer interface {
+	Items() ([]int, error)
+}
+
+/*
+InventoryResponse is the response body of GET /inventory.
+*/
+type InventoryResponse struct {
+	Items []int `json:"items"`
+}
+
+/*
+HealthResponse is the response body of the health endpoints.
+*/
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+/*
+Creates the handler of the HTTP gateway. The gateway exposes the same offer handler and inventory as
+the TCP listeners, so that TCP and HTTP clients see one consistent inventory. It serves:
+
+  - POST /offers, with a messages.Offer as the request body and a messages.Answer as the response body.
+  - GET /inventory, with an InventoryResponse as the response body.
+  - GET /livez and GET /healthz, which respond with 200 OK as long as the server process is responsive.
+  - GET /readyz, which responds with 200 OK if the server is ready, and 503 otherwise, with the state of the server
+    as the status of the response body.
+
+Requests to /offers and /inventory count as open connections of their remote address towards the connection
+limits while they are handled. Requests over a limit are answered with a THROTTLED answer and 429 Too Many Requests.
+*/
+func (p *PawnShopServer) newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/offers", p.limitHTTP(p.handleHTTPOffer))
+	mux.Handle("/inventory", p.limitHTTP(p.handleHTTPInventory))
+	mux.HandleFunc("/livez", p.handleHTTPLive)
+	mux.HandleFunc("/healthz", p.handleHTTPLive)
+	mux.HandleFunc("/readyz", p.handleHTTPReady)
+	return mux
+}
+
+/*
+Returns a handler that handles requests with h, as long as their remote address is within the connection limits.
+*/
+func (p *PawnShopServer) limitHTTP(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := addrKey(r.RemoteAddr)
+		if err := p.limiter.acquireConn(addr); err != nil {
+			log.Warnf("Rejecting HTTP request from %s: %s", r.RemoteAddr, err)
+			writeJSON(w, http.StatusTooManyRequests, messages.CreateThrottledAnswerFor(err))
+			return
+		}
+		defer p.limiter.releaseConn(addr)
+
+		h(w, r)
+	})
+}
+
+/*
+Handles POST /offers. Malformed offers are answered with a reject answer and 400 Bad Request,
+and offers larger than the maximum frame size of the gateway with an error answer and 413 Request Entity Too Large.
+*/
+func (p *PawnShopServer) handleHTTPOffer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, messages.CreateRejectAnswer())
+		return
+	}
+
+	start := time.Now()
+	connID := logging.NewID()
+	ctx := logging.WithFields(r.Context(), log.Fields{
+		logging.ConnIDField:     connID,
+		logging.RemoteAddrField: r.RemoteAddr,
+	})
+
+	var off messages.Offer
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(p.opts.HTTPMaxFrameSize))).Decode(&off); err != nil {
+		logging.FromContext(ctx).Errorf("Failed to decode offer from HTTP request: %s", err)
+
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, messages.CreateErrorAnswerFor(messages.NewError(messages.ReasonFrameTooLarge, err)))
+			return
+		}
+		writeJSON(w, http.StatusBadRequest, malformedOfferAnswer(err))
+		return
+	}
+
+	// The trace context of the client may also be given in the traceparent header of the W3C Trace Context
+	if off.TraceParent == "" {
+		off.TraceParent = r.Header.Get("traceparent")
+	}
+	ctx, span := p.startOffer(ctx, "PawnShopServer.handleHTTPOffer", off)
+	defer span.End()
+	span.SetAttribute(tracing.ConnIDAttribute, connID)
+	span.SetAttribute(tracing.RemoteAddrAttribute, r.RemoteAddr)
+
+	logging.FromContext(ctx).Debugf("Received offer from HTTP client: %+v", off)
+	ans := p.handleOffer(withClientKey(ctx, addrKey(r.RemoteAddr)), off)
+	recordAnswer(ctx, ans, time.Since(start))
+	if ans.Code == messages.ThrottledCode {
+		writeJSON(w, http.StatusTooManyRequests, ans)
+		return
+	}
+	writeJSON(w, http.StatusOK, ans)
+}
+
+/*
+Handles GET /inventory.
+*/
+func (p *PawnShopServer) handleHTTPInventory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	items, err := p.inventory.Items()
+	if err != nil {
+		log.Errorf("Failed to get inventory items: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, InventoryResponse{Items: items})
+}
+
+/*
+Writes v as a JSON response body with the given status code.
+*/
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Failed to marshal HTTP response: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(b); err != nil {
+		log.Errorf("Failed to write HTTP response: %s", err)
+	}
+}
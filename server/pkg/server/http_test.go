@@ -0,0 +1,256 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"pawnshop/server/pkg/framing"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/pawnshop"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPGateway(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 2,
+		HTTPAddress:   "127.0.0.1:0",
+	})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	require.NotNil(t, s.HTTPAddr())
+	baseURL := "http://" + s.HTTPAddr().String()
+
+	cases := []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		expStatus int
+		expBody   any
+	}{
+		{
+			name:      "Accepted offer",
+			method:    http.MethodPost,
+			path:      "/offers",
+			body:      `{"code": "PAWN", "offer": 5, "demand": 1}`,
+			expStatus: http.StatusOK,
+			expBody:   messages.CreateAcceptedAnswer(1),
+		},
+		{
+			name:      "Rejected offer",
+			method:    http.MethodPost,
+			path:      "/offers",
+			body:      `{"code": "PAWN", "offer": 5, "demand": 6}`,
+			expStatus: http.StatusOK,
+			expBody:   invalidAnswer(pawnshop.EnsureProfitRuleID),
+		},
+		{
+			name:      "Malformed offer",
+			method:    http.MethodPost,
+			path:      "/offers",
+			body:      `not a JSON body`,
+			expStatus: http.StatusBadRequest,
+			expBody:   rejectAnswer(messages.ReasonMalformedOffer),
+		},
+		{
+			name:      "Oversized offer",
+			method:    http.MethodPost,
+			path:      "/offers",
+			body:      `{"code": "` + strings.Repeat("A", framing.DefaultMaxFrameSize) + `"}`,
+			expStatus: http.StatusRequestEntityTooLarge,
+			expBody:   errorAnswer(messages.ReasonFrameTooLarge),
+		},
+		{
+			name:      "Wrong method for offers",
+			method:    http.MethodGet,
+			path:      "/offers",
+			expStatus: http.StatusMethodNotAllowed,
+			expBody:   messages.CreateRejectAnswer(),
+		},
+		{
+			name:      "Inventory",
+			method:    http.MethodGet,
+			path:      "/inventory",
+			expStatus: http.StatusOK,
+			expBody:   InventoryResponse{Items: []int{5, 1}},
+		},
+		{
+			name:      "Health",
+			method:    http.MethodGet,
+			path:      "/healthz",
+			expStatus: http.StatusOK,
+			expBody:   HealthResponse{Status: "ok"},
+		},
+		{
+			name:      "Readiness",
+			method:    http.MethodGet,
+			path:      "/readyz",
+			expStatus: http.StatusOK,
+			expBody:   HealthResponse{Status: "ready"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, err := http.NewRequest(c.method, baseURL+c.path, strings.NewReader(c.body))
+			require.NoError(t, err)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, c.expStatus, resp.StatusCode)
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			// Only the reason codes of answers are compared, see withoutReasonMessage
+			if expAnswer, ok := c.expBody.(messages.Answer); ok {
+				var answer messages.Answer
+				require.NoError(t, json.Unmarshal(body, &answer))
+				require.Equal(t, expAnswer, withoutReasonMessage(t, answer))
+				return
+			}
+
+			expBody, err := json.Marshal(c.expBody)
+			require.NoError(t, err)
+			require.JSONEq(t, string(expBody), string(body))
+		})
+	}
+}
+
+func TestHTTPGatewaySharesInventoryWithTCP(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 1,
+		HTTPAddress:   "127.0.0.1:0",
+	})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(`{"code": "PAWN", "offer": 3, "demand": 1}` + "\n"))
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 128))
+	require.NoError(t, err)
+
+	// The item received over TCP must be the item handed out over HTTP
+	resp, err := http.Post("http://"+s.HTTPAddr().String()+"/offers", "application/json",
+		strings.NewReader(`{"code": "PAWN", "offer": 4, "demand": 3}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var answer messages.Answer
+	err = json.NewDecoder(resp.Body).Decode(&answer)
+	require.NoError(t, err)
+	require.Equal(t, messages.CreateAcceptedAnswer(3), answer)
+}
+
+func TestHTTPGatewayRateLimit(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 2,
+		HTTPAddress:   "127.0.0.1:0",
+		Limits:        LimitOptions{Rate: 0.001, Burst: 1},
+	})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	post := func() (int, messages.Answer) {
+		resp, err := http.Post("http://"+s.HTTPAddr().String()+"/offers", "application/json",
+			strings.NewReader(`{"code": "PAWN", "offer": 4, "demand": 1}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var answer messages.Answer
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&answer))
+		return resp.StatusCode, withoutReasonMessage(t, answer)
+	}
+
+	status, answer := post()
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, messages.CreateAcceptedAnswer(1), answer)
+
+	// Offers over the rate limit are answered with 429 Too Many Requests
+	status, answer = post()
+	require.Equal(t, http.StatusTooManyRequests, status)
+	require.Equal(t, throttledAnswer(messages.ReasonRateLimited), answer)
+}
+
+func TestHTTPGatewayMaxFrameSize(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize:    2,
+		HTTPAddress:      "127.0.0.1:0",
+		HTTPMaxFrameSize: 64,
+	})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	post := func(body string) int {
+		resp, err := http.Post("http://"+s.HTTPAddr().String()+"/offers", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, post(`{"code": "PAWN", "offer": 4, "demand": 1}`))
+	require.Equal(t, http.StatusRequestEntityTooLarge, post(`{"code": "PAWN", "offer": 4, "demand": 1, "quote": "`+strings.Repeat("A", 64)+`"}`))
+}
+
+func TestHTTPGatewayConnectionLimit(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 2,
+		HTTPAddress:   "127.0.0.1:0",
+		Limits:        LimitOptions{MaxConnsPerClient: 1},
+	})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	get := func() (int, messages.Answer) {
+		resp, err := http.Get("http://" + s.HTTPAddr().String() + "/inventory")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var answer messages.Answer
+		if resp.StatusCode == http.StatusTooManyRequests {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&answer))
+		}
+		return resp.StatusCode, withoutReasonMessage(t, answer)
+	}
+
+	// A TCP connection from the same address uses up the only connection of the client
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(`{"code": "PAWN", "offer": 4, "demand": 1}` + "\n"))
+	require.NoError(t, err)
+	var answer messages.Answer
+	require.NoError(t, json.NewDecoder(conn).Decode(&answer))
+
+	status, answer := get()
+	require.Equal(t, http.StatusTooManyRequests, status)
+	require.Equal(t, throttledAnswer(messages.ReasonTooManyConnections), answer)
+
+	// Requests are handled again once the connection is closed
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		status, _ := get()
+		return status == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+}
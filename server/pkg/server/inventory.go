@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"pawnshop/server/pkg/inventory"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/persistence"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+serverInventory is an interface for the inventory of the server, which is either an inventory.Inventory
+or an inventory.ShardedInventory.
+*/
+type serverInventory interface {
+	inventoryViewer
+	HandleOffer(ctx context.Context, o messages.Offer) messages.Answer
+	Max() (int, bool)
+	SetJournal(j inventory.Journal)
+	SetLockObserver(o inventory.LockObserver)
+	Resize(size, fill int, policy inventory.ShrinkPolicy) (inventory.ResizeResult, error)
+	fmt.Stringer
+}
+
+/*
+Creates the inventory of the server, backed by the storage in the options. If the options have a data
+directory, the inventory is recovered from it and journaled to it. If the options have more than one shard,
+the inventory is sharded. Also returns everything that must be closed once the server has stopped,
+in the order it must be closed.
+*/
+func newInventory(opts Options) (serverInventory, []io.Closer, error) {
+	st, closers, err := newStorage(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var store *persistence.Store
+	if opts.DataDir != "" {
+		if store, err = recoverStorage(st, opts); err != nil {
+			closeAll(closers)
+			return nil, nil, err
+		}
+		// The store must be closed before the storage, so that its final snapshot is taken first
+		closers = append([]io.Closer{store}, closers...)
+	}
+
+	var inv serverInventory
+	if opts.Shards > 1 {
+		inv, err = inventory.NewShardedInventory(st, opts.Shards, opts.Routing)
+	} else {
+		inv, err = inventory.NewInventoryWithStorage(st)
+	}
+	if err != nil {
+		closeAll(closers)
+		return nil, nil, fmt.Errorf("failed to create inventory: %w", err)
+	}
+
+	if store != nil {
+		inv.SetJournal(store)
+	}
+
+	return inv, closers, nil
+}
+
+/*
+Creates the storage in the options, containing a fresh inventory of the configured size unless
+the storage already contains items. Also returns everything that must be closed once the server has stopped.
+*/
+func newStorage(opts Options) (inventory.Storage, []io.Closer, error) {
+	if opts.Storage != FileStorage {
+		return inventory.NewMemoryStorage(inventory.DefaultItems(opts.InventorySize)), nil, nil
+	}
+
+	fs, err := inventory.OpenFileStorage(opts.StorageFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	closers := []io.Closer{fs}
+
+	if fs.Size() == 0 {
+		if err = fs.Load(inventory.DefaultItems(opts.InventorySize)); err != nil {
+			closeAll(closers)
+			return nil, nil, err
+		}
+	} else if fs.Size() != opts.InventorySize {
+		log.Warnf("Storage file contains %d items, ignoring configured size %d", fs.Size(), opts.InventorySize)
+	}
+
+	return fs, closers, nil
+}
+
+/*
+Recovers the items in the data directory of the options into the storage, and returns the store
+that every change to the inventory must be journaled to.
+*/
+func recoverStorage(st inventory.Storage, opts Options) (*persistence.Store, error) {
+	items := make([]int, 0, st.Size())
+	err := st.Iterate(func(_, item int) bool {
+		items = append(items, item)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory from storage: %w", err)
+	}
+
+	store, items, err := persistence.Open(opts.DataDir, items, opts.SnapshotInterval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data directory: %w", err)
+	}
+
+	if len(items) != st.Size() {
+		log.Warnf("Recovered inventory has size %d, ignoring configured size %d", len(items), st.Size())
+	}
+
+	if err = st.Load(items); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load recovered inventory into storage: %w", err)
+	}
+
+	return store, nil
+}
+
+/*
+Closes everything in order, and returns all errors that occurred.
+*/
+func closeAll(closers []io.Closer) error {
+	var errs []error
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
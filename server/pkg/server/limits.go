@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"pawnshop/server/pkg/loans"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/pawnshop"
+	"sync"
+	"time"
+)
+
+/*
+LimitOptions configures how much a single client, and all clients together, may use the server.
+Clients are told apart by their certificate if they authenticated with one, and by their remote address otherwise.
+Offers and connections over a limit are answered with a THROTTLED answer. All limits are disabled if 0.
+*/
+type LimitOptions struct {
+	// Rate is the number of offers per second a client may make on average.
+	Rate float64
+	// Burst is the number of offers a client may make at once before it is limited to Rate.
+	// Defaults to Rate rounded up.
+	Burst int
+	// MaxConnsPerClient is the number of connections a single remote address may have open at once.
+	MaxConnsPerClient int
+	// MaxConns is the number of connections all clients may have open at once.
+	MaxConns int
+	// DailyQuota is the number of accepted offers a client may make per day, in UTC.
+	DailyQuota int
+}
+
+/*
+Returns a copy of the limit options with defaults applied, or an error if any option is invalid.
+*/
+func (o LimitOptions) withDefaults() (LimitOptions, error) {
+	if o.Rate < 0 || math.IsNaN(o.Rate) || math.IsInf(o.Rate, 0) {
+		return LimitOptions{}, errors.New("rate limit must be a non-negative number")
+	}
+	if o.Burst < 0 {
+		return LimitOptions{}, errors.New("rate limit burst can not be negative")
+	}
+	if o.Rate > 0 && o.Burst == 0 {
+		o.Burst = int(math.Ceil(o.Rate))
+	}
+	if o.MaxConnsPerClient < 0 || o.MaxConns < 0 {
+		return LimitOptions{}, errors.New("connection limits can not be negative")
+	}
+	if o.DailyQuota < 0 {
+		return LimitOptions{}, errors.New("daily quota can not be negative")
+	}
+	return o, nil
+}
+
+/*
+tokenBucket is a token bucket that fills up at the rate limit, up to the burst.
+*/
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+quota is the number of offers a client has had accepted on a day.
+*/
+type quota struct {
+	day  time.Time
+	used int
+}
+
+/*
+limiter enforces the limit options of a server. It is thread-safe.
+*/
+type limiter struct {
+	opts  LimitOptions
+	clock loans.Clock
+	// conns holds the number of open connections by remote address, and total the number of all open connections
+	conns map[string]int
+	total int
+	// buckets and quotas hold the token bucket and quota of every client by its key, and swept the number
+	// of clients after idle clients were last removed
+	buckets map[string]*tokenBucket
+	quotas  map[string]*quota
+	swept   int
+	lock    sync.Mutex
+}
+
+/*
+Creates a new limiter with the given options, using clock as the source of the current time.
+*/
+func newLimiter(opts LimitOptions, clock loans.Clock) *limiter {
+	return &limiter{
+		opts:    opts,
+		clock:   clock,
+		conns:   make(map[string]int),
+		buckets: make(map[string]*tokenBucket),
+		quotas:  make(map[string]*quota),
+	}
+}
+
+/*
+Acquires a connection for the given remote address. Returns a TOO_MANY_CONNECTIONS error if the address,
+or all clients together, already have the maximum number of connections open.
+Every acquired connection must be released with releaseConn.
+*/
+func (l *limiter) acquireConn(addr string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.opts.MaxConns > 0 && l.total >= l.opts.MaxConns {
+		return messages.Errorf(messages.ReasonTooManyConnections, "the server already has %d connections open", l.total)
+	}
+	if l.opts.MaxConnsPerClient > 0 && l.conns[addr] >= l.opts.MaxConnsPerClient {
+		return messages.Errorf(messages.ReasonTooManyConnections, "client already has %d connections open", l.conns[addr])
+	}
+
+	l.conns[addr]++
+	l.total++
+	return nil
+}
+
+/*
+Releases a connection acquired with acquireConn.
+*/
+func (l *limiter) releaseConn(addr string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.total--
+	if l.conns[addr]--; l.conns[addr] <= 0 {
+		delete(l.conns, addr)
+	}
+}
+
+/*
+Returns the number of connections that are open.
+*/
+func (l *limiter) open() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.total
+}
+
+/*
+Takes a token from the bucket of the client for an offer. Returns a RATE_LIMITED error if the bucket is empty.
+*/
+func (l *limiter) allowOffer(client string) error {
+	if l.opts.Rate == 0 {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.clock.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.opts.Burst), last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens = math.Min(float64(l.opts.Burst), b.tokens+now.Sub(b.last).Seconds()*l.opts.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return messages.Errorf(messages.ReasonRateLimited, "client may make at most %v offers per second", l.opts.Rate)
+	}
+
+	b.tokens--
+	return nil
+}
+
+/*
+Reserves an accepted offer from the daily quota of the client. Returns a QUOTA_EXCEEDED error if the client has
+used up its quota. The reservation must be refunded with refundQuota if the offer is not accepted.
+*/
+func (l *limiter) reserveQuota(client string) error {
+	if l.opts.DailyQuota == 0 {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.sweep(l.clock.Now())
+	day := l.today()
+	q, ok := l.quotas[client]
+	if !ok || !q.day.Equal(day) {
+		q = &quota{day: day}
+		l.quotas[client] = q
+	}
+
+	if q.used >= l.opts.DailyQuota {
+		return messages.Errorf(messages.ReasonQuotaExceeded, "client has used its daily quota of %d accepted offers", l.opts.DailyQuota)
+	}
+
+	q.used++
+	return nil
+}
+
+/*
+Refunds an accepted offer reserved with reserveQuota, for an offer that was not accepted.
+*/
+func (l *limiter) refundQuota(client string) {
+	if l.opts.DailyQuota == 0 {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Reservations of a previous day have already been reset
+	if q, ok := l.quotas[client]; ok && q.day.Equal(l.today()) && q.used > 0 {
+		q.used--
+	}
+}
+
+/*
+Returns the start of the current day in UTC. It is NOT thread-safe.
+*/
+func (l *limiter) today() time.Time {
+	return l.clock.Now().UTC().Truncate(24 * time.Hour)
+}
+
+/*
+Removes the buckets of clients that are full again, and the quotas of previous days, once the number of
+clients has doubled since they were last removed, so that sweeping takes amortized O(1) time.
+It is NOT thread-safe.
+*/
+func (l *limiter) sweep(now time.Time) {
+	if len(l.buckets)+len(l.quotas) <= 2*l.swept {
+		return
+	}
+
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.opts.Rate >= float64(l.opts.Burst) {
+			delete(l.buckets, client)
+		}
+	}
+	day := now.UTC().Truncate(24 * time.Hour)
+	for client, q := range l.quotas {
+		if !q.day.Equal(day) {
+			delete(l.quotas, client)
+		}
+	}
+	l.swept = len(l.buckets) + len(l.quotas)
+}
+
+/*
+Returns the key that connections from the remote address addr are limited by, which is the host of the address
+without its port, so that all connections from the same host count towards the same limit.
+All clients of a Unix domain socket share the same key.
+*/
+func addrKey(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+/*
+clientKeyKey is the context key of the key that the offers of a client are limited by.
+*/
+type clientKeyKey struct{}
+
+/*
+Returns a copy of ctx carrying the key that the offers of its client are limited by, which is the fingerprint
+of its certificate if it authenticated with one, and its remote address otherwise.
+*/
+func withClientKey(ctx context.Context, remote string) context.Context {
+	key := "addr:" + remote
+	if id, ok := pawnshop.ClientIdentityFromContext(ctx); ok {
+		key = "id:" + id.Fingerprint
+	}
+	return context.WithValue(ctx, clientKeyKey{}, key)
+}
+
+/*
+Returns the key that the offers of the client of ctx are limited by.
+*/
+func clientKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(clientKeyKey{}).(string)
+	return key
+}
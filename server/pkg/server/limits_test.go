@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/pawnshop"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitOptionsWithDefaults(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     LimitOptions
+		expected LimitOptions
+		expError bool
+	}{
+		{
+			name:     "No limits",
+			opts:     LimitOptions{},
+			expected: LimitOptions{},
+		},
+		{
+			name:     "Burst defaults to the rate rounded up",
+			opts:     LimitOptions{Rate: 2.5},
+			expected: LimitOptions{Rate: 2.5, Burst: 3},
+		},
+		{
+			name:     "Burst is kept if given",
+			opts:     LimitOptions{Rate: 2.5, Burst: 10},
+			expected: LimitOptions{Rate: 2.5, Burst: 10},
+		},
+		{
+			name:     "Negative rate",
+			opts:     LimitOptions{Rate: -1},
+			expError: true,
+		},
+		{
+			name:     "Negative burst",
+			opts:     LimitOptions{Rate: 1, Burst: -1},
+			expError: true,
+		},
+		{
+			name:     "Negative connection limit",
+			opts:     LimitOptions{MaxConnsPerClient: -1},
+			expError: true,
+		},
+		{
+			name:     "Negative daily quota",
+			opts:     LimitOptions{DailyQuota: -1},
+			expError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts, err := c.opts.withDefaults()
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expected, opts)
+		})
+	}
+}
+
+func TestLimiterConns(t *testing.T) {
+	l := newLimiter(LimitOptions{MaxConnsPerClient: 2, MaxConns: 3}, &fakeClock{})
+
+	require.NoError(t, l.acquireConn("10.0.0.1"))
+	require.NoError(t, l.acquireConn("10.0.0.1"))
+	err := l.acquireConn("10.0.0.1")
+	require.Error(t, err)
+	assert.Equal(t, messages.ReasonTooManyConnections, messages.ReasonFor(err).Code)
+
+	// The global limit applies to all addresses together
+	require.NoError(t, l.acquireConn("10.0.0.2"))
+	err = l.acquireConn("10.0.0.3")
+	require.Error(t, err)
+	assert.Equal(t, messages.ReasonTooManyConnections, messages.ReasonFor(err).Code)
+
+	l.releaseConn("10.0.0.1")
+	require.NoError(t, l.acquireConn("10.0.0.1"))
+	l.releaseConn("10.0.0.2")
+	require.NoError(t, l.acquireConn("10.0.0.3"))
+}
+
+func TestLimiterRate(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := newLimiter(LimitOptions{Rate: 2, Burst: 2}, clock)
+
+	// The burst is available at once
+	require.NoError(t, l.allowOffer("alice"))
+	require.NoError(t, l.allowOffer("alice"))
+	err := l.allowOffer("alice")
+	require.Error(t, err)
+	assert.Equal(t, messages.ReasonRateLimited, messages.ReasonFor(err).Code)
+
+	// Every client has its own bucket
+	require.NoError(t, l.allowOffer("bob"))
+
+	// The bucket fills up at the rate
+	clock.Advance(500 * time.Millisecond)
+	require.NoError(t, l.allowOffer("alice"))
+	require.Error(t, l.allowOffer("alice"))
+
+	// But never beyond the burst
+	clock.Advance(time.Hour)
+	require.NoError(t, l.allowOffer("alice"))
+	require.NoError(t, l.allowOffer("alice"))
+	require.Error(t, l.allowOffer("alice"))
+}
+
+func TestLimiterQuota(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)}
+	l := newLimiter(LimitOptions{DailyQuota: 2}, clock)
+
+	require.NoError(t, l.reserveQuota("alice"))
+	require.NoError(t, l.reserveQuota("alice"))
+	err := l.reserveQuota("alice")
+	require.Error(t, err)
+	assert.Equal(t, messages.ReasonQuotaExceeded, messages.ReasonFor(err).Code)
+
+	// Offers that were not accepted do not count towards the quota
+	l.refundQuota("alice")
+	require.NoError(t, l.reserveQuota("alice"))
+	require.Error(t, l.reserveQuota("alice"))
+	require.NoError(t, l.reserveQuota("bob"))
+
+	// The quota is reset at midnight UTC
+	clock.Advance(time.Hour)
+	require.NoError(t, l.reserveQuota("alice"))
+	require.NoError(t, l.reserveQuota("alice"))
+	require.Error(t, l.reserveQuota("alice"))
+}
+
+func TestWithClientKey(t *testing.T) {
+	ctx := withClientKey(context.Background(), "10.0.0.1")
+	assert.Equal(t, "addr:10.0.0.1", clientKeyFromContext(ctx))
+
+	// Authenticated clients are limited by their certificate, wherever they connect from
+	ctx = pawnshop.WithClientIdentity(context.Background(), pawnshop.ClientIdentity{CommonName: "alice", Fingerprint: "a1"})
+	assert.Equal(t, "id:a1", clientKeyFromContext(withClientKey(ctx, "10.0.0.1")))
+
+	assert.Equal(t, "10.0.0.1", addrKey("10.0.0.1:1234"))
+	assert.Equal(t, "/tmp/pawnshop.sock", addrKey("/tmp/pawnshop.sock"))
+}
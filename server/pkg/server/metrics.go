@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/metrics"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// otherCode is the code label of offers with an unknown code, so that clients can not create arbitrary series.
+const otherCode = "other"
+
+/*
+serverMetrics are the metrics of a server, which are served by the admin listener at /metrics.
+*/
+type serverMetrics struct {
+	registry        *metrics.Registry
+	offersReceived  *metrics.Counter
+	offersAccepted  *metrics.Counter
+	offersRejected  *metrics.Counter
+	handlingLatency *metrics.Histogram
+	lockWait        *metrics.Histogram
+	openConns       *metrics.Gauge
+	activeConns     *metrics.Gauge
+	queuedConns     *metrics.Gauge
+	inventoryItems  *metrics.Gauge
+	inventoryValue  *metrics.Gauge
+	inventoryMin    *metrics.Gauge
+	inventoryMax    *metrics.Gauge
+}
+
+/*
+Creates the metrics of a server.
+*/
+func newServerMetrics() (*serverMetrics, error) {
+	m := &serverMetrics{
+		registry:       metrics.NewRegistry(),
+		offersReceived: metrics.NewCounter("pawnshop_offers_received_total", "Offers received, by code.", "code"),
+		offersAccepted: metrics.NewCounter("pawnshop_offers_accepted_total", "Offers accepted, by code.", "code"),
+		offersRejected: metrics.NewCounter("pawnshop_offers_rejected_total",
+			"Offers not accepted, by the code and reason of their answer.", "answer", "reason"),
+		handlingLatency: metrics.NewHistogram("pawnshop_offer_handling_seconds",
+			"Time to handle an offer received on a connection, from reading it to answering it.", metrics.LatencyBuckets),
+		lockWait: metrics.NewHistogram("pawnshop_inventory_lock_wait_seconds",
+			"Time offers waited for the lock of the inventory, or of a shard.", metrics.LockWaitBuckets),
+		openConns:      metrics.NewGauge("pawnshop_open_connections", "Connections that are open, including queued connections."),
+		activeConns:    metrics.NewGauge("pawnshop_active_connections", "Connections that are being handled."),
+		queuedConns:    metrics.NewGauge("pawnshop_queued_connections", "Connections waiting for a worker of the worker pool."),
+		inventoryItems: metrics.NewGauge("pawnshop_inventory_items", "Items in the inventory."),
+		inventoryValue: metrics.NewGauge("pawnshop_inventory_value", "Total value of the items in the inventory."),
+		inventoryMin:   metrics.NewGauge("pawnshop_inventory_min_item_value", "Value of the least valuable item in the inventory."),
+		inventoryMax:   metrics.NewGauge("pawnshop_inventory_max_item_value", "Value of the most valuable item in the inventory."),
+	}
+
+	err := m.registry.Register(m.offersReceived, m.offersAccepted, m.offersRejected, m.handlingLatency, m.lockWait,
+		m.openConns, m.activeConns, m.queuedConns, m.inventoryItems, m.inventoryValue, m.inventoryMin, m.inventoryMax)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metrics: %w", err)
+	}
+	return m, nil
+}
+
+/*
+Observes the time an offer waited for the lock of the inventory.
+*/
+func (m *serverMetrics) ObserveLockWait(wait time.Duration) {
+	m.lockWait.ObserveDuration(wait)
+}
+
+/*
+Counts an offer with the given code, and its answer.
+*/
+func (m *serverMetrics) countOffer(code string, ans messages.Answer) {
+	switch code {
+	case messages.PawnCode, messages.RedeemCode, messages.SellCode, messages.BuyCode, messages.QuoteCode,
+		messages.AcceptCounterCode:
+	default:
+		code = otherCode
+	}
+
+	m.offersReceived.Inc(code)
+	if ans.Code == messages.AcceptCode {
+		m.offersAccepted.Inc(code)
+		return
+	}
+
+	var reason messages.ReasonCode
+	if ans.Reason != nil {
+		reason = ans.Reason.Code
+	}
+	m.offersRejected.Inc(ans.Code, string(reason))
+}
+
+/*
+Updates the gauges of the server before the metrics are scraped.
+*/
+func (p *PawnShopServer) updateGauges() {
+	stats := p.PoolStats()
+	p.metrics.openConns.Set(float64(p.limiter.open()))
+	p.metrics.activeConns.Set(float64(stats.Active))
+	p.metrics.queuedConns.Set(float64(stats.Queued))
+
+	// Computing the statistics of the inventory takes O(n) time, so it is only done when scraped
+	items, err := p.inventory.Items()
+	if err != nil {
+		log.Errorf("Failed to get items of the inventory for metrics: %s", err)
+		return
+	}
+
+	var total, minItem, maxItem int
+	for i, item := range items {
+		total += item
+		if i == 0 || item < minItem {
+			minItem = item
+		}
+		if i == 0 || item > maxItem {
+			maxItem = item
+		}
+	}
+	p.metrics.inventoryItems.Set(float64(len(items)))
+	p.metrics.inventoryValue.Set(float64(total))
+	p.metrics.inventoryMin.Set(float64(minItem))
+	p.metrics.inventoryMax.Set(float64(maxItem))
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"pawnshop/server/pkg/framing"
+	"pawnshop/server/pkg/inventory"
+	"pawnshop/server/pkg/loans"
+	"pawnshop/server/pkg/pawnshop"
+	"pawnshop/server/pkg/ruleconfig"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TCPNetwork is the network used by listeners accepting TCP connections.
+	TCPNetwork = "tcp"
+	// UnixNetwork is the network used by listeners accepting connections on a Unix domain socket.
+	UnixNetwork = "unix"
+
+	// MemoryStorage keeps the items of the inventory in memory.
+	MemoryStorage = "memory"
+	// FileStorage keeps the items of the inventory in a file on disk.
+	FileStorage = "file"
+
+	defaultAddr         = "127.0.0.1:8080"
+	defaultIdleTimeout  = 30 * time.Second
+	defaultDrainTimeout = 30 * time.Second
+)
+
+/*
+Options configures a PawnShopServer.
+*/
+type Options struct {
+	// InventorySize is the size of the inventory of the pawn shop. Must be at least 1.
+	InventorySize int
+	// Listeners are the listeners the server accepts connections on.
+	// Defaults to a single TCP listener on 127.0.0.1:8080.
+	Listeners []ListenerOptions
+	// IdleTimeout is how long a session may be idle before it is closed. Defaults to 30 seconds.
+	IdleTimeout time.Duration
+	// ReadTimeout is how long reading an offer may take, from its first byte until it is complete, before the
+	// session is closed. It also bounds reading requests to the HTTP gateway. Defaults to IdleTimeout.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long writing an answer may take before the session is closed, e.g. because the client
+	// does not read its answers. It also bounds writing responses of the HTTP gateway. Defaults to IdleTimeout.
+	WriteTimeout time.Duration
+	// DrainTimeout is how long a stopping server waits for the offers on open connections, and the requests to the
+	// HTTP gateway and the admin listener, to finish once it stopped accepting connections. Connections that are
+	// still open after the drain timeout are closed. Defaults to 30 seconds.
+	DrainTimeout time.Duration
+	// HTTPAddress is the host:port pair the HTTP gateway listens on. The gateway is disabled if empty.
+	HTTPAddress string
+	// HTTPMaxFrameSize is the maximum size of the body of a request to the HTTP gateway.
+	// Defaults to framing.DefaultMaxFrameSize.
+	HTTPMaxFrameSize int
+	// AdminAddress is the host:port pair the admin listener listens on. The admin listener serves
+	// operations for operators of the pawn shop, and should not be reachable by clients.
+	// It is disabled if empty.
+	AdminAddress string
+	// DataDir is the directory the inventory is persisted in. If set, the inventory is recovered from
+	// the directory on startup, and InventorySize is only used if the directory contains no inventory yet.
+	// The inventory is only kept in memory if empty.
+	DataDir string
+	// SnapshotInterval is the number of accepted offers after which the write-ahead log in DataDir
+	// is compacted into a snapshot. Defaults to persistence.DefaultSnapshotInterval.
+	SnapshotInterval int
+	// Storage is the storage backend of the inventory, either MemoryStorage or FileStorage. Defaults to MemoryStorage.
+	Storage string
+	// StorageFile is the path of the storage file when using FileStorage. If the file already contains
+	// items, InventorySize is ignored.
+	StorageFile string
+	// Shards is the number of independently locked shards the inventory is partitioned into.
+	// Defaults to 1, which does not shard the inventory.
+	Shards int
+	// Routing decides which shard gives up an item for an offer when the inventory is sharded.
+	// Defaults to inventory.GlobalRouting.
+	Routing inventory.Routing
+	// LoanTerm enables loans if positive. Every accepted PAWN offer then pledges the offered item as security
+	// for a loan of the item given up for it, which must be redeemed with a REDEEM offer within the loan term.
+	// Otherwise the pledged item is forfeited. Loans are only kept in memory.
+	LoanTerm time.Duration
+	// InterestRate is the interest on a loan as a fraction of its principal, e.g. 0.1 for 10%.
+	InterestRate float64
+	// Clock is the source of the current time for loans and quotes. Defaults to loans.SystemClock.
+	Clock loans.Clock
+	// RetailMargin is the margin, as a fraction of the value of an item, that the pawn shop buys items below
+	// their value for with SELL offers, and sells items above their value for with BUY offers. Must be less than 1.
+	// Defaults to 0, which buys and sells items for their value.
+	RetailMargin float64
+	// QuoteTTL enables quote tokens if positive. The item quoted by an accepted QUOTE offer is then reserved
+	// for the TTL, and the answer carries a token that guarantees the quoted answer to a PAWN offer until then.
+	// Otherwise QUOTE offers are only answered.
+	QuoteTTL time.Duration
+	// CounterMargin enables counter-offers if positive. A rejected PAWN offer that would be accepted if its offer
+	// were raised, or its demand lowered, by at most this fraction of its value is then answered with a COUNTER,
+	// which can be accepted with an ACCEPT_COUNTER offer on the same connection. Must be at most 1.
+	CounterMargin float64
+	// Rules are custom rules that PAWN offers are validated with, after the pawn shop checks that the offer is greater
+	// than the demand. Offers that a rule does not accept are rejected as invalid. Defaults to no custom rules.
+	Rules []pawnshop.Rule
+	// RetailRules are custom rules that SELL and BUY offers are validated with instead of Rules.
+	// Defaults to no custom rules.
+	RetailRules []pawnshop.Rule
+	// RuleConfig is a configuration of rules and retail rules that offers are validated with after the custom rules,
+	// see ruleconfig.Load. Defaults to no configured rules.
+	RuleConfig *ruleconfig.Config
+	// Limits limits how much a single client, and all clients together, may use the server.
+	// Defaults to no limits.
+	Limits LimitOptions
+	// Pool bounds the number of connections that are handled at once. Defaults to no worker pool.
+	Pool PoolOptions
+	// Tracing configures where the spans of connections and offers are exported to. Defaults to no tracing.
+	Tracing TracingOptions
+	// Probes configures the TCP probes of the server, and how long it drains before it stops.
+	// Defaults to no TCP probes and no drain delay.
+	Probes ProbeOptions
+}
+
+/*
+ListenerOptions configures a single listener of a PawnShopServer.
+*/
+type ListenerOptions struct {
+	// Network is either TCPNetwork or UnixNetwork. Defaults to TCPNetwork.
+	Network string
+	// Address is a host:port pair for TCP listeners, or a socket path for Unix domain socket listeners.
+	// A TCP port of 0 lets the operating system choose a free port, see PawnShopServer.Addrs.
+	Address string
+	// Framing is the framing mode used on connections accepted by the listener. Defaults to framing.NewlineMode.
+	Framing framing.Mode
+	// MaxFrameSize is the maximum frame size on connections accepted by the listener.
+	// Defaults to framing.DefaultMaxFrameSize.
+	MaxFrameSize int
+	// TLS enables TLS on the listener if set.
+	TLS *TLSOptions
+}
+
+/*
+Returns a copy of the options with all unset fields set to their defaults,
+or an error if any of the options are invalid.
+*/
+func (o Options) withDefaults() (Options, error) {
+	if o.InventorySize < 1 {
+		return Options{}, errors.New("inventory size must be at least 1")
+	}
+
+	if o.IdleTimeout < 0 {
+		return Options{}, errors.New("idle timeout can not be negative")
+	}
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = defaultIdleTimeout
+	}
+
+	if o.ReadTimeout < 0 || o.WriteTimeout < 0 || o.DrainTimeout < 0 {
+		return Options{}, errors.New("read, write and drain timeouts can not be negative")
+	}
+	if o.ReadTimeout == 0 {
+		o.ReadTimeout = o.IdleTimeout
+	}
+	if o.WriteTimeout == 0 {
+		o.WriteTimeout = o.IdleTimeout
+	}
+	if o.DrainTimeout == 0 {
+		o.DrainTimeout = defaultDrainTimeout
+	}
+
+	if o.HTTPMaxFrameSize < 0 {
+		return Options{}, errors.New("HTTP max frame size can not be negative")
+	}
+	if o.HTTPMaxFrameSize == 0 {
+		o.HTTPMaxFrameSize = framing.DefaultMaxFrameSize
+	}
+
+	if o.SnapshotInterval < 0 {
+		return Options{}, errors.New("snapshot interval can not be negative")
+	}
+
+	switch o.Storage {
+	case "":
+		o.Storage = MemoryStorage
+	case MemoryStorage:
+	case FileStorage:
+		if o.StorageFile == "" {
+			return Options{}, errors.New("a storage file is required for file storage")
+		}
+	default:
+		return Options{}, fmt.Errorf("unsupported storage %q", o.Storage)
+	}
+
+	if o.Shards < 0 {
+		return Options{}, errors.New("number of shards can not be negative")
+	}
+	if o.Shards == 0 {
+		o.Shards = 1
+	}
+
+	if o.Routing == "" {
+		o.Routing = inventory.GlobalRouting
+	}
+	if _, err := inventory.ParseRouting(string(o.Routing)); err != nil {
+		return Options{}, err
+	}
+
+	if o.LoanTerm < 0 {
+		return Options{}, errors.New("loan term can not be negative")
+	}
+	if o.InterestRate < 0 {
+		return Options{}, errors.New("interest rate can not be negative")
+	}
+	if o.Clock == nil {
+		o.Clock = loans.SystemClock{}
+	}
+
+	if o.RetailMargin < 0 || o.RetailMargin >= 1 {
+		return Options{}, errors.New("retail margin must be at least 0 and less than 1")
+	}
+
+	if o.QuoteTTL < 0 {
+		return Options{}, errors.New("quote TTL can not be negative")
+	}
+
+	if o.CounterMargin < 0 || o.CounterMargin > 1 {
+		return Options{}, errors.New("counter margin must be at least 0 and at most 1")
+	}
+
+	limits, err := o.Limits.withDefaults()
+	if err != nil {
+		return Options{}, fmt.Errorf("invalid limits: %w", err)
+	}
+	o.Limits = limits
+
+	pool, err := o.Pool.withDefaults()
+	if err != nil {
+		return Options{}, fmt.Errorf("invalid worker pool: %w", err)
+	}
+	o.Pool = pool
+
+	tracingOpts, err := o.Tracing.withDefaults()
+	if err != nil {
+		return Options{}, fmt.Errorf("invalid tracing: %w", err)
+	}
+	o.Tracing = tracingOpts
+
+	probes, err := o.Probes.withDefaults()
+	if err != nil {
+		return Options{}, fmt.Errorf("invalid probes: %w", err)
+	}
+	o.Probes = probes
+
+	if len(o.Listeners) == 0 {
+		o.Listeners = []ListenerOptions{{Address: defaultAddr}}
+	}
+
+	listeners := make([]ListenerOptions, len(o.Listeners))
+	for i, l := range o.Listeners {
+		l, err := l.withDefaults()
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid listener %d: %w", i, err)
+		}
+		listeners[i] = l
+	}
+	o.Listeners = listeners
+
+	return o, nil
+}
+
+/*
+Returns a copy of the listener options with all unset fields set to their defaults,
+or an error if any of the options are invalid.
+*/
+func (l ListenerOptions) withDefaults() (ListenerOptions, error) {
+	switch l.Network {
+	case "":
+		l.Network = TCPNetwork
+	case TCPNetwork, UnixNetwork:
+	default:
+		return ListenerOptions{}, fmt.Errorf("unsupported network %q", l.Network)
+	}
+
+	if l.Address == "" {
+		return ListenerOptions{}, errors.New("address can not be empty")
+	}
+
+	if l.Framing == "" {
+		l.Framing = framing.NewlineMode
+	}
+	if _, err := framing.ParseMode(string(l.Framing)); err != nil {
+		return ListenerOptions{}, err
+	}
+
+	if l.MaxFrameSize < 0 {
+		return ListenerOptions{}, errors.New("max frame size can not be negative")
+	}
+	if l.MaxFrameSize == 0 {
+		l.MaxFrameSize = framing.DefaultMaxFrameSize
+	}
+
+	return l, nil
+}
+
+/*
+Parses listener options from a listen address. The address is either a plain TCP host:port pair,
+a tcp://host:port URL or a unix:///path/to/socket URL. URLs may set the framing mode and maximum frame
+size of the listener with the framing and maxframesize query parameters, e.g.
+unix:///tmp/pawnshop.sock?framing=length&maxframesize=1024. TLS is enabled with the tlscert and tlskey
+query parameters, and mutual TLS additionally with the clientca query parameter, e.g.
+tcp://0.0.0.0:8443?tlscert=server.pem&tlskey=server-key.pem&clientca=ca.pem.
+*/
+func ParseListenAddress(s string) (ListenerOptions, error) {
+	if !strings.Contains(s, "://") {
+		return ListenerOptions{
+			Network: TCPNetwork,
+			Address: s,
+		}.withDefaults()
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return ListenerOptions{}, fmt.Errorf("failed to parse listen address %q: %w", s, err)
+	}
+
+	var l ListenerOptions
+	switch u.Scheme {
+	case TCPNetwork:
+		l.Network = TCPNetwork
+		l.Address = u.Host
+	case UnixNetwork:
+		l.Network = UnixNetwork
+		l.Address = u.Path
+	default:
+		return ListenerOptions{}, fmt.Errorf("unsupported network %q in listen address %q", u.Scheme, s)
+	}
+
+	q := u.Query()
+	if f := q.Get("framing"); f != "" {
+		mode, err := framing.ParseMode(f)
+		if err != nil {
+			return ListenerOptions{}, fmt.Errorf("invalid listen address %q: %w", s, err)
+		}
+		l.Framing = mode
+	}
+	if m := q.Get("maxframesize"); m != "" {
+		sz, err := strconv.Atoi(m)
+		if err != nil {
+			return ListenerOptions{}, fmt.Errorf("invalid max frame size in listen address %q: %w", s, err)
+		}
+		l.MaxFrameSize = sz
+	}
+	if q.Has("tlscert") || q.Has("tlskey") || q.Has("clientca") {
+		l.TLS = &TLSOptions{
+			CertFile:     q.Get("tlscert"),
+			KeyFile:      q.Get("tlskey"),
+			ClientCAFile: q.Get("clientca"),
+		}
+	}
+
+	return l.withDefaults()
+}
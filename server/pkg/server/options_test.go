@@ -0,0 +1,95 @@
+package server
+
+import (
+	"pawnshop/server/pkg/framing"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	cases := []struct {
+		name     string
+		addr     string
+		expOpts  ListenerOptions
+		expError bool
+	}{
+		{
+			name: "Plain host:port",
+			addr: "127.0.0.1:8080",
+			expOpts: ListenerOptions{
+				Network:      TCPNetwork,
+				Address:      "127.0.0.1:8080",
+				Framing:      framing.NewlineMode,
+				MaxFrameSize: framing.DefaultMaxFrameSize,
+			},
+		},
+		{
+			name: "TCP URL with framing options",
+			addr: "tcp://0.0.0.0:9000?framing=length&maxframesize=512",
+			expOpts: ListenerOptions{
+				Network:      TCPNetwork,
+				Address:      "0.0.0.0:9000",
+				Framing:      framing.LengthPrefixedMode,
+				MaxFrameSize: 512,
+			},
+		},
+		{
+			name: "Unix socket URL",
+			addr: "unix:///tmp/pawnshop.sock",
+			expOpts: ListenerOptions{
+				Network:      UnixNetwork,
+				Address:      "/tmp/pawnshop.sock",
+				Framing:      framing.NewlineMode,
+				MaxFrameSize: framing.DefaultMaxFrameSize,
+			},
+		},
+		{
+			name: "TCP URL with mutual TLS",
+			addr: "tcp://0.0.0.0:8443?tlscert=server.pem&tlskey=server-key.pem&clientca=ca.pem",
+			expOpts: ListenerOptions{
+				Network:      TCPNetwork,
+				Address:      "0.0.0.0:8443",
+				Framing:      framing.NewlineMode,
+				MaxFrameSize: framing.DefaultMaxFrameSize,
+				TLS: &TLSOptions{
+					CertFile:     "server.pem",
+					KeyFile:      "server-key.pem",
+					ClientCAFile: "ca.pem",
+				},
+			},
+		},
+		{
+			name:     "Unsupported network, should return error",
+			addr:     "udp://127.0.0.1:8080",
+			expError: true,
+		},
+		{
+			name:     "Unknown framing mode, should return error",
+			addr:     "tcp://127.0.0.1:8080?framing=unknown",
+			expError: true,
+		},
+		{
+			name:     "Non-numeric max frame size, should return error",
+			addr:     "tcp://127.0.0.1:8080?maxframesize=large",
+			expError: true,
+		},
+		{
+			name:     "Missing address, should return error",
+			addr:     "unix://",
+			expError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts, err := ParseListenAddress(c.addr)
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expOpts, opts)
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"pawnshop/server/pkg/messages"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+OverflowPolicy decides what happens to a connection that is accepted while the queue of the worker pool is full.
+*/
+type OverflowPolicy string
+
+const (
+	// BlockOverflow stops accepting connections until a worker takes a connection from the queue.
+	// Clients wait in the backlog of the listener in the meantime.
+	BlockOverflow OverflowPolicy = "block"
+	// RejectOverflow answers the connection with a BUSY answer and closes it.
+	RejectOverflow OverflowPolicy = "reject"
+	// CloseOverflow closes the connection without answering it.
+	CloseOverflow OverflowPolicy = "close"
+)
+
+/*
+Parses an overflow policy from its string representation.
+*/
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch o := OverflowPolicy(s); o {
+	case BlockOverflow, RejectOverflow, CloseOverflow:
+		return o, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q", s)
+	}
+}
+
+/*
+PoolOptions configures the worker pool that handles the connections of a server.
+*/
+type PoolOptions struct {
+	// Workers is the number of connections that are handled at once. If 0, the pool is disabled and every
+	// connection is handled by its own goroutine as soon as it is accepted.
+	Workers int
+	// QueueSize is the number of accepted connections that may wait for a worker. Defaults to Workers.
+	QueueSize int
+	// Overflow decides what happens to a connection accepted while the queue is full. Defaults to BlockOverflow.
+	Overflow OverflowPolicy
+}
+
+/*
+Returns a copy of the pool options with defaults applied, or an error if any option is invalid.
+*/
+func (o PoolOptions) withDefaults() (PoolOptions, error) {
+	if o.Workers < 0 {
+		return PoolOptions{}, errors.New("number of workers can not be negative")
+	}
+	if o.QueueSize < 0 {
+		return PoolOptions{}, errors.New("queue size can not be negative")
+	}
+	if o.QueueSize == 0 {
+		o.QueueSize = o.Workers
+	}
+
+	if o.Overflow == "" {
+		o.Overflow = BlockOverflow
+	}
+	if _, err := ParseOverflowPolicy(string(o.Overflow)); err != nil {
+		return PoolOptions{}, err
+	}
+	return o, nil
+}
+
+/*
+PoolStats is a snapshot of the state of the worker pool of a server.
+*/
+type PoolStats struct {
+	// Workers is the number of connections that are handled at once, or 0 if the pool is disabled.
+	Workers int `json:"workers"`
+	// Active is the number of connections that are being handled.
+	Active int64 `json:"active"`
+	// Queued is the number of accepted connections that are waiting for a worker.
+	Queued int `json:"queued"`
+	// QueueSize is the number of accepted connections that may wait for a worker.
+	QueueSize int `json:"queue_size"`
+	// Rejected is the number of connections that were answered with a BUSY answer since the server was created.
+	Rejected uint64 `json:"rejected"`
+	// Dropped is the number of connections that were closed without an answer since the server was created.
+	Dropped uint64 `json:"dropped"`
+}
+
+/*
+poolCounters are the counters of the worker pool of a server.
+*/
+type poolCounters struct {
+	active   atomic.Int64
+	rejected atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+/*
+Returns a snapshot of the state of the worker pool.
+*/
+func (p *PawnShopServer) PoolStats() PoolStats {
+	return PoolStats{
+		Workers:   p.opts.Pool.Workers,
+		Active:    p.pool.active.Load(),
+		Queued:    len(p.connections),
+		QueueSize: cap(p.connections),
+		Rejected:  p.pool.rejected.Load(),
+		Dropped:   p.pool.dropped.Load(),
+	}
+}
+
+/*
+Queues an accepted connection to be handled, applying the overflow policy if the queue of the worker pool is full.
+Returns false if the connection was not queued, in which case it is closed.
+*/
+func (p *PawnShopServer) enqueue(conn connection) bool {
+	if p.opts.Pool.Workers == 0 || p.opts.Pool.Overflow == BlockOverflow {
+		select {
+		case p.connections <- conn:
+			return true
+		case <-p.shutdownCtx.Done():
+			conn.Close()
+			return false
+		}
+	}
+
+	select {
+	case p.connections <- conn:
+		return true
+	default:
+	}
+
+	if p.opts.Pool.Overflow == RejectOverflow {
+		log.Warnf("Rejecting connection from %s, all workers are busy", conn.RemoteAddr())
+		if p.reject(conn.Conn, conn.listener, messages.CreateBusyAnswer()) {
+			p.pool.rejected.Add(1)
+		} else {
+			p.pool.dropped.Add(1)
+		}
+	} else {
+		p.pool.dropped.Add(1)
+		log.Warnf("Closing connection from %s, all workers are busy", conn.RemoteAddr())
+		conn.Close()
+	}
+	return false
+}
+
+/*
+Handles connections received from the connections channel with a fixed number of workers, until the server
+shuts down. Every worker finishes the connection it is handling before it exits.
+*/
+func (p *PawnShopServer) runWorkers() {
+	workers := sync.WaitGroup{}
+	workers.Add(p.opts.Pool.Workers)
+	for i := 0; i < p.opts.Pool.Workers; i++ {
+		go func() {
+			defer workers.Done()
+
+			for {
+				select {
+				case <-p.shutdownCtx.Done():
+					return
+				case conn := <-p.connections:
+					p.handleConnection(conn)
+				}
+			}
+		}()
+	}
+
+	log.Debug("handleConnections waiting for all workers to finish their connections...")
+	workers.Wait()
+}
+
+/*
+Closes the connections that are still waiting in the queue once the server has stopped accepting connections.
+*/
+func (p *PawnShopServer) closeQueued() {
+	for {
+		select {
+		case conn := <-p.connections:
+			log.Debugf("Closing queued connection from %s, the server is shutting down", conn.RemoteAddr())
+			p.limiter.releaseConn(addrKey(conn.RemoteAddr().String()))
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
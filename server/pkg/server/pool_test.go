@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"pawnshop/server/pkg/messages"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolOptionsWithDefaults(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     PoolOptions
+		expected PoolOptions
+		expError bool
+	}{
+		{
+			name:     "No worker pool",
+			opts:     PoolOptions{},
+			expected: PoolOptions{Overflow: BlockOverflow},
+		},
+		{
+			name:     "Queue size defaults to the number of workers",
+			opts:     PoolOptions{Workers: 4, Overflow: RejectOverflow},
+			expected: PoolOptions{Workers: 4, QueueSize: 4, Overflow: RejectOverflow},
+		},
+		{
+			name:     "Negative number of workers",
+			opts:     PoolOptions{Workers: -1},
+			expError: true,
+		},
+		{
+			name:     "Negative queue size",
+			opts:     PoolOptions{Workers: 1, QueueSize: -1},
+			expError: true,
+		},
+		{
+			name:     "Unknown overflow policy",
+			opts:     PoolOptions{Workers: 1, Overflow: "drop"},
+			expError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts, err := c.opts.withDefaults()
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expected, opts)
+		})
+	}
+}
+
+func TestServerPool(t *testing.T) {
+	cases := []struct {
+		name     string
+		overflow OverflowPolicy
+		// expAnswer is the answer to a connection accepted while the queue is full, or nil if it is closed
+		expAnswer *messages.Answer
+		expStats  PoolStats
+	}{
+		{
+			name:      "Reject overflow",
+			overflow:  RejectOverflow,
+			expAnswer: &messages.Answer{Code: messages.BusyCode, Reason: &messages.Reason{Code: messages.ReasonServerBusy}},
+			expStats:  PoolStats{Workers: 1, Active: 1, Queued: 1, QueueSize: 1, Rejected: 1},
+		},
+		{
+			name:     "Close overflow",
+			overflow: CloseOverflow,
+			expStats: PoolStats{Workers: 1, Active: 1, Queued: 1, QueueSize: 1, Dropped: 1},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := startServerAndWait(t, Options{
+				InventorySize: 3,
+				AdminAddress:  "127.0.0.1:0",
+				Pool:          PoolOptions{Workers: 1, QueueSize: 1, Overflow: c.overflow},
+			})
+			defer func() {
+				require.NoError(t, s.Stop())
+			}()
+
+			// The only worker handles the first connection, and the second connection waits in the queue
+			first := dialSession(t, s)
+			require.Equal(t, messages.CreateAcceptedAnswer(1), first.send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+			second := dialSession(t, s)
+			require.Eventually(t, func() bool { return s.PoolStats().Queued == 1 }, time.Second, 5*time.Millisecond)
+
+			// So the third connection overflows
+			third, err := net.Dial("tcp", s.Addrs()[0].String())
+			require.NoError(t, err)
+			defer third.Close()
+
+			var answer messages.Answer
+			err = json.NewDecoder(third).Decode(&answer)
+			if c.expAnswer != nil {
+				require.NoError(t, err)
+				require.Equal(t, *c.expAnswer, withoutReasonMessage(t, answer))
+			} else {
+				require.Error(t, err)
+			}
+
+			resp, err := http.Get("http://" + s.AdminAddr().String() + "/pool")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			var stats PoolStats
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+			require.Equal(t, c.expStats, stats)
+
+			// Once the first connection is closed, the queued connection is handled
+			require.NoError(t, first.Close())
+			require.Equal(t, messages.CreateAcceptedAnswer(1), second.send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+			require.NoError(t, second.Close())
+		})
+	}
+}
+
+func TestServerPoolRejectLimit(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 3,
+		Pool:          PoolOptions{Workers: 1, QueueSize: 1, Overflow: RejectOverflow},
+	})
+	defer func() {
+		require.NoError(t, s.Stop())
+	}()
+
+	first := dialSession(t, s)
+	require.Equal(t, messages.CreateAcceptedAnswer(1), first.send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+	second := dialSession(t, s)
+	require.Eventually(t, func() bool { return s.PoolStats().Queued == 1 }, time.Second, 5*time.Millisecond)
+	defer first.Close()
+	defer second.Close()
+
+	// Pretend that as many connections as allowed are being rejected already
+	for i := 0; i < maxRejecting; i++ {
+		s.rejecting <- struct{}{}
+	}
+
+	overflow := func() error {
+		conn, err := net.Dial("tcp", s.Addrs()[0].String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		var answer messages.Answer
+		if err := json.NewDecoder(conn).Decode(&answer); err != nil {
+			return err
+		}
+		require.Equal(t, messages.BusyCode, answer.Code)
+		return nil
+	}
+
+	// So an overflowing connection is closed without an answer
+	require.Error(t, overflow())
+	require.Eventually(t, func() bool { return s.PoolStats().Dropped == 1 }, time.Second, 5*time.Millisecond)
+
+	// Until one of them is done
+	<-s.rejecting
+	require.NoError(t, overflow())
+	require.Eventually(t, func() bool { return len(s.rejecting) == maxRejecting-1 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, uint64(1), s.PoolStats().Rejected)
+
+	for i := 0; i < maxRejecting-1; i++ {
+		<-s.rejecting
+	}
+}
+
+func TestServerPoolBlockOverflow(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 3,
+		Pool:          PoolOptions{Workers: 1, QueueSize: 1},
+	})
+	defer func() {
+		require.NoError(t, s.Stop())
+	}()
+
+	first := dialSession(t, s)
+	require.Equal(t, messages.CreateAcceptedAnswer(1), first.send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+	second := dialSession(t, s)
+	require.Eventually(t, func() bool { return s.PoolStats().Queued == 1 }, time.Second, 5*time.Millisecond)
+
+	// The third connection waits until there is room in the queue, instead of overflowing
+	third := dialSession(t, s)
+	require.NoError(t, first.Close())
+	require.Equal(t, messages.CreateAcceptedAnswer(1), second.send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+	require.NoError(t, second.Close())
+	require.Equal(t, messages.CreateAcceptedAnswer(1), third.send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+	require.NoError(t, third.Close())
+
+	require.Zero(t, s.PoolStats().Rejected+s.PoolStats().Dropped)
+}
+
+/*
+session is a newline framed connection to a server that offers are sent on one at a time.
+*/
+type session struct {
+	net.Conn
+	t   *testing.T
+	dec *json.Decoder
+}
+
+/*
+Opens a session to the first listener of the server.
+*/
+func dialSession(t *testing.T, s *PawnShopServer) *session {
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return &session{Conn: conn, t: t, dec: json.NewDecoder(conn)}
+}
+
+/*
+Sends an offer in the session, and returns the answer.
+*/
+func (s *session) send(offer string) messages.Answer {
+	_, err := s.Write([]byte(offer + "\n"))
+	require.NoError(s.t, err)
+
+	var answer messages.Answer
+	require.NoError(s.t, s.dec.Decode(&answer))
+	return answer
+}
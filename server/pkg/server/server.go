@@ -4,149 +4,528 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"pawnshop/server/pkg/inventory"
+	"net/http"
+	"pawnshop/server/pkg/framing"
+	"pawnshop/server/pkg/loans"
+	"pawnshop/server/pkg/logging"
 	"pawnshop/server/pkg/messages"
 	"pawnshop/server/pkg/pawnshop"
+	"pawnshop/server/pkg/tracing"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	addr    = "127.0.0.1:8080"
-	bufSize = 128
-)
-
 // OfferHandler is an interface that handles offers.
+// The context carries the identity of the client if it authenticated with a certificate, see pawnshop.ClientIdentityFromContext.
 type OfferHandler interface {
-	HandleOffer(offer messages.Offer) messages.Answer
+	HandleOffer(ctx context.Context, offer messages.Offer) messages.Answer
 }
 
 // PawnShopServer is a TCP server that handles offers from clients and responds to them.
 type PawnShopServer struct {
-	addr         string
-	isRunning    bool
-	offerHandler OfferHandler
-	listener     net.Listener
-	connections  chan net.Conn
-	shutdownCtx  context.Context
-	cancel       context.CancelFunc
-	wg           sync.WaitGroup
+	opts          Options
+	tlsConfigs    []*tls.Config
+	state         atomic.Value
+	offerHandler  OfferHandler
+	limiter       *limiter
+	pool          poolCounters
+	metrics       *serverMetrics
+	tracer        *tracing.Tracer
+	inventory     serverInventory
+	closers       []io.Closer
+	listeners     []*listener
+	httpServer    *http.Server
+	httpListener  net.Listener
+	adminServer   *http.Server
+	adminListener net.Listener
+	liveness      net.Listener
+	readiness     net.Listener
+	listenersMu   sync.Mutex
+	connections   chan connection
+	// rejecting holds a token for every connection that is being answered before it is closed, see reject
+	rejecting   chan struct{}
+	shutdownCtx context.Context
+	cancel      context.CancelFunc
+	drainCtx    context.Context
+	forceClose  context.CancelFunc
+	shutdown    shutdownCounters
+	wg          sync.WaitGroup
+}
+
+/*
+listener is a net.Listener together with the options it was created from.
+*/
+type listener struct {
+	net.Listener
+	opts ListenerOptions
+	tls  bool
 }
 
 /*
-Creates a new PawnShopServer with the given inventory size.
-If size is less than 1, an error is returned.
+connection is an accepted connection together with the listener that accepted it.
 */
-func NewPawnShopServer(sz int) (*PawnShopServer, error) {
-	if sz < 1 {
-		return nil, errors.New("inventory size must be at least 1")
+type connection struct {
+	net.Conn
+	listener *listener
+}
+
+/*
+Creates a new PawnShopServer with the given options.
+If the inventory size is less than 1, or any of the other options are invalid, an error is returned.
+*/
+func NewPawnShopServer(opts Options) (*PawnShopServer, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid server options: %w", err)
+	}
+
+	tlsConfigs := make([]*tls.Config, len(opts.Listeners))
+	for i, lOpts := range opts.Listeners {
+		if lOpts.TLS == nil {
+			continue
+		}
+		if tlsConfigs[i], err = newTLSConfig(lOpts.TLS); err != nil {
+			return nil, fmt.Errorf("invalid TLS options for listener %d: %w", i, err)
+		}
 	}
 
-	inv := inventory.NewInventory(sz)
+	inv, closers, err := newInventory(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer, err := newTracer(opts.Tracing)
+	if err != nil {
+		closeAll(closers)
+		return nil, err
+	}
+	// The tracer is closed last, so that it exports the spans of all offers
+	if tracer != nil {
+		closers = append(closers, tracer)
+	}
 
-	pawnshop, err := pawnshop.NewPawnShop(inv)
+	m, err := newServerMetrics()
 	if err != nil {
+		closeAll(closers)
+		return nil, err
+	}
+	inv.SetLockObserver(m)
+
+	rules, retailRules := opts.Rules, opts.RetailRules
+	if opts.RuleConfig != nil {
+		rules = append(rules[:len(rules):len(rules)], opts.RuleConfig.Rules(inv)...)
+		retailRules = append(retailRules[:len(retailRules):len(retailRules)], opts.RuleConfig.RetailRules(inv)...)
+	}
+
+	shop, err := pawnshop.NewPawnShop(inv,
+		pawnshop.WithRules(rules...), pawnshop.WithRetailRules(retailRules...), pawnshop.WithClock(opts.Clock))
+	if err != nil {
+		closeAll(closers)
 		return nil, fmt.Errorf("failed to create new PawnShop, %w", err)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	pricing, err := pawnshop.NewMarginPricing(opts.RetailMargin)
+	if err == nil {
+		err = shop.EnableRetail(pricing)
+	}
+	if err != nil {
+		closeAll(closers)
+		return nil, fmt.Errorf("failed to enable retail: %w", err)
+	}
 
-	log.Debugf("Created new pawn shop with an inventory of size %d: %s", sz, inv)
-	return &PawnShopServer{
-		addr:         addr,
-		isRunning:    false,
-		offerHandler: pawnshop,
-		connections:  make(chan net.Conn),
+	if err = shop.EnableQuotes(opts.Clock, opts.QuoteTTL); err != nil {
+		closeAll(closers)
+		return nil, fmt.Errorf("failed to enable quotes: %w", err)
+	}
+
+	if opts.CounterMargin > 0 {
+		if err = shop.EnableCounters(opts.CounterMargin); err != nil {
+			closeAll(closers)
+			return nil, fmt.Errorf("failed to enable counters: %w", err)
+		}
+	}
+
+	if opts.LoanTerm > 0 {
+		book, err := loans.NewBook(opts.Clock, opts.LoanTerm, opts.InterestRate)
+		if err == nil {
+			err = shop.EnableLoans(book)
+		}
+		if err != nil {
+			closeAll(closers)
+			return nil, fmt.Errorf("failed to enable loans: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	drainCtx, forceClose := context.WithCancel(context.Background())
+
+	log.Debugf("Created new pawn shop with an inventory: %s", inv)
+	p := &PawnShopServer{
+		opts:         opts,
+		tlsConfigs:   tlsConfigs,
+		offerHandler: shop,
+		limiter:      newLimiter(opts.Limits, opts.Clock),
+		metrics:      m,
+		tracer:       tracer,
+		inventory:    inv,
+		closers:      closers,
+		connections:  make(chan connection, opts.Pool.QueueSize),
+		rejecting:    make(chan struct{}, maxRejecting),
 		shutdownCtx:  ctx,
 		cancel:       cancel,
+		drainCtx:     drainCtx,
+		forceClose:   forceClose,
 		wg:           sync.WaitGroup{},
-	}, nil
+	}
+	p.state.Store(StartingState)
+	m.registry.OnScrape(p.updateGauges)
+	return p, nil
 }
 
 /*
-Starts the server and listens for connections.
+Starts the server and listens for connections on all of its listeners.
+If any of the listeners fail to start, all listeners are closed and an error is returned.
+If the server is stopped before all of its listeners have started, they are closed, the inventory is closed,
+and an error is returned.
 */
 func (p *PawnShopServer) Start() error {
-	l, err := net.Listen("tcp", p.addr)
-	if err != nil {
-		return fmt.Errorf("failed to start server: %w", err)
+	listeners := make([]*listener, 0, len(p.opts.Listeners))
+	for i, lOpts := range p.opts.Listeners {
+		l, err := net.Listen(lOpts.Network, lOpts.Address)
+		if err != nil {
+			for _, started := range listeners {
+				started.Close()
+			}
+			return fmt.Errorf("failed to start server: %w", err)
+		}
+
+		if p.tlsConfigs[i] != nil {
+			l = tls.NewListener(l, p.tlsConfigs[i])
+		}
+		listeners = append(listeners, &listener{Listener: l, opts: lOpts, tls: p.tlsConfigs[i] != nil})
+	}
+
+	var httpListener, adminListener, liveness, readiness net.Listener
+	for _, l := range []struct {
+		name    string
+		address string
+		l       *net.Listener
+	}{
+		{"HTTP gateway", p.opts.HTTPAddress, &httpListener},
+		{"admin listener", p.opts.AdminAddress, &adminListener},
+		{"liveness probe", p.opts.Probes.LivenessAddress, &liveness},
+		{"readiness probe", p.opts.Probes.ReadinessAddress, &readiness},
+	} {
+		if l.address == "" {
+			continue
+		}
+		var err error
+		if *l.l, err = net.Listen(TCPNetwork, l.address); err != nil {
+			for _, started := range listeners {
+				started.Close()
+			}
+			for _, started := range []net.Listener{httpListener, adminListener, liveness} {
+				if started != nil {
+					started.Close()
+				}
+			}
+			return fmt.Errorf("failed to start %s: %w", l.name, err)
+		}
 	}
 
-	p.listener = l
+	p.listenersMu.Lock()
+	p.listeners = listeners
+	p.liveness = liveness
+	p.readiness = readiness
+	p.httpListener = httpListener
+	if httpListener != nil {
+		p.httpServer = p.newHTTPServer(p.newHTTPHandler())
+	}
+	p.adminListener = adminListener
+	if adminListener != nil {
+		p.adminServer = p.newHTTPServer(p.newAdminHandler())
+	}
+	// If the server was stopped while its listeners were being created, Stop has already closed the listeners
+	// it could see, so the new ones are closed here instead
+	if p.shutdownCtx.Err() != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, l := range []net.Listener{httpListener, adminListener, liveness, readiness} {
+			if l != nil {
+				l.Close()
+			}
+		}
+		p.listenersMu.Unlock()
+
+		err := errors.New("failed to start server: server was stopped while starting")
+		if closeErr := closeAll(p.closers); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close inventory: %w", closeErr))
+		}
+		p.state.Store(StoppedState)
+		return err
+	}
+	p.listenersMu.Unlock()
 
 	// Use a waitgroup to enable graceful shutdown using server.Stop()
-	p.wg.Add(2)
+	p.wg.Add(1 + len(listeners))
 	go p.handleConnections()
-	go p.acceptConnections()
-	log.Infof("Started server, listening at %s", addr)
+	if httpListener != nil {
+		p.wg.Add(1)
+		go p.serveHTTP("HTTP gateway", p.httpServer, httpListener)
+	}
+	if adminListener != nil {
+		p.wg.Add(1)
+		go p.serveHTTP("admin listener", p.adminServer, adminListener)
+	}
+	for _, l := range listeners {
+		go p.acceptConnections(l)
+		if l.tls {
+			log.Infof("Started server, listening at %s://%s with TLS", l.Addr().Network(), l.Addr())
+		} else {
+			log.Infof("Started server, listening at %s://%s", l.Addr().Network(), l.Addr())
+		}
+	}
+	for _, probe := range []net.Listener{liveness, readiness} {
+		if probe != nil {
+			p.wg.Add(1)
+			go p.acceptProbes(probe)
+		}
+	}
+
+	// Only report ready once every listener accepts connections. The server may already be draining
+	// if it is being stopped.
+	p.transition(StartingState, ReadyState)
 
-	// In case of a graceful shutdown, wait for both the
-	// acceptConnections and handleConnections goroutines to exit
+	// In case of a graceful shutdown, wait for the acceptConnections
+	// and handleConnections goroutines to exit
 	p.wg.Wait()
+	p.closeQueued()
+
+	// No more offers can be handled, so the inventory can be persisted for the last time
+	if err := closeAll(p.closers); err != nil {
+		return fmt.Errorf("failed to close inventory: %w", err)
+	}
 
-	log.Info("Server has stopped")
+	p.state.Store(StoppedState)
+	p.logShutdownReport()
 	return nil
 }
 
 /*
-Stops the server and closes the listener.
-Returns an error if the listener could not be closed.
+Stops the server and closes all listeners. The server stops being ready first, and keeps its listeners open
+for the drain delay, so that it is taken out of load balancing before it refuses connections. Offers on open
+connections and requests to the HTTP gateway are then given the drain timeout to finish, after which their
+connections are closed. Returns once the HTTP gateway and the admin listener have shut down, see Start for
+when the server has stopped completely. Returns an error if any of the listeners could not be closed.
 */
 func (p *PawnShopServer) Stop() error {
-	p.isRunning = false
-	p.cancel()
+	var errs []error
+	if p.transition(ReadyState, DrainingState) || p.transition(StartingState, DrainingState) {
+		p.listenersMu.Lock()
+		if p.readiness != nil {
+			if err := p.readiness.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to close readiness probe: %w", err))
+			}
+		}
+		p.listenersMu.Unlock()
 
-	if p.listener != nil {
-		if err := p.listener.Close(); err != nil {
-			return fmt.Errorf("failed to close listener: %w", err)
+		if p.opts.Probes.DrainDelay > 0 {
+			log.Infof("Draining for %s before closing listeners", p.opts.Probes.DrainDelay)
+			time.Sleep(p.opts.Probes.DrainDelay)
 		}
 	}
-	return nil
+	p.startShutdown()
+
+	// Shutting down the HTTP servers may take up to the drain timeout, so the lock is not held meanwhile.
+	// Start closes listeners it publishes after this point itself, as the server is shutting down.
+	p.listenersMu.Lock()
+	listeners, liveness, httpServer, adminServer := p.listeners, p.liveness, p.httpServer, p.adminServer
+	p.listenersMu.Unlock()
+
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close listener %s: %w", l.Addr(), err))
+		}
+	}
+	if liveness != nil {
+		if err := liveness.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close liveness probe: %w", err))
+		}
+	}
+	if httpServer != nil {
+		if err := shutdownHTTP(p.drainCtx, "HTTP gateway", httpServer); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if adminServer != nil {
+		if err := shutdownHTTP(p.drainCtx, "admin listener", adminServer); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 /*
-Returns true if the server is running and able to accept new connections, false otherwise.
+Returns true if the server is ready, i.e. running and accepting new connections, false otherwise.
 */
 func (p *PawnShopServer) IsRunning() bool {
-	return p.isRunning
+	return p.State() == ReadyState
+}
+
+/*
+Returns the addresses the server is listening on, in the same order as the listeners in its options.
+Returns nil if the server has not been started.
+*/
+func (p *PawnShopServer) Addrs() []net.Addr {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+
+	if p.listeners == nil {
+		return nil
+	}
+
+	addrs := make([]net.Addr, len(p.listeners))
+	for i, l := range p.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+/*
+Returns the address the HTTP gateway is listening on.
+Returns nil if the server has not been started or the HTTP gateway is disabled.
+*/
+func (p *PawnShopServer) HTTPAddr() net.Addr {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+
+	if p.httpListener == nil {
+		return nil
+	}
+	return p.httpListener.Addr()
+}
+
+/*
+Returns the address the admin listener is listening on.
+Returns nil if the server has not been started or the admin listener is disabled.
+*/
+func (p *PawnShopServer) AdminAddr() net.Addr {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+
+	if p.adminListener == nil {
+		return nil
+	}
+	return p.adminListener.Addr()
+}
+
+/*
+Returns the address the TCP liveness probe is listening on.
+Returns nil if the server has not been started or the liveness probe is disabled.
+*/
+func (p *PawnShopServer) LivenessAddr() net.Addr {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+
+	if p.liveness == nil {
+		return nil
+	}
+	return p.liveness.Addr()
+}
+
+/*
+Returns the address the TCP readiness probe is listening on, even once it is closed because the server is draining.
+Returns nil if the server has not been started or the readiness probe is disabled.
+*/
+func (p *PawnShopServer) ReadinessAddr() net.Addr {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+
+	if p.readiness == nil {
+		return nil
+	}
+	return p.readiness.Addr()
+}
+
+/*
+Creates an HTTP server for the given handler, with the idle, read and write timeouts of the server.
+*/
+func (p *PawnShopServer) newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  p.opts.ReadTimeout,
+		WriteTimeout: p.opts.WriteTimeout,
+		IdleTimeout:  p.opts.IdleTimeout,
+	}
 }
 
 /*
-Accepts new TCP connections and sends any new connections to the connections channel,
+Serves an HTTP server with the given name on a listener until the server is stopped.
+*/
+func (p *PawnShopServer) serveHTTP(name string, srv *http.Server, l net.Listener) {
+	defer p.wg.Done()
+
+	log.Infof("Started %s, listening at %s", name, l.Addr())
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("%s failed: %s", name, err)
+	}
+}
+
+/*
+Accepts new connections on a listener and sends any new connections to the connections channel,
 which will be handled by the handleConnection function. Supports graceful shutdown.
 */
-func (p *PawnShopServer) acceptConnections() {
+func (p *PawnShopServer) acceptConnections(l *listener) {
 	defer p.wg.Done()
 
-	p.isRunning = true
 	for {
-		conn, err := p.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			select {
 			case <-p.shutdownCtx.Done():
-				log.Debug("acceptConnections received shutdown signal, shutting down...")
+				log.Debugf("acceptConnections for %s received shutdown signal, shutting down...", l.Addr())
 				return
 			default:
 				log.Errorf("Failed to accept connection: %s", err)
+				continue
 			}
 		}
-		p.connections <- conn
+
+		addr := addrKey(conn.RemoteAddr().String())
+		if err := p.limiter.acquireConn(addr); err != nil {
+			log.Warnf("Rejecting connection from %s: %s", conn.RemoteAddr(), err)
+			p.reject(conn, l, messages.CreateThrottledAnswerFor(err))
+			continue
+		}
+
+		if !p.enqueue(connection{Conn: conn, listener: l}) {
+			p.limiter.releaseConn(addr)
+		}
 	}
 }
 
 /*
-Handles TCP connections received from the connections channel.
+Handles connections received from the connections channel, with the worker pool if it is enabled.
 Supports graceful shutdown.
 */
 func (p *PawnShopServer) handleConnections() {
 	defer p.wg.Done()
 
+	if p.opts.Pool.Workers > 0 {
+		p.runWorkers()
+		return
+	}
+
 	connsWG := sync.WaitGroup{}
 
 	for {
@@ -169,68 +548,334 @@ func (p *PawnShopServer) handleConnections() {
 }
 
 /*
-Reads an offer from a connection, handles it and writes the answer back on the connection.
+sessionConn is the connection of a session. The session waits for the first byte of an offer for up to the idle
+timeout, after which reading the rest of the offer is bounded by the read timeout.
 */
-func (p *PawnShopServer) handleConnection(conn net.Conn) {
-	buf := make([]byte, bufSize)
+type sessionConn struct {
+	net.Conn
+	timeout     time.Duration
+	shutdownCtx context.Context
+	// reading is true once the first byte of the next offer has been read, and must be reset for every offer
+	reading bool
+}
 
-	var n int
-	n, err := conn.Read(buf)
-	if err != nil {
-		if !errors.Is(err, io.EOF) {
-			log.Errorf("Failed to read from connection: %s", err)
-		}
-		return
+func (r *sessionConn) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if n == 0 || r.reading {
+		return n, err
 	}
 
-	offB := buf[:n]
+	r.reading = true
+	if dErr := r.Conn.SetReadDeadline(time.Now().Add(r.timeout)); dErr != nil {
+		return n, errors.Join(err, dErr)
+	}
+	// A shutdown must still interrupt the read, even if it happened before the deadline was extended
+	if r.shutdownCtx.Err() != nil {
+		_ = r.Conn.SetReadDeadline(time.Now())
+	}
+	return n, err
+}
 
-	var off messages.Offer
-	if err = json.Unmarshal(offB, &off); err != nil {
-		rejectOffer(conn.Write)
-		log.Errorf("Failed to unmarshal offer: %s", err)
-		return
+/*
+Handles a session on a connection. Offers are read from the connection, handled and answered
+one at a time until the client closes the connection, the connection has been idle for longer
+than the idle timeout, or the server shuts down.
+*/
+func (p *PawnShopServer) handleConnection(conn connection) {
+	p.pool.active.Add(1)
+	defer p.pool.active.Add(-1)
+	defer conn.Close()
+	defer p.limiter.releaseConn(addrKey(conn.RemoteAddr().String()))
+
+	// Counter-offers are kept for the lifetime of the connection
+	ctx := pawnshop.WithSession(context.Background(), pawnshop.NewSession())
+	connID := logging.NewID()
+	ctx = logging.WithFields(ctx, log.Fields{
+		logging.ConnIDField:     connID,
+		logging.RemoteAddrField: conn.RemoteAddr().String(),
+	})
+	logger := logging.FromContext(ctx)
+
+	ctx, span := p.tracer.Start(ctx, "PawnShopServer.handleConnection")
+	defer span.End()
+	span.SetAttribute(tracing.ConnIDAttribute, connID)
+	span.SetAttribute(tracing.RemoteAddrAttribute, conn.RemoteAddr().String())
+	if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+		id, ok, err := p.handshake(tlsConn)
+		if err != nil {
+			logger.Errorf("TLS handshake failed: %s", err)
+			span.SetError(err)
+			return
+		}
+		if ok {
+			logger.Debugf("Client authenticated as %s", id)
+			ctx = pawnshop.WithClientIdentity(ctx, id)
+		}
 	}
+	ctx = withClientKey(ctx, addrKey(conn.RemoteAddr().String()))
 
-	log.Infof("Received offer from client: %s", string(offB))
-	ans := p.handleOffer(off)
-	ansB, err := json.Marshal(ans)
+	session := &sessionConn{Conn: conn.Conn, timeout: p.opts.ReadTimeout, shutdownCtx: p.shutdownCtx}
+	framer, err := framing.New(session, conn.listener.opts.Framing, conn.listener.opts.MaxFrameSize)
 	if err != nil {
-		rejectOffer(conn.Write)
-		log.Errorf("Failed to marshal answer: %s", err)
+		logger.Errorf("Failed to create framer for connection: %s", err)
 		return
 	}
 
-	log.Infof("Sending answer to client: %s", string(ansB))
+	// Interrupt any blocking read when the server shuts down, so that idle
+	// sessions do not hold up the shutdown until their idle timeout expires
+	stopInterrupt := context.AfterFunc(p.shutdownCtx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stopInterrupt()
+	// Sessions that are still handling or answering an offer are closed after the drain timeout
+	stopForceClose := p.closeAfterDrainTimeout(conn)
+	defer stopForceClose()
 
-	if _, err = conn.Write(ansB); err != nil {
-		log.Errorf("Failed to write answer: %s", err)
-		return
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(p.opts.IdleTimeout)); err != nil {
+			logger.Errorf("Failed to set read deadline on connection: %s", err)
+			return
+		}
+		session.reading = false
+
+		// Checked after setting the deadline, so that a shutdown can never be
+		// missed in between the check and the deadline being reset
+		if p.shutdownCtx.Err() != nil {
+			return
+		}
+
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			p.handleReadError(ctx, framer, session, err)
+			return
+		}
+
+		start := time.Now()
+		var off messages.Offer
+		if err = json.Unmarshal(frame, &off); err != nil {
+			logger.Errorf("Failed to unmarshal offer: %s", err)
+			ans := malformedOfferAnswer(err)
+			p.metrics.countOffer("", ans)
+			if err = p.writeSessionAnswer(conn, framer, ans); err != nil {
+				logger.Errorf("Failed to write answer: %s", err)
+				return
+			}
+			continue
+		}
+
+		offerCtx, offerSpan := p.startOffer(ctx, "PawnShopServer.handleOffer", off)
+		logging.FromContext(offerCtx).Debugf("Received offer from client: %s", string(frame))
+		ans := p.handleOffer(offerCtx, off)
+		recordAnswer(offerCtx, ans, time.Since(start))
+		err = p.writeSessionAnswer(conn, framer, ans)
+		p.countShutdownOffer(err)
+		offerSpan.SetError(err)
+		offerSpan.End()
+		p.metrics.handlingLatency.ObserveDuration(time.Since(start))
+		if err != nil {
+			logger.Errorf("Failed to write answer: %s", err)
+			return
+		}
+	}
+}
+
+/*
+Completes the TLS handshake on a connection, bounded by the idle timeout.
+Returns the identity of the client, and whether the client presented a certificate at all.
+*/
+func (p *PawnShopServer) handshake(conn *tls.Conn) (pawnshop.ClientIdentity, bool, error) {
+	ctx, cancel := context.WithTimeout(p.shutdownCtx, p.opts.IdleTimeout)
+	defer cancel()
+
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return pawnshop.ClientIdentity{}, false, err
+	}
+
+	id, ok := clientIdentity(conn.ConnectionState())
+	return id, ok, nil
+}
+
+/*
+Writes an answer in a session, bounded by the write timeout.
+*/
+func (p *PawnShopServer) writeSessionAnswer(conn net.Conn, framer framing.Framer, ans messages.Answer) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(p.opts.WriteTimeout)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+	return writeAnswer(framer, ans)
+}
+
+/*
+Handles an error that occurred while reading a frame from a connection. Oversized and truncated frames are answered
+with an error, while closed, idle or slow connections are simply ended.
+*/
+func (p *PawnShopServer) handleReadError(ctx context.Context, framer framing.Framer, session *sessionConn, err error) {
+	logger := logging.FromContext(ctx)
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF):
+		logger.Debug("Client closed the connection")
+	case errors.Is(err, framing.ErrFrameTooLarge):
+		logger.Errorf("Failed to read offer: %s", err)
+		p.writeErrorAnswer(framer, messages.NewError(messages.ReasonFrameTooLarge, err))
+	case errors.Is(err, framing.ErrFrameTruncated):
+		logger.Errorf("Failed to read offer: %s", err)
+		p.writeErrorAnswer(framer, messages.NewError(messages.ReasonTruncatedFrame, err))
+	case p.shutdownCtx.Err() != nil:
+		logger.Debug("Closing connection due to shutdown")
+	case errors.As(err, &netErr) && netErr.Timeout() && session.reading:
+		logger.Warnf("Closing connection after reading an offer took longer than %s", p.opts.ReadTimeout)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		logger.Debugf("Closing connection after being idle for %s", p.opts.IdleTimeout)
+	case errors.Is(err, net.ErrClosed):
+		logger.Debug("Connection was closed")
+	default:
+		logger.Errorf("Failed to read from connection: %s", err)
 	}
 }
 
 /*
 Handles an offer and takes appropriate action depending on the Code.
+Offers with an unknown code get an UNSUPPORTED answer, and offers over the limits of their client a THROTTLED answer.
 */
-func (p *PawnShopServer) handleOffer(offer messages.Offer) messages.Answer {
+func (p *PawnShopServer) handleOffer(ctx context.Context, offer messages.Offer) (ans messages.Answer) {
+	defer func() {
+		p.metrics.countOffer(offer.Code, ans)
+	}()
+
+	client := clientKeyFromContext(ctx)
+	if err := p.limiter.allowOffer(client); err != nil {
+		logging.FromContext(ctx).Infof("Throttling offer from %s: %s", client, err)
+		return messages.CreateThrottledAnswerFor(err)
+	}
+
 	switch offer.Code {
-	case messages.PawnCode:
-		return p.offerHandler.HandleOffer(offer)
+	case messages.PawnCode, messages.RedeemCode, messages.SellCode, messages.BuyCode, messages.AcceptCounterCode:
+		// Only offers that change the inventory count towards the daily quota
+		if err := p.limiter.reserveQuota(client); err != nil {
+			logging.FromContext(ctx).Infof("Throttling offer from %s: %s", client, err)
+			return messages.CreateThrottledAnswerFor(err)
+		}
+
+		ans = p.offerHandler.HandleOffer(ctx, offer)
+		if ans.Code != messages.AcceptCode {
+			p.limiter.refundQuota(client)
+		}
+		return ans
+	case messages.QuoteCode:
+		return p.offerHandler.HandleOffer(ctx, offer)
+	default:
+		return messages.CreateUnsupportedAnswer(offer.Code)
+	}
+}
+
+/*
+Logs the answer to an offer, and how long it took to handle the offer. The answer is also recorded in the span of the
+offer, if ctx carries one.
+*/
+func recordAnswer(ctx context.Context, ans messages.Answer, d time.Duration) {
+	span := tracing.SpanFromContext(ctx)
+	span.SetAttribute(tracing.DecisionAttribute, ans.Code)
+
+	fields := log.Fields{
+		logging.DecisionField: ans.Code,
+		logging.DurationField: d,
+	}
+	if ans.Reason != nil {
+		fields[logging.ReasonField] = ans.Reason.Code
+		span.SetAttribute(tracing.ReasonAttribute, string(ans.Reason.Code))
+		if ans.Reason.Rule != "" {
+			fields[logging.RuleField] = ans.Reason.Rule
+			span.SetAttribute(tracing.RuleAttribute, ans.Reason.Rule)
+		}
+	}
+	logging.FromContext(ctx).WithFields(fields).Info("Handled offer")
+}
+
+// maxRejecting is the number of connections that may be answered at once before they are closed, see reject.
+const maxRejecting = 64
+
+/*
+Answers a connection that the server does not handle in a new goroutine, which the server waits for when it stops,
+and closes it. If maxRejecting connections are being answered already, the connection is closed right away, so that
+clients that do not read their answers can not make the server hold on to goroutines and file descriptors.
+Returns false if the connection was closed without an answer.
+*/
+func (p *PawnShopServer) reject(conn net.Conn, l *listener, ans messages.Answer) bool {
+	select {
+	case p.rejecting <- struct{}{}:
 	default:
-		return messages.CreateRejectAnswer()
+		log.Debugf("Closing connection from %s without an answer, too many connections are being rejected", conn.RemoteAddr())
+		conn.Close()
+		return false
 	}
+
+	// The caller is a goroutine the server waits for, so the server is not done waiting yet
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.rejecting }()
+
+		stop := p.closeAfterDrainTimeout(conn)
+		defer stop()
+		p.rejectConnection(conn, l, ans)
+	}()
+	return true
 }
 
 /*
-Rejects an offer by writing a reject answer on the connection.
+Answers a connection that the server does not handle, e.g. because it is over the connection limits, and closes it.
 */
-func rejectOffer(writeConn func([]byte) (n int, err error)) {
-	rejAns := messages.CreateRejectAnswer()
-	rejAnsB, err := json.Marshal(rejAns)
+func (p *PawnShopServer) rejectConnection(conn net.Conn, l *listener, ans messages.Answer) {
+	defer conn.Close()
+
+	// Bound the write, and the TLS handshake it may trigger, in case the client does not read
+	if err := conn.SetDeadline(time.Now().Add(p.opts.IdleTimeout)); err != nil {
+		log.Debugf("Failed to set deadline on rejected connection: %s", err)
+		return
+	}
+
+	framer, err := framing.New(conn, l.opts.Framing, l.opts.MaxFrameSize)
 	if err != nil {
-		log.Errorf("Failed to marshal reject answer: %s", err)
+		log.Errorf("Failed to create framer for rejected connection: %s", err)
 		return
 	}
+	if err = writeAnswer(framer, ans); err != nil {
+		log.Debugf("Failed to write %s answer: %s", ans.Code, err)
+	}
+}
+
+/*
+Writes an error answer with the reason for err to a connection that is about to be closed.
+*/
+func (p *PawnShopServer) writeErrorAnswer(framer framing.Framer, err error) {
+	if err = writeAnswer(framer, messages.CreateErrorAnswerFor(err)); err != nil {
+		log.Debugf("Failed to write error answer: %s", err)
+	}
+}
+
+/*
+Returns a reject answer for an offer that could not be unmarshalled because of err.
+*/
+func malformedOfferAnswer(err error) messages.Answer {
+	return messages.CreateRejectAnswerFor(messages.NewError(messages.ReasonMalformedOffer, err))
+}
+
+/*
+Writes an answer as a single frame. If the answer can not be marshalled,
+a reject answer is written instead.
+*/
+func writeAnswer(framer framing.Framer, ans messages.Answer) error {
+	ansB, err := json.Marshal(ans)
+	if err != nil {
+		log.Errorf("Failed to marshal answer: %s", err)
+		ansB, err = json.Marshal(messages.CreateRejectAnswer())
+		if err != nil {
+			return fmt.Errorf("failed to marshal reject answer: %w", err)
+		}
+	}
+
+	log.Debugf("Sending answer to client: %s", string(ansB))
 
-	writeConn(rejAnsB)
+	return framer.WriteFrame(ansB)
 }
@@ -1,19 +1,33 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"path/filepath"
+	"pawnshop/server/pkg/framing"
+	"pawnshop/server/pkg/inventory"
+	"pawnshop/server/pkg/logging"
 	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/pawnshop"
+	"pawnshop/server/pkg/ruleconfig"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 )
 
 func TestServer(t *testing.T) {
-	invSz := 2
-	s := startServerAndWait(t, invSz)
+	s := startServerAndWait(t, Options{InventorySize: 2})
 	defer func() {
 		err := s.Stop()
 		require.NoError(t, err)
@@ -26,88 +40,949 @@ func TestServer(t *testing.T) {
 		expAnswer   messages.Answer
 	}{
 		{
-			name: "Accepted offer",
-			offerString: `{
-				"code": "PAWN",
-				"offer": 5,
-				"demand": -2
-				}`,
+			name:        "Accepted offer",
+			offerString: `{"code": "PAWN", "offer": 5, "demand": -2}`,
 			expAnswer: messages.Answer{
 				Code:  messages.AcceptCode,
 				Value: 1,
 			},
 		},
 		{
-			name: "Rejected offer",
-			offerString: `
-				"code": "PAWN",
-				"offer": 5,
-				"demand": 6
-				}`,
-			expAnswer: messages.Answer{
-				Code: messages.RejectCode,
-			},
+			name:        "Rejected offer",
+			offerString: `"code": "PAWN", "offer": 5, "demand": 6}`,
+			expAnswer:   rejectAnswer(messages.ReasonMalformedOffer),
 		},
 		{
-			name: "Unsupported offer",
-			offerString: `{
-			"code": "unsupported code",
-			"offer": 5,
-			"demand": -2
-			}`,
+			name:        "Unsupported offer",
+			offerString: `{"code": "unsupported code", "offer": 5, "demand": -2}`,
 			expAnswer: messages.Answer{
-				Code: messages.RejectCode,
+				Code:   messages.UnsupportedCode,
+				Reason: &messages.Reason{Code: messages.ReasonUnsupportedCode},
 			},
 		},
 		{
 			name:        "Non-JSON body",
 			offerString: `not a JSON body`,
+			expAnswer:   rejectAnswer(messages.ReasonMalformedOffer),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", s.Addrs()[0].String())
+			require.NoError(t, err)
+
+			_, err = conn.Write([]byte(c.offerString + "\n"))
+			require.NoError(t, err)
+
+			var answer messages.Answer
+			err = json.NewDecoder(conn).Decode(&answer)
+			require.NoError(t, err)
+
+			require.Equal(t, c.expAnswer, withoutReasonMessage(t, answer))
+		})
+	}
+}
+
+func TestServerSession(t *testing.T) {
+	s := startServerAndWait(t, Options{InventorySize: 2})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	cases := []struct {
+		name        string
+		offerString string
+		expAnswer   messages.Answer
+	}{
+		{
+			name:        "First offer in session is accepted",
+			offerString: `{"code": "PAWN", "offer": 5, "demand": 1}`,
+			expAnswer: messages.Answer{
+				Code:  messages.AcceptCode,
+				Value: 1,
+			},
+		},
+		{
+			name:        "Second offer in session is rejected",
+			offerString: `{"code": "PAWN", "offer": 5, "demand": 6}`,
+			expAnswer:   invalidAnswer(pawnshop.EnsureProfitRuleID),
+		},
+		{
+			name:        "Third offer in session is accepted",
+			offerString: `{"code": "PAWN", "offer": 3, "demand": 1}`,
 			expAnswer: messages.Answer{
-				Code: messages.RejectCode,
+				Code:  messages.AcceptCode,
+				Value: 1,
 			},
 		},
 	}
 
+	dec := json.NewDecoder(conn)
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			conn, err := net.Dial("tcp", s.addr)
+			_, err := conn.Write([]byte(c.offerString + "\n"))
 			require.NoError(t, err)
 
-			_, err = conn.Write([]byte(c.offerString))
+			var answer messages.Answer
+			err = dec.Decode(&answer)
+			require.NoError(t, err)
+
+			require.Equal(t, c.expAnswer, withoutReasonMessage(t, answer))
+		})
+	}
+}
+
+func TestServerFraming(t *testing.T) {
+	cases := []struct {
+		name         string
+		mode         framing.Mode
+		maxFrameSize int
+		input        []byte
+		closeWrite   bool
+		expAnswers   []messages.Answer
+	}{
+		{
+			name:         "Newline-delimited frames, malformed offer does not end session",
+			mode:         framing.NewlineMode,
+			maxFrameSize: framing.DefaultMaxFrameSize,
+			input:        []byte("not a JSON body\n{\"code\": \"PAWN\", \"offer\": 5, \"demand\": 1}\n"),
+			expAnswers: []messages.Answer{
+				rejectAnswer(messages.ReasonMalformedOffer),
+				messages.CreateAcceptedAnswer(1),
+			},
+		},
+		{
+			name:         "Length-prefixed frames",
+			mode:         framing.LengthPrefixedMode,
+			maxFrameSize: framing.DefaultMaxFrameSize,
+			input:        []byte("\x00\x00\x00\x29{\"code\": \"PAWN\", \"offer\": 5, \"demand\": 1}"),
+			expAnswers: []messages.Answer{
+				messages.CreateAcceptedAnswer(1),
+			},
+		},
+		{
+			name:         "Oversized frame, should return error answer",
+			mode:         framing.NewlineMode,
+			maxFrameSize: 16,
+			input:        []byte("{\"code\": \"PAWN\", \"offer\": 5, \"demand\": 1}\n"),
+			expAnswers: []messages.Answer{
+				errorAnswer(messages.ReasonFrameTooLarge),
+			},
+		},
+		{
+			name:         "Truncated frame, should return error answer",
+			mode:         framing.LengthPrefixedMode,
+			maxFrameSize: framing.DefaultMaxFrameSize,
+			input:        []byte("\x00\x00\x00\x2a{\"code\": \"PAWN\""),
+			closeWrite:   true,
+			expAnswers: []messages.Answer{
+				errorAnswer(messages.ReasonTruncatedFrame),
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := startServerAndWait(t, Options{
+				InventorySize: 1,
+				Listeners: []ListenerOptions{{
+					Address:      "127.0.0.1:0",
+					Framing:      c.mode,
+					MaxFrameSize: c.maxFrameSize,
+				}},
+			})
+			defer func() {
+				err := s.Stop()
+				require.NoError(t, err)
+			}()
+
+			conn, err := net.Dial("tcp", s.Addrs()[0].String())
 			require.NoError(t, err)
+			defer conn.Close()
 
-			buf := make([]byte, 128)
+			_, err = conn.Write(c.input)
+			require.NoError(t, err)
+			if c.closeWrite {
+				err = conn.(*net.TCPConn).CloseWrite()
+				require.NoError(t, err)
+			}
 
-			n, err := conn.Read(buf)
+			framer, err := framing.New(conn, c.mode, framing.DefaultMaxFrameSize)
 			require.NoError(t, err)
 
-			var answer messages.Answer
-			err = json.Unmarshal(buf[:n], &answer)
+			for _, expAnswer := range c.expAnswers {
+				frame, err := framer.ReadFrame()
+				require.NoError(t, err)
+
+				var answer messages.Answer
+				err = json.Unmarshal(frame, &answer)
+				require.NoError(t, err)
+				require.Equal(t, expAnswer, withoutReasonMessage(t, answer))
+			}
+		})
+	}
+}
+
+func TestServerSessionIdleTimeout(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 1,
+		IdleTimeout:   20 * time.Millisecond,
+	})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The server should close the connection once the session has been idle for too long
+	err = conn.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, err)
+
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerSessionReadTimeout(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 1,
+		IdleTimeout:   5 * time.Second,
+		ReadTimeout:   50 * time.Millisecond,
+	})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	// A session may be idle for longer than the read timeout
+	idle := dialSession(t, s)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, messages.CreateAcceptedAnswer(1), idle.send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+
+	// But the server should close the connection once reading an offer takes too long
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(`{"code": "PAWN"`))
+	require.NoError(t, err)
+	err = conn.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, err)
+
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerSessionWriteTimeout(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 1,
+		WriteTimeout:  50 * time.Millisecond,
+	})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	conn, err := net.DialTCP("tcp", nil, s.Addrs()[0].(*net.TCPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadBuffer(1024))
+
+	// The server should close the connection once its answers can not be written, because the client does not
+	// read them, which fails the writes of the client
+	err = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	require.NoError(t, err)
+	offers := []byte(strings.Repeat(`{"code": "HAGGLE"}`+"\n", 1024))
+	for err == nil {
+		_, err = conn.Write(offers)
+	}
+	var netErr net.Error
+	require.False(t, errors.As(err, &netErr) && netErr.Timeout(), "the server did not close the connection: %s", err)
+}
+
+func TestServerListeners(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "pawnshop.sock")
+	s := startServerAndWait(t, Options{
+		InventorySize: 2,
+		Listeners: []ListenerOptions{
+			{
+				Address: "127.0.0.1:0",
+			},
+			{
+				Network: UnixNetwork,
+				Address: socket,
+				Framing: framing.LengthPrefixedMode,
+			},
+		},
+	})
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	addrs := s.Addrs()
+	require.Len(t, addrs, 2)
+	require.Equal(t, TCPNetwork, addrs[0].Network())
+	require.NotEqual(t, "127.0.0.1:0", addrs[0].String())
+	require.Equal(t, UnixNetwork, addrs[1].Network())
+	require.Equal(t, socket, addrs[1].String())
+
+	cases := []struct {
+		name      string
+		network   string
+		address   string
+		mode      framing.Mode
+		expAnswer messages.Answer
+	}{
+		{
+			name:      "TCP listener accepts offer",
+			network:   TCPNetwork,
+			address:   addrs[0].String(),
+			mode:      framing.NewlineMode,
+			expAnswer: messages.CreateAcceptedAnswer(1),
+		},
+		{
+			name:      "Unix listener accepts offer from the same inventory",
+			network:   UnixNetwork,
+			address:   socket,
+			mode:      framing.LengthPrefixedMode,
+			expAnswer: messages.CreateAcceptedAnswer(1),
+		},
+		{
+			name:      "TCP listener rejects offer, as both items have been replaced",
+			network:   TCPNetwork,
+			address:   addrs[0].String(),
+			mode:      framing.NewlineMode,
+			expAnswer: rejectAnswer(messages.ReasonNotProfitable),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, err := net.Dial(c.network, c.address)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			framer, err := framing.New(conn, c.mode, framing.DefaultMaxFrameSize)
 			require.NoError(t, err)
 
-			require.Equal(t, c.expAnswer, answer)
+			err = framer.WriteFrame([]byte(`{"code": "PAWN", "offer": 2, "demand": 1}`))
+			require.NoError(t, err)
+
+			frame, err := framer.ReadFrame()
+			require.NoError(t, err)
+
+			var answer messages.Answer
+			err = json.Unmarshal(frame, &answer)
+			require.NoError(t, err)
+			require.Equal(t, c.expAnswer, withoutReasonMessage(t, answer))
 		})
 	}
 }
 
+func TestServerStoppedWhileStarting(t *testing.T) {
+	s, err := NewPawnShopServer(Options{
+		InventorySize: 2,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		HTTPAddress:   "127.0.0.1:0",
+	})
+	require.NoError(t, err)
+
+	// Stopping the server before its listeners are published must not leave them open
+	require.NoError(t, s.Stop())
+	require.EqualError(t, s.Start(), "failed to start server: server was stopped while starting")
+	require.Equal(t, StoppedState, s.State())
+
+	for _, addr := range append(s.Addrs(), s.HTTPAddr()) {
+		_, err = net.Dial("tcp", addr.String())
+		require.Error(t, err)
+	}
+}
+
+func TestServerPersistence(t *testing.T) {
+	opts := Options{
+		InventorySize: 2,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		DataDir:       t.TempDir(),
+	}
+
+	// Run a server until it has accepted an offer, and wait for it to stop completely
+	s, stopped := startServer(t, opts)
+	require.Equal(t, messages.CreateAcceptedAnswer(1), sendOffer(t, s, `{"code": "PAWN", "offer": 5, "demand": 1}`))
+	require.NoError(t, s.Stop())
+	require.NoError(t, <-stopped)
+
+	// A new server using the same data directory should recover the inventory [5, 1]
+	s, stopped = startServer(t, opts)
+	defer func() {
+		require.NoError(t, s.Stop())
+		require.NoError(t, <-stopped)
+	}()
+
+	items, err := s.inventory.Items()
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 1}, items)
+	require.Equal(t, messages.CreateAcceptedAnswer(5), sendOffer(t, s, `{"code": "PAWN", "offer": 6, "demand": 5}`))
+}
+
+func TestServerFileStorage(t *testing.T) {
+	opts := Options{
+		InventorySize: 2,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		Storage:       FileStorage,
+		StorageFile:   filepath.Join(t.TempDir(), "inventory.db"),
+	}
+
+	// Run a server until it has accepted an offer, and wait for it to stop completely
+	s, stopped := startServer(t, opts)
+	require.Equal(t, messages.CreateAcceptedAnswer(1), sendOffer(t, s, `{"code": "PAWN", "offer": 5, "demand": 1}`))
+	require.NoError(t, s.Stop())
+	require.NoError(t, <-stopped)
+
+	// A new server using the same storage file should contain the inventory [5, 1], even with another size
+	opts.InventorySize = 3
+	s, stopped = startServer(t, opts)
+	defer func() {
+		require.NoError(t, s.Stop())
+		require.NoError(t, <-stopped)
+	}()
+
+	items, err := s.inventory.Items()
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 1}, items)
+}
+
+func TestServerShards(t *testing.T) {
+	opts := Options{
+		InventorySize: 4,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		DataDir:       t.TempDir(),
+		Shards:        2,
+	}
+
+	// Run a sharded server until it has accepted offers in both shards, and wait for it to stop completely
+	s, stopped := startServer(t, opts)
+	require.Equal(t, messages.CreateAcceptedAnswer(1), sendOffer(t, s, `{"code": "PAWN", "offer": 5, "demand": 1}`))
+	require.Equal(t, messages.CreateAcceptedAnswer(1), sendOffer(t, s, `{"code": "PAWN", "offer": 6, "demand": 1}`))
+	require.NoError(t, s.Stop())
+	require.NoError(t, <-stopped)
+
+	// A new server with another number of shards should recover the inventory [5, 6, 1, 1]
+	opts.Shards = 3
+	opts.Routing = inventory.FirstFitRouting
+	s, stopped = startServer(t, opts)
+	defer func() {
+		require.NoError(t, s.Stop())
+		require.NoError(t, <-stopped)
+	}()
+
+	items, err := s.inventory.Items()
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 6, 1, 1}, items)
+}
+
+func TestServerLoans(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s, stopped := startServer(t, Options{
+		InventorySize: 2,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		LoanTerm:      time.Hour,
+		InterestRate:  0.5,
+		Clock:         clock,
+	})
+	defer func() {
+		require.NoError(t, s.Stop())
+		require.NoError(t, <-stopped)
+	}()
+
+	// Pawning an item lends the item given up for it, and pledged items are never given up
+	first := sendOffer(t, s, `{"code": "PAWN", "offer": 5, "demand": 1}`)
+	require.Equal(t, messages.AcceptCode, first.Code)
+	require.Equal(t, 1, first.Value)
+	require.NotNil(t, first.Loan)
+	require.Equal(t, 1, first.Loan.Principal)
+	require.Equal(t, 2, first.Loan.Repayment)
+	require.True(t, clock.Now().Add(time.Hour).Equal(first.Loan.Due))
+
+	second := sendOffer(t, s, `{"code": "PAWN", "offer": 10, "demand": 1}`)
+	require.Equal(t, messages.AcceptCode, second.Code)
+	require.NotNil(t, second.Loan)
+	require.Equal(t, rejectAnswer(messages.ReasonNoMatchingItem), withoutReasonMessage(t, sendOffer(t, s, `{"code": "PAWN", "offer": 20, "demand": 1}`)))
+
+	// Redeeming a loan requires the full repayment, and gives back the pledged item
+	redeem := func(loan string, repayment int) messages.Answer {
+		return sendOffer(t, s, fmt.Sprintf(`{"code": "REDEEM", "offer": %d, "loan": %q}`, repayment, loan))
+	}
+	require.Equal(t, rejectAnswer(messages.ReasonPriceNotMet), withoutReasonMessage(t, redeem(first.Loan.ID, 1)))
+	require.Equal(t, messages.CreateAcceptedAnswer(5), redeem(first.Loan.ID, 2))
+	require.Equal(t, rejectAnswer(messages.ReasonUnknownLoan), withoutReasonMessage(t, redeem(first.Loan.ID, 2)))
+	require.Equal(t, rejectAnswer(messages.ReasonUnknownLoan), withoutReasonMessage(t, redeem("unknown", 2)))
+
+	items, err := s.inventory.Items()
+	require.NoError(t, err)
+	require.Equal(t, []int{2, 10}, items)
+
+	// Once a loan is due, its pledge is forfeited and can be given up for offers
+	clock.Advance(2 * time.Hour)
+	require.Equal(t, rejectAnswer(messages.ReasonUnknownLoan), withoutReasonMessage(t, redeem(second.Loan.ID, 2)))
+	ans := sendOffer(t, s, `{"code": "PAWN", "offer": 11, "demand": 5}`)
+	require.Equal(t, messages.AcceptCode, ans.Code)
+	require.Equal(t, 10, ans.Value)
+}
+
+func TestServerRetail(t *testing.T) {
+	opts := Options{
+		InventorySize: 2,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		DataDir:       t.TempDir(),
+		RetailMargin:  0.2,
+	}
+
+	// Run a server until it has bought and sold items, and wait for it to stop completely
+	s, stopped := startServer(t, opts)
+	require.Equal(t, messages.CreateAcceptedAnswer(8), sendOffer(t, s, `{"code": "SELL", "offer": 10, "demand": 8}`))
+	require.Equal(t, rejectAnswer(messages.ReasonPriceNotMet), withoutReasonMessage(t, sendOffer(t, s, `{"code": "SELL", "offer": 10, "demand": 9}`)))
+	require.Equal(t, rejectAnswer(messages.ReasonPriceNotMet), withoutReasonMessage(t, sendOffer(t, s, `{"code": "BUY", "offer": 11, "demand": 10, "item": 2}`)))
+	require.Equal(t, messages.CreateBuyAnswer(1, 2), sendOffer(t, s, `{"code": "BUY", "offer": 2, "demand": 1}`))
+	require.Equal(t, rejectAnswer(messages.ReasonUnknownItem), withoutReasonMessage(t, sendOffer(t, s, `{"code": "BUY", "offer": 100, "demand": 10, "item": 2}`)))
+	// The last item took the index of the bought item, so the item the client expects is no longer there
+	require.Equal(t, rejectAnswer(messages.ReasonUnknownItem), withoutReasonMessage(t, sendOffer(t, s, `{"code": "BUY", "offer": 100, "demand": 1}`)))
+	require.NoError(t, s.Stop())
+	require.NoError(t, <-stopped)
+
+	// A new server should recover the inventory [10, 1]
+	s, stopped = startServer(t, opts)
+	defer func() {
+		require.NoError(t, s.Stop())
+		require.NoError(t, <-stopped)
+	}()
+
+	items, err := s.inventory.Items()
+	require.NoError(t, err)
+	require.Equal(t, []int{10, 1}, items)
+}
+
+func TestServerQuotes(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s, stopped := startServer(t, Options{
+		InventorySize: 2,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		Clock:         clock,
+		QuoteTTL:      time.Minute,
+	})
+	defer func() {
+		require.NoError(t, s.Stop())
+		require.NoError(t, <-stopped)
+	}()
+
+	// A quote reserves the quoted item until its token is used or it expires
+	quoted := sendOffer(t, s, `{"code": "QUOTE", "offer": 5, "demand": 1}`)
+	require.Equal(t, messages.AcceptCode, quoted.Code)
+	require.Equal(t, 1, quoted.Value)
+	require.NotNil(t, quoted.Quote)
+	require.True(t, clock.Now().Add(time.Minute).Equal(quoted.Quote.Expires))
+
+	require.Equal(t, messages.CreateAcceptedAnswer(1), sendOffer(t, s, `{"code": "PAWN", "offer": 3, "demand": 1}`))
+	require.Equal(t, rejectAnswer(messages.ReasonNoMatchingItem), withoutReasonMessage(t, sendOffer(t, s, `{"code": "PAWN", "offer": 5, "demand": 4}`)))
+
+	items, err := s.inventory.Items()
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 3}, items)
+
+	require.Equal(t, messages.CreateAcceptedAnswer(1), sendOffer(t, s, fmt.Sprintf(`{"code": "PAWN", "offer": 5, "demand": 1, "quote": %q}`, quoted.Quote.Token)))
+	require.Equal(t, rejectAnswer(messages.ReasonUnknownQuote),
+		withoutReasonMessage(t, sendOffer(t, s, fmt.Sprintf(`{"code": "PAWN", "offer": 5, "demand": 1, "quote": %q}`, quoted.Quote.Token))))
+
+	items, err = s.inventory.Items()
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 3}, items)
+}
+
+func TestServerCounters(t *testing.T) {
+	s, stopped := startServer(t, Options{
+		InventorySize: 2,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		CounterMargin: 0.5,
+	})
+	defer func() {
+		require.NoError(t, s.Stop())
+		require.NoError(t, <-stopped)
+	}()
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	require.NoError(t, err)
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+
+	send := func(offer string) messages.Answer {
+		_, err := conn.Write([]byte(offer + "\n"))
+		require.NoError(t, err)
+
+		var answer messages.Answer
+		require.NoError(t, dec.Decode(&answer))
+		return answer
+	}
+
+	// A counter-offer can only be accepted on the connection it was made on
+	countered := send(`{"code": "PAWN", "offer": 4, "demand": 2}`)
+	require.Equal(t, messages.CounterCode, countered.Code)
+	require.Equal(t, 1, countered.Value)
+	require.Equal(t, &messages.CounterOffer{Offer: 4, Demand: 1}, countered.Counter)
+	require.Equal(t, messages.ReasonNoMatchingItem, countered.Reason.Code)
+
+	require.Equal(t, rejectAnswer(messages.ReasonUnknownCounter), withoutReasonMessage(t, sendOffer(t, s, `{"code": "ACCEPT_COUNTER"}`)))
+	require.Equal(t, messages.CreateAcceptedAnswer(1), send(`{"code": "ACCEPT_COUNTER"}`))
+	require.Equal(t, rejectAnswer(messages.ReasonUnknownCounter), withoutReasonMessage(t, send(`{"code": "ACCEPT_COUNTER"}`)))
+
+	items, err := s.inventory.Items()
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 1}, items)
+}
+
+func TestServerRules(t *testing.T) {
+	// Offers must not demand more than 1
+	rule := pawnshop.RuleFunc(func(_ context.Context, o messages.Offer) error {
+		if o.Demand > 1 {
+			return errors.New("demand must be at most 1")
+		}
+		return nil
+	})
+	// Offers must not be more than 10, or exceed the demand by less than 2
+	cfg, err := ruleconfig.Parse([]byte(`{"rules": [
+		{"rule": "offer_bounds", "max": 10},
+		{"rule": "min_profit", "amount": 2}
+	]}`))
+	require.NoError(t, err)
+
+	s := startServerAndWait(t, Options{InventorySize: 2, Rules: []pawnshop.Rule{rule}, RuleConfig: cfg})
+	defer func() {
+		require.NoError(t, s.Stop())
+	}()
+
+	require.Equal(t, messages.CreateAcceptedAnswer(1), sendOffer(t, s, `{"code": "PAWN", "offer": 5, "demand": 1}`))
+	require.Equal(t, messages.CreateRejectAnswerFor(messages.Errorf(messages.ReasonInvalidOffer, "demand must be at most 1")),
+		sendOffer(t, s, `{"code": "PAWN", "offer": 5, "demand": 2}`))
+	require.Equal(t, invalidAnswer(pawnshop.EnsureProfitRuleID), withoutReasonMessage(t, sendOffer(t, s, `{"code": "PAWN", "offer": 1, "demand": 1}`)))
+	require.Equal(t, messages.Answer{Code: messages.RejectCode, Reason: &messages.Reason{
+		Code:    messages.ReasonInvalidOffer,
+		Message: "offer must be at most 10",
+		Rule:    "offer_bounds",
+	}}, sendOffer(t, s, `{"code": "PAWN", "offer": 11, "demand": 1}`))
+	require.Equal(t, invalidAnswer("min_profit"), withoutReasonMessage(t, sendOffer(t, s, `{"code": "PAWN", "offer": 2, "demand": 1}`)))
+}
+
+func TestServerRetailRules(t *testing.T) {
+	// The rules would reject every SELL and BUY offer below, so they must only validate PAWN offers
+	cfg, err := ruleconfig.Parse([]byte(`{
+		"rules": [
+			{"rule": "offer_bounds", "max": 5},
+			{"rule": "demand_bounds", "min": 1},
+			{"rule": "max_demand_ratio", "percent": 50}
+		],
+		"retail_rules": [{"rule": "deny_clients", "clients": ["mallory"]}]
+	}`))
+	require.NoError(t, err)
+
+	s := startServerAndWait(t, Options{InventorySize: 2, RetailMargin: 0.2, RuleConfig: cfg})
+	defer func() {
+		require.NoError(t, s.Stop())
+	}()
+
+	require.Equal(t, invalidAnswer("offer_bounds"), withoutReasonMessage(t, sendOffer(t, s, `{"code": "PAWN", "offer": 10, "demand": 1}`)))
+	require.Equal(t, messages.CreateAcceptedAnswer(8), sendOffer(t, s, `{"code": "SELL", "offer": 10}`))
+	require.Equal(t, messages.CreateBuyAnswer(10, 12), sendOffer(t, s, `{"code": "BUY", "offer": 12, "demand": 10, "item": 2}`))
+}
+
+func TestServerLimits(t *testing.T) {
+	s := startServerAndWait(t, Options{
+		InventorySize: 2,
+		Limits:        LimitOptions{Rate: 0.001, Burst: 3, MaxConnsPerClient: 1, DailyQuota: 1},
+	})
+	defer func() {
+		require.NoError(t, s.Stop())
+	}()
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	require.NoError(t, err)
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+
+	send := func(offer string) messages.Answer {
+		_, err := conn.Write([]byte(offer + "\n"))
+		require.NoError(t, err)
+
+		var answer messages.Answer
+		require.NoError(t, dec.Decode(&answer))
+		return withoutReasonMessage(t, answer)
+	}
+
+	// Rejected offers do not count towards the daily quota, but towards the rate limit
+	require.Equal(t, invalidAnswer(pawnshop.EnsureProfitRuleID), send(`{"code": "PAWN", "offer": 1, "demand": 2}`))
+	require.Equal(t, messages.CreateAcceptedAnswer(1), send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+	require.Equal(t, throttledAnswer(messages.ReasonQuotaExceeded), send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+	require.Equal(t, throttledAnswer(messages.ReasonRateLimited), send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+
+	// A second connection from the same address is answered and closed
+	require.Equal(t, throttledAnswer(messages.ReasonTooManyConnections), withoutReasonMessage(t, sendOffer(t, s, `{"code": "QUOTE", "offer": 5, "demand": 1}`)))
+}
+
+func TestServerLogging(t *testing.T) {
+	hooks := log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	defer log.StandardLogger().ReplaceHooks(hooks)
+	hook := logtest.NewGlobal()
+
+	s := startServerAndWait(t, Options{InventorySize: 2})
+	defer func() {
+		require.NoError(t, s.Stop())
+	}()
+
+	sess := dialSession(t, s)
+	require.Equal(t, messages.CreateAcceptedAnswer(1), sess.send(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+	require.Equal(t, invalidAnswer(pawnshop.EnsureProfitRuleID), withoutReasonMessage(t, sess.send(`{"code": "PAWN", "offer": 1, "demand": 2}`)))
+
+	var handled []log.Fields
+	for _, e := range hook.AllEntries() {
+		if e.Message == "Handled offer" {
+			handled = append(handled, e.Data)
+		}
+	}
+	require.Len(t, handled, 2)
+
+	// Both offers were received on the same connection, but are different offers
+	require.Equal(t, handled[0][logging.ConnIDField], handled[1][logging.ConnIDField])
+	require.NotEqual(t, handled[0][logging.OfferIDField], handled[1][logging.OfferIDField])
+	require.Equal(t, sess.LocalAddr().String(), handled[0][logging.RemoteAddrField])
+
+	require.Equal(t, messages.PawnCode, handled[0][logging.CodeField])
+	require.Equal(t, 5, handled[0][logging.OfferField])
+	require.Equal(t, 1, handled[0][logging.DemandField])
+	require.Equal(t, messages.AcceptCode, handled[0][logging.DecisionField])
+	require.NotContains(t, handled[0], logging.RuleField)
+	require.IsType(t, time.Duration(0), handled[0][logging.DurationField])
+
+	require.Equal(t, messages.RejectCode, handled[1][logging.DecisionField])
+	require.Equal(t, messages.ReasonInvalidOffer, handled[1][logging.ReasonField])
+	require.Equal(t, pawnshop.EnsureProfitRuleID, handled[1][logging.RuleField])
+}
+
 func TestServerErrors(t *testing.T) {
 	cases := []struct {
 		name          string
-		addr          string
-		size          int
+		opts          Options
 		expNewError   bool
 		expStartError bool
 	}{
 		{
 			name:          "Invalid size",
-			size:          0,
+			opts:          Options{InventorySize: 0},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Invalid network",
+			opts: Options{
+				InventorySize: 1,
+				Listeners:     []ListenerOptions{{Network: "udp", Address: "127.0.0.1:0"}},
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Invalid framing mode",
+			opts: Options{
+				InventorySize: 1,
+				Listeners:     []ListenerOptions{{Address: "127.0.0.1:0", Framing: "invalid"}},
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Unsupported storage",
+			opts: Options{
+				InventorySize: 1,
+				Storage:       "tape",
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "File storage without storage file",
+			opts: Options{
+				InventorySize: 1,
+				Storage:       FileStorage,
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Negative number of shards",
+			opts: Options{
+				InventorySize: 1,
+				Shards:        -1,
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "More shards than items",
+			opts: Options{
+				InventorySize: 2,
+				Shards:        3,
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Unknown routing",
+			opts: Options{
+				InventorySize: 1,
+				Routing:       "random",
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Negative loan term",
+			opts: Options{
+				InventorySize: 1,
+				LoanTerm:      -time.Hour,
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Negative interest rate",
+			opts: Options{
+				InventorySize: 1,
+				LoanTerm:      time.Hour,
+				InterestRate:  -0.1,
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Retail margin of 100%",
+			opts: Options{
+				InventorySize: 1,
+				RetailMargin:  1,
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Negative quote TTL",
+			opts: Options{
+				InventorySize: 1,
+				QuoteTTL:      -time.Minute,
+			},
 			expNewError:   true,
 			expStartError: false,
 		},
 		{
-			name:          "Invalid address",
-			size:          1,
-			addr:          "invalid",
+			name: "Counter margin of more than 100%",
+			opts: Options{
+				InventorySize: 1,
+				CounterMargin: 1.5,
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Negative rate limit",
+			opts: Options{
+				InventorySize: 1,
+				Limits:        LimitOptions{Rate: -1},
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Unknown overflow policy",
+			opts: Options{
+				InventorySize: 1,
+				Pool:          PoolOptions{Workers: 1, Overflow: "drop"},
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Unknown trace exporter",
+			opts: Options{
+				InventorySize: 1,
+				Tracing:       TracingOptions{Exporter: "jaeger"},
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "File trace exporter without a file",
+			opts: Options{
+				InventorySize: 1,
+				Tracing:       TracingOptions{Exporter: FileTraceExporter},
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "OTLP trace exporter with an invalid endpoint",
+			opts: Options{
+				InventorySize: 1,
+				Tracing:       TracingOptions{Exporter: OTLPTraceExporter, Endpoint: "localhost:4318"},
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Negative write timeout",
+			opts: Options{
+				InventorySize: 1,
+				WriteTimeout:  -time.Second,
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Negative drain delay",
+			opts: Options{
+				InventorySize: 1,
+				Probes:        ProbeOptions{DrainDelay: -time.Second},
+			},
+			expNewError:   true,
+			expStartError: false,
+		},
+		{
+			name: "Invalid address",
+			opts: Options{
+				InventorySize: 1,
+				Listeners:     []ListenerOptions{{Address: "invalid"}},
+			},
+			expNewError:   false,
+			expStartError: true,
+		},
+		{
+			name: "Readiness probe has invalid address",
+			opts: Options{
+				InventorySize: 1,
+				Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+				Probes:        ProbeOptions{LivenessAddress: "127.0.0.1:0", ReadinessAddress: "invalid"},
+			},
+			expNewError:   false,
+			expStartError: true,
+		},
+		{
+			name: "Second listener has invalid address",
+			opts: Options{
+				InventorySize: 1,
+				Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}, {Address: "invalid"}},
+			},
 			expNewError:   false,
 			expStartError: true,
 		},
@@ -115,15 +990,13 @@ func TestServerErrors(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			s, err := NewPawnShopServer(c.size)
+			s, err := NewPawnShopServer(c.opts)
 			if c.expNewError {
 				require.Error(t, err)
 				return
 			}
 			require.NoError(t, err)
 
-			s.addr = c.addr
-
 			err = s.Start()
 			if c.expStartError {
 				require.Error(t, err)
@@ -137,20 +1010,132 @@ func TestServerErrors(t *testing.T) {
 	}
 }
 
-func startServerAndWait(t *testing.T, size int) *PawnShopServer {
-	s, err := NewPawnShopServer(size)
+func BenchmarkServerConcurrentOffers(b *testing.B) {
+	// Logging every offer would dominate the benchmark
+	lvl := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(lvl)
+
+	cases := []struct {
+		shards  int
+		routing inventory.Routing
+	}{
+		{shards: 1, routing: inventory.GlobalRouting},
+		{shards: 4, routing: inventory.GlobalRouting},
+		{shards: 16, routing: inventory.GlobalRouting},
+		{shards: 4, routing: inventory.FirstFitRouting},
+		{shards: 16, routing: inventory.FirstFitRouting},
+	}
+
+	for _, c := range cases {
+		b.Run(fmt.Sprintf("%s/shards=%d", c.routing, c.shards), func(b *testing.B) {
+			s, stopped := startServer(b, Options{
+				InventorySize: 100000,
+				Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+				Shards:        c.shards,
+				Routing:       c.routing,
+			})
+			defer func() {
+				require.NoError(b, s.Stop())
+				require.NoError(b, <-stopped)
+			}()
+
+			// Every goroutine has its own session and sends random offers with a demand below the offer
+			var seed atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.Dial("tcp", s.Addrs()[0].String())
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+
+				framer, err := framing.New(conn, framing.NewlineMode, framing.DefaultMaxFrameSize)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+
+				r := rand.New(rand.NewSource(seed.Add(1)))
+				for pb.Next() {
+					off := r.Intn(1000) + 1
+					frame, err := json.Marshal(messages.CreateOffer(off, r.Intn(off)))
+					if err != nil {
+						b.Error(err)
+						return
+					}
+
+					if err = framer.WriteFrame(frame); err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err = framer.ReadFrame(); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+/*
+Sends a single newline framed offer to the first listener of the server, and returns the answer.
+*/
+func sendOffer(t *testing.T, s *PawnShopServer, offer string) messages.Answer {
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(offer + "\n"))
 	require.NoError(t, err)
 
-	availablePort, err := getAvailablePort()
+	var answer messages.Answer
+	err = json.NewDecoder(conn).Decode(&answer)
+	require.NoError(t, err)
+	return answer
+}
+
+/*
+Creates and starts a server with the given options, and waits for it to start.
+If no listeners are given, the server listens on a free port on localhost.
+*/
+func startServerAndWait(t *testing.T, opts Options) *PawnShopServer {
+	if len(opts.Listeners) == 0 {
+		opts.Listeners = []ListenerOptions{{Address: "127.0.0.1:0"}}
+	}
+
+	s, err := NewPawnShopServer(opts)
 	require.NoError(t, err)
-	s.addr = fmt.Sprintf("127.0.0.1:%d", availablePort)
 
 	go func() {
-		err = s.Start()
+		err := s.Start()
 		require.NoError(t, err)
 	}()
+	waitForServer(t, s)
+
+	return s
+}
+
+/*
+Creates and starts a server with the given options, and waits for it to start.
+Returns the server and a channel receiving the result of Start once the server has stopped completely.
+*/
+func startServer(t testing.TB, opts Options) (*PawnShopServer, chan error) {
+	s, err := NewPawnShopServer(opts)
+	require.NoError(t, err)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(t, s)
 
-	// Wait for server to start
+	return s, stopped
+}
+
+func waitForServer(t testing.TB, s *PawnShopServer) {
 	for i := 0; i < 40; i++ {
 		if s.IsRunning() {
 			break
@@ -158,15 +1143,83 @@ func startServerAndWait(t *testing.T, size int) *PawnShopServer {
 		time.Sleep(5 * time.Millisecond)
 	}
 	require.True(t, s.IsRunning())
+}
 
-	return s
+/*
+fakeClock is a loans.Clock whose time only changes when it is advanced.
+*/
+type fakeClock struct {
+	now  time.Time
+	lock sync.Mutex
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
 }
 
-func getAvailablePort() (int, error) {
-	l, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		return 0, err
+/*
+Returns a THROTTLED answer with a reason without message, see withoutReasonMessage.
+*/
+func throttledAnswer(code messages.ReasonCode) messages.Answer {
+	return messages.Answer{
+		Code:   messages.ThrottledCode,
+		Reason: &messages.Reason{Code: code},
 	}
-	defer l.Close()
-	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+/*
+Returns a REJECT answer with a reason without message, see withoutReasonMessage.
+*/
+func rejectAnswer(code messages.ReasonCode) messages.Answer {
+	return messages.Answer{
+		Code:   messages.RejectCode,
+		Reason: &messages.Reason{Code: code},
+	}
+}
+
+/*
+Returns a REJECT answer for an offer that the rule with the given ID did not accept, with a reason without message,
+see withoutReasonMessage.
+*/
+func invalidAnswer(rule string) messages.Answer {
+	return messages.Answer{
+		Code:   messages.RejectCode,
+		Reason: &messages.Reason{Code: messages.ReasonInvalidOffer, Rule: rule},
+	}
+}
+
+/*
+Returns an ERROR answer with a reason without message, see withoutReasonMessage.
+*/
+func errorAnswer(code messages.ReasonCode) messages.Answer {
+	return messages.Answer{
+		Code:   messages.ErrorCode,
+		Reason: &messages.Reason{Code: code},
+	}
+}
+
+/*
+Asserts that the reason of ans, if any, has a message, and returns ans without the message.
+The message is meant for humans, so only the reason code is compared.
+*/
+func withoutReasonMessage(t *testing.T, ans messages.Answer) messages.Answer {
+	if ans.Reason == nil {
+		return ans
+	}
+	require.NotEmpty(t, ans.Reason.Message)
+
+	reason := *ans.Reason
+	reason.Message = ""
+	ans.Reason = &reason
+	return ans
 }
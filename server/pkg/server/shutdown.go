@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ShutdownReport reports how the offers that were in flight when a server stopped accepting connections ended.
+*/
+type ShutdownReport struct {
+	// Completed is the number of offers that were answered after the server stopped accepting connections.
+	Completed uint64 `json:"completed"`
+	// Aborted is the number of offers that were read after the server stopped accepting connections,
+	// but could not be answered, e.g. because their connection was closed after the drain timeout.
+	Aborted uint64 `json:"aborted"`
+	// ForceClosed is the number of connections that were closed because they were still open after the drain timeout.
+	ForceClosed uint64 `json:"force_closed"`
+	// Duration is how long it took from the server no longer accepting connections until it stopped.
+	Duration time.Duration `json:"duration"`
+}
+
+/*
+shutdownCounters are the counters of the shutdown report of a server.
+*/
+type shutdownCounters struct {
+	completed   atomic.Uint64
+	aborted     atomic.Uint64
+	forceClosed atomic.Uint64
+	// started and stopped are the Unix times in nanoseconds the shutdown started and ended, or 0.
+	started atomic.Int64
+	stopped atomic.Int64
+}
+
+/*
+Returns the shutdown report of the server. The report is only complete once Start has returned.
+*/
+func (p *PawnShopServer) ShutdownReport() ShutdownReport {
+	r := ShutdownReport{
+		Completed:   p.shutdown.completed.Load(),
+		Aborted:     p.shutdown.aborted.Load(),
+		ForceClosed: p.shutdown.forceClosed.Load(),
+	}
+	if started, stopped := p.shutdown.started.Load(), p.shutdown.stopped.Load(); started != 0 && stopped != 0 {
+		r.Duration = time.Duration(stopped - started)
+	}
+	return r
+}
+
+/*
+Counts an offer read from a connection towards the shutdown report if the server is shutting down.
+The offer was completed if err is nil, and aborted otherwise.
+*/
+func (p *PawnShopServer) countShutdownOffer(err error) {
+	if p.shutdownCtx.Err() == nil {
+		return
+	}
+	if err != nil {
+		p.shutdown.aborted.Add(1)
+	} else {
+		p.shutdown.completed.Add(1)
+	}
+}
+
+/*
+Stops accepting connections, and starts the drain timeout after which open connections are closed.
+*/
+func (p *PawnShopServer) startShutdown() {
+	p.shutdown.started.CompareAndSwap(0, time.Now().UnixNano())
+	p.cancel()
+	time.AfterFunc(p.opts.DrainTimeout, p.forceClose)
+}
+
+/*
+Closes a connection once the drain timeout has passed, unless the returned function is called first.
+*/
+func (p *PawnShopServer) closeAfterDrainTimeout(conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(p.drainCtx, func() {
+		p.shutdown.forceClosed.Add(1)
+		log.Warnf("Closing connection from %s, it is still open after the drain timeout", conn.RemoteAddr())
+		_ = conn.Close()
+	})
+}
+
+/*
+Shuts down an HTTP server with the given name, closing its connections if they are still open once ctx is done.
+*/
+func shutdownHTTP(ctx context.Context, name string, srv *http.Server) error {
+	err := srv.Shutdown(ctx)
+	if err != nil && ctx.Err() != nil {
+		log.Warnf("Closing connections to %s, they are still open after the drain timeout", name)
+		err = srv.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to shut down %s: %w", name, err)
+	}
+	return nil
+}
+
+/*
+Logs the shutdown report of the server once it has stopped.
+*/
+func (p *PawnShopServer) logShutdownReport() {
+	p.shutdown.stopped.Store(time.Now().UnixNano())
+	r := p.ShutdownReport()
+	log.Infof("Server has stopped after draining for %s: %d offers completed, %d offers aborted, %d connections closed after the drain timeout",
+		r.Duration, r.Completed, r.Aborted, r.ForceClosed)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/pawnshop"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerDrainTimeout(t *testing.T) {
+	// Offers are held up by the rule until they are released
+	started := make(chan int, 2)
+	release := map[int]chan struct{}{5: make(chan struct{}), 7: make(chan struct{})}
+	rule := pawnshop.RuleFunc(func(_ context.Context, o messages.Offer) error {
+		if ch, ok := release[o.Offer]; ok {
+			started <- o.Offer
+			<-ch
+		}
+		return nil
+	})
+
+	s, stopped := startServer(t, Options{
+		InventorySize: 2,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		DrainTimeout:  200 * time.Millisecond,
+		Rules:         []pawnshop.Rule{rule},
+	})
+
+	completed, aborted, idle := dialSession(t, s), dialSession(t, s), dialSession(t, s)
+	_, err := completed.Write([]byte(`{"code": "PAWN", "offer": 5, "demand": 1}` + "\n"))
+	require.NoError(t, err)
+	_, err = aborted.Write([]byte(`{"code": "PAWN", "offer": 7, "demand": 1}` + "\n"))
+	require.NoError(t, err)
+	<-started
+	<-started
+
+	start := time.Now()
+	require.NoError(t, s.Stop())
+
+	// Idle sessions are closed right away, while offers that are being handled may still finish and be answered
+	require.NoError(t, idle.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = idle.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	close(release[5])
+	var answer messages.Answer
+	require.NoError(t, completed.dec.Decode(&answer))
+	require.Equal(t, messages.CreateAcceptedAnswer(1), answer)
+
+	// Until the drain timeout, after which their connections are closed
+	require.NoError(t, aborted.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = aborted.Read(make([]byte, 1))
+	require.Error(t, err)
+	var netErr net.Error
+	require.False(t, errors.As(err, &netErr) && netErr.Timeout())
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	close(release[7])
+
+	require.NoError(t, <-stopped)
+	report := s.ShutdownReport()
+	require.GreaterOrEqual(t, report.Duration, 200*time.Millisecond)
+	report.Duration = 0
+	require.Equal(t, ShutdownReport{Completed: 1, Aborted: 1, ForceClosed: 1}, report)
+}
+
+func TestServerStopDoesNotBlockAddrs(t *testing.T) {
+	s, stopped := startServer(t, Options{
+		InventorySize: 2,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		HTTPAddress:   "127.0.0.1:0",
+		DrainTimeout:  time.Second,
+	})
+
+	// A request that is still being read holds up the shutdown of the HTTP gateway until the drain timeout
+	conn, err := net.Dial("tcp", s.HTTPAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /inventory HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	stopErr := make(chan error, 1)
+	go func() {
+		stopErr <- s.Stop()
+	}()
+	// The server stops while Stop still waits for the HTTP gateway to shut down
+	require.NoError(t, <-stopped)
+
+	// The addresses are available in the meantime
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.Len(t, s.Addrs(), 1)
+		require.NotNil(t, s.HTTPAddr())
+	}()
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("addresses are blocked by Stop")
+	}
+	select {
+	case <-stopErr:
+		t.Fatal("Stop returned before the drain timeout")
+	default:
+	}
+
+	require.NoError(t, <-stopErr)
+}
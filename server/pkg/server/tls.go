@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"pawnshop/server/pkg/pawnshop"
+)
+
+/*
+TLSOptions configures TLS on a listener of a PawnShopServer.
+*/
+type TLSOptions struct {
+	// CertFile is the path to the PEM encoded certificate chain of the server.
+	CertFile string
+	// KeyFile is the path to the PEM encoded private key of the server.
+	KeyFile string
+	// ClientCAFile is the path to PEM encoded CA certificates. If set, mutual TLS is enabled,
+	// and clients must present a certificate signed by one of the CAs to be able to connect.
+	ClientCAFile string
+}
+
+/*
+Creates a TLS configuration from the given options.
+Returns an error if any of the certificates or keys can not be loaded.
+*/
+func newTLSConfig(opts *TLSOptions) (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("both a certificate and a key file are required for TLS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate and key: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", opts.ClientCAFile)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+/*
+Returns the identity of the client from the verified certificate it presented during the TLS handshake,
+and whether the client presented a certificate at all.
+*/
+func clientIdentity(state tls.ConnectionState) (pawnshop.ClientIdentity, bool) {
+	if len(state.PeerCertificates) == 0 {
+		return pawnshop.ClientIdentity{}, false
+	}
+
+	cert := state.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	return pawnshop.ClientIdentity{
+		CommonName:   cert.Subject.CommonName,
+		SerialNumber: cert.SerialNumber.String(),
+		Fingerprint:  hex.EncodeToString(fingerprint[:]),
+	}, true
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"pawnshop/server/pkg/framing"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/pawnshop"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	certs := writeTestCerts(t)
+
+	cases := []struct {
+		name          string
+		opts          TLSOptions
+		expClientAuth tls.ClientAuthType
+		expError      bool
+	}{
+		{
+			name: "TLS without client CA",
+			opts: TLSOptions{
+				CertFile: certs.serverCert,
+				KeyFile:  certs.serverKey,
+			},
+			expClientAuth: tls.NoClientCert,
+		},
+		{
+			name: "Mutual TLS with client CA",
+			opts: TLSOptions{
+				CertFile:     certs.serverCert,
+				KeyFile:      certs.serverKey,
+				ClientCAFile: certs.ca,
+			},
+			expClientAuth: tls.RequireAndVerifyClientCert,
+		},
+		{
+			name: "Missing key file, should return error",
+			opts: TLSOptions{
+				CertFile: certs.serverCert,
+			},
+			expError: true,
+		},
+		{
+			name: "Non-existent certificate file, should return error",
+			opts: TLSOptions{
+				CertFile: filepath.Join(t.TempDir(), "missing.pem"),
+				KeyFile:  certs.serverKey,
+			},
+			expError: true,
+		},
+		{
+			name: "Client CA file without certificates, should return error",
+			opts: TLSOptions{
+				CertFile:     certs.serverCert,
+				KeyFile:      certs.serverKey,
+				ClientCAFile: certs.serverKey,
+			},
+			expError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := newTLSConfig(&c.opts)
+			if c.expError {
+				require.Nil(t, cfg)
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expClientAuth, cfg.ClientAuth)
+		})
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	certs := writeTestCerts(t)
+
+	s, err := NewPawnShopServer(Options{
+		InventorySize: 1,
+		Listeners: []ListenerOptions{
+			{
+				Address: "127.0.0.1:0",
+				TLS: &TLSOptions{
+					CertFile: certs.serverCert,
+					KeyFile:  certs.serverKey,
+				},
+			},
+			{
+				Address: "127.0.0.1:0",
+				TLS: &TLSOptions{
+					CertFile:     certs.serverCert,
+					KeyFile:      certs.serverKey,
+					ClientCAFile: certs.ca,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	recorder := &identityRecorder{}
+	s.offerHandler = recorder
+
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	waitForServer(t, s)
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	caPEM, err := os.ReadFile(certs.ca)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caPEM))
+
+	clientCert, err := tls.LoadX509KeyPair(certs.clientCert, certs.clientKey)
+	require.NoError(t, err)
+
+	addrs := s.Addrs()
+
+	cases := []struct {
+		name      string
+		addr      string
+		certs     []tls.Certificate
+		expError  bool
+		expID     pawnshop.ClientIdentity
+		expIDSent bool
+	}{
+		{
+			name: "TLS listener, client without certificate, should carry no identity",
+			addr: addrs[0].String(),
+		},
+		{
+			name:     "Mutual TLS listener, client without certificate, should fail",
+			addr:     addrs[1].String(),
+			expError: true,
+		},
+		{
+			name:  "Mutual TLS listener, client with certificate, should carry identity",
+			addr:  addrs[1].String(),
+			certs: []tls.Certificate{clientCert},
+			expID: pawnshop.ClientIdentity{
+				CommonName:   "test-client",
+				SerialNumber: "3",
+			},
+			expIDSent: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", c.addr, &tls.Config{
+				RootCAs:      roots,
+				Certificates: c.certs,
+				MinVersion:   tls.VersionTLS12,
+			})
+			if err != nil && c.expError {
+				return
+			}
+			require.NoError(t, err)
+			defer conn.Close()
+
+			framer, err := framing.New(conn, framing.NewlineMode, framing.DefaultMaxFrameSize)
+			require.NoError(t, err)
+
+			// With TLS 1.3, a rejected client certificate is only noticed by the client when it reads
+			err = framer.WriteFrame([]byte(`{"code": "PAWN", "offer": 2, "demand": 1}`))
+			if err == nil {
+				var frame []byte
+				frame, err = framer.ReadFrame()
+				if err == nil {
+					var answer messages.Answer
+					require.NoError(t, json.Unmarshal(frame, &answer))
+					require.Equal(t, messages.CreateAcceptedAnswer(1), answer)
+				}
+			}
+			if c.expError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			id, ok := recorder.last()
+			require.Equal(t, c.expIDSent, ok)
+			require.Equal(t, c.expID.CommonName, id.CommonName)
+			require.Equal(t, c.expID.SerialNumber, id.SerialNumber)
+			if c.expIDSent {
+				require.Len(t, id.Fingerprint, 64)
+			}
+		})
+	}
+}
+
+/*
+identityRecorder is an OfferHandler that accepts every offer and records the client identity of the last offer.
+*/
+type identityRecorder struct {
+	lock  sync.Mutex
+	id    pawnshop.ClientIdentity
+	hasID bool
+}
+
+func (r *identityRecorder) HandleOffer(ctx context.Context, _ messages.Offer) messages.Answer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.id, r.hasID = pawnshop.ClientIdentityFromContext(ctx)
+	return messages.CreateAcceptedAnswer(1)
+}
+
+func (r *identityRecorder) last() (pawnshop.ClientIdentity, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.id, r.hasID
+}
+
+/*
+testCerts contains the paths to a generated CA, and server and client certificates signed by the CA.
+*/
+type testCerts struct {
+	ca         string
+	serverCert string
+	serverKey  string
+	clientCert string
+	clientKey  string
+}
+
+/*
+Generates a self-signed CA, and a server certificate for 127.0.0.1 and a client certificate
+signed by the CA, and writes them as PEM files to a temporary directory.
+*/
+func writeTestCerts(t *testing.T) testCerts {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage, ips []net.IP) ([]byte, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  ips,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		return der, key
+	}
+
+	write := func(name, typ string, b []byte) string {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0o600)
+		require.NoError(t, err)
+		return path
+	}
+
+	writeKey := func(name string, key *ecdsa.PrivateKey) string {
+		b, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		return write(name, "EC PRIVATE KEY", b)
+	}
+
+	serverDER, serverKey := issue(2, "test-server", x509.ExtKeyUsageServerAuth, []net.IP{net.ParseIP("127.0.0.1")})
+	clientDER, clientKey := issue(3, "test-client", x509.ExtKeyUsageClientAuth, nil)
+
+	return testCerts{
+		ca:         write("ca.pem", "CERTIFICATE", caDER),
+		serverCert: write("server.pem", "CERTIFICATE", serverDER),
+		serverKey:  writeKey("server-key.pem", serverKey),
+		clientCert: write("client.pem", "CERTIFICATE", clientDER),
+		clientKey:  writeKey("client-key.pem", clientKey),
+	}
+}
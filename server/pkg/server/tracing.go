@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"pawnshop/server/pkg/logging"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/tracing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+TraceExporter decides where the spans of offers are exported to.
+*/
+type TraceExporter string
+
+const (
+	// NoTraceExporter does not trace offers.
+	NoTraceExporter TraceExporter = "none"
+	// StdoutTraceExporter writes every span as a line of JSON to stdout.
+	StdoutTraceExporter TraceExporter = "stdout"
+	// FileTraceExporter appends every span as a line of JSON to a file.
+	FileTraceExporter TraceExporter = "file"
+	// OTLPTraceExporter exports spans to an OpenTelemetry collector with OTLP over HTTP.
+	OTLPTraceExporter TraceExporter = "otlp"
+)
+
+/*
+Parses a trace exporter from its string representation.
+*/
+func ParseTraceExporter(s string) (TraceExporter, error) {
+	switch e := TraceExporter(s); e {
+	case NoTraceExporter, StdoutTraceExporter, FileTraceExporter, OTLPTraceExporter:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unknown trace exporter %q", s)
+	}
+}
+
+/*
+TracingOptions configures the tracing of the offers handled by a server.
+*/
+type TracingOptions struct {
+	// Exporter is where the spans of offers are exported to. Defaults to NoTraceExporter.
+	Exporter TraceExporter
+	// File is the file spans are appended to when using FileTraceExporter.
+	File string
+	// Endpoint is the URL of the OpenTelemetry collector when using OTLPTraceExporter, e.g. http://localhost:4318.
+	Endpoint string
+	// ServiceName is the name of the service the spans are exported with to the collector.
+	// Defaults to tracing.DefaultServiceName.
+	ServiceName string
+}
+
+/*
+Returns a copy of the tracing options with defaults applied, or an error if any option is invalid.
+*/
+func (o TracingOptions) withDefaults() (TracingOptions, error) {
+	if o.Exporter == "" {
+		o.Exporter = NoTraceExporter
+	}
+	if _, err := ParseTraceExporter(string(o.Exporter)); err != nil {
+		return TracingOptions{}, err
+	}
+
+	if o.Exporter == FileTraceExporter && o.File == "" {
+		return TracingOptions{}, errors.New("a trace file is required for the file trace exporter")
+	}
+	if o.Exporter == OTLPTraceExporter && o.Endpoint == "" {
+		return TracingOptions{}, errors.New("an endpoint is required for the OTLP trace exporter")
+	}
+	return o, nil
+}
+
+/*
+Creates the tracer of a server, or returns nil if offers are not traced.
+*/
+func newTracer(opts TracingOptions) (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+	var err error
+	switch opts.Exporter {
+	case StdoutTraceExporter:
+		exporter = tracing.NewWriterExporter(os.Stdout)
+	case FileTraceExporter:
+		exporter, err = tracing.NewFileExporter(opts.File)
+	case OTLPTraceExporter:
+		exporter, err = tracing.NewOTLPExporter(tracing.OTLPOptions{Endpoint: opts.Endpoint, ServiceName: opts.ServiceName})
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	return tracing.NewTracer(exporter), nil
+}
+
+/*
+Starts handling an offer. Returns a copy of ctx carrying a new offer ID and the code, offer and demand of the offer
+for the logs, and the span of the offer. The span is a child of the span of the client if the offer carries its trace
+context, in which case it is linked to the span carried by ctx, e.g. the span of the connection. Otherwise it is a child
+of the span carried by ctx.
+*/
+func (p *PawnShopServer) startOffer(ctx context.Context, name string, offer messages.Offer) (context.Context, *tracing.Span) {
+	id := logging.NewID()
+	ctx = logging.WithFields(ctx, log.Fields{
+		logging.OfferIDField: id,
+		logging.CodeField:    offer.Code,
+		logging.OfferField:   offer.Offer,
+		logging.DemandField:  offer.Demand,
+	})
+
+	outer := tracing.SpanFromContext(ctx)
+	remote := false
+	if offer.TraceParent != "" {
+		sc, err := tracing.ParseTraceParent(offer.TraceParent)
+		if err != nil {
+			// Offers are not rejected because of their trace context, which only affects tracing
+			logging.FromContext(ctx).Debugf("Ignoring trace context of offer: %s", err)
+		} else {
+			ctx = tracing.WithRemoteSpanContext(ctx, sc)
+			remote = true
+		}
+	}
+
+	ctx, span := p.tracer.Start(ctx, name)
+	if span == nil {
+		return ctx, nil
+	}
+	if remote && outer != nil {
+		span.AddLink(outer.SpanContext())
+	}
+	span.SetAttribute(tracing.OfferIDAttribute, id)
+	span.SetAttribute(tracing.CodeAttribute, offer.Code)
+	span.SetAttribute(tracing.OfferAttribute, offer.Offer)
+	span.SetAttribute(tracing.DemandAttribute, offer.Demand)
+	return logging.WithFields(ctx, log.Fields{logging.TraceIDField: span.SpanContext().TraceID.String()}), span
+}
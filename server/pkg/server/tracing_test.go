@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pawnshop/server/pkg/messages"
+	"pawnshop/server/pkg/pawnshop"
+	"pawnshop/server/pkg/tracing"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerTracing(t *testing.T) {
+	client, err := tracing.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	httpClient, err := tracing.ParseTraceParent("00-0af7651916cd43dd8448eb211c00f319-b7ad6b7169203331-01")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	s, stopped := startServer(t, Options{
+		InventorySize: 2,
+		Listeners:     []ListenerOptions{{Address: "127.0.0.1:0"}},
+		HTTPAddress:   "127.0.0.1:0",
+		Tracing:       TracingOptions{Exporter: FileTraceExporter, File: path},
+	})
+
+	// Invalid trace context is ignored
+	sess := dialSession(t, s)
+	require.Equal(t, messages.CreateAcceptedAnswer(1),
+		sess.send(`{"code": "PAWN", "offer": 5, "demand": 1, "traceparent": "`+client.TraceParent()+`"}`))
+	require.Equal(t, invalidAnswer(pawnshop.EnsureProfitRuleID),
+		withoutReasonMessage(t, sess.send(`{"code": "PAWN", "offer": 1, "demand": 2, "traceparent": "invalid"}`)))
+	require.NoError(t, sess.Close())
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+s.HTTPAddr().String()+"/offers",
+		bytes.NewBufferString(`{"code": "PAWN", "offer": 5, "demand": 1}`))
+	require.NoError(t, err)
+	req.Header.Set("traceparent", httpClient.TraceParent())
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	// All spans have been exported once the server has stopped
+	require.NoError(t, s.Stop())
+	require.NoError(t, <-stopped)
+	spans := readSpans(t, path)
+
+	conn := spans.named(t, "PawnShopServer.handleConnection", 1)[0]
+	require.False(t, conn.ParentSpanID.IsValid())
+	require.Contains(t, conn.Attributes, tracing.ConnIDAttribute)
+
+	// The offer with trace context is part of the trace of the client, and linked to the connection
+	offers := spans.named(t, "PawnShopServer.handleOffer", 2)
+	require.Equal(t, client.TraceID, offers[0].TraceID)
+	require.Equal(t, client.SpanID, offers[0].ParentSpanID)
+	require.Equal(t, []tracing.SpanContext{{TraceID: conn.TraceID, SpanID: conn.SpanID}}, offers[0].Links)
+	require.Equal(t, messages.AcceptCode, offers[0].Attributes[tracing.DecisionAttribute])
+	require.Equal(t, conn.TraceID, offers[1].TraceID)
+	require.Equal(t, conn.SpanID, offers[1].ParentSpanID)
+	require.Equal(t, pawnshop.EnsureProfitRuleID, offers[1].Attributes[tracing.RuleAttribute])
+
+	// The work done for the accepted offer is traced down to the wait for the lock of the inventory
+	lock := spans.named(t, "Inventory.lock", 2)[0]
+	require.Equal(t, []string{
+		"Inventory.lock", "Inventory.HandleOffer", "PawnShop.HandleOffer", "PawnShopServer.handleOffer",
+	}, spans.ancestry(lock))
+	require.Equal(t, client.TraceID, lock.TraceID)
+
+	// Every rule is traced, and the rule that rejected the offer failed
+	rules := spans.named(t, "Rule.Validate", 3)
+	require.Equal(t, []string{
+		"Rule.Validate", "Validator.Validate", "PawnShop.HandleOffer", "PawnShopServer.handleOffer",
+		"PawnShopServer.handleConnection",
+	}, spans.ancestry(rules[1]))
+	require.Equal(t, pawnshop.EnsureProfitRuleID, rules[1].Attributes[tracing.RuleAttribute])
+	require.NotEmpty(t, rules[1].Error)
+
+	// Offers to the HTTP gateway take the trace context from the traceparent header
+	httpOffer := spans.named(t, "PawnShopServer.handleHTTPOffer", 1)[0]
+	require.Equal(t, httpClient.TraceID, httpOffer.TraceID)
+	require.Equal(t, httpClient.SpanID, httpOffer.ParentSpanID)
+}
+
+/*
+exportedSpans are the spans exported by a server, in the order they ended.
+*/
+type exportedSpans []tracing.SpanData
+
+/*
+Reads the spans exported to a trace file.
+*/
+func readSpans(t *testing.T, path string) exportedSpans {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var spans exportedSpans
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var span tracing.SpanData
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &span))
+		spans = append(spans, span)
+	}
+	require.NoError(t, scanner.Err())
+	return spans
+}
+
+/*
+Returns the spans with the given name, in the order they started, and requires that there are n of them.
+*/
+func (s exportedSpans) named(t *testing.T, name string, n int) []tracing.SpanData {
+	var named []tracing.SpanData
+	for _, span := range s {
+		if span.Name == name {
+			named = append(named, span)
+		}
+	}
+	require.Len(t, named, n, "spans named %s", name)
+
+	sort.Slice(named, func(i, j int) bool {
+		return named[i].Start.Before(named[j].Start)
+	})
+	return named
+}
+
+/*
+Returns the names of a span and its exported ancestors, starting with the span.
+*/
+func (s exportedSpans) ancestry(span tracing.SpanData) []string {
+	names := []string{span.Name}
+	for {
+		found := false
+		for _, parent := range s {
+			if parent.SpanID == span.ParentSpanID {
+				names = append(names, parent.Name)
+				span = parent
+				found = true
+				break
+			}
+		}
+		if !found {
+			return names
+		}
+	}
+}
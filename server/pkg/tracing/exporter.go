@@ -0,0 +1,69 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+WriterExporter is an Exporter that writes every span as a JSON object on its own line,
+e.g. to stdout or to a file, so that traces can be inspected without a collector.
+*/
+type WriterExporter struct {
+	w      io.Writer
+	closer io.Closer
+	lock   sync.Mutex
+}
+
+/*
+Creates a new exporter that writes spans to w. Closing the exporter does not close w.
+*/
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+/*
+Creates a new exporter that appends spans to the file at the given path, creating it if it does not exist.
+*/
+func NewFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace file: %w", err)
+	}
+	return &WriterExporter{w: f, closer: f}, nil
+}
+
+/*
+Writes the span as a line of JSON.
+*/
+func (e *WriterExporter) ExportSpan(s SpanData) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		log.Errorf("Failed to marshal span %s: %s", s.Name, err)
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if _, err = e.w.Write(append(b, '\n')); err != nil {
+		log.Errorf("Failed to write span %s: %s", s.Name, err)
+	}
+}
+
+/*
+Closes the file of the exporter, if it has one.
+*/
+func (e *WriterExporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
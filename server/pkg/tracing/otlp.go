@@ -0,0 +1,392 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultServiceName is the service name spans are exported with if none is given.
+	DefaultServiceName = "pawnshop"
+
+	// otlpTracesPath is the path spans are posted to if the endpoint has no path, as with OTLP/HTTP collectors.
+	otlpTracesPath = "/v1/traces"
+
+	defaultBatchSize = 512
+	defaultQueueSize = 2048
+	defaultInterval  = 5 * time.Second
+	defaultTimeout   = 10 * time.Second
+)
+
+/*
+OTLPOptions configures an OTLPExporter.
+*/
+type OTLPOptions struct {
+	// Endpoint is the URL of an OpenTelemetry collector, e.g. http://localhost:4318. If it has no path,
+	// spans are posted to /v1/traces.
+	Endpoint string
+	// ServiceName is the service.name resource attribute of the spans. Defaults to DefaultServiceName.
+	ServiceName string
+	// BatchSize is the number of spans after which spans are exported early. Defaults to 512.
+	BatchSize int
+	// QueueSize is the number of spans that may wait to be exported. Spans ending while the queue is full
+	// are dropped. Defaults to 2048.
+	QueueSize int
+	// Interval is how often spans are exported. Defaults to 5 seconds.
+	Interval time.Duration
+	// Timeout bounds every export, including the last one when the exporter is closed. Defaults to 10 seconds.
+	Timeout time.Duration
+	// Client is the HTTP client spans are posted with. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+/*
+Returns a copy of the options with all unset fields set to their defaults,
+or an error if any of the options are invalid.
+*/
+func (o OTLPOptions) withDefaults() (OTLPOptions, error) {
+	u, err := url.Parse(o.Endpoint)
+	if err != nil {
+		return OTLPOptions{}, fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return OTLPOptions{}, fmt.Errorf("OTLP endpoint %q must be an http or https URL", o.Endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpTracesPath
+	}
+	o.Endpoint = u.String()
+
+	if o.ServiceName == "" {
+		o.ServiceName = DefaultServiceName
+	}
+	if o.BatchSize < 0 || o.QueueSize < 0 || o.Interval < 0 || o.Timeout < 0 {
+		return OTLPOptions{}, errors.New("OTLP batch size, queue size, interval and timeout can not be negative")
+	}
+	if o.BatchSize == 0 {
+		o.BatchSize = defaultBatchSize
+	}
+	if o.QueueSize == 0 {
+		o.QueueSize = defaultQueueSize
+	}
+	if o.QueueSize < o.BatchSize {
+		o.QueueSize = o.BatchSize
+	}
+	if o.Interval == 0 {
+		o.Interval = defaultInterval
+	}
+	if o.Timeout == 0 {
+		o.Timeout = defaultTimeout
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	return o, nil
+}
+
+/*
+OTLPExporter is an Exporter that exports spans in batches to an OpenTelemetry collector,
+with OTLP over HTTP in the JSON encoding.
+*/
+type OTLPExporter struct {
+	opts    OTLPOptions
+	lock    sync.Mutex
+	queue   []SpanData
+	dropped uint64
+	flush   chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+/*
+Creates a new OTLP exporter, which exports spans in the background until it is closed.
+*/
+func NewOTLPExporter(opts OTLPOptions) (*OTLPExporter, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &OTLPExporter{
+		opts:    opts,
+		flush:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+/*
+Queues the span to be exported with the next batch. The span is dropped if the queue is full.
+*/
+func (e *OTLPExporter) ExportSpan(s SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if len(e.queue) >= e.opts.QueueSize {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, s)
+	if len(e.queue) >= e.opts.BatchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+/*
+Returns the number of spans that were dropped because the queue was full.
+*/
+func (e *OTLPExporter) Dropped() uint64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.dropped
+}
+
+/*
+Stops exporting in the background, and exports all queued spans.
+*/
+func (e *OTLPExporter) Close() error {
+	e.once.Do(func() {
+		close(e.done)
+	})
+	<-e.stopped
+	return e.export()
+}
+
+/*
+Exports the queued spans every interval, or once a batch is full, until the exporter is closed.
+*/
+func (e *OTLPExporter) run() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(e.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		case <-e.flush:
+		}
+
+		if err := e.export(); err != nil {
+			log.Errorf("Failed to export spans: %s", err)
+		}
+	}
+}
+
+/*
+Exports all queued spans, in batches of at most the batch size.
+*/
+func (e *OTLPExporter) export() error {
+	e.lock.Lock()
+	spans := e.queue
+	e.queue = nil
+	e.lock.Unlock()
+
+	for len(spans) > 0 {
+		n := min(len(spans), e.opts.BatchSize)
+		if err := e.post(spans[:n]); err != nil {
+			return fmt.Errorf("failed to export %d spans: %w", len(spans), err)
+		}
+		spans = spans[n:]
+	}
+	return nil
+}
+
+/*
+Posts a batch of spans to the collector.
+*/
+func (e *OTLPExporter) post(spans []SpanData) error {
+	body, err := json.Marshal(newOTLPRequest(e.opts.ServiceName, spans))
+	if err != nil {
+		return fmt.Errorf("failed to marshal spans: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.opts.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post spans: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// The types below are the JSON encoding of an OTLP ExportTraceServiceRequest. IDs are hex encoded,
+// and 64 bit integers are encoded as strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name         string `json:"name"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+const (
+	// otlpKindInternal is the kind of spans of work within the server.
+	otlpKindInternal = 1
+	// otlpStatusError is the status code of failed spans.
+	otlpStatusError = 2
+)
+
+/*
+Creates the OTLP request exporting the given spans of a service.
+*/
+func newOTLPRequest(service string, spans []SpanData) otlpRequest {
+	converted := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		converted[i] = otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: unixNano(s.Start),
+			EndTimeUnixNano:   unixNano(s.End),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.ParentSpanID.IsValid() {
+			converted[i].ParentSpanID = s.ParentSpanID.String()
+		}
+		for _, ev := range s.Events {
+			converted[i].Events = append(converted[i].Events, otlpEvent{TimeUnixNano: unixNano(ev.Time), Name: ev.Name})
+		}
+		for _, l := range s.Links {
+			converted[i].Links = append(converted[i].Links, otlpLink{TraceID: l.TraceID.String(), SpanID: l.SpanID.String()})
+		}
+		if s.Error != "" {
+			converted[i].Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]any{"service.name": service})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: DefaultServiceName}, Spans: converted}},
+	}}}
+}
+
+/*
+Converts attributes to OTLP key values, sorted by key. Values of unsupported types are converted to strings.
+*/
+func otlpAttributes(attrs map[string]any) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]otlpKeyValue, len(keys))
+	for i, k := range keys {
+		var v otlpAnyValue
+		switch a := attrs[k].(type) {
+		case string:
+			v.StringValue = &a
+		case bool:
+			v.BoolValue = &a
+		case int:
+			s := strconv.Itoa(a)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(a, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &a
+		default:
+			s := fmt.Sprint(a)
+			v.StringValue = &s
+		}
+		kvs[i] = otlpKeyValue{Key: k, Value: v}
+	}
+	return kvs
+}
+
+/*
+Returns a time as nanoseconds since the Unix epoch, encoded as a string.
+*/
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,444 @@
+/*
+Package tracing records spans of the work done for an offer, e.g. in the server, pawnshop and inventory packages,
+so that it can be seen where the latency of an offer goes. Spans are carried through a context.Context, and trace
+context is propagated from clients in the W3C Trace Context format. Finished spans are exported either to an
+OpenTelemetry collector with OTLP, or to a file or stdout.
+*/
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The names of the span attributes, which are the same as the names of the corresponding log fields.
+const (
+	// ConnIDAttribute is the ID of the connection, or HTTP request, an offer was received on.
+	ConnIDAttribute = "conn_id"
+	// RemoteAddrAttribute is the remote address of the client.
+	RemoteAddrAttribute = "remote_addr"
+	// OfferIDAttribute is the ID of the offer.
+	OfferIDAttribute = "offer_id"
+	// CodeAttribute is the code of the offer.
+	CodeAttribute = "code"
+	// OfferAttribute is the offer of the offer.
+	OfferAttribute = "offer"
+	// DemandAttribute is the demand of the offer.
+	DemandAttribute = "demand"
+	// DecisionAttribute is the code of the answer to the offer.
+	DecisionAttribute = "decision"
+	// ReasonAttribute is the reason code of the answer to the offer, if it has one.
+	ReasonAttribute = "reason"
+	// RuleAttribute is the ID of a validation rule.
+	RuleAttribute = "rule"
+)
+
+/*
+TraceID is the ID of a trace, which all spans of the work done for an offer share.
+*/
+type TraceID [16]byte
+
+/*
+Returns the trace ID as 32 lowercase hex characters.
+*/
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+/*
+Returns whether the trace ID is valid, i.e. not all zeroes.
+*/
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+/*
+Marshals the trace ID as hex characters.
+*/
+func (t TraceID) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+/*
+Unmarshals the trace ID from hex characters.
+*/
+func (t *TraceID) UnmarshalText(b []byte) error {
+	id, err := decodeHex(string(b), len(t))
+	if err != nil {
+		return fmt.Errorf("invalid trace ID %q", b)
+	}
+	copy(t[:], id)
+	return nil
+}
+
+/*
+SpanID is the ID of a span within a trace.
+*/
+type SpanID [8]byte
+
+/*
+Returns the span ID as 16 lowercase hex characters.
+*/
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+/*
+Returns whether the span ID is valid, i.e. not all zeroes.
+*/
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+/*
+Marshals the span ID as hex characters, or as an empty string if it is not valid.
+*/
+func (s SpanID) MarshalText() ([]byte, error) {
+	if !s.IsValid() {
+		return []byte{}, nil
+	}
+	return []byte(s.String()), nil
+}
+
+/*
+Unmarshals the span ID from hex characters, or from an empty string if it is not valid.
+*/
+func (s *SpanID) UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*s = SpanID{}
+		return nil
+	}
+	id, err := decodeHex(string(b), len(s))
+	if err != nil {
+		return fmt.Errorf("invalid span ID %q", b)
+	}
+	copy(s[:], id)
+	return nil
+}
+
+/*
+SpanContext identifies a span, either of this process or of a remote process such as a client.
+*/
+type SpanContext struct {
+	TraceID TraceID `json:"trace_id"`
+	SpanID  SpanID  `json:"span_id"`
+	// Sampled is whether the remote process records the trace.
+	Sampled bool `json:"-"`
+}
+
+/*
+Returns whether both IDs of the span context are valid.
+*/
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+/*
+Returns the span context in the format of the traceparent header of the W3C Trace Context.
+*/
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+/*
+Parses a span context in the format of the traceparent header of the W3C Trace Context,
+e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+*/
+func ParseTraceParent(s string) (SpanContext, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 {
+		return SpanContext{}, fmt.Errorf("traceparent %q must have four fields", s)
+	}
+
+	version, err := decodeHex(parts[0], 1)
+	if err != nil || version[0] == 0xff {
+		return SpanContext{}, fmt.Errorf("traceparent %q has an invalid version", s)
+	}
+	// Later versions may append fields, which are ignored
+	if version[0] == 0 && len(parts) != 4 {
+		return SpanContext{}, fmt.Errorf("traceparent %q must have four fields", s)
+	}
+
+	var sc SpanContext
+	traceID, err := decodeHex(parts[1], len(sc.TraceID))
+	if err != nil {
+		return SpanContext{}, fmt.Errorf("traceparent %q has an invalid trace ID", s)
+	}
+	spanID, err := decodeHex(parts[2], len(sc.SpanID))
+	if err != nil {
+		return SpanContext{}, fmt.Errorf("traceparent %q has an invalid parent ID", s)
+	}
+	flags, err := decodeHex(parts[3], 1)
+	if err != nil {
+		return SpanContext{}, fmt.Errorf("traceparent %q has invalid flags", s)
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("traceparent %q has an all zero ID", s)
+	}
+	return sc, nil
+}
+
+/*
+Decodes exactly n bytes from lowercase hex characters.
+*/
+func decodeHex(s string, n int) ([]byte, error) {
+	if len(s) != 2*n || strings.ToLower(s) != s {
+		return nil, errors.New("invalid hex")
+	}
+	return hex.DecodeString(s)
+}
+
+/*
+Event is something that happened at a point in time during a span.
+*/
+type Event struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+/*
+SpanData is a finished span, as it is exported.
+*/
+type SpanData struct {
+	Name    string  `json:"name"`
+	TraceID TraceID `json:"trace_id"`
+	SpanID  SpanID  `json:"span_id"`
+	// ParentSpanID is the ID of the parent span, which may be a span of a client. It is not valid for root spans.
+	ParentSpanID SpanID    `json:"parent_span_id"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	// Attributes describe the work done in the span, and must be strings, integers, floats or booleans.
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Events     []Event        `json:"events,omitempty"`
+	// Links are spans of other traces that the span is related to.
+	Links []SpanContext `json:"links,omitempty"`
+	// Error is the message of the error the span failed with, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+/*
+Exporter is an interface for an exporter of finished spans.
+*/
+type Exporter interface {
+	// ExportSpan exports a finished span. It is called when the span ends, so it must not block for long.
+	ExportSpan(s SpanData)
+	// Close exports all spans that have not been exported yet, and releases the resources of the exporter.
+	Close() error
+}
+
+/*
+Tracer starts spans, and exports them once they end.
+*/
+type Tracer struct {
+	exporter Exporter
+}
+
+/*
+Creates a new tracer that exports spans to the given exporter.
+*/
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+/*
+Starts a span with the given name. The span is a child of the span carried by ctx, which may be a remote span,
+see WithRemoteSpanContext, or the root span of a new trace if ctx carries no span. Returns a copy of ctx carrying
+the span, and the span. A nil tracer starts no span, and returns ctx and a nil span, which does nothing.
+*/
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:   name,
+			SpanID: newSpanID(),
+			Start:  time.Now(),
+		},
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentSpanID = parent.data.SpanID
+	} else {
+		s.data.TraceID = newTraceID()
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+/*
+Closes the exporter of the tracer, exporting all spans that have not been exported yet.
+*/
+func (t *Tracer) Close() error {
+	return t.exporter.Close()
+}
+
+/*
+Starts a span with the given name as a child of the span carried by ctx, with the tracer of that span.
+If ctx carries no span of a tracer, no span is started, and ctx and a nil span, which does nothing, are returned.
+This lets packages trace their work without knowing whether, or by which tracer, offers are traced.
+*/
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name)
+}
+
+/*
+spanKey is the context key of the current span.
+*/
+type spanKey struct{}
+
+/*
+Returns the span carried by ctx, or nil if it carries none.
+*/
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+/*
+Returns a copy of ctx carrying a remote span, e.g. of the client that sent an offer, so that the next span started
+with a tracer is its child. The remote span itself is not recorded, and Start does not start spans for it.
+*/
+func WithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, &Span{
+		data: SpanData{TraceID: sc.TraceID, SpanID: sc.SpanID},
+	})
+}
+
+/*
+Span is the work done for an offer in a single function, from when it is started until it ends.
+All methods of Span can be called concurrently, and do nothing on a nil span.
+*/
+type Span struct {
+	// tracer is the tracer that started the span, or nil for a remote span, which is not recorded
+	tracer *Tracer
+	lock   sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+/*
+Returns the span context of the span, which can be propagated to other processes.
+*/
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: s.data.TraceID, SpanID: s.data.SpanID, Sampled: true}
+}
+
+/*
+Sets an attribute of the span, which must be a string, an integer, a float or a boolean.
+*/
+func (s *Span) SetAttribute(key string, value any) {
+	s.update(func(d *SpanData) {
+		if d.Attributes == nil {
+			d.Attributes = make(map[string]any)
+		}
+		d.Attributes[key] = value
+	})
+}
+
+/*
+Adds an event that happened now to the span.
+*/
+func (s *Span) AddEvent(name string) {
+	s.update(func(d *SpanData) {
+		d.Events = append(d.Events, Event{Name: name, Time: time.Now()})
+	})
+}
+
+/*
+Links the span to a span of another trace that it is related to.
+*/
+func (s *Span) AddLink(sc SpanContext) {
+	s.update(func(d *SpanData) {
+		d.Links = append(d.Links, sc)
+	})
+}
+
+/*
+Marks the span as failed with the given error. Does nothing if err is nil.
+*/
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.update(func(d *SpanData) {
+		d.Error = err.Error()
+	})
+}
+
+/*
+Ends the span and exports it. Only the first call ends the span.
+*/
+func (s *Span) End() {
+	if s == nil || s.tracer == nil {
+		return
+	}
+
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.lock.Unlock()
+
+	s.tracer.exporter.ExportSpan(data)
+}
+
+/*
+Updates the data of a recorded span that has not ended yet.
+*/
+func (s *Span) update(f func(d *SpanData)) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.ended {
+		f(&s.data)
+	}
+}
+
+/*
+Returns a new random trace ID.
+*/
+func newTraceID() TraceID {
+	var t TraceID
+	// Reading from crypto/rand never fails on supported platforms
+	_, _ = rand.Read(t[:])
+	return t
+}
+
+/*
+Returns a new random span ID.
+*/
+func newSpanID() SpanID {
+	var s SpanID
+	_, _ = rand.Read(s[:])
+	return s
+}
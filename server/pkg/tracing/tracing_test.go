@@ -0,0 +1,354 @@
+package tracing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	cases := []struct {
+		name        string
+		traceParent string
+		expected    string
+		sampled     bool
+		expectedErr bool
+	}{
+		{
+			name:        "Sampled",
+			traceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			expected:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			sampled:     true,
+		},
+		{
+			name:        "Not sampled",
+			traceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			expected:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		},
+		{
+			name:        "Later version with more fields",
+			traceParent: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			expected:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			sampled:     true,
+		},
+		{
+			name:        "Version 00 with more fields",
+			traceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			expectedErr: true,
+		},
+		{
+			name:        "Invalid version",
+			traceParent: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			expectedErr: true,
+		},
+		{
+			name:        "Too few fields",
+			traceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+			expectedErr: true,
+		},
+		{
+			name:        "Short trace ID",
+			traceParent: "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+			expectedErr: true,
+		},
+		{
+			name:        "Uppercase parent ID",
+			traceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00F067AA0BA902B7-01",
+			expectedErr: true,
+		},
+		{
+			name:        "All zero trace ID",
+			traceParent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			expectedErr: true,
+		},
+		{
+			name:        "Empty",
+			traceParent: "",
+			expectedErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sc, err := ParseTraceParent(c.traceParent)
+			if c.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, sc.TraceParent())
+			assert.Equal(t, c.sampled, sc.Sampled)
+		})
+	}
+}
+
+func TestTracer(t *testing.T) {
+	exp := &recordingExporter{}
+	tracer := NewTracer(exp)
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	childCtx, child := Start(ctx, "child")
+	_, grandchild := Start(childCtx, "grandchild")
+	grandchild.SetAttribute("offer", 5)
+	grandchild.AddEvent("locked")
+	grandchild.SetError(errors.New("offer rejected"))
+	grandchild.End()
+	child.End()
+	root.SetAttribute("code", "PAWN")
+	root.End()
+	// Spans can only end once, and ended spans do not change
+	root.End()
+	root.SetAttribute("code", "SELL")
+
+	spans := exp.spans()
+	require.Len(t, spans, 3)
+	assert.Equal(t, []string{"grandchild", "child", "root"}, []string{spans[0].Name, spans[1].Name, spans[2].Name})
+	for _, s := range spans {
+		assert.Equal(t, root.SpanContext().TraceID, s.TraceID)
+		assert.False(t, s.End.Before(s.Start))
+	}
+	assert.False(t, spans[2].ParentSpanID.IsValid())
+	assert.Equal(t, spans[2].SpanID, spans[1].ParentSpanID)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, map[string]any{"offer": 5}, spans[0].Attributes)
+	assert.Equal(t, "locked", spans[0].Events[0].Name)
+	assert.Equal(t, "offer rejected", spans[0].Error)
+	assert.Equal(t, map[string]any{"code": "PAWN"}, spans[2].Attributes)
+}
+
+func TestTracerRemoteParent(t *testing.T) {
+	exp := &recordingExporter{}
+	tracer := NewTracer(exp)
+
+	remote, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+
+	// Packages can not start spans for a remote span, only the tracer can
+	ctx := WithRemoteSpanContext(context.Background(), remote)
+	_, s := Start(ctx, "ignored")
+	assert.Nil(t, s)
+	SpanFromContext(ctx).End()
+
+	_, s = tracer.Start(ctx, "offer")
+	s.End()
+
+	spans := exp.spans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, remote.TraceID, spans[0].TraceID)
+	assert.Equal(t, remote.SpanID, spans[0].ParentSpanID)
+}
+
+func TestNilSpans(t *testing.T) {
+	var tracer *Tracer
+	ctx, s := tracer.Start(context.Background(), "offer")
+	assert.Nil(t, s)
+	_, s = Start(ctx, "child")
+	assert.Nil(t, s)
+
+	// None of the methods of a nil span do anything
+	s.SetAttribute("offer", 5)
+	s.AddEvent("locked")
+	s.AddLink(SpanContext{})
+	s.SetError(errors.New("offer rejected"))
+	s.End()
+	assert.False(t, s.SpanContext().IsValid())
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	exp, err := NewFileExporter(path)
+	require.NoError(t, err)
+	tracer := NewTracer(exp)
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	_, child := Start(ctx, "child")
+	child.SetAttribute("rule", "ensure_profit")
+	child.End()
+	root.End()
+	require.NoError(t, tracer.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, lines, 2)
+
+	assert.Equal(t, "child", lines[0]["name"])
+	assert.Equal(t, root.SpanContext().TraceID.String(), lines[0]["trace_id"])
+	assert.Equal(t, root.SpanContext().SpanID.String(), lines[0]["parent_span_id"])
+	assert.Equal(t, map[string]any{"rule": "ensure_profit"}, lines[0]["attributes"])
+	assert.Equal(t, "", lines[1]["parent_span_id"])
+
+	// Exported spans can be read back
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var span SpanData
+	require.NoError(t, json.Unmarshal(bytes.Split(b, []byte("\n"))[1], &span))
+	assert.Equal(t, "root", span.Name)
+	assert.Equal(t, root.SpanContext().TraceID, span.TraceID)
+	assert.Equal(t, root.SpanContext().SpanID, span.SpanID)
+	assert.False(t, span.ParentSpanID.IsValid())
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var lock sync.Mutex
+	var requests []map[string]any
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var req map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		lock.Lock()
+		requests = append(requests, req)
+		lock.Unlock()
+	}))
+	defer collector.Close()
+
+	exp, err := NewOTLPExporter(OTLPOptions{Endpoint: collector.URL, BatchSize: 2, Interval: time.Hour})
+	require.NoError(t, err)
+	tracer := NewTracer(exp)
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	_, child := Start(ctx, "child")
+	child.SetAttribute("offer", 5)
+	child.SetAttribute("code", "PAWN")
+	child.SetError(errors.New("offer rejected"))
+	child.End()
+	root.End()
+
+	// A full batch is exported without waiting for the interval
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(requests) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// Closing exports the remaining spans
+	_, last := tracer.Start(context.Background(), "last")
+	last.End()
+	require.NoError(t, tracer.Close())
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, requests, 2)
+
+	b, err := json.Marshal(requests[0])
+	require.NoError(t, err)
+	var req otlpRequest
+	require.NoError(t, json.Unmarshal(b, &req))
+	require.Len(t, req.ResourceSpans, 1)
+	assert.Equal(t, "service.name", req.ResourceSpans[0].Resource.Attributes[0].Key)
+	assert.Equal(t, DefaultServiceName, *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, root.SpanContext().TraceID.String(), spans[0].TraceID)
+	assert.Equal(t, root.SpanContext().SpanID.String(), spans[0].ParentSpanID)
+	assert.Equal(t, "code", spans[0].Attributes[0].Key)
+	assert.Equal(t, "PAWN", *spans[0].Attributes[0].Value.StringValue)
+	assert.Equal(t, "offer", spans[0].Attributes[1].Key)
+	assert.Equal(t, "5", *spans[0].Attributes[1].Value.IntValue)
+	assert.Equal(t, otlpStatus{Code: otlpStatusError, Message: "offer rejected"}, spans[0].Status)
+	assert.Empty(t, spans[1].ParentSpanID)
+}
+
+func TestOTLPExporterErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		opts OTLPOptions
+	}{
+		{
+			name: "No endpoint",
+			opts: OTLPOptions{},
+		},
+		{
+			name: "Unsupported scheme",
+			opts: OTLPOptions{Endpoint: "grpc://localhost:4317"},
+		},
+		{
+			name: "Negative batch size",
+			opts: OTLPOptions{Endpoint: "http://localhost:4318", BatchSize: -1},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := NewOTLPExporter(c.opts)
+			require.Error(t, err)
+		})
+	}
+
+	t.Run("Collector error", func(t *testing.T) {
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer collector.Close()
+
+		exp, err := NewOTLPExporter(OTLPOptions{Endpoint: collector.URL + "/custom/traces", Interval: time.Hour})
+		require.NoError(t, err)
+		_, s := NewTracer(exp).Start(context.Background(), "offer")
+		s.End()
+		require.Error(t, exp.Close())
+	})
+
+	t.Run("Full queue", func(t *testing.T) {
+		exp, err := NewOTLPExporter(OTLPOptions{Endpoint: "http://localhost:4318", BatchSize: 1, QueueSize: 1, Interval: time.Hour})
+		require.NoError(t, err)
+		// Stop the background export, so that the queue stays full
+		close(exp.done)
+		<-exp.stopped
+
+		exp.ExportSpan(SpanData{Name: "first"})
+		exp.ExportSpan(SpanData{Name: "second"})
+		assert.Equal(t, uint64(1), exp.Dropped())
+	})
+}
+
+/*
+recordingExporter is an Exporter that keeps the spans in memory.
+*/
+type recordingExporter struct {
+	lock     sync.Mutex
+	exported []SpanData
+}
+
+func (e *recordingExporter) ExportSpan(s SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.exported = append(e.exported, s)
+}
+
+func (e *recordingExporter) Close() error {
+	return nil
+}
+
+func (e *recordingExporter) spans() []SpanData {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]SpanData(nil), e.exported...)
+}